@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"socks4/server"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serveAdmin serves the admin API of s, and the published expvars at
+// /debug/vars, on addr until the returned server is shut down, requiring
+// token as a bearer token if it isn't empty.
+func serveAdmin(log *zap.Logger, s *server.Server, addr, token string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.AdminHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	var handler http.Handler = mux
+	if token != "" {
+		handler = requireToken(handler, token)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: time.Second * 10}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed to serve admin API", zap.Error(err))
+		}
+	}()
+	log.Info("serving admin API", zap.Stringer("endpoint", ln.Addr()))
+	return srv, nil
+}
+
+// requireToken rejects requests to next without token as their bearer
+// token.
+func requireToken(next http.Handler, token string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DialFunc returns a dial function, as used by net/smtp-style APIs, that
+// connects to every address through the proxy server with a new Client.
+func DialFunc(serverAddress, user string, opts ...Option) func(network, addr string) (net.Conn, error) {
+	dial := DialContextFunc(serverAddress, user, opts...)
+	return func(network, addr string) (net.Conn, error) {
+		return dial(context.Background(), network, addr)
+	}
+}
+
+// DialContextFunc returns a context-aware dial function, as used by
+// net/http.Transport and pgx, that connects to every address through the
+// proxy server with a new Client.
+func DialContextFunc(serverAddress, user string, opts ...Option) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return NewClient(serverAddress, user, opts...).DialContext
+}
+
+// AddrDialer returns a context-aware dial function taking only an address,
+// as used by grpc.WithContextDialer and mysql.RegisterDialContext.
+func AddrDialer(serverAddress, user string, opts ...Option) func(ctx context.Context, addr string) (net.Conn, error) {
+	dial := DialContextFunc(serverAddress, user, opts...)
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return dial(ctx, "tcp", addr)
+	}
+}
+
+// Dial connects to addr through the proxy server, returning a new
+// connection with the configuration of c on every call. c itself is left
+// untouched.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, abandoning the handshake if ctx is done first.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	conn := c.fork(c.serverAddress)
+	conn.raceProxies = c.raceProxies
+	if err := connectContext(ctx, conn, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connectContext connects c to addr, closing it if ctx is done first.
+func connectContext(ctx context.Context, c *Client, addr string) error {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	err := c.Connect(addr)
+	close(done)
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		c.Close()
+		return ctxErr
+	} else if err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
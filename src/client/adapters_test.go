@@ -0,0 +1,109 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	msg := []byte("hello world")
+	_, err := conn.Write(msg)
+	require.NoError(t, err)
+
+	buff := make([]byte, len(msg))
+	n, err := conn.Read(buff)
+	require.NoError(t, err)
+	require.Equal(t, msg, buff[:n])
+}
+
+func TestDialFunc(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	dial := client.DialFunc(setupProxy(t), "")
+
+	conn, err := dial("tcp", echoServer)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	requireEcho(t, conn)
+
+	_, err = dial("udp", echoServer)
+	require.ErrorContains(t, err, "unsupported network")
+}
+
+func TestDialContextFunc(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	dial := client.DialContextFunc(setupProxy(t), "")
+
+	conn, err := dial(context.Background(), "tcp4", echoServer)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	requireEcho(t, conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dial(ctx, "tcp", echoServer)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAddrDialer(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	dial := client.AddrDialer(setupProxy(t), "")
+
+	conn, err := dial(context.Background(), echoServer)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	requireEcho(t, conn)
+}
+
+func TestDialContextAbortsHandshake(t *testing.T) {
+	t.Parallel()
+
+	// a proxy that accepts but never replies
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	_, err = client.AddrDialer(ln.Addr().String(), "")(ctx, "127.0.0.1:80")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientDial(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	c := client.NewClient(setupProxy(t), "")
+
+	first, err := c.Dial("tcp", echoServer)
+	require.NoError(t, err)
+	t.Cleanup(func() { first.Close() })
+	second, err := c.DialContext(context.Background(), "tcp", echoServer)
+	require.NoError(t, err)
+	t.Cleanup(func() { second.Close() })
+
+	require.NotSame(t, first, second)
+	requireEcho(t, first)
+	requireEcho(t, second)
+	require.Equal(t, client.StateIdle, c.State())
+}
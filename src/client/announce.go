@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// AnnounceFunc tells the peer of a BIND where to connect, typically by
+// sending addr in an application protocol message such as FTP's PORT.
+type AnnounceFunc func(addr *net.TCPAddr) error
+
+// BindAnnounce is like Bind, but passes announce the address the peer can
+// actually reach. A proxy replying 0.0.0.0 means "my own address", so the
+// proxy's address is substituted for it.
+func (c *Client) BindAnnounce(remote string, announce AnnounceFunc) error {
+	return c.Bind(remote, func(boundAddress string) error {
+		addr, err := c.reachable(boundAddress)
+		if err != nil {
+			return err
+		}
+		return announce(addr)
+	})
+}
+
+// reachable returns the address of a BIND reply, substituting the proxy's
+// address if the reply's is unspecified.
+func (c *Client) reachable(boundAddress string) (*net.TCPAddr, error) {
+	addr, err := net.ResolveTCPAddr("tcp4", boundAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bound address - %w", err)
+	}
+	if !addr.IP.IsUnspecified() {
+		return addr, nil
+	}
+
+	conn := c.conn()
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	proxy, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || proxy.IP.To4() == nil {
+		return nil, fmt.Errorf("proxy address %v can't be announced", conn.RemoteAddr())
+	}
+	return &net.TCPAddr{IP: proxy.IP.To4(), Port: addr.Port}, nil
+}
+
+// FTPPort formats addr as the argument of an FTP PORT command (RFC 959),
+// "h1,h2,h3,h4,p1,p2".
+func FTPPort(addr *net.TCPAddr) (string, error) {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return "", fmt.Errorf("PORT requires an IPv4 address, got %v", addr.IP)
+	}
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], addr.Port>>8, addr.Port&0xff), nil
+}
+
+// FTPEPRT formats addr as the argument of an FTP EPRT command (RFC 2428),
+// "|1|h.h.h.h|port|".
+func FTPEPRT(addr *net.TCPAddr) string {
+	proto := "2"
+	if addr.IP.To4() != nil {
+		proto = "1"
+	}
+	return "|" + proto + "|" + addr.IP.String() + "|" + strconv.Itoa(addr.Port) + "|"
+}
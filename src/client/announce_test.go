@@ -0,0 +1,54 @@
+package client_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindAnnounce(t *testing.T) {
+	t.Parallel()
+
+	c := client.NewClient(setupProxy(t), "")
+	defer c.Close()
+
+	var port string
+	err := c.BindAnnounce("127.0.0.1:0", func(addr *net.TCPAddr) error {
+		// the proxy replies 0.0.0.0, so its own address is announced
+		require.True(t, addr.IP.Equal(net.IPv4(127, 0, 0, 1)))
+
+		var err error
+		port, err = client.FTPPort(addr)
+		if err != nil {
+			return err
+		}
+
+		remote, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			return fmt.Errorf("failed to dial remote - %w", err)
+		}
+		go echo(t, remote)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Regexp(t, `^127,0,0,1,\d+,\d+$`, port)
+	requireEcho(t, c)
+}
+
+func TestFTPPort(t *testing.T) {
+	t.Parallel()
+
+	port, err := client.FTPPort(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1234})
+	require.NoError(t, err)
+	require.Equal(t, "192,168,1,2,4,210", port)
+
+	_, err = client.FTPPort(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234})
+	require.Error(t, err)
+
+	require.Equal(t, "|1|192.168.1.2|1234|", client.FTPEPRT(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1234}))
+	require.Equal(t, "|2|::1|1234|", client.FTPEPRT(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}))
+}
@@ -1,71 +1,219 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"socks4/proto"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
+// Maximum time to spend writing a request to the server
+const requestTimeout = time.Second * 30
+
 type Client struct {
 	serverAddress string
 	user          string
 	net.Conn
+
+	dialer    proxy.ContextDialer
+	localAddr net.Addr
+	resolver  *net.Resolver
+
+	tlsConfig       *tls.Config
+	tlsSessionCache tls.ClientSessionCache
+
+	noLocalDNS bool
+	resolution Resolution
+
+	handshakeTimeout time.Duration
+
+	raceProxies []string
+	negative    *NegativeCache
+	clock       Clock
+
+	mu     sync.Mutex
+	state  State
+	racers []*Client
 }
 
-func NewClient(serverAddress string, user string) *Client {
-	return &Client{
+func NewClient(serverAddress string, user string, opts ...Option) *Client {
+	c := &Client{
 		serverAddress: serverAddress,
 		user:          user,
 		Conn:          nil,
+		state:         StateIdle,
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
+}
+
+// State returns the current lifecycle state of the client.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
 }
 
 func (c *Client) connectServer() error {
-	conn, err := net.Dial("tcp", c.serverAddress)
+	c.mu.Lock()
+	switch c.state {
+	case StateIdle:
+		c.state = StateConnecting
+	case StateClosed:
+		c.mu.Unlock()
+		return net.ErrClosed
+	default:
+		c.mu.Unlock()
+		return errors.New("client is already connected")
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dialServer()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if err != nil {
+		if c.state == StateConnecting {
+			c.state = StateIdle
+		}
 		return fmt.Errorf("failed to dial server %v - %w", c.serverAddress, err)
 	}
 
+	// closed while dialing
+	if c.state == StateClosed {
+		conn.Close()
+		return net.ErrClosed
+	}
+
+	if c.tlsConfig != nil {
+		// the TLS handshake happens along with the first write
+		conn = tls.Client(conn, c.clientTLSConfig())
+	}
 	c.Conn = conn
 	return nil
 }
 
+// dialServer connects to the proxy server with the configured dialer.
+func (c *Client) dialServer() (net.Conn, error) {
+	dialer := c.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{LocalAddr: c.localAddr}
+	}
+	return dialer.DialContext(context.Background(), "tcp", c.serverAddress)
+}
+
+func (c *Client) clientTLSConfig() *tls.Config {
+	config := c.tlsConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.serverAddress); err == nil {
+			config.ServerName = host
+		}
+	}
+	if c.tlsSessionCache != nil {
+		config.ClientSessionCache = c.tlsSessionCache
+	}
+	return config
+}
+
+func (c *Client) established() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == StateClosed {
+		return net.ErrClosed
+	}
+	c.state = StateEstablished
+	return nil
+}
+
+func (c *Client) conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn
+}
+
 func (c *Client) makeRequest(remote string, cmd proto.Command) (*proto.Reply, error) {
+	if conn := c.conn(); conn != nil && c.handshakeTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(c.handshakeTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set handshake deadline - %w", err)
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
 	if req, err := proto.NewRequest(cmd, remote, c.user); err != nil {
 		return nil, fmt.Errorf("failed to create request - %w", err)
-	} else if _, err = c.Write(req.Serialize()); err != nil {
+	} else if err = c.writeRequest(req); err != nil {
 		return nil, fmt.Errorf("failed to write request - %w", err)
 	}
 
 	return c.readServerReply()
 }
 
+func (c *Client) writeRequest(req *proto.Request) error {
+	conn := c.conn()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	timeout := requestTimeout
+	if c.handshakeTimeout > 0 && c.handshakeTimeout < timeout {
+		timeout = c.handshakeTimeout
+	}
+	return proto.WriteFull(conn, req.Serialize(), timeout)
+}
+
 func (c *Client) readServerReply() (*proto.Reply, error) {
-	resp, err := proto.ReadReply(c.Conn)
+	resp, err := proto.ReadReply(c.conn())
 	if err != nil {
 		return nil, fmt.Errorf("failed to read server reply - %w", err)
 	} else if resp.Version() != proto.Version {
-		return nil, errors.New("server version does not match client")
+		return nil, fmt.Errorf("got version %d - %w", resp.Version(), ErrBadVersion)
 	} else if resp.Code() != proto.SuccessReply {
-		return nil, errors.New("received error reply from server")
+		return nil, &ReplyError{Reply: resp}
 	}
 
 	return resp, nil
 }
 
 func (c *Client) Connect(remote string) error {
+	remote, err := c.destination(remote)
+	if err != nil {
+		return err
+	}
+	if len(c.raceProxies) != 0 {
+		return c.raceConnect(remote)
+	}
+	if c.negative != nil {
+		if err := c.negative.check(c.serverAddress, remote, c.now()); err != nil {
+			return fmt.Errorf("connect request failed - %w", err)
+		}
+	}
 	if err := c.connectServer(); err != nil {
 		return fmt.Errorf("failed to connect to proxy server - %w", err)
 	}
-	_, err := c.makeRequest(remote, proto.ConnectCommand)
+	_, err = c.makeRequest(remote, proto.ConnectCommand)
+	if c.negative != nil {
+		c.negative.record(c.serverAddress, remote, err, c.now())
+	}
 	if err != nil {
 		return fmt.Errorf("connect request failed - %w", err)
 	}
-	return nil
+	return c.established()
 }
 
 func (c *Client) Bind(remote string, onAddressBound func(boundAddress string) error) error {
+	remote, err := c.destination(remote)
+	if err != nil {
+		return err
+	}
 	if err := c.connectServer(); err != nil {
 		return fmt.Errorf("failed to connect to proxy server - %w", err)
 	}
@@ -82,24 +230,54 @@ func (c *Client) Bind(remote string, onAddressBound func(boundAddress string) er
 	if err != nil {
 		return fmt.Errorf("remote failed to connect - %w", err)
 	}
-	return nil
+	return c.established()
 }
 
 func (c *Client) Write(buff []byte) (int, error) {
-	if c.Conn == nil {
+	if c.State() == StateIdle {
 		if err := c.connectServer(); err != nil {
 			return 0, fmt.Errorf("failed to connect to proxy server - %w", err)
 		}
 	}
 
-	return c.Conn.Write(buff)
+	conn := c.conn()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	return conn.Write(buff)
 }
 
 func (c *Client) Read(buff []byte) (int, error) {
-	if c.Conn == nil {
+	if c.State() == StateIdle {
 		if err := c.connectServer(); err != nil {
 			return 0, fmt.Errorf("failed to connect to proxy server - %w", err)
 		}
 	}
-	return c.Conn.Read(buff)
+
+	conn := c.conn()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	return conn.Read(buff)
+}
+
+// Close closes the client, aborting any handshake in progress. Closing an
+// already closed client is a no-op.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == StateClosed {
+		return nil
+	}
+	c.state = StateClosed
+
+	for _, racer := range c.racers {
+		racer.Close()
+	}
+
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
 }
@@ -51,10 +51,10 @@ func echo(t *testing.T, conn net.Conn) {
 	conn.Close()
 }
 
-func setupProxy(t *testing.T) string {
+func setupProxy(t *testing.T, opts ...server.Option) string {
 	t.Helper()
 
-	s := server.NewServer(zaptest.NewLogger(t))
+	s := server.NewServer(zaptest.NewLogger(t), opts...)
 	require.NotNil(t, s)
 
 	addr, err := s.ListenAndServe("localhost:0")
@@ -94,6 +94,7 @@ func TestConnect(t *testing.T) {
 			return func(t *testing.T) {
 				t.Parallel()
 				c := client.NewClient(proxyServer, user)
+				defer c.Close()
 
 				err := c.Connect(remote)
 				require.Error(t, err)
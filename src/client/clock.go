@@ -0,0 +1,16 @@
+package client
+
+import "time"
+
+// Clock tells the time for the client's time-based behavior, such as the
+// expiry of negative cache entries.
+type Clock interface {
+	Now() time.Time
+}
+
+func (c *Client) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"socks4/proto"
+)
+
+var (
+	// ErrRejected matches error replies with code 91: the request was
+	// rejected or failed.
+	ErrRejected = errors.New("request rejected or failed")
+
+	// ErrNoIdentd matches error replies with code 92: the server couldn't
+	// reach identd on the client.
+	ErrNoIdentd = errors.New("server cannot connect to identd on the client")
+
+	// ErrIdentMismatch matches error replies with code 93: identd on the
+	// client reported a different user ID.
+	ErrIdentMismatch = errors.New("identd reported a different user ID")
+
+	// ErrBadVersion is returned when the server replies with a version
+	// other than SOCKS4.
+	ErrBadVersion = errors.New("server version does not match client")
+)
+
+// ReplyError is returned when the server replies to a request with an
+// error code. It matches ErrRejected, ErrNoIdentd or ErrIdentMismatch by
+// its code with errors.Is.
+type ReplyError struct {
+	Reply *proto.Reply
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("received error reply %d from server", e.Reply.Code())
+}
+
+func (e *ReplyError) Is(target error) bool {
+	switch target {
+	case ErrRejected:
+		return e.Reply.Code() == proto.RejectedFailed
+	case ErrNoIdentd:
+		return e.Reply.Code() == proto.NoIdentd
+	case ErrIdentMismatch:
+		return e.Reply.Code() == proto.IdentMismatch
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyErrors(t *testing.T) {
+	t.Parallel()
+
+	proxy := setupProxy(t, server.WithIdentity(func(_ context.Context, _ net.Conn, userID string) (string, error) {
+		switch userID {
+		case "noidentd":
+			return "", server.ErrNoIdentd
+		case "mismatch":
+			return "", server.ErrIdentMismatch
+		}
+		return "", server.ErrUnauthorized
+	}))
+	echoServer := setupEcho(t)
+
+	for user, target := range map[string]error{
+		"noidentd": client.ErrNoIdentd,
+		"mismatch": client.ErrIdentMismatch,
+		"rejected": client.ErrRejected,
+	} {
+		c := client.NewClient(proxy, user)
+		t.Cleanup(func() { c.Close() })
+
+		err := c.Connect(echoServer)
+		require.ErrorIs(t, err, target)
+
+		var replyErr *client.ReplyError
+		require.True(t, errors.As(err, &replyErr))
+		require.NotEqual(t, proto.SuccessReply, replyErr.Reply.Code())
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 64))
+		conn.Write([]byte{5, proto.SuccessReply, 0, 0, 0, 0, 0, 0})
+	}()
+
+	c := client.NewClient(ln.Addr().String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.ErrorIs(t, c.Connect(setupEcho(t)), client.ErrBadVersion)
+}
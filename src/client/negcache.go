@@ -0,0 +1,96 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"socks4/metrics"
+	"sync"
+	"time"
+)
+
+// ErrSuppressed is returned, along with the cached failure, for requests
+// that the negative cache suppressed without contacting the proxy.
+var ErrSuppressed = errors.New("suppressed after a recent failure")
+
+type negativeKey struct {
+	server, destination string
+}
+
+type negativeEntry struct {
+	err    error
+	failed time.Time
+}
+
+// NegativeCache remembers destinations the proxy recently refused, so a
+// retry loop doesn't repeat the handshake for each attempt. It may be
+// shared between clients; entries are kept per proxy server.
+type NegativeCache struct {
+	ttl     time.Duration
+	metrics *metrics.Registry
+
+	mu       sync.Mutex
+	failures map[negativeKey]negativeEntry
+	swept    time.Time
+}
+
+// NewNegativeCache creates a cache suppressing requests to a destination
+// for ttl after the proxy refused it.
+func NewNegativeCache(ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		ttl:      ttl,
+		metrics:  metrics.NewRegistry("socks4_client_"),
+		failures: make(map[negativeKey]negativeEntry),
+	}
+}
+
+// Metrics returns the registry holding the cache's metrics.
+func (n *NegativeCache) Metrics() *metrics.Registry {
+	return n.metrics
+}
+
+// check returns the cached failure for destination, if it hasn't expired
+// by now.
+func (n *NegativeCache) check(server, destination string, now time.Time) error {
+	key := negativeKey{server: server, destination: destination}
+
+	n.mu.Lock()
+	entry, ok := n.failures[key]
+	if ok && now.Sub(entry.failed) > n.ttl {
+		delete(n.failures, key)
+		ok = false
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	n.metrics.Counter("negative_cache_suppressed_total", "Requests suppressed by a cached failure.").Inc()
+	return fmt.Errorf("%s failed %v ago - %w - %w", destination, now.Sub(entry.failed).Round(time.Millisecond), ErrSuppressed, entry.err)
+}
+
+// record caches the outcome of a request to destination at now. Only
+// refusals by the proxy are cached, since failures to reach the proxy
+// itself say nothing about the destination.
+func (n *NegativeCache) record(server, destination string, err error, now time.Time) {
+	key := negativeKey{server: server, destination: destination}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.swept) > n.ttl {
+		for k, entry := range n.failures {
+			if now.Sub(entry.failed) > n.ttl {
+				delete(n.failures, k)
+			}
+		}
+		n.swept = now
+	}
+
+	var replyErr *ReplyError
+	if err == nil {
+		delete(n.failures, key)
+	} else if errors.As(err, &replyErr) {
+		n.failures[key] = negativeEntry{err: replyErr, failed: now}
+		n.metrics.Counter("negative_cache_failures_total", "Failures cached by the negative cache.").Inc()
+	}
+}
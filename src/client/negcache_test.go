@@ -0,0 +1,92 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	requests := &atomic.Int32{}
+	proxy := setupProxy(t, server.WithIdentity(func(_ context.Context, _ net.Conn, userID string) (string, error) {
+		requests.Add(1)
+		return "", server.ErrUnauthorized
+	}))
+	echoServer := setupEcho(t)
+
+	cache := client.NewNegativeCache(time.Millisecond * 200)
+	connect := func() error {
+		c := client.NewClient(proxy, "", client.WithNegativeCache(cache))
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(echoServer)
+	}
+
+	err := connect()
+	require.ErrorIs(t, err, client.ErrRejected)
+	require.NotErrorIs(t, err, client.ErrSuppressed)
+
+	err = connect()
+	require.ErrorIs(t, err, client.ErrSuppressed)
+	require.ErrorIs(t, err, client.ErrRejected)
+	require.EqualValues(t, 1, requests.Load())
+
+	m := cache.Metrics()
+	require.EqualValues(t, 1, m.Counter("negative_cache_suppressed_total", "").Value())
+	require.EqualValues(t, 1, m.Counter("negative_cache_failures_total", "").Value())
+
+	// the proxy is asked again once the failure expires
+	time.Sleep(time.Millisecond * 250)
+	require.NotErrorIs(t, connect(), client.ErrSuppressed)
+	require.EqualValues(t, 2, requests.Load())
+}
+
+// manualClock is a Clock that only moves when told to.
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestNegativeCacheClock(t *testing.T) {
+	t.Parallel()
+
+	proxy := setupProxy(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("token")))
+	echoServer := setupEcho(t)
+
+	clock := &manualClock{now: time.Unix(0, 0)}
+	cache := client.NewNegativeCache(time.Hour)
+	connect := func() error {
+		c := client.NewClient(proxy, "", client.WithNegativeCache(cache), client.WithClock(clock))
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(echoServer)
+	}
+
+	require.ErrorIs(t, connect(), client.ErrRejected)
+	clock.Advance(time.Minute * 59)
+	require.ErrorIs(t, connect(), client.ErrSuppressed)
+	clock.Advance(time.Minute * 2)
+	err := connect()
+	require.ErrorIs(t, err, client.ErrRejected)
+	require.NotErrorIs(t, err, client.ErrSuppressed)
+}
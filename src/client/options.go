@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Option configures optional behavior of a Client.
+type Option func(*Client)
+
+// WithOSUser sends the name of the current OS user as the user ID, unless a
+// user was explicitly given to NewClient.
+func WithOSUser() Option {
+	return func(c *Client) {
+		if c.user == "" {
+			c.user = osUser()
+		}
+	}
+}
+
+func osUser() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	} else if name == "" {
+		name = os.Getenv("USERNAME")
+	}
+
+	// windows usernames are qualified as DOMAIN\user
+	if _, after, found := strings.Cut(name, `\`); found {
+		name = after
+	}
+	return name
+}
+
+// WithTLSConfig connects to the proxy server over TLS (SOCKS-over-TLS).
+// If config has no ServerName, the host of the server address is used.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithTLSSessionCache resumes TLS sessions to the proxy server using cache,
+// which may be shared between clients to skip full handshakes on new tunnels.
+// It only has an effect together with WithTLSConfig.
+//
+// Note that crypto/tls doesn't implement TLS 1.3 early data, so the SOCKS
+// request can't be sent as 0-RTT data; resumption still saves the cost of a
+// full handshake.
+func WithTLSSessionCache(cache tls.ClientSessionCache) Option {
+	return func(c *Client) {
+		c.tlsSessionCache = cache
+	}
+}
+
+// WithNoLocalDNS guarantees the client never resolves hostnames itself, so
+// no DNS query for a destination leaks from the client host. Unless remote
+// resolution is enabled with WithResolution, hostname destinations fail
+// with ErrLocalResolution before the proxy is contacted.
+func WithNoLocalDNS() Option {
+	return func(c *Client) {
+		c.noLocalDNS = true
+	}
+}
+
+// WithResolution selects where hostname destinations are resolved. The
+// default is ResolveLocal.
+func WithResolution(resolution Resolution) Option {
+	return func(c *Client) {
+		c.resolution = resolution
+	}
+}
+
+// WithHandshakeTimeout bounds each SOCKS request/reply exchange with the
+// proxy, so a wedged proxy fails fast. It doesn't apply to the wait for a
+// BIND peer to connect, nor to I/O on the established tunnel.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.handshakeTimeout = timeout
+	}
+}
+
+// WithDialer connects to the proxy server with dialer, which may itself
+// tunnel through other proxies. The default is a net.Dialer.
+func WithDialer(dialer proxy.ContextDialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// WithLocalAddr connects to the proxy server from addr. It has no effect
+// together with WithDialer.
+func WithLocalAddr(addr net.Addr) Option {
+	return func(c *Client) {
+		c.localAddr = addr
+	}
+}
+
+// WithResolver resolves hostname destinations locally with resolver instead
+// of net.DefaultResolver.
+func WithResolver(resolver *net.Resolver) Option {
+	return func(c *Client) {
+		c.resolver = resolver
+	}
+}
+
+// WithRaceProxies races every CONNECT through the given proxy servers in
+// addition to the client's own, keeping whichever tunnel is established
+// first and cancelling the others. This trades extra handshakes for latency
+// and availability.
+func WithRaceProxies(serverAddresses ...string) Option {
+	return func(c *Client) {
+		c.raceProxies = append(c.raceProxies, serverAddresses...)
+	}
+}
+
+// WithNegativeCache fails CONNECTs to destinations the proxy refused within
+// the cache's TTL with ErrSuppressed, instead of repeating the handshake.
+func WithNegativeCache(cache *NegativeCache) Option {
+	return func(c *Client) {
+		c.negative = cache
+	}
+}
+
+// WithClock makes the client tell the time with clock, e.g. to test how an
+// application retries around the negative cache without sleeping. It has no
+// effect on I/O deadlines.
+func WithClock(clock Clock) Option {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
@@ -0,0 +1,213 @@
+package client_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithOSUser(t *testing.T) {
+	t.Parallel()
+
+	u, err := user.Current()
+	require.NoError(t, err)
+	_, osUser, found := strings.Cut(u.Username, `\`)
+	if !found {
+		osUser = u.Username
+	}
+
+	users := make(chan string, 2)
+	proxyServer := setupProxy(t, server.WithAuthenticator(server.AuthenticatorFunc(
+		func(_ context.Context, _, userID string) error {
+			users <- userID
+			return nil
+		},
+	)))
+	echoServer := setupEcho(t)
+
+	c := client.NewClient(proxyServer, "", client.WithOSUser())
+	require.NoError(t, c.Connect(echoServer))
+	require.NoError(t, c.Close())
+	require.Equal(t, osUser, <-users)
+
+	c = client.NewClient(proxyServer, "override", client.WithOSUser())
+	require.NoError(t, c.Connect(echoServer))
+	require.NoError(t, c.Close())
+	require.Equal(t, "override", <-users)
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// setupTLSFront terminates TLS in front of a plaintext proxy server.
+func setupTLSFront(t *testing.T, proxyServer string, cert tls.Certificate) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				proxy, err := net.Dial("tcp", proxyServer)
+				if err != nil {
+					return
+				}
+				defer proxy.Close()
+				go io.Copy(proxy, conn)
+				io.Copy(conn, proxy)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestWithTLSSessionCache(t *testing.T) {
+	t.Parallel()
+
+	cert := selfSignedCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	echoServer := setupEcho(t)
+	front := setupTLSFront(t, setupProxy(t), cert)
+	cache := tls.NewLRUClientSessionCache(4)
+
+	for _, resumed := range []bool{false, true} {
+		c := client.NewClient(front, "",
+			client.WithTLSConfig(&tls.Config{RootCAs: pool}),
+			client.WithTLSSessionCache(cache),
+		)
+		require.NoError(t, c.Connect(echoServer))
+
+		msg := []byte("hello world")
+		_, err := c.Write(msg)
+		require.NoError(t, err)
+		buff := make([]byte, len(msg))
+		_, err = io.ReadFull(c, buff)
+		require.NoError(t, err)
+		require.Equal(t, msg, buff)
+
+		tlsConn, ok := c.Conn.(*tls.Conn)
+		require.True(t, ok)
+		require.Equal(t, resumed, tlsConn.ConnectionState().DidResume)
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestWithHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+
+	t.Run("WedgedProxy", func(t *testing.T) {
+		t.Parallel()
+
+		c := client.NewClient(setupBlackhole(t), "", client.WithHandshakeTimeout(100*time.Millisecond))
+		defer c.Close()
+
+		start := time.Now()
+		require.ErrorIs(t, c.Connect(echoServer), os.ErrDeadlineExceeded)
+		require.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("TunnelUnaffected", func(t *testing.T) {
+		t.Parallel()
+
+		c := client.NewClient(setupProxy(t), "", client.WithHandshakeTimeout(100*time.Millisecond))
+		defer c.Close()
+
+		require.NoError(t, c.Connect(echoServer))
+		time.Sleep(200 * time.Millisecond)
+		requireEcho(t, c)
+	})
+}
+
+func TestWithDialer(t *testing.T) {
+	t.Parallel()
+
+	var dials []string
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials = append(dials, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+
+	proxy := setupProxy(t)
+	c := client.NewClient(proxy, "", client.WithDialer(dialer))
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(setupEcho(t)))
+	require.Equal(t, []string{proxy}, dials)
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestWithLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	c := client.NewClient(setupProxy(t), "", client.WithLocalAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(setupEcho(t)))
+	require.True(t, c.LocalAddr().(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)))
+}
+
+func TestWithResolver(t *testing.T) {
+	t.Parallel()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("no DNS here")
+		},
+	}
+	c := client.NewClient(setupProxy(t), "", client.WithResolver(resolver))
+	t.Cleanup(func() { c.Close() })
+	require.ErrorContains(t, c.Connect("example.invalid:80"), "failed to resolve")
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("socks4", fromURL)
+	proxy.RegisterDialerType("socks4a", fromURL)
+}
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+)
+
+// Dialer connects to every address through the proxy server with a new
+// Client. It implements proxy.Dialer and proxy.ContextDialer.
+type Dialer struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func NewDialer(serverAddress, user string, opts ...Option) *Dialer {
+	return &Dialer{dial: DialContextFunc(serverAddress, user, opts...)}
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.dial(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dial(ctx, network, addr)
+}
+
+// fromURL creates a Dialer for proxy.FromURL. The user of the URL is sent
+// as the user ID; the socks4a scheme has the proxy server resolve hostnames.
+// The proxy server is reached through forward.
+func fromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	opts := []Option{withForward(forward)}
+	if u.Scheme == "socks4a" {
+		opts = append(opts, WithResolution(ResolveRemote))
+	}
+	return NewDialer(u.Host, u.User.Username(), opts...), nil
+}
+
+// withForward reaches the proxy server through forward instead of dialing
+// it directly.
+func withForward(forward proxy.Dialer) Option {
+	return func(c *Client) {
+		switch forward := forward.(type) {
+		case nil:
+		case proxy.ContextDialer:
+			if forward != proxy.Direct {
+				c.dialer = forward
+			}
+		default:
+			c.dialer = forwardDialer{forward}
+		}
+	}
+}
+
+// forwardDialer adapts a proxy.Dialer without context support.
+type forwardDialer struct {
+	proxy.Dialer
+}
+
+func (d forwardDialer) DialContext(_ context.Context, network, addr string) (net.Conn, error) {
+	return d.Dial(network, addr)
+}
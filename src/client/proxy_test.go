@@ -0,0 +1,46 @@
+package client_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestProxyFromURL(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	for _, scheme := range []string{"socks4", "socks4a"} {
+		u, err := url.Parse(scheme + "://user@" + setupProxy(t))
+		require.NoError(t, err)
+
+		dialer, err := proxy.FromURL(u, proxy.Direct)
+		require.NoError(t, err)
+		require.IsType(t, &client.Dialer{}, dialer)
+
+		conn, err := dialer.Dial("tcp", echoServer)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		requireEcho(t, conn)
+	}
+}
+
+func TestDialerContext(t *testing.T) {
+	t.Parallel()
+
+	var dialer proxy.ContextDialer = client.NewDialer(setupProxy(t), "")
+	conn, err := dialer.DialContext(context.Background(), "tcp", setupEcho(t))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	requireEcho(t, conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dialer.DialContext(ctx, "tcp", setupEcho(t))
+	require.ErrorIs(t, err, context.Canceled)
+}
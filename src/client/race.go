@@ -0,0 +1,102 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+type raceResult struct {
+	racer *Client
+	err   error
+}
+
+// fork creates an idle client with the same configuration as c, for the
+// proxy server at serverAddress.
+func (c *Client) fork(serverAddress string) *Client {
+	return &Client{
+		serverAddress:    serverAddress,
+		user:             c.user,
+		dialer:           c.dialer,
+		localAddr:        c.localAddr,
+		resolver:         c.resolver,
+		tlsConfig:        c.tlsConfig,
+		tlsSessionCache:  c.tlsSessionCache,
+		noLocalDNS:       c.noLocalDNS,
+		resolution:       c.resolution,
+		handshakeTimeout: c.handshakeTimeout,
+		negative:         c.negative,
+		clock:            c.clock,
+		state:            StateIdle,
+	}
+}
+
+// raceConnect performs the same CONNECT through every configured proxy
+// server at once and keeps the first tunnel established.
+func (c *Client) raceConnect(remote string) error {
+	addrs := append([]string{c.serverAddress}, c.raceProxies...)
+	racers := make([]*Client, len(addrs))
+	for i, addr := range addrs {
+		racers[i] = c.fork(addr)
+	}
+
+	c.mu.Lock()
+	switch c.state {
+	case StateIdle:
+		c.state = StateConnecting
+		c.racers = racers
+	case StateClosed:
+		c.mu.Unlock()
+		return net.ErrClosed
+	default:
+		c.mu.Unlock()
+		return errors.New("client is already connected")
+	}
+	c.mu.Unlock()
+
+	results := make(chan raceResult, len(racers))
+	for _, racer := range racers {
+		go func(racer *Client) {
+			results <- raceResult{racer, racer.Connect(remote)}
+		}(racer)
+	}
+
+	var winner *Client
+	var errs []error
+	for range racers {
+		res := <-results
+		switch {
+		case res.err != nil:
+			errs = append(errs, fmt.Errorf("%s - %w", res.racer.serverAddress, res.err))
+		case winner == nil:
+			winner = res.racer
+			// losers abort their handshakes
+			for _, racer := range racers {
+				if racer != winner {
+					racer.Close()
+				}
+			}
+		default:
+			res.racer.Close()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.racers = nil
+	if c.state == StateClosed {
+		if winner != nil {
+			winner.Close()
+		}
+		return net.ErrClosed
+	} else if winner == nil {
+		c.state = StateIdle
+		return fmt.Errorf("connect failed through every proxy - %w", errors.Join(errs...))
+	}
+
+	c.serverAddress = winner.serverAddress
+	c.Conn = winner.Conn
+	c.state = StateEstablished
+	return nil
+}
@@ -0,0 +1,111 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// setupQuietProxy is like setupProxy for proxies whose handlers can
+// outlive the test, as those of losing races do, so they can't log to it.
+func setupQuietProxy(t *testing.T) string {
+	t.Helper()
+
+	s := server.NewServer(zap.NewNop())
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		s.Close(ctx)
+		cancel()
+	})
+
+	return addr.String()
+}
+
+// setupBlackhole accepts connections but never answers them.
+func setupBlackhole(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestWithRaceProxies(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	proxyServer := setupQuietProxy(t)
+	blackhole := setupBlackhole(t)
+
+	t.Run("FirstWins", func(t *testing.T) {
+		t.Parallel()
+
+		c := client.NewClient(blackhole, "", client.WithRaceProxies(proxyServer))
+		t.Cleanup(func() { c.Close() })
+
+		done := make(chan error, 1)
+		go func() { done <- c.Connect(echoServer) }()
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("race was not won by the working proxy")
+		}
+		require.Equal(t, client.StateEstablished, c.State())
+		requireEcho(t, c)
+	})
+
+	t.Run("AllFail", func(t *testing.T) {
+		t.Parallel()
+
+		c := client.NewClient(proxyServer, "", client.WithRaceProxies(proxyServer))
+		t.Cleanup(func() { c.Close() })
+
+		require.ErrorContains(t, c.Connect("127.0.0.1:1"), "connect failed through every proxy")
+		require.Equal(t, client.StateIdle, c.State())
+	})
+
+	t.Run("CloseAborts", func(t *testing.T) {
+		t.Parallel()
+
+		c := client.NewClient(blackhole, "", client.WithRaceProxies(blackhole))
+
+		done := make(chan error, 1)
+		go func() { done <- c.Connect(echoServer) }()
+
+		require.Eventually(t, func() bool {
+			return c.State() == client.StateConnecting
+		}, time.Second, time.Millisecond)
+		require.NoError(t, c.Close())
+
+		select {
+		case err := <-done:
+			require.Error(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("close did not abort the race")
+		}
+	})
+}
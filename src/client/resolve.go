@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrLocalResolution is returned for hostname destinations when the client
+// is not allowed to resolve them locally.
+var ErrLocalResolution = errors.New("refusing to resolve hostname locally")
+
+// Resolution selects where hostname destinations are resolved.
+type Resolution int
+
+const (
+	// ResolveLocal resolves hostnames on the client host and sends the
+	// proxy a plain SOCKS4 request for the first IPv4 address.
+	ResolveLocal Resolution = iota
+
+	// ResolveRemote sends hostnames to the proxy in a SOCKS4a request for
+	// it to resolve. The proxy must support SOCKS4a.
+	ResolveRemote
+)
+
+// destination returns the address to request for remote, resolving its
+// host locally if required.
+func (c *Client) destination(remote string) (string, error) {
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to split remote host & port - %w", err)
+	} else if net.ParseIP(host) != nil || c.resolution == ResolveRemote {
+		return remote, nil
+	} else if c.noLocalDNS {
+		return "", fmt.Errorf("%s - %w", host, ErrLocalResolution)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resolver := c.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s - %w", host, err)
+	} else if len(ips) == 0 {
+		return "", fmt.Errorf("no IPv4 addresses for %s", host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,54 @@
+package client_test
+
+import (
+	"net"
+	"testing"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithNoLocalDNS(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	proxyServer := setupProxy(t)
+
+	c := client.NewClient(proxyServer, "", client.WithNoLocalDNS())
+	require.ErrorIs(t, c.Connect("localhost:80"), client.ErrLocalResolution)
+	require.ErrorIs(t, c.Bind("localhost:80", nil), client.ErrLocalResolution)
+
+	// the proxy was never contacted
+	require.Equal(t, client.StateIdle, c.State())
+
+	require.NoError(t, c.Connect(echoServer))
+	require.NoError(t, c.Close())
+}
+
+func TestWithResolution(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	_, port, err := net.SplitHostPort(echoServer)
+	require.NoError(t, err)
+	proxyServer := setupProxy(t)
+
+	for name, opts := range map[string][]client.Option{
+		"Local":            nil,
+		"Remote":           {client.WithResolution(client.ResolveRemote)},
+		"RemoteNoLocalDNS": {client.WithResolution(client.ResolveRemote), client.WithNoLocalDNS()},
+	} {
+		t.Run(name, func(opts []client.Option) func(t *testing.T) {
+			return func(t *testing.T) {
+				t.Parallel()
+
+				c := client.NewClient(proxyServer, "", opts...)
+				defer c.Close()
+
+				require.NoError(t, c.Connect(net.JoinHostPort("localhost", port)))
+				requireEcho(t, c)
+			}
+		}(opts))
+	}
+}
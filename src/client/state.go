@@ -0,0 +1,34 @@
+package client
+
+// State is the lifecycle state of a Client.
+type State int
+
+const (
+	// StateIdle is a client that hasn't connected to the proxy server yet.
+	StateIdle State = iota
+
+	// StateConnecting is a client connecting to the proxy server or
+	// performing its SOCKS handshake.
+	StateConnecting
+
+	// StateEstablished is a client with an established tunnel.
+	StateEstablished
+
+	// StateClosed is a client that has been closed. It can't be reused.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateEstablished:
+		return "established"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
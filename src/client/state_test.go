@@ -0,0 +1,78 @@
+package client_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientState(t *testing.T) {
+	t.Parallel()
+
+	echoServer := setupEcho(t)
+	proxyServer := setupProxy(t)
+
+	c := client.NewClient(proxyServer, "")
+	require.Equal(t, client.StateIdle, c.State())
+
+	require.NoError(t, c.Connect(echoServer))
+	require.Equal(t, client.StateEstablished, c.State())
+	require.Error(t, c.Connect(echoServer))
+
+	require.NoError(t, c.Close())
+	require.Equal(t, client.StateClosed, c.State())
+
+	// double close is a no-op
+	require.NoError(t, c.Close())
+
+	require.ErrorIs(t, c.Connect(echoServer), net.ErrClosed)
+	_, err := c.Write([]byte{0})
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestCloseIdle(t *testing.T) {
+	t.Parallel()
+
+	c := client.NewClient("localhost:0", "")
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+	require.Equal(t, client.StateClosed, c.State())
+}
+
+func TestCloseMidHandshake(t *testing.T) {
+	t.Parallel()
+
+	// a proxy that accepts but never replies
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	c := client.NewClient(ln.Addr().String(), "")
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- c.Connect("127.0.0.1:80") }()
+
+	require.Eventually(t, func() bool {
+		return c.State() == client.StateConnecting
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 10)
+	require.NoError(t, c.Close())
+
+	select {
+	case err := <-errChan:
+		require.Error(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("handshake was not aborted by Close")
+	}
+	require.Equal(t, client.StateClosed, c.State())
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errNotConnected = errors.New("client is not connected")
+
+// tcpConn returns the TCP connection to the proxy server, beneath any TLS.
+func (c *Client) tcpConn() (*net.TCPConn, error) {
+	conn := c.conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if conn == nil {
+		return nil, errNotConnected
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("connection to the proxy server is a %T, not TCP", conn)
+	}
+	return tcpConn, nil
+}
+
+// SetReadBuffer sets the size of the receive buffer of the connection to
+// the proxy server.
+func (c *Client) SetReadBuffer(bytes int) error {
+	conn, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size of the send buffer of the connection to the
+// proxy server.
+func (c *Client) SetWriteBuffer(bytes int) error {
+	conn, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteBuffer(bytes)
+}
+
+// SetKeepAlive enables or disables TCP keep-alives on the connection to the
+// proxy server.
+func (c *Client) SetKeepAlive(keepalive bool) error {
+	conn, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetKeepAlive(keepalive)
+}
+
+// SetKeepAlivePeriod sets the period between TCP keep-alives on the
+// connection to the proxy server.
+func (c *Client) SetKeepAlivePeriod(d time.Duration) error {
+	conn, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(d)
+}
+
+// SetNoDelay sets TCP_NODELAY on the connection to the proxy server,
+// disabling Nagle's algorithm when true.
+func (c *Client) SetNoDelay(noDelay bool) error {
+	conn, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	return conn.SetNoDelay(noDelay)
+}
@@ -0,0 +1,26 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"socks4/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPControls(t *testing.T) {
+	t.Parallel()
+
+	c := client.NewClient(setupProxy(t), "")
+	t.Cleanup(func() { c.Close() })
+	require.Error(t, c.SetNoDelay(true))
+
+	require.NoError(t, c.Connect(setupEcho(t)))
+	require.NoError(t, c.SetReadBuffer(1<<16))
+	require.NoError(t, c.SetWriteBuffer(1<<16))
+	require.NoError(t, c.SetKeepAlive(true))
+	require.NoError(t, c.SetKeepAlivePeriod(time.Minute))
+	require.NoError(t, c.SetNoDelay(false))
+	requireEcho(t, c)
+}
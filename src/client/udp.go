@@ -0,0 +1,122 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"socks4/proto"
+	"time"
+)
+
+// Size of the header the relay frames datagrams to the client with
+const datagramHeaderSize = 8
+
+// PacketConn relays UDP datagrams through a UDP association with the proxy
+// server, established by Client.Associate. It is a net.PacketConn whose
+// addresses are those of the destinations.
+type PacketConn struct {
+	client *Client
+	conn   *net.UDPConn
+}
+
+// Associate asks the server to relay UDP datagrams for the client, with the
+// UDP ASSOCIATE extension to SOCKS4 (see proto.UDPAssociateCommand). The
+// association lasts until the returned PacketConn, or the client, is closed.
+func (c *Client) Associate() (*PacketConn, error) {
+	if err := c.connectServer(); err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy server - %w", err)
+	}
+	reply, err := c.makeRequest("0.0.0.0:0", proto.UDPAssociateCommand)
+	if err != nil {
+		return nil, fmt.Errorf("udp associate request failed - %w", err)
+	} else if err := c.established(); err != nil {
+		return nil, err
+	}
+
+	// an unspecified relay IP is the server's own
+	relay := &net.UDPAddr{IP: reply.IP(), Port: reply.Port()}
+	if relay.IP.IsUnspecified() {
+		relay.IP = addrIP(c.conn().RemoteAddr())
+	}
+
+	var local *net.UDPAddr
+	if addr, ok := c.localAddr.(*net.TCPAddr); ok {
+		local = &net.UDPAddr{IP: addr.IP}
+	}
+	conn, err := net.DialUDP("udp", local, relay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial udp relay %v - %w", relay, err)
+	}
+
+	// the server ends the association by closing the control connection
+	go func() {
+		c.conn().Read(make([]byte, 1))
+		conn.Close()
+	}()
+	return &PacketConn{client: c, conn: conn}, nil
+}
+
+// ReadFrom reads a datagram relayed from addr.
+func (p *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buff := make([]byte, datagramHeaderSize+len(b))
+	for {
+		n, err := p.conn.Read(buff)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg, err := proto.ReadDatagram(buff[:n])
+		if err != nil || msg.Hostname != "" {
+			// not from the relay
+			continue
+		}
+		return copy(b, msg.Data), &net.UDPAddr{IP: msg.IP, Port: msg.Port}, nil
+	}
+}
+
+// WriteTo relays a datagram to addr, which may have a hostname for the
+// server to resolve.
+func (p *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg, err := proto.NewDatagram(addr.String(), b)
+	if err != nil {
+		return 0, fmt.Errorf("invalid destination - %w", err)
+	}
+	if _, err := p.conn.Write(msg.Serialize()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the association, closing the client.
+func (p *PacketConn) Close() error {
+	return errors.Join(p.conn.Close(), p.client.Close())
+}
+
+// LocalAddr returns the local address datagrams are sent to the relay from.
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	return p.conn.SetDeadline(t)
+}
+
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	return p.conn.SetReadDeadline(t)
+}
+
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return p.conn.SetWriteDeadline(t)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Package geoip locates IP addresses by country and autonomous system with
+// MaxMind DB files, such as the GeoLite2 Country and ASN databases.
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// DB locates addresses with one or more MaxMind DB files, e.g. a GeoLite2
+// Country database for countries and a GeoLite2 ASN database for
+// autonomous systems.
+type DB struct {
+	dbs []*mmdb
+}
+
+// Open loads the MaxMind DB files at paths into memory.
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GeoIP database - %w", err)
+		}
+		parsed, err := parseMMDB(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GeoIP database %s - %w", path, err)
+		}
+		db.dbs = append(db.dbs, parsed)
+	}
+	return db, nil
+}
+
+// Locate returns the ISO 3166 country code and the autonomous system number
+// of ip, each empty or zero if none of the databases has it. The country of
+// an address is its registered country if it has no known location.
+func (db *DB) Locate(ip net.IP) (country string, asn uint32, err error) {
+	for _, d := range db.dbs {
+		record, err := d.lookup(ip)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to look up %v in %s - %w", ip, d.databaseType, err)
+		}
+		fields, ok := record.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if country == "" {
+			country = isoCode(fields["country"])
+		}
+		if country == "" {
+			country = isoCode(fields["registered_country"])
+		}
+		if number, ok := fields["autonomous_system_number"].(uint64); ok && asn == 0 {
+			asn = uint32(number)
+		}
+	}
+	return country, asn, nil
+}
+
+func isoCode(country any) string {
+	fields, _ := country.(map[string]any)
+	code, _ := fields["iso_code"].(string)
+	return code
+}
@@ -0,0 +1,187 @@
+package geoip_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"socks4/geoip"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mmdbWriter builds minimal MaxMind DB files with 24 bit records.
+type mmdbWriter struct {
+	root *trieNode
+	data bytes.Buffer
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	offset   int // data offset of a leaf, or -1
+	index    int
+}
+
+func newWriter() *mmdbWriter {
+	return &mmdbWriter{root: &trieNode{offset: -1}}
+}
+
+// insert maps network to the data at offset.
+func (w *mmdbWriter) insert(t *testing.T, network string, offset int) {
+	_, ipNet, err := net.ParseCIDR(network)
+	require.NoError(t, err)
+	ones, _ := ipNet.Mask.Size()
+	ip := ipNet.IP.To16()
+	if v4 := ipNet.IP.To4(); v4 != nil {
+		// IPv4 is stored in ::/96 of IPv6 databases
+		ip = append(make(net.IP, 12), v4...)
+		ones += 96
+	}
+
+	node := w.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{offset: -1}
+		}
+		node = node.children[bit]
+	}
+	node.offset = offset
+}
+
+// value appends a value to the data section, returning its offset.
+func (w *mmdbWriter) value(v any) int {
+	offset := w.data.Len()
+	encode(&w.data, v)
+	return offset
+}
+
+type pointer int
+
+func encode(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		if len(v) < 29 {
+			buf.WriteByte(2<<5 | byte(len(v)))
+		} else {
+			buf.Write([]byte{2<<5 | 29, byte(len(v) - 29)})
+		}
+		buf.WriteString(v)
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		buf.WriteByte(6<<5 | 4)
+		buf.Write(b)
+	case uint16:
+		buf.WriteByte(5<<5 | 2)
+		buf.Write(binary.BigEndian.AppendUint16(nil, v))
+	case pointer:
+		buf.WriteByte(1<<5 | byte(v>>8))
+		buf.WriteByte(byte(v))
+	case map[string]any:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		for key, value := range v {
+			encode(buf, key)
+			encode(buf, value)
+		}
+	}
+}
+
+func (w *mmdbWriter) write(t *testing.T) string {
+	var nodes []*trieNode
+	var number func(*trieNode)
+	number = func(n *trieNode) {
+		if n == nil || n.offset >= 0 {
+			return
+		}
+		n.index = len(nodes)
+		nodes = append(nodes, n)
+		number(n.children[0])
+		number(n.children[1])
+	}
+	number(w.root)
+
+	var file bytes.Buffer
+	record := func(n *trieNode) int {
+		switch {
+		case n == nil:
+			return len(nodes)
+		case n.offset >= 0:
+			return len(nodes) + 16 + n.offset
+		default:
+			return n.index
+		}
+	}
+	for _, n := range nodes {
+		for _, child := range n.children {
+			r := record(child)
+			file.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(w.data.Bytes())
+
+	file.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&file, map[string]any{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(6),
+		"database_type": "Test",
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, file.Bytes(), 0o644))
+	return path
+}
+
+func TestLocate(t *testing.T) {
+	t.Parallel()
+
+	countries := newWriter()
+	de := countries.value(map[string]any{"iso_code": "DE"})
+	countries.insert(t, "192.0.2.0/24", countries.value(map[string]any{"country": pointer(de)}))
+	countries.insert(t, "2001:db8::/32", countries.value(map[string]any{"registered_country": map[string]any{"iso_code": "NL"}}))
+
+	asns := newWriter()
+	asns.insert(t, "192.0.2.0/25", asns.value(map[string]any{
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example",
+	}))
+
+	db, err := geoip.Open(countries.write(t), asns.write(t))
+	require.NoError(t, err)
+
+	country, asn, err := db.Locate(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	require.Equal(t, "DE", country)
+	require.EqualValues(t, 64500, asn)
+
+	country, asn, err = db.Locate(net.ParseIP("192.0.2.200"))
+	require.NoError(t, err)
+	require.Equal(t, "DE", country)
+	require.Zero(t, asn)
+
+	// registered countries stand in for unknown locations
+	country, _, err = db.Locate(net.ParseIP("2001:db8::1"))
+	require.NoError(t, err)
+	require.Equal(t, "NL", country)
+
+	country, asn, err = db.Locate(net.ParseIP("198.51.100.1"))
+	require.NoError(t, err)
+	require.Empty(t, country)
+	require.Zero(t, asn)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "invalid.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o644))
+	_, err := geoip.Open(path)
+	require.Error(t, err)
+
+	_, err = geoip.Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	require.Error(t, err)
+}
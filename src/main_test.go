@@ -0,0 +1,57 @@
+package main
+
+import (
+	"socks4/server"
+
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsers(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		lines []string
+		users map[string][]netip.Prefix
+	}{
+		{nil, map[string][]netip.Prefix{}},
+		{[]string{"alice"}, map[string][]netip.Prefix{"alice": nil}},
+		{
+			[]string{"bob 10.0.0.0/8, ::1/128", "bob\t192.0.2.0/24"},
+			map[string][]netip.Prefix{"bob": {
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("::1/128"),
+				netip.MustParsePrefix("192.0.2.0/24"),
+			}},
+		},
+		{[]string{",", ", ,", " \t", "alice,"}, map[string][]netip.Prefix{"alice": nil}},
+	} {
+		users, err := parseUsers(test.lines)
+		require.NoError(t, err)
+		require.Equal(t, test.users, users)
+	}
+
+	_, err := parseUsers([]string{"alice 10.0.0.0"})
+	require.Error(t, err)
+	_, err = parseUsers([]string{"alice 10.0.0.0/33"})
+	require.Error(t, err)
+}
+
+func TestParseDNSRoutes(t *testing.T) {
+	t.Parallel()
+
+	routes, err := parseDNSRoutes([]string{"corp=10.0.0.53,10.0.1.53:5353", "=1.1.1.1", "v6=::1,[::2]:5353"})
+	require.NoError(t, err)
+	require.Equal(t, []server.DNSRoute{
+		{Suffix: "corp", Servers: []string{"10.0.0.53:53", "10.0.1.53:5353"}},
+		{Servers: []string{"1.1.1.1:53"}},
+		{Suffix: "v6", Servers: []string{"[::1]:53", "[::2]:5353"}},
+	}, routes)
+
+	for _, entry := range []string{"corp", "corp="} {
+		_, err := parseDNSRoutes([]string{entry})
+		require.Error(t, err)
+	}
+}
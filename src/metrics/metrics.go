@@ -0,0 +1,359 @@
+// Package metrics is a small, dependency-free registry of counters, gauges,
+// and histograms that can be exported in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) Set(n int64) {
+	g.v.Store(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	bounds []float64
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// DefaultBuckets suit latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+	sliKind       kind = "sli"
+)
+
+// promType is the Prometheus type a kind is exported as.
+func (k kind) promType() string {
+	if k == sliKind {
+		return string(gaugeKind)
+	}
+	return string(k)
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	series map[string]any
+}
+
+// Registry holds named metrics. Metrics are identified by name and an
+// optional list of label name/value pairs, and are created on first use.
+type Registry struct {
+	mu         sync.Mutex
+	prefix     string
+	families   map[string]*family
+	collectors []func()
+	labels     []string // added to every metric
+}
+
+// NewRegistry creates a registry whose metric names are all prefixed with
+// prefix.
+func NewRegistry(prefix string) *Registry {
+	return &Registry{
+		prefix:   prefix,
+		families: make(map[string]*family),
+	}
+}
+
+// SetConstLabels adds the given label pairs to every metric of r, e.g. to
+// tell apart the metrics of several instances in one process. It must be
+// called before any metric is created.
+func (r *Registry) SetConstLabels(labels ...string) {
+	if len(labels)%2 != 0 {
+		panic("metrics: odd number of constant label pairs")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels = append([]string(nil), labels...)
+}
+
+// Counter returns the counter with the given name and label pairs.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.get(name, help, counterKind, labels, func() any { return &Counter{} }).(*Counter)
+}
+
+// Gauge returns the gauge with the given name and label pairs.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.get(name, help, gaugeKind, labels, func() any { return &Gauge{} }).(*Gauge)
+}
+
+// Histogram returns the histogram with the given name and label pairs,
+// creating it with DefaultBuckets.
+func (r *Registry) Histogram(name, help string, labels ...string) *Histogram {
+	return r.get(name, help, histogramKind, labels, func() any {
+		return &Histogram{
+			bounds: DefaultBuckets,
+			counts: make([]uint64, len(DefaultBuckets)),
+		}
+	}).(*Histogram)
+}
+
+// SLI returns the SLI with the given name and label pairs, creating it
+// with the given rolling window. It is exported as a gauge of its ratio.
+func (r *Registry) SLI(name, help string, window time.Duration, labels ...string) *SLI {
+	return r.get(name, help, sliKind, labels, func() any { return newSLI(window) }).(*SLI)
+}
+
+// OnCollect registers f to be called before every Snapshot and
+// WritePrometheus, to update metrics that are sampled rather than recorded
+// as they happen.
+func (r *Registry) OnCollect(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, f)
+}
+
+func (r *Registry) collect() {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, f := range collectors {
+		f()
+	}
+}
+
+func (r *Registry) get(name, help string, k kind, labels []string, create func() any) any {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of label pairs for %s", name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.prefix + name
+	fam, ok := r.families[name]
+	if !ok {
+		fam = &family{name: name, help: help, kind: k, series: make(map[string]any)}
+		r.families[name] = fam
+	} else if fam.kind != k {
+		panic(fmt.Sprintf("metrics: %s registered as a %s", name, fam.kind))
+	}
+
+	key := labelString(append(append([]string(nil), r.labels...), labels...))
+	m, ok := fam.series[key]
+	if !ok {
+		m = create()
+		fam.series[key] = m
+	}
+	return m
+}
+
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Snapshot returns the current value of every counter and gauge, and the
+// count of every histogram, keyed by name and labels.
+func (r *Registry) Snapshot() map[string]float64 {
+	r.collect()
+	snap := make(map[string]float64)
+	r.each(func(fam *family, labels string, m any) {
+		key := fam.name
+		if labels != "" {
+			key += "{" + labels + "}"
+		}
+		switch m := m.(type) {
+		case *Counter:
+			snap[key] = float64(m.Value())
+		case *Gauge:
+			snap[key] = float64(m.Value())
+		case *Histogram:
+			snap[key+"_count"] = float64(m.Count())
+			snap[key+"_sum"] = m.Sum()
+		case *SLI:
+			snap[key] = m.Ratio()
+		}
+	})
+	return snap
+}
+
+// WritePrometheus writes every metric in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.collect()
+	var err error
+	var last string
+	r.each(func(fam *family, labels string, m any) {
+		if err != nil {
+			return
+		}
+		if fam.name != last {
+			last = fam.name
+			_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.kind.promType())
+		}
+		if err == nil {
+			err = writeSeries(w, fam.name, labels, m)
+		}
+	})
+	return err
+}
+
+func writeSeries(w io.Writer, name, labels string, m any) error {
+	switch m := m.(type) {
+	case *Counter:
+		_, err := fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), m.Value())
+		return err
+	case *Gauge:
+		_, err := fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), m.Value())
+		return err
+	case *SLI:
+		_, err := fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(m.Ratio()))
+		return err
+	case *Histogram:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i, bound := range m.bounds {
+			le := fmt.Sprintf("le=%q", formatFloat(bound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(join(labels, le)), m.counts[i]); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			name, braces(join(labels, `le="+Inf"`)), m.count,
+			name, braces(labels), formatFloat(m.sum),
+			name, braces(labels), m.count)
+		return err
+	}
+	return nil
+}
+
+func (r *Registry) each(f func(fam *family, labels string, m any)) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, fam := range r.families {
+		families = append(families, fam)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, fam := range families {
+		r.mu.Lock()
+		keys := make([]string, 0, len(fam.series))
+		for key := range fam.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		series := make([]any, len(keys))
+		for i, key := range keys {
+			series[i] = fam.series[key]
+		}
+		r.mu.Unlock()
+
+		for i, key := range keys {
+			f(fam, key, series[i])
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func join(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
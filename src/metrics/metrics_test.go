@@ -0,0 +1,110 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"socks4/metrics"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("test_")
+
+	c := r.Counter("events_total", "Events.")
+	c.Inc()
+	c.Add(2)
+	require.EqualValues(t, 3, c.Value())
+
+	// same name and labels yield the same counter
+	require.Same(t, c, r.Counter("events_total", "Events."))
+	require.NotSame(t, c, r.Counter("events_total", "Events.", "kind", "other"))
+}
+
+func TestGauge(t *testing.T) {
+	t.Parallel()
+
+	g := metrics.NewRegistry("").Gauge("active", "Active things.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	require.EqualValues(t, 1, g.Value())
+
+	g.Set(10)
+	require.EqualValues(t, 10, g.Value())
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := metrics.NewRegistry("").Histogram("latency_seconds", "Latency.")
+	h.Observe(0.2)
+	h.Observe(3)
+	require.EqualValues(t, 2, h.Count())
+	require.InDelta(t, 3.2, h.Sum(), 1e-9)
+}
+
+func TestMismatchedKind(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("")
+	r.Counter("thing", "")
+	require.Panics(t, func() { r.Gauge("thing", "") })
+	require.Panics(t, func() { r.Counter("other", "", "odd") })
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("test_")
+	r.Counter("events_total", "", "kind", "a").Add(4)
+	r.Gauge("active", "").Set(2)
+	r.Histogram("latency_seconds", "").Observe(1)
+
+	require.Equal(t, map[string]float64{
+		`test_events_total{kind="a"}`: 4,
+		"test_active":                 2,
+		"test_latency_seconds_count":  1,
+		"test_latency_seconds_sum":    1,
+	}, r.Snapshot())
+}
+
+func TestSetConstLabels(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("test_")
+	r.SetConstLabels("server", "a")
+	r.Counter("events_total", "", "kind", "b").Inc()
+	r.Gauge("active", "").Set(1)
+
+	require.Equal(t, map[string]float64{
+		`test_events_total{kind="b",server="a"}`: 1,
+		`test_active{server="a"}`:                1,
+	}, r.Snapshot())
+	require.Equal(t, int64(1), r.Counter("events_total", "", "kind", "b").Value())
+}
+
+func TestWritePrometheus(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("test_")
+	r.Counter("events_total", "Events.", "kind", "a").Inc()
+	r.Counter("events_total", "Events.", "kind", "b").Add(2)
+	r.Histogram("latency_seconds", "Latency.").Observe(0.3)
+
+	var out strings.Builder
+	require.NoError(t, r.WritePrometheus(&out))
+
+	text := out.String()
+	require.Contains(t, text, "# HELP test_events_total Events.\n# TYPE test_events_total counter\n")
+	require.Contains(t, text, "test_events_total{kind=\"a\"} 1\ntest_events_total{kind=\"b\"} 2\n")
+	require.Contains(t, text, "# TYPE test_latency_seconds histogram\n")
+	require.Contains(t, text, "test_latency_seconds_bucket{le=\"0.25\"} 0\n")
+	require.Contains(t, text, "test_latency_seconds_bucket{le=\"0.5\"} 1\n")
+	require.Contains(t, text, "test_latency_seconds_bucket{le=\"+Inf\"} 1\n")
+	require.Contains(t, text, "test_latency_seconds_count 1\n")
+	require.Equal(t, 1, strings.Count(text, "# TYPE test_events_total"))
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"runtime"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+)
+
+// RegisterRuntime adds gauges of the Go runtime's goroutines, heap and
+// garbage collector to r, sampled on every collection.
+func RegisterRuntime(r *Registry) {
+	goroutines := r.Gauge("go_goroutines", "Number of goroutines.")
+	heapAlloc := r.Gauge("go_heap_alloc_bytes", "Bytes of allocated heap objects.")
+	heapSys := r.Gauge("go_heap_sys_bytes", "Bytes of heap memory obtained from the OS.")
+	nextGC := r.Gauge("go_next_gc_bytes", "Heap size target of the next GC cycle.")
+	gcCycles := r.Gauge("go_gc_cycles_total", "Completed GC cycles.")
+	gcPause := r.Gauge("go_gc_pause_nanoseconds_total", "Cumulative time the world was stopped for GC.")
+	gcPercent := r.Gauge("go_gc_percent", "GOGC setting; 0 if GC is disabled.")
+	memLimit := r.Gauge("go_memory_limit_bytes", "GOMEMLIMIT setting; max int64 if unlimited.")
+
+	r.OnCollect(func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+
+		goroutines.Set(int64(runtime.NumGoroutine()))
+		heapAlloc.Set(int64(stats.HeapAlloc))
+		heapSys.Set(int64(stats.HeapSys))
+		nextGC.Set(int64(stats.NextGC))
+		gcCycles.Set(int64(stats.NumGC))
+		gcPause.Set(int64(stats.PauseTotalNs))
+
+		// a negative limit only reads the current one
+		memLimit.Set(debug.SetMemoryLimit(-1))
+
+		// debug.SetGCPercent can't read without writing, so use the
+		// runtime/metrics sample where the runtime provides it
+		sample := []rtmetrics.Sample{{Name: "/gc/gogc:percent"}}
+		rtmetrics.Read(sample)
+		if sample[0].Value.Kind() == rtmetrics.KindUint64 {
+			gcPercent.Set(int64(sample[0].Value.Uint64()))
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package metrics_test
+
+import (
+	"bytes"
+	"runtime/debug"
+	"testing"
+
+	"socks4/metrics"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterRuntime(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("test_")
+	metrics.RegisterRuntime(r)
+
+	snap := r.Snapshot()
+	require.Greater(t, snap["test_go_goroutines"], 0.0)
+	require.Greater(t, snap["test_go_heap_alloc_bytes"], 0.0)
+	require.Equal(t, float64(debug.SetMemoryLimit(-1)), snap["test_go_memory_limit_bytes"])
+
+	var buff bytes.Buffer
+	require.NoError(t, r.WritePrometheus(&buff))
+	require.Contains(t, buff.String(), "# TYPE test_go_goroutines gauge\n")
+}
+
+func TestOnCollect(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("")
+	calls := 0
+	r.OnCollect(func() {
+		calls++
+		r.Gauge("sampled", "").Set(int64(calls))
+	})
+
+	require.Equal(t, 1.0, r.Snapshot()["sampled"])
+	require.NoError(t, r.WritePrometheus(&bytes.Buffer{}))
+	require.Equal(t, 3.0, r.Snapshot()["sampled"])
+}
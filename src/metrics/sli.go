@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// number of slots a rolling window is divided into
+const sliSlots = 60
+
+type sliSlot struct {
+	start       time.Time
+	good, total int64
+}
+
+// SLI tracks the ratio of good events to all events over a rolling window,
+// e.g. the fraction of dials succeeding over the last 5 minutes.
+type SLI struct {
+	mu       sync.Mutex
+	slotSize time.Duration
+	slots    [sliSlots]sliSlot
+	now      func() time.Time
+}
+
+func newSLI(window time.Duration) *SLI {
+	slotSize := window / sliSlots
+	if slotSize <= 0 {
+		slotSize = 1
+	}
+	return &SLI{slotSize: slotSize, now: time.Now}
+}
+
+// Record counts an event as good or bad.
+func (s *SLI) Record(good bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the index follows from the slot's start, as Truncate rounds from
+	// the zero time rather than the Unix epoch
+	start := s.now().Truncate(s.slotSize)
+	slot := &s.slots[(start.UnixNano()/int64(s.slotSize))%sliSlots]
+	if !slot.start.Equal(start) {
+		*slot = sliSlot{start: start}
+	}
+
+	slot.total++
+	if good {
+		slot.good++
+	}
+}
+
+// Counts returns the good and total events within the window.
+func (s *SLI) Counts() (good, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldest := s.now().Add(-s.slotSize * sliSlots)
+	for _, slot := range s.slots {
+		if slot.start.After(oldest) {
+			good += slot.good
+			total += slot.total
+		}
+	}
+	return good, total
+}
+
+// Ratio returns the fraction of good events within the window, or 1 if
+// there were none.
+func (s *SLI) Ratio() float64 {
+	good, total := s.Counts()
+	if total == 0 {
+		return 1
+	}
+	return float64(good) / float64(total)
+}
@@ -0,0 +1,57 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"socks4/metrics"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLI(t *testing.T) {
+	t.Parallel()
+
+	sli := metrics.NewRegistry("").SLI("dial_success", "Dials succeeding.", time.Minute)
+	require.EqualValues(t, 1, sli.Ratio())
+
+	sli.Record(true)
+	sli.Record(true)
+	sli.Record(true)
+	sli.Record(false)
+
+	good, total := sli.Counts()
+	require.EqualValues(t, 3, good)
+	require.EqualValues(t, 4, total)
+	require.InDelta(t, 0.75, sli.Ratio(), 1e-9)
+}
+
+func TestSLIWindow(t *testing.T) {
+	t.Parallel()
+
+	sli := metrics.NewRegistry("").SLI("dial_success", "", time.Millisecond*60)
+	sli.Record(false)
+	require.EqualValues(t, 0, sli.Ratio())
+
+	time.Sleep(time.Millisecond * 100)
+
+	// the failure fell out of the window
+	sli.Record(true)
+	require.EqualValues(t, 1, sli.Ratio())
+}
+
+func TestSLIExport(t *testing.T) {
+	t.Parallel()
+
+	r := metrics.NewRegistry("")
+	sli := r.SLI("dial_success", "Dials succeeding.", time.Minute)
+	sli.Record(true)
+	sli.Record(false)
+
+	require.Equal(t, map[string]float64{"dial_success": 0.5}, r.Snapshot())
+
+	var out strings.Builder
+	require.NoError(t, r.WritePrometheus(&out))
+	require.Equal(t, "# HELP dial_success Dials succeeding.\n# TYPE dial_success gauge\ndial_success 0.5\n", out.String())
+}
@@ -0,0 +1,165 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// FuzzCase is a SOCKS4 message, or a mutation of one, for seeding fuzz
+// targets.
+type FuzzCase struct {
+	Name string
+	Data []byte
+
+	// Whether Data is exactly one well-formed message of this package's
+	// Version with a known command or reply code. Parsers should reject
+	// anything else, or at least never act on it.
+	Valid bool
+}
+
+// Corpus holds the edge cases of the wire format that fuzz targets start
+// from.
+type Corpus struct {
+	Requests []FuzzCase
+	Replies  []FuzzCase
+}
+
+// FuzzCorpus returns valid requests and replies along with structured
+// mutations of them: truncations, trailing data, bad versions, commands and
+// codes, oversized and missing fields, and fields written in little-endian
+// byte order, as a client on a little-endian platform that forgets to
+// convert them would. It is the source of edge cases for this module's own
+// fuzz targets and may seed those of middleware handling SOCKS4 traffic.
+// Each call returns a fresh copy.
+func FuzzCorpus() Corpus {
+	return Corpus{
+		Requests: requestCorpus(),
+		Replies:  replyCorpus(),
+	}
+}
+
+func requestCorpus() []FuzzCase {
+	var cases []FuzzCase
+	add := func(name string, valid bool, data []byte) {
+		cases = append(cases, FuzzCase{Name: name, Data: data, Valid: valid})
+	}
+
+	// port 8080 and 10.0.0.1 read differently in either byte order
+	bases := []struct {
+		name     string
+		command  Command
+		ip       []byte
+		user     string
+		hostname string
+	}{
+		{"connect", ConnectCommand, []byte{10, 0, 0, 1}, "user", ""},
+		{"bind", BindCommand, []byte{10, 0, 0, 1}, "user", ""},
+		{"udp-associate", UDPAssociateCommand, []byte{0, 0, 0, 0}, "", ""},
+		{"no-user", ConnectCommand, []byte{10, 0, 0, 1}, "", ""},
+		{"max-user", ConnectCommand, []byte{10, 0, 0, 1}, strings.Repeat("u", maxRequestSize-minRequestSize), ""},
+		{"socks4a", ConnectCommand, []byte{0, 0, 0, 1}, "user", "example.com"},
+		{"socks4a-max-hostname", ConnectCommand, []byte{0, 0, 0, 255}, "", strings.Repeat("h", max4aRequestSize-maxRequestSize-1)},
+	}
+	for _, base := range bases {
+		data := rawRequest(base.command, 8080, base.ip, base.user, base.hostname)
+		add(base.name, true, data)
+
+		add(base.name+"/header-only", false, clone(data[:minRequestSize-1]))
+		add(base.name+"/unterminated", false, clone(data[:len(data)-1]))
+		add(base.name+"/trailing-data", false, append(clone(data), 'x'))
+		add(base.name+"/pipelined", false, append(clone(data), data...))
+
+		for _, version := range []byte{0, 5, 0xff} {
+			add(base.name+"/version-"+strconv.Itoa(int(version)), false, with(data, 0, version))
+		}
+		for _, command := range []byte{0, 4, 0xff} {
+			add(base.name+"/command-"+strconv.Itoa(int(command)), false, with(data, 1, command))
+		}
+
+		// a little-endian port is still a valid request, for another port
+		port := clone(data)
+		binary.LittleEndian.PutUint16(port[2:4], 8080)
+		add(base.name+"/little-endian-port", true, port)
+	}
+
+	// a little-endian IP of a SOCKS4 request is another IP, but reversing
+	// 0.0.0.x makes a SOCKS4a request's hostname trailing data
+	add("connect/little-endian-ip", true, rawRequest(ConnectCommand, 8080, []byte{1, 0, 0, 10}, "user", ""))
+	add("socks4a/little-endian-ip", false, rawRequest(ConnectCommand, 8080, []byte{1, 0, 0, 0}, "user", "example.com"))
+
+	add("empty", false, nil)
+	add("port-zero", true, rawRequest(ConnectCommand, 0, []byte{10, 0, 0, 1}, "", ""))
+	add("port-max", true, rawRequest(ConnectCommand, 0xffff, []byte{10, 0, 0, 1}, "", ""))
+	add("user-high-bytes", true, rawRequest(ConnectCommand, 8080, []byte{10, 0, 0, 1}, "\x80\xfe\xff", ""))
+	add("user-too-long", false, rawRequest(ConnectCommand, 8080, []byte{10, 0, 0, 1}, strings.Repeat("u", maxRequestSize-minRequestSize+1), ""))
+	add("user-embedded-null", false, rawRequest(ConnectCommand, 8080, []byte{10, 0, 0, 1}, "us\x00er", ""))
+	add("socks4a/missing-hostname", false, rawRequest(ConnectCommand, 8080, []byte{0, 0, 0, 1}, "user", ""))
+	add("socks4a/empty-hostname", false, append(rawRequest(ConnectCommand, 8080, []byte{0, 0, 0, 1}, "user", ""), 0))
+	add("socks4a/hostname-too-long", false, rawRequest(ConnectCommand, 8080, []byte{0, 0, 0, 1}, "", strings.Repeat("h", max4aRequestSize-maxRequestSize)))
+	add("socks4a/ip-zero", false, rawRequest(ConnectCommand, 8080, []byte{0, 0, 0, 0}, "user", "example.com"))
+	add("socks4a/hostname-embedded-null", false, rawRequest(ConnectCommand, 8080, []byte{0, 0, 0, 1}, "", "exa\x00mple.com"))
+	return cases
+}
+
+func replyCorpus() []FuzzCase {
+	var cases []FuzzCase
+	add := func(name string, valid bool, data []byte) {
+		cases = append(cases, FuzzCase{Name: name, Data: data, Valid: valid})
+	}
+
+	for _, code := range []ReplyCode{SuccessReply, RejectedFailed, NoIdentd, IdentMismatch} {
+		data := NewReply(code, []byte{10, 0, 0, 1}, 8080).Serialize()
+		name := "code-" + strconv.Itoa(int(code))
+		add(name, true, data)
+		add(name+"/truncated", false, clone(data[:len(data)-1]))
+		add(name+"/trailing-data", false, append(clone(data), 'x'))
+	}
+
+	success := NewReply(SuccessReply, []byte{10, 0, 0, 1}, 8080).Serialize()
+	for _, code := range []byte{0, 89, 94, 0xff} {
+		add("code-"+strconv.Itoa(int(code)), false, with(success, 1, code))
+	}
+	// SOCKS4 servers conventionally reply with version 0, but this
+	// package's servers and clients use Version
+	for _, version := range []byte{0, 5} {
+		add("version-"+strconv.Itoa(int(version)), false, with(success, 0, version))
+	}
+
+	port := clone(success)
+	binary.LittleEndian.PutUint16(port[2:4], 8080)
+	add("little-endian-port", true, port)
+	add("little-endian-ip", true, NewReply(SuccessReply, []byte{1, 0, 0, 10}, 8080).Serialize())
+	add("unspecified-ip", true, NewReply(SuccessReply, []byte{0, 0, 0, 0}, 0).Serialize())
+	add("empty", false, nil)
+	return cases
+}
+
+// rawRequest builds a request without NewRequest's checks, so mutations
+// can break the rules it enforces.
+func rawRequest(cmd Command, port int, ip []byte, user, hostname string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(Version)
+	b.WriteByte(cmd)
+	binary.Write(&b, binary.BigEndian, uint16(port))
+	b.Write(ip)
+	b.WriteString(user)
+	b.WriteByte(0)
+	if hostname != "" {
+		b.WriteString(hostname)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func clone(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
+
+// with returns a copy of data with the byte at i replaced by b.
+func with(data []byte, i int, b byte) []byte {
+	data = clone(data)
+	data[i] = b
+	return data
+}
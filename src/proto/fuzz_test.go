@@ -0,0 +1,87 @@
+package proto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"socks4/proto"
+
+	"github.com/stretchr/testify/require"
+)
+
+func validReply(t *testing.T, data []byte) (*proto.Reply, bool) {
+	reply, err := relay(t, proto.ReadReply, data)
+	if err != nil {
+		return nil, false
+	}
+	return reply, reply.Version() == proto.Version && reply.Code() != proto.InvalidReply
+}
+
+func TestFuzzCorpus(t *testing.T) {
+	t.Parallel()
+
+	corpus := proto.FuzzCorpus()
+	require.NotEmpty(t, corpus.Requests)
+	require.NotEmpty(t, corpus.Replies)
+
+	names := make(map[string]bool)
+	for _, c := range corpus.Requests {
+		require.False(t, names["request/"+c.Name], c.Name)
+		names["request/"+c.Name] = true
+
+		req, ok := proto.ParseRequest(c.Data)
+		require.Equal(t, c.Valid, ok, c.Name)
+		if ok {
+			require.Equal(t, c.Data, req.Serialize(), c.Name)
+		}
+	}
+	for _, c := range corpus.Replies {
+		require.False(t, names["reply/"+c.Name], c.Name)
+		names["reply/"+c.Name] = true
+
+		_, ok := validReply(t, c.Data)
+		require.Equal(t, c.Valid, ok, c.Name)
+	}
+
+	// callers may mutate what they get
+	corpus.Requests[0].Data[0] = 0
+	require.Equal(t, byte(proto.Version), proto.FuzzCorpus().Requests[0].Data[0])
+}
+
+func FuzzReadRequest(f *testing.F) {
+	for _, c := range proto.FuzzCorpus().Requests {
+		f.Add(c.Data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		req, err := proto.ReadRequest(r)
+		if err != nil {
+			return
+		}
+
+		// a parsed request is exactly what was consumed, and reads the same
+		// when serialized again
+		consumed := data[:len(data)-r.Len()]
+		require.Equal(t, consumed, req.Serialize())
+		again, err := proto.ReadRequest(bytes.NewReader(req.Serialize()))
+		require.NoError(t, err)
+		require.Equal(t, req.Address(), again.Address())
+		require.Equal(t, req.UserID(), again.UserID())
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	for _, c := range proto.FuzzCorpus().Replies {
+		f.Add(c.Data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reply, ok := validReply(t, data)
+		if !ok {
+			return
+		}
+		require.Len(t, data, 8)
+		require.Equal(t, data, reply.Serialize())
+	})
+}
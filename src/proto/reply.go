@@ -24,7 +24,20 @@ type ReplyCode = byte
 var (
 	InvalidReply ReplyCode = 0
 	SuccessReply ReplyCode = 90
-	ErrorReply   ReplyCode = 91
+
+	// Request rejected or failed
+	RejectedFailed ReplyCode = 91
+
+	// Request rejected because the server cannot connect to identd on the
+	// client
+	NoIdentd ReplyCode = 92
+
+	// Request rejected because identd on the client reported a different
+	// user ID than the request
+	IdentMismatch ReplyCode = 93
+
+	// Generic rejection, same as RejectedFailed
+	ErrorReply = RejectedFailed
 )
 
 func NewReply(code ReplyCode, ip net.IP, port int) *Reply {
@@ -45,7 +58,7 @@ func ReadReply(conn net.Conn) (*Reply, error) {
 	} else if n > maxReplySize {
 		return nil, errors.New("reply is too long")
 	}
-	return &Reply{raw: buf}, nil
+	return &Reply{raw: buf[:maxReplySize]}, nil
 }
 
 func (r Reply) Version() int {
@@ -56,8 +69,12 @@ func (r Reply) Code() ReplyCode {
 	switch r.raw[1] {
 	case SuccessReply:
 		return SuccessReply
-	case ErrorReply:
-		return ErrorReply
+	case RejectedFailed:
+		return RejectedFailed
+	case NoIdentd:
+		return NoIdentd
+	case IdentMismatch:
+		return IdentMismatch
 	default:
 		return InvalidReply
 	}
@@ -79,7 +79,9 @@ func TestReplyCode(t *testing.T) {
 
 	for _, code := range []proto.ReplyCode{
 		proto.SuccessReply,
-		proto.ErrorReply,
+		proto.RejectedFailed,
+		proto.NoIdentd,
+		proto.IdentMismatch,
 	} {
 		t.Run(strconv.Itoa(int(code)), func(code byte) func(t *testing.T) {
 			return func(t *testing.T) {
@@ -94,7 +96,7 @@ func TestReplyCode(t *testing.T) {
 
 	t.Run("random", func(t *testing.T) {
 		t.Parallel()
-		rand := byte(rand.Intn(256-int(proto.ErrorReply)) + int(proto.ErrorReply))
+		rand := byte(rand.Intn(256-int(proto.IdentMismatch+1)) + int(proto.IdentMismatch+1))
 		reply := proto.NewReply(rand, net.IPv4(0, 0, 0, 0), 0)
 		require.NotNil(t, reply)
 
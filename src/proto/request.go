@@ -1,20 +1,26 @@
 package proto
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 )
 
 type Request struct {
-	//  version byte
-	//  command byte
-	//  dstPort uint16 BIG
-	//  dstAddr uint32 BIG
-	//  userID  string
+	//  version  byte
+	//  command  byte
+	//  dstPort  uint16 BIG
+	//  dstAddr  uint32 BIG
+	//  userID   string
+	//  hostname string (SOCKS4a only)
 	raw []byte
+
+	// index of the user ID's null terminator
+	userEnd int
 }
 
 type Command = byte
@@ -23,6 +29,15 @@ var (
 	InvalidCommand Command = 0
 	ConnectCommand Command = 1
 	BindCommand    Command = 2
+
+	// UDPAssociateCommand is an extension to SOCKS4 asking the server to
+	// relay UDP datagrams for the client, framed as described by Datagram.
+	// The request's address is the client's UDP source, or 0.0.0.0:0 if
+	// unknown, and the reply's address is the server's relay; an IP of
+	// 0.0.0.0 means the server's own address. The association lasts until
+	// the TCP connection closes. Servers that don't support it reject it
+	// like any other unknown command.
+	UDPAssociateCommand Command = 3
 )
 
 const (
@@ -33,9 +48,19 @@ const (
 	// Minimum possible size of a socks4 Request.
 	minRequestSize = 9
 
+	// Maximum allowed size of a socks4a Request, which adds a hostname of
+	// up to 255 characters, excluding the null terminator
+	max4aRequestSize = maxRequestSize + 256
+
+	// Default limit of ReadRequest, which fits any valid request
+	DefaultRequestLimit = max4aRequestSize
+
 	Version = 4
 )
 
+// NewRequest creates a request for remote, which is host:port. If host is
+// a hostname rather than an IPv4 address, a SOCKS4a request is created so
+// the server resolves it.
 func NewRequest(cmd Command, remote string, user string) (*Request, error) {
 	if len(user)+minRequestSize > maxRequestSize {
 		return nil, errors.New("user must be less than 63 characters")
@@ -50,9 +75,16 @@ func NewRequest(cmd Command, remote string, user string) (*Request, error) {
 		return nil, errors.New("invalid port")
 	}
 
+	var hostname string
 	ip := net.ParseIP(host).To4()
-	if ip == nil {
+	if ip == nil && net.ParseIP(host) != nil {
 		return nil, errors.New("expected a IPv4 remote")
+	} else if ip == nil {
+		if len(host) > max4aRequestSize-maxRequestSize-1 {
+			return nil, errors.New("hostname must be less than 256 characters")
+		}
+		hostname = host
+		ip = net.IPv4(0, 0, 0, 1).To4()
 	}
 
 	port, err := strconv.Atoi(portStr)
@@ -68,20 +100,105 @@ func NewRequest(cmd Command, remote string, user string) (*Request, error) {
 	copy(buff[8:], user)
 	buff[minRequestSize+len(user)-1] = 0
 
-	return &Request{raw: buff}, nil
+	r := &Request{raw: buff, userEnd: len(buff) - 1}
+	if hostname != "" {
+		r.raw = append(append(r.raw, hostname...), 0)
+	}
+	return r, nil
 }
 
-func ReadRequest(conn net.Conn) (*Request, error) {
-	rawBytes := make([]byte, maxRequestSize+1)
-	n, err := conn.Read(rawBytes)
+// ReadRequest reads a request from r, limited to DefaultRequestLimit bytes.
+func ReadRequest(r io.Reader) (*Request, error) {
+	return ReadRequestLimit(r, DefaultRequestLimit)
+}
+
+// ParseRequest parses data as a request, reporting whether it is exactly
+// one well-formed request of this package's Version with a known command,
+// as FuzzCase.Valid describes. Anything else, such as trailing data, is
+// not.
+func ParseRequest(data []byte) (*Request, bool) {
+	r := bytes.NewReader(data)
+	req, err := ReadRequest(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from connection - %w", err)
-	} else if n < minRequestSize {
+		return nil, false
+	}
+	return req, r.Len() == 0 && req.Version() == Version && req.Command() != InvalidCommand
+}
+
+// ReadRequestLimit reads a request of at most limit bytes from r. Nothing
+// past the end of the request is consumed, so r may go on to carry other
+// data. If r is an io.ByteReader, such as a *bufio.Reader, the variable
+// length fields are read from it a byte at a time; otherwise each of their
+// bytes is a separate Read.
+func ReadRequestLimit(r io.Reader, limit int) (*Request, error) {
+	raw := make([]byte, 8, minRequestSize)
+	if _, err := io.ReadFull(r, raw); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 		return nil, errors.New("failed to read entire request")
-	} else if n > maxRequestSize {
-		return nil, errors.New("request is too long")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read from connection - %w", err)
+	}
+
+	req := &Request{raw: raw}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
 	}
-	return &Request{raw: rawBytes[:n]}, nil
+
+	// user ID
+	raw, err := readField(br, raw, maxRequestSize-minRequestSize, limit)
+	if err != nil {
+		return nil, fmt.Errorf("user ID - %w", err)
+	}
+	req.userEnd = len(raw) - 1
+
+	if req.IsSocks4a() {
+		start := len(raw)
+		raw, err = readField(br, raw, max4aRequestSize-maxRequestSize-1, limit)
+		if err != nil {
+			return nil, fmt.Errorf("hostname - %w", err)
+		} else if len(raw) == start+1 {
+			return nil, errors.New("socks4a request has an empty hostname")
+		}
+	}
+
+	req.raw = raw
+	return req, nil
+}
+
+// readField appends a null-terminated field of at most max bytes, excluding
+// the terminator, to raw without exceeding limit bytes in total.
+func readField(br io.ByteReader, raw []byte, max, limit int) ([]byte, error) {
+	for n := 0; ; n++ {
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("failed to read entire request")
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read from connection - %w", err)
+		}
+
+		raw = append(raw, b)
+		if b == 0 {
+			return raw, nil
+		} else if n == max {
+			return nil, errors.New("field is too long")
+		} else if len(raw) >= limit {
+			return nil, errors.New("request is too long")
+		}
+	}
+}
+
+// byteReader reads one byte at a time from an io.Reader that doesn't
+// implement io.ByteReader, so nothing past the request is consumed.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
 }
 
 func (r Request) Version() int {
@@ -94,6 +211,8 @@ func (r Request) Command() Command {
 		return ConnectCommand
 	case BindCommand:
 		return BindCommand
+	case UDPAssociateCommand:
+		return UDPAssociateCommand
 	default:
 		return InvalidCommand
 	}
@@ -104,15 +223,35 @@ func (r Request) Port() int {
 }
 
 func (r Request) IP() net.IP {
-	return net.IPv4(r.raw[4], r.raw[5], r.raw[6], r.raw[7])
+	return net.IPv4(r.raw[4], r.raw[5], r.raw[6], r.raw[7]).To4()
+}
+
+// IsSocks4a reports whether the request is a SOCKS4a request, which asks
+// the server to resolve a hostname by setting the IP to 0.0.0.x, x != 0.
+func (r Request) IsSocks4a() bool {
+	return r.raw[4] == 0 && r.raw[5] == 0 && r.raw[6] == 0 && r.raw[7] != 0
 }
 
+// Hostname returns the destination hostname of a SOCKS4a request, or an
+// empty string for SOCKS4 requests.
+func (r Request) Hostname() string {
+	if !r.IsSocks4a() {
+		return ""
+	}
+	return string(r.raw[r.userEnd+1 : len(r.raw)-1])
+}
+
+// Address returns the destination as host:port, where host is the hostname
+// of SOCKS4a requests.
 func (r Request) Address() string {
+	if r.IsSocks4a() {
+		return net.JoinHostPort(r.Hostname(), strconv.Itoa(r.Port()))
+	}
 	return fmt.Sprintf("%v:%d", r.IP(), r.Port())
 }
 
 func (r Request) UserID() string {
-	return string(r.raw[8 : len(r.raw)-1])
+	return string(r.raw[8:r.userEnd])
 }
 
 func (r Request) Serialize() []byte {
@@ -1,6 +1,9 @@
 package proto_test
 
 import (
+	"bufio"
+	"bytes"
+	"io"
 	"math/rand"
 	"net"
 	"strings"
@@ -18,15 +21,20 @@ func relay[T any](t *testing.T, f func(net.Conn) (*T, error), packet []byte) (*T
 	defer client.Close()
 	defer conn.Close()
 
+	// the reader may stop before the end of the packet, leaving the rest
+	// unwritten, or read on past it and see EOF
 	go func() {
-		n, err := client.Write(packet)
-		require.Equal(t, len(packet), n)
-		require.NoError(t, err)
+		client.Write(packet)
+		client.Close()
 	}()
 
 	return f(conn)
 }
 
+func readRequest(conn net.Conn) (*proto.Request, error) {
+	return proto.ReadRequest(conn)
+}
+
 func TestNewRequest(t *testing.T) {
 	t.Parallel()
 
@@ -37,7 +45,9 @@ func TestNewRequest(t *testing.T) {
 		{"something bad", ""},
 		{":5", ""},
 		{"localhost:", ""},
-		{"localhost:80", ""},
+		{"[::1]:80", ""},
+		{"localhost:80", strings.Repeat("A", 64)},
+		{strings.Repeat("h", 256) + ":80", ""},
 		{"localhost:num", ""},
 		{"1.1.1.1:tmp", ""},
 		{"1.1.1.1:80", strings.Repeat("A", 64)},
@@ -76,7 +86,7 @@ func TestReadRequest(t *testing.T) {
 	t.Run("TooShort", func(t *testing.T) {
 		t.Parallel()
 
-		r, err := relay(t, proto.ReadRequest, []byte{})
+		r, err := relay(t, readRequest, []byte{})
 		require.Nil(t, r)
 		require.ErrorContains(t, err, "failed to read entire request")
 	})
@@ -84,24 +94,91 @@ func TestReadRequest(t *testing.T) {
 	t.Run("TooLong", func(t *testing.T) {
 		t.Parallel()
 
-		r, err := relay(t, proto.ReadRequest, make([]byte, 72))
+		header := []byte{4, 1, 0, 80, 127, 0, 0, 1}
+		r, err := relay(t, readRequest, append(append(header, strings.Repeat("a", 63)...), 0))
 		require.NotNil(t, r)
 		require.NoError(t, err)
 
-		r, err = relay(t, proto.ReadRequest, make([]byte, 73))
+		r, err = relay(t, readRequest, append(append(header, strings.Repeat("a", 64)...), 0))
+		require.Nil(t, r)
+		require.ErrorContains(t, err, "user ID - field is too long")
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		t.Parallel()
+
+		packet := []byte{4, 1, 0, 80, 0, 0, 0, 1, 0, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0}
+		r, err := proto.ReadRequestLimit(bytes.NewReader(packet), len(packet))
+		require.NoError(t, err)
+		require.Equal(t, "example", r.Hostname())
+
+		r, err = proto.ReadRequestLimit(bytes.NewReader(packet), len(packet)-1)
 		require.Nil(t, r)
 		require.ErrorContains(t, err, "request is too long")
 	})
 
+	t.Run("Segmented", func(t *testing.T) {
+		t.Parallel()
+
+		client, conn := net.Pipe()
+		defer client.Close()
+		defer conn.Close()
+
+		packet := []byte{4, 1, 0, 80, 127, 0, 0, 1, 'm', 'c', 'r', 0}
+		go func() {
+			for _, b := range packet {
+				client.Write([]byte{b})
+			}
+		}()
+
+		r, err := proto.ReadRequest(conn)
+		require.NoError(t, err)
+		require.Equal(t, "mcr", r.UserID())
+		require.Equal(t, packet, r.Serialize())
+	})
+
+	t.Run("LeavesPipelinedData", func(t *testing.T) {
+		t.Parallel()
+
+		packet := []byte{4, 1, 0, 80, 127, 0, 0, 1, 0, 'd', 'a', 't', 'a'}
+		reader := bufio.NewReader(bytes.NewReader(packet))
+		r, err := proto.ReadRequest(reader)
+		require.NoError(t, err)
+		require.Equal(t, packet[:9], r.Serialize())
+
+		rest, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "data", string(rest))
+	})
+
 	t.Run("Ok", func(t *testing.T) {
 		t.Parallel()
 
-		r, err := relay(t, proto.ReadRequest, []byte{4, 0, 0, 0, 0, 0, 0, 0, 0})
+		r, err := relay(t, readRequest, []byte{4, 0, 0, 0, 0, 0, 0, 0, 0})
 		require.NotNil(t, r)
 		require.NoError(t, err)
 	})
 }
 
+func TestParseRequest(t *testing.T) {
+	t.Parallel()
+
+	data := []byte{proto.Version, byte(proto.ConnectCommand), 0, 80, 127, 0, 0, 1, 'a', 0}
+	req, ok := proto.ParseRequest(data)
+	require.True(t, ok)
+	require.Equal(t, 80, req.Port())
+
+	for _, invalid := range [][]byte{
+		data[:len(data)-1],
+		append(append([]byte(nil), data...), 'x'),
+		append([]byte{5}, data[1:]...),
+		append([]byte{proto.Version, 9}, data[2:]...),
+	} {
+		_, ok := proto.ParseRequest(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
 func TestRequestVersion(t *testing.T) {
 	t.Parallel()
 
@@ -201,3 +278,86 @@ func TestRequestSerialize(t *testing.T) {
 
 	require.Equal(t, []byte{proto.Version, proto.ConnectCommand, 0, 80, 127, 0, 0, 1, 0}, req.Serialize())
 }
+
+func TestReadSocks4aRequest(t *testing.T) {
+	t.Parallel()
+
+	packet := func(user, host string) []byte {
+		p := append([]byte{4, 1, 0, 80, 0, 0, 0, 1}, user...)
+		return append(append(append(p, 0), host...), 0)
+	}
+
+	t.Run("Ok", func(t *testing.T) {
+		t.Parallel()
+
+		r, err := relay(t, readRequest, packet("mcr", "example.com"))
+		require.NoError(t, err)
+		require.True(t, r.IsSocks4a())
+		require.Equal(t, "mcr", r.UserID())
+		require.Equal(t, "example.com", r.Hostname())
+		require.Equal(t, "example.com:80", r.Address())
+		require.Equal(t, packet("mcr", "example.com"), r.Serialize())
+	})
+
+	t.Run("LongHostname", func(t *testing.T) {
+		t.Parallel()
+
+		r, err := relay(t, readRequest, packet(strings.Repeat("u", 63), strings.Repeat("h", 255)))
+		require.NoError(t, err)
+		require.Len(t, r.Hostname(), 255)
+
+		r, err = relay(t, readRequest, packet("", strings.Repeat("h", 256)))
+		require.Nil(t, r)
+		require.ErrorContains(t, err, "hostname - field is too long")
+	})
+
+	t.Run("EmptyHostname", func(t *testing.T) {
+		t.Parallel()
+
+		r, err := relay(t, readRequest, packet("", ""))
+		require.Nil(t, r)
+		require.ErrorContains(t, err, "empty hostname")
+	})
+
+	t.Run("Unterminated", func(t *testing.T) {
+		t.Parallel()
+
+		p := packet("", "example.com")
+		r, err := relay(t, readRequest, p[:len(p)-1])
+		require.Nil(t, r)
+		require.ErrorContains(t, err, "failed to read entire request")
+	})
+
+	t.Run("Socks4", func(t *testing.T) {
+		t.Parallel()
+
+		r, err := relay(t, readRequest, []byte{4, 1, 0, 80, 127, 0, 0, 1, 0})
+		require.NoError(t, err)
+		require.False(t, r.IsSocks4a())
+		require.Empty(t, r.Hostname())
+	})
+}
+
+func TestRequestIPIsCanonical(t *testing.T) {
+	t.Parallel()
+
+	r, err := proto.NewRequest(proto.ConnectCommand, "[::ffff:10.1.2.3]:80", "")
+	require.NoError(t, err)
+	require.Equal(t, net.IP{10, 1, 2, 3}, r.IP())
+	require.Equal(t, "10.1.2.3:80", r.Address())
+}
+
+func TestNewSocks4aRequest(t *testing.T) {
+	t.Parallel()
+
+	req, err := proto.NewRequest(proto.ConnectCommand, "example.com:443", "mcr")
+	require.NoError(t, err)
+	require.True(t, req.IsSocks4a())
+	require.Equal(t, "example.com", req.Hostname())
+	require.Equal(t, "example.com:443", req.Address())
+	require.Equal(t, "mcr", req.UserID())
+
+	r, err := relay(t, readRequest, req.Serialize())
+	require.NoError(t, err)
+	require.Equal(t, req.Serialize(), r.Serialize())
+}
@@ -0,0 +1,321 @@
+// Package socks5 implements the messages of SOCKS protocol version 5
+// (RFC 1928) and its username/password authentication (RFC 1929).
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const Version = 5
+
+// Authentication methods
+const (
+	MethodNoAuth       byte = 0x00
+	MethodGSSAPI       byte = 0x01
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xff
+)
+
+// Request commands
+const (
+	ConnectCommand      byte = 0x01
+	BindCommand         byte = 0x02
+	UDPAssociateCommand byte = 0x03
+)
+
+// Address types
+const (
+	AddrIPv4   byte = 0x01
+	AddrDomain byte = 0x03
+	AddrIPv6   byte = 0x04
+)
+
+// Reply codes
+const (
+	Succeeded               byte = 0x00
+	GeneralFailure          byte = 0x01
+	NotAllowed              byte = 0x02
+	NetworkUnreachable      byte = 0x03
+	HostUnreachable         byte = 0x04
+	ConnectionRefused       byte = 0x05
+	TTLExpired              byte = 0x06
+	CommandNotSupported     byte = 0x07
+	AddressTypeNotSupported byte = 0x08
+)
+
+// ErrAddressType is returned when reading an address of an unknown type.
+var ErrAddressType = errors.New("unsupported address type")
+
+// Addr is a destination or bound address: an IP or a domain name, and a port.
+type Addr struct {
+	IP   net.IP
+	Host string // set instead of IP for domain names
+	Port int
+}
+
+// AddrFrom converts a *net.TCPAddr or *net.UDPAddr into an Addr. Anything
+// else gives the unspecified IPv4 address.
+func AddrFrom(addr net.Addr) Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return Addr{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return Addr{IP: a.IP, Port: a.Port}
+	}
+	return Addr{IP: net.IPv4zero, Port: 0}
+}
+
+func (a Addr) String() string {
+	host := a.Host
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+func (a Addr) serialize() ([]byte, error) {
+	var buff []byte
+	switch {
+	case a.Host != "":
+		if len(a.Host) > 255 {
+			return nil, errors.New("domain name must be at most 255 characters")
+		}
+		buff = append([]byte{AddrDomain, byte(len(a.Host))}, a.Host...)
+	case a.IP.To4() != nil:
+		buff = append([]byte{AddrIPv4}, a.IP.To4()...)
+	case len(a.IP) == net.IPv6len:
+		buff = append([]byte{AddrIPv6}, a.IP...)
+	default:
+		return nil, fmt.Errorf("invalid IP %v", a.IP)
+	}
+	return binary.BigEndian.AppendUint16(buff, uint16(a.Port)), nil
+}
+
+func readAddr(r io.Reader) (Addr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return Addr{}, err
+	}
+
+	var addr Addr
+	switch atyp[0] {
+	case AddrIPv4, AddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == AddrIPv6 {
+			size = net.IPv6len
+		}
+		addr.IP = make(net.IP, size)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return Addr{}, err
+		}
+	case AddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return Addr{}, err
+		}
+		host := make([]byte, size[0])
+		if _, err := io.ReadFull(r, host); err != nil {
+			return Addr{}, err
+		} else if len(host) == 0 {
+			return Addr{}, errors.New("empty domain name")
+		}
+		addr.Host = string(host)
+	default:
+		return Addr{}, fmt.Errorf("%w %#x", ErrAddressType, atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return Addr{}, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port[:]))
+	return addr, nil
+}
+
+// Greeting is the first message of a client, offering its authentication
+// methods.
+type Greeting struct {
+	Methods []byte
+}
+
+func ReadGreeting(r io.Reader) (*Greeting, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read greeting - %w", err)
+	} else if header[0] != Version {
+		return nil, fmt.Errorf("unexpected version %d", header[0])
+	} else if header[1] == 0 {
+		return nil, errors.New("greeting offers no methods")
+	}
+
+	g := &Greeting{Methods: make([]byte, header[1])}
+	if _, err := io.ReadFull(r, g.Methods); err != nil {
+		return nil, fmt.Errorf("failed to read greeting methods - %w", err)
+	}
+	return g, nil
+}
+
+// Offers reports whether the client offered method.
+func (g Greeting) Offers(method byte) bool {
+	for _, m := range g.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Greeting) Serialize() []byte {
+	return append([]byte{Version, byte(len(g.Methods))}, g.Methods...)
+}
+
+// MethodSelection is the server's answer to a Greeting.
+type MethodSelection struct {
+	Method byte
+}
+
+func ReadMethodSelection(r io.Reader) (*MethodSelection, error) {
+	var buff [2]byte
+	if _, err := io.ReadFull(r, buff[:]); err != nil {
+		return nil, fmt.Errorf("failed to read method selection - %w", err)
+	} else if buff[0] != Version {
+		return nil, fmt.Errorf("unexpected version %d", buff[0])
+	}
+	return &MethodSelection{Method: buff[1]}, nil
+}
+
+func (m MethodSelection) Serialize() []byte {
+	return []byte{Version, m.Method}
+}
+
+// Version of the username/password subnegotiation
+const userPassVersion = 1
+
+// UserPassRequest carries the credentials of the username/password method.
+type UserPassRequest struct {
+	Username string
+	Password string
+}
+
+func ReadUserPassRequest(r io.Reader) (*UserPassRequest, error) {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return nil, fmt.Errorf("failed to read credentials - %w", err)
+	} else if version[0] != userPassVersion {
+		return nil, fmt.Errorf("unexpected username/password version %d", version[0])
+	}
+
+	username, err := readString(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read username - %w", err)
+	}
+	password, err := readString(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password - %w", err)
+	}
+	return &UserPassRequest{Username: username, Password: password}, nil
+}
+
+func (u UserPassRequest) Serialize() ([]byte, error) {
+	if len(u.Username) > 255 || len(u.Password) > 255 {
+		return nil, errors.New("username and password must be at most 255 characters")
+	}
+	buff := append([]byte{userPassVersion, byte(len(u.Username))}, u.Username...)
+	buff = append(append(buff, byte(len(u.Password))), u.Password...)
+	return buff, nil
+}
+
+// UserPassStatus answers a UserPassRequest; zero is success.
+type UserPassStatus struct {
+	Status byte
+}
+
+func ReadUserPassStatus(r io.Reader) (*UserPassStatus, error) {
+	var buff [2]byte
+	if _, err := io.ReadFull(r, buff[:]); err != nil {
+		return nil, fmt.Errorf("failed to read authentication status - %w", err)
+	}
+	return &UserPassStatus{Status: buff[1]}, nil
+}
+
+func (u UserPassStatus) Serialize() []byte {
+	return []byte{userPassVersion, u.Status}
+}
+
+func readString(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	buff := make([]byte, size[0])
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return "", err
+	}
+	return string(buff), nil
+}
+
+// Request asks the server to carry out Command for Addr.
+type Request struct {
+	Command byte
+	Addr    Addr
+}
+
+// ReadRequest reads a request. A request with an unknown address type
+// fails with an error wrapping ErrAddressType.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read request - %w", err)
+	} else if header[0] != Version {
+		return nil, fmt.Errorf("unexpected version %d", header[0])
+	}
+
+	addr, err := readAddr(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request address - %w", err)
+	}
+	return &Request{Command: header[1], Addr: addr}, nil
+}
+
+func (req Request) Serialize() ([]byte, error) {
+	addr, err := req.Addr.serialize()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Version, req.Command, 0}, addr...), nil
+}
+
+// Reply answers a Request with Code, and the address relevant to the
+// command, e.g. the address a BIND listens on.
+type Reply struct {
+	Code byte
+	Addr Addr
+}
+
+func ReadReply(r io.Reader) (*Reply, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read reply - %w", err)
+	} else if header[0] != Version {
+		return nil, fmt.Errorf("unexpected version %d", header[0])
+	}
+
+	addr, err := readAddr(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply address - %w", err)
+	}
+	return &Reply{Code: header[1], Addr: addr}, nil
+}
+
+func (rep Reply) Serialize() ([]byte, error) {
+	addr, err := rep.Addr.serialize()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{Version, rep.Code, 0}, addr...), nil
+}
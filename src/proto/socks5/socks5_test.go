@@ -0,0 +1,89 @@
+package socks5_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"socks4/proto/socks5"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGreeting(t *testing.T) {
+	t.Parallel()
+
+	g := socks5.Greeting{Methods: []byte{socks5.MethodNoAuth, socks5.MethodUserPass}}
+	read, err := socks5.ReadGreeting(bytes.NewReader(g.Serialize()))
+	require.NoError(t, err)
+	require.Equal(t, g.Methods, read.Methods)
+	require.True(t, read.Offers(socks5.MethodUserPass))
+	require.False(t, read.Offers(socks5.MethodGSSAPI))
+
+	for _, bad := range [][]byte{{}, {4, 1, 0}, {5, 0}, {5, 2, 0}} {
+		_, err := socks5.ReadGreeting(bytes.NewReader(bad))
+		require.Error(t, err, "%v", bad)
+	}
+}
+
+func TestUserPassRequest(t *testing.T) {
+	t.Parallel()
+
+	creds := socks5.UserPassRequest{Username: "alice", Password: "secret"}
+	body, err := creds.Serialize()
+	require.NoError(t, err)
+	read, err := socks5.ReadUserPassRequest(bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, creds, *read)
+
+	_, err = socks5.UserPassRequest{Username: strings.Repeat("a", 256)}.Serialize()
+	require.Error(t, err)
+	_, err = socks5.ReadUserPassRequest(bytes.NewReader([]byte{5, 1, 'a', 0}))
+	require.Error(t, err)
+}
+
+func TestRequest(t *testing.T) {
+	t.Parallel()
+
+	for _, addr := range []socks5.Addr{
+		{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		{Host: "example.com", Port: 8080},
+	} {
+		req := socks5.Request{Command: socks5.ConnectCommand, Addr: addr}
+		body, err := req.Serialize()
+		require.NoError(t, err)
+
+		read, err := socks5.ReadRequest(bytes.NewReader(body))
+		require.NoError(t, err)
+		require.Equal(t, req, *read)
+	}
+}
+
+func TestRequestAddressType(t *testing.T) {
+	t.Parallel()
+
+	_, err := socks5.ReadRequest(bytes.NewReader([]byte{5, 1, 0, 9, 0, 0}))
+	require.ErrorIs(t, err, socks5.ErrAddressType)
+
+	_, err = socks5.ReadRequest(bytes.NewReader([]byte{5, 1, 0, socks5.AddrDomain, 0, 0, 80}))
+	require.Error(t, err)
+
+	_, err = socks5.ReadRequest(bytes.NewReader([]byte{5, 1, 0, socks5.AddrIPv4, 127, 0}))
+	require.Error(t, err)
+}
+
+func TestReply(t *testing.T) {
+	t.Parallel()
+
+	rep := socks5.Reply{Code: socks5.Succeeded, Addr: socks5.AddrFrom(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080})}
+	body, err := rep.Serialize()
+	require.NoError(t, err)
+	require.Len(t, body, 10)
+
+	read, err := socks5.ReadReply(bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, socks5.Succeeded, read.Code)
+	require.Equal(t, "127.0.0.1:1080", read.Addr.String())
+}
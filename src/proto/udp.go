@@ -0,0 +1,104 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Size of a datagram header without a hostname
+const datagramHeaderSize = 8
+
+// Datagram is a UDP datagram relayed over a UDP association. Each is framed
+// with a header giving the destination of datagrams from the client, or
+// the source of datagrams to it:
+//
+//	reserved uint16 (zero)
+//	dstPort  uint16 BIG
+//	dstAddr  uint32 BIG
+//	hostname string (only if dstAddr is 0.0.0.x, x != 0, as in SOCKS4a)
+//	data     []byte
+type Datagram struct {
+	IP       net.IP
+	Hostname string
+	Port     int
+	Data     []byte
+}
+
+// NewDatagram creates a datagram of data for remote, which is host:port.
+// If host is a hostname rather than an IPv4 address, the server resolves
+// it.
+func NewDatagram(remote string, data []byte) (*Datagram, error) {
+	host, portStr, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split remote host & port - %w", err)
+	} else if host == "" {
+		return nil, errors.New("invalid host")
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse port as an int - %w", err)
+	}
+
+	d := &Datagram{Port: port, Data: data}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > max4aRequestSize-maxRequestSize-1 {
+			return nil, errors.New("hostname must be less than 256 characters")
+		}
+		d.Hostname = host
+	} else if d.IP = ip.To4(); d.IP == nil {
+		return nil, errors.New("expected a IPv4 remote")
+	}
+	return d, nil
+}
+
+// ReadDatagram parses a datagram received over a UDP association. Data
+// refers to packet rather than a copy.
+func ReadDatagram(packet []byte) (*Datagram, error) {
+	if len(packet) < datagramHeaderSize {
+		return nil, errors.New("datagram is too short")
+	} else if packet[0] != 0 || packet[1] != 0 {
+		return nil, errors.New("datagram reserved field is not zero")
+	}
+
+	d := &Datagram{
+		IP:   net.IPv4(packet[4], packet[5], packet[6], packet[7]).To4(),
+		Port: int(binary.BigEndian.Uint16(packet[2:4])),
+		Data: packet[datagramHeaderSize:],
+	}
+	if d.IP[0] == 0 && d.IP[1] == 0 && d.IP[2] == 0 && d.IP[3] != 0 {
+		end := bytes.IndexByte(d.Data, 0)
+		if end <= 0 {
+			return nil, errors.New("datagram has no hostname")
+		}
+		d.Hostname = string(d.Data[:end])
+		d.IP = nil
+		d.Data = d.Data[end+1:]
+	}
+	return d, nil
+}
+
+// Address returns the destination or source as host:port.
+func (d Datagram) Address() string {
+	if d.Hostname != "" {
+		return net.JoinHostPort(d.Hostname, strconv.Itoa(d.Port))
+	}
+	return fmt.Sprintf("%v:%d", d.IP, d.Port)
+}
+
+// Serialize returns the framed datagram.
+func (d Datagram) Serialize() []byte {
+	buff := make([]byte, datagramHeaderSize, datagramHeaderSize+len(d.Hostname)+1+len(d.Data))
+	binary.BigEndian.PutUint16(buff[2:4], uint16(d.Port))
+	if d.Hostname != "" {
+		buff[7] = 1
+		buff = append(append(buff, d.Hostname...), 0)
+	} else {
+		copy(buff[4:8], d.IP.To4())
+	}
+	return append(buff, d.Data...)
+}
@@ -0,0 +1,38 @@
+package proto_test
+
+import (
+	"testing"
+
+	"socks4/proto"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagram(t *testing.T) {
+	t.Parallel()
+
+	for _, remote := range []string{"1.2.3.4:53", "dns.example:853"} {
+		d, err := proto.NewDatagram(remote, []byte("query"))
+		require.NoError(t, err)
+
+		parsed, err := proto.ReadDatagram(d.Serialize())
+		require.NoError(t, err)
+		require.Equal(t, remote, parsed.Address())
+		require.Equal(t, "query", string(parsed.Data))
+	}
+
+	for _, remote := range []string{"[::1]:53", "1.2.3.4", "1.2.3.4:dns"} {
+		_, err := proto.NewDatagram(remote, nil)
+		require.Error(t, err, remote)
+	}
+
+	for _, packet := range [][]byte{
+		{0, 0, 0, 53},
+		{1, 0, 0, 53, 1, 2, 3, 4},
+		{0, 0, 0, 53, 0, 0, 0, 1, 'h', 'o', 's', 't'},
+		{0, 0, 0, 53, 0, 0, 0, 1, 0},
+	} {
+		_, err := proto.ReadDatagram(packet)
+		require.Error(t, err, packet)
+	}
+}
@@ -0,0 +1,34 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// WriteFull writes all of msg to conn, retrying partial writes until the
+// message is complete or timeout elapses. The write deadline of conn is
+// cleared afterwards.
+func WriteFull(conn net.Conn, msg []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("failed to set write deadline - %w", err)
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	for written := 0; written < len(msg); {
+		n, err := conn.Write(msg[written:])
+		written += n
+		if err == nil && n == 0 {
+			return fmt.Errorf("failed to write entire message - %w", io.ErrShortWrite)
+		} else if err != nil && (n == 0 || errors.Is(err, os.ErrDeadlineExceeded)) {
+			return fmt.Errorf("failed to write entire message (%d of %d bytes) - %w", written, len(msg), err)
+		}
+		// a partial write that made progress is retried
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package proto_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"socks4/proto"
+
+	"github.com/stretchr/testify/require"
+)
+
+// choppyConn accepts at most one byte per write, failing every other write.
+type choppyConn struct {
+	net.Conn
+	written []byte
+	fail    bool
+}
+
+func (c *choppyConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b[0])
+	c.fail = !c.fail
+	if c.fail && len(b) > 1 {
+		return 1, errors.New("temporary failure")
+	}
+	if len(b) > 1 {
+		return 1, io.ErrShortWrite
+	}
+	return 1, nil
+}
+
+func (c *choppyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestWriteFull(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Partial", func(t *testing.T) {
+		t.Parallel()
+
+		conn := &choppyConn{}
+		msg := []byte{4, 90, 0, 80, 1, 2, 3, 4}
+		require.NoError(t, proto.WriteFull(conn, msg, time.Second))
+		require.Equal(t, msg, conn.written)
+	})
+
+	t.Run("Ok", func(t *testing.T) {
+		t.Parallel()
+
+		client, conn := net.Pipe()
+		defer client.Close()
+		defer conn.Close()
+
+		msg := []byte("hello")
+		go func() { require.NoError(t, proto.WriteFull(conn, msg, time.Second)) }()
+
+		buff := make([]byte, len(msg))
+		_, err := io.ReadFull(client, buff)
+		require.NoError(t, err)
+		require.Equal(t, msg, buff)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+
+		client, conn := net.Pipe()
+		defer client.Close()
+		defer conn.Close()
+
+		// nobody reads from client
+		err := proto.WriteFull(conn, []byte("hello"), time.Millisecond*50)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+
+		client, conn := net.Pipe()
+		client.Close()
+		defer conn.Close()
+
+		require.Error(t, proto.WriteFull(conn, []byte("hello"), time.Second))
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type checkResult struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type checkReport struct {
+	OK     bool          `json:"ok"`
+	Checks []checkResult `json:"checks"`
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// selfCheck verifies the environment the server is about to run in.
+func selfCheck(ctx context.Context, conf *config) checkReport {
+	checks := []check{
+		{"listen-port", func(ctx context.Context) error {
+			if _, ok := os.LookupEnv(listenFDsEnv); ok {
+				// the ports are held by the process being upgraded
+				return nil
+			}
+			lc := net.ListenConfig{}
+			for _, addr := range listenAddresses(conf) {
+				ln, err := lc.Listen(ctx, "tcp", addr)
+				if err != nil {
+					return err
+				}
+				ln.Close()
+			}
+			return nil
+		}},
+		{"policy-files", func(ctx context.Context) error {
+			_, err := loadPolicy(conf)
+			return err
+		}},
+		{"tls-certificate", func(ctx context.Context) error {
+			if conf.TLSCertFile == "" {
+				return nil
+			}
+			return checkCertificate(conf.TLSCertFile, conf.TLSKeyFile, time.Now())
+		}},
+		{"resolver", func(ctx context.Context) error {
+			addrs, err := net.DefaultResolver.LookupHost(ctx, conf.CheckResolveHost)
+			if err != nil {
+				return err
+			} else if len(addrs) == 0 {
+				return fmt.Errorf("no addresses for %s", conf.CheckResolveHost)
+			}
+			return nil
+		}},
+		{"egress-route", func(ctx context.Context) error {
+			// a UDP "dial" only selects a route and local address
+			d := net.Dialer{}
+			conn, err := d.DialContext(ctx, "udp4", conf.CheckEgressAddress)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}},
+	}
+
+	report := checkReport{OK: true}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		start := time.Now()
+		err := c.run(ctx)
+		cancel()
+
+		result := checkResult{Name: c.name, OK: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// checkCertificate loads the certificate and key of the TLS listeners,
+// failing if the certificate isn't valid at now.
+func checkCertificate(certFile, keyFile string, now time.Time) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate - %w", err)
+	}
+
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate isn't valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	} else if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func logReport(log *zap.Logger, report checkReport) {
+	for _, result := range report.Checks {
+		fields := []zap.Field{zap.String("check", result.Name), zap.Duration("duration", result.Duration)}
+		if result.OK {
+			log.Info("self-check passed", fields...)
+		} else {
+			log.Error("self-check failed", append(fields, zap.String("error", result.Error))...)
+		}
+	}
+	log.Info("self-check complete", zap.Bool("ok", report.OK), zap.Any("report", report))
+}
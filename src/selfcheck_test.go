@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate valid from notBefore to
+// notAfter and its key, returning their files.
+func writeCert(t *testing.T, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestCheckCertificate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	certFile, keyFile := writeCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+	require.NoError(t, checkCertificate(certFile, keyFile, now))
+
+	expiredCert, expiredKey := writeCert(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.ErrorContains(t, checkCertificate(expiredCert, expiredKey, now), "expired")
+
+	futureCert, futureKey := writeCert(t, now.Add(time.Hour), now.Add(2*time.Hour))
+	require.ErrorContains(t, checkCertificate(futureCert, futureKey, now), "isn't valid before")
+
+	// the key must match the certificate
+	require.Error(t, checkCertificate(certFile, expiredKey, now))
+}
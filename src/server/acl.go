@@ -0,0 +1,384 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrACLDenied is returned for destinations denied by the policy's ACL.
+var ErrACLDenied = fmt.Errorf("denied by ACL - %w", ErrDestinationDenied)
+
+// Action is what a Rule does with the destinations it matches.
+type Action int
+
+const (
+	Deny Action = iota
+	Allow
+
+	// Log records the destinations it matches, and evaluation continues
+	// with the next rule.
+	Log
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Log:
+		return "log"
+	default:
+		return "deny"
+	}
+}
+
+// GeoIP locates destination addresses for rules matching countries or
+// autonomous systems, e.g. a *geoip.DB. An empty country and a zero ASN
+// mean the address is unknown.
+type GeoIP interface {
+	Locate(ip net.IP) (country string, asn uint32, err error)
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To int
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+// Rule allows or denies the destinations it matches. Each of Ports and
+// Users that is empty matches anything; otherwise one of its entries must
+// match. Likewise, the destination must be in one of Networks, Countries
+// (ISO 3166 codes) or ASNs, unless all are empty. Countries and ASNs are
+// looked up with the policy's GeoIP, and never match without one. A rule
+// with a Schedule only matches within it.
+type Rule struct {
+	Action    Action
+	Networks  []netip.Prefix
+	Countries []string
+	ASNs      []uint32
+	Ports     []PortRange
+	Users     []string
+	Schedule  *Schedule
+
+	// The local address or interface the destinations an allow rule
+	// matches are dialed from, instead of the server's source address.
+	Source string
+}
+
+// destination is what rules are matched against, located at most once and
+// only if a rule needs it.
+type destination struct {
+	user string
+	ip   net.IP
+	addr netip.Addr
+	port int
+	now  time.Time
+
+	geo     GeoIP
+	located bool
+	country string
+	asn     uint32
+	geoErr  error
+}
+
+func (d *destination) locate() (string, uint32) {
+	if !d.located && d.geo != nil {
+		d.country, d.asn, d.geoErr = d.geo.Locate(d.ip)
+	}
+	d.located = true
+	return d.country, d.asn
+}
+
+// matches reports whether the rule applies to dst.
+func (r *Rule) matches(dst *destination) bool {
+	if len(r.Users) != 0 && !containsString(r.Users, dst.user) {
+		return false
+	} else if r.Schedule != nil && !r.Schedule.Contains(dst.now) {
+		return false
+	}
+
+	if len(r.Ports) != 0 {
+		matched := false
+		for _, ports := range r.Ports {
+			matched = matched || ports.contains(dst.port)
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Networks) == 0 && len(r.Countries) == 0 && len(r.ASNs) == 0 {
+		return true
+	}
+	for _, network := range r.Networks {
+		if network.Contains(dst.addr) {
+			return true
+		}
+	}
+	if len(r.Countries) == 0 && len(r.ASNs) == 0 {
+		return false
+	}
+	country, asn := dst.locate()
+	if country != "" && containsString(r.Countries, country) {
+		return true
+	}
+	for _, a := range r.ASNs {
+		if asn != 0 && a == asn {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) String() string {
+	join := func(n int, list func() []string) string {
+		if n == 0 {
+			return "*"
+		}
+		return strings.Join(list(), ",")
+	}
+	networks := join(len(r.Networks)+len(r.Countries)+len(r.ASNs), func() []string {
+		var out []string
+		for _, network := range r.Networks {
+			out = append(out, network.String())
+		}
+		for _, country := range r.Countries {
+			out = append(out, "cc:"+country)
+		}
+		for _, asn := range r.ASNs {
+			out = append(out, fmt.Sprintf("as:%d", asn))
+		}
+		return out
+	})
+	ports := join(len(r.Ports), func() []string {
+		out := make([]string, len(r.Ports))
+		for i, ports := range r.Ports {
+			if ports.From == ports.To {
+				out[i] = strconv.Itoa(ports.From)
+			} else {
+				out[i] = fmt.Sprintf("%d-%d", ports.From, ports.To)
+			}
+		}
+		return out
+	})
+	users := join(len(r.Users), func() []string { return r.Users })
+	rule := fmt.Sprintf("%v %s %s %s", r.Action, networks, ports, users)
+	if r.Schedule != nil {
+		rule += fmt.Sprintf(" at %v", r.Schedule)
+	}
+	if r.Source != "" {
+		rule += " from " + r.Source
+	}
+	return rule
+}
+
+// ParseRule parses a rule of the form "<allow|deny|log> <networks> <ports>
+// [users] [at <schedule>] [from <source>]", where each field is a comma
+// separated list, or "*" to match anything, e.g. "allow
+// 10.0.0.0/8,192.168.1.1 80,443,8000-8999 alice". Networks may be single
+// addresses, countries as "cc:DE" or autonomous systems as "as:64500". A
+// schedule is days, a time window or both, e.g. "deny * 1935 * at mon-fri
+// 09:00-17:00". A source is a local address or interface name.
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	clauses := make(map[string][]string)
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i] != "at" && fields[i] != "from" {
+			continue
+		} else if _, ok := clauses[fields[i]]; ok {
+			return Rule{}, fmt.Errorf("invalid rule %q, repeated %q", s, fields[i])
+		}
+		clauses[fields[i]] = fields[i+1:]
+		fields = fields[:i]
+	}
+	if len(fields) != 3 && len(fields) != 4 {
+		return Rule{}, fmt.Errorf("invalid rule %q, expected <allow|deny|log> <networks> <ports> [users] [at <schedule>] [from <source>]", s)
+	}
+
+	var rule Rule
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	case "log":
+		rule.Action = Log
+	default:
+		return Rule{}, fmt.Errorf("invalid rule action %q", fields[0])
+	}
+
+	for _, network := range listField(fields[1]) {
+		if country, ok := strings.CutPrefix(network, "cc:"); ok && len(country) == 2 {
+			rule.Countries = append(rule.Countries, strings.ToUpper(country))
+			continue
+		} else if asn, ok := strings.CutPrefix(network, "as:"); ok {
+			number, err := strconv.ParseUint(asn, 10, 32)
+			if err != nil {
+				return Rule{}, fmt.Errorf("invalid rule ASN %q - %w", network, err)
+			}
+			rule.ASNs = append(rule.ASNs, uint32(number))
+			continue
+		}
+
+		prefix, err := parsePrefix(network)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid rule network %q - %w", network, err)
+		}
+		rule.Networks = append(rule.Networks, prefix)
+	}
+
+	for _, ports := range listField(fields[2]) {
+		portRange, err := parsePortRange(ports)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid rule ports %q - %w", ports, err)
+		}
+		rule.Ports = append(rule.Ports, portRange)
+	}
+
+	if len(fields) == 4 {
+		rule.Users = listField(fields[3])
+	}
+
+	if scheduleFields, ok := clauses["at"]; ok {
+		schedule, err := parseSchedule(scheduleFields)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid rule schedule - %w", err)
+		}
+		rule.Schedule = schedule
+	}
+	if source, ok := clauses["from"]; ok {
+		if len(source) != 1 {
+			return Rule{}, fmt.Errorf("invalid rule source %q", strings.Join(source, " "))
+		}
+		rule.Source = source[0]
+	}
+	return rule, nil
+}
+
+// listField splits a comma separated rule field, where "*" is empty.
+func listField(field string) []string {
+	if field == "*" {
+		return nil
+	}
+	return strings.Split(field, ",")
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		toStr = fromStr
+	}
+	from, err := strconv.ParseUint(fromStr, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	to, err := strconv.ParseUint(toStr, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	if from > to {
+		return PortRange{}, fmt.Errorf("port range %d-%d is empty", from, to)
+	}
+	return PortRange{From: int(from), To: int(to)}, nil
+}
+
+// acl returns the rules that apply to user's requests.
+func (p *Policy) acl(user string) []Rule {
+	if acl, ok := p.UserACLs[user]; ok {
+		return acl
+	}
+	return p.ACL
+}
+
+// hasACL reports whether the policy restricts any user's destinations.
+func (p *Policy) hasACL() bool {
+	return len(p.ACL) != 0 || len(p.UserACLs) != 0
+}
+
+// checkACL evaluates the ACL of the session's user for ip:port, in order,
+// where the first matching rule that allows or denies applies, and returns
+// the rule that allowed it, if any. Schedules are evaluated at the time of
+// each check. Destinations no rule matches are denied, unless the ACL is
+// empty.
+func (s *Server) checkACL(sess *session, ip net.IP, port int) (*Rule, error) {
+	if !sess.rules.hasACL() {
+		// early dials check destinations before the user is read
+		return nil, nil
+	}
+	acl := sess.rules.acl(sess.user)
+	if len(acl) == 0 {
+		return nil, nil
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, fmt.Errorf("invalid destination IP %v - %w", ip, ErrACLDenied)
+	}
+
+	hostPort := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	dst := &destination{user: sess.user, ip: ip, addr: addr.Unmap(), port: port, now: time.Now(), geo: sess.rules.GeoIP}
+	defer func() {
+		if dst.geoErr != nil {
+			sess.log.Warn("failed to locate destination", zap.Error(dst.geoErr))
+		}
+	}()
+
+	for i := range acl {
+		if !acl[i].matches(dst) {
+			continue
+		}
+		switch acl[i].Action {
+		case Allow:
+			return &acl[i], nil
+		case Log:
+			s.metrics.Counter("acl_logged_total", "Destinations matched by ACL log rules.").Inc()
+			country, asn := dst.locate()
+			sess.log.Info("ACL rule matched",
+				zap.Int("rule", i+1),
+				zap.String("destination", hostPort),
+				zap.String("country", country),
+				zap.Uint32("asn", asn))
+			continue
+		}
+		s.metrics.Counter("acl_denied_total", "Destinations denied by the ACL.").Inc()
+		return nil, fmt.Errorf("%s by rule %d (%v) - %w", hostPort, i+1, &acl[i], ErrACLDenied)
+	}
+	s.metrics.Counter("acl_denied_total", "Destinations denied by the ACL.").Inc()
+	return nil, fmt.Errorf("%s matched no rule - %w", hostPort, ErrACLDenied)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package server_test
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func parseACL(t *testing.T, rules ...string) []server.Rule {
+	t.Helper()
+
+	var acl []server.Rule
+	for _, r := range rules {
+		rule, err := server.ParseRule(r)
+		require.NoError(t, err)
+		acl = append(acl, rule)
+	}
+	return acl
+}
+
+func TestParseRule(t *testing.T) {
+	t.Parallel()
+
+	rule, err := server.ParseRule("allow 10.0.0.0/8,192.168.1.1 80,8000-8999 alice,bob")
+	require.NoError(t, err)
+	require.Equal(t, server.Rule{
+		Action:   server.Allow,
+		Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.1/32")},
+		Ports:    []server.PortRange{{From: 80, To: 80}, {From: 8000, To: 8999}},
+		Users:    []string{"alice", "bob"},
+	}, rule)
+	require.Equal(t, "allow 10.0.0.0/8,192.168.1.1/32 80,8000-8999 alice,bob", rule.String())
+
+	rule, err = server.ParseRule("deny * *")
+	require.NoError(t, err)
+	require.Equal(t, server.Rule{Action: server.Deny}, rule)
+	require.Equal(t, "deny * * *", rule.String())
+
+	rule, err = server.ParseRule("allow * * from eth1 at sat")
+	require.NoError(t, err)
+	require.Equal(t, "eth1", rule.Source)
+	require.Equal(t, "allow * * * at sat from eth1", rule.String())
+
+	for _, invalid := range []string{"", "allow * * from", "allow * * from a b", "allow * * at sat at sun", "allow *", "permit * *", "allow 10.0.0.0/33 *", "allow * 99999", "allow * 90-80", "allow * * * *"} {
+		_, err := server.ParseRule(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	port := portOf(t, echoServer)
+	s := createServer(t, server.WithPolicy(server.Policy{ACL: parseACL(t,
+		"deny * * mallory",
+		fmt.Sprintf("allow 127.0.0.0/8 %d", port),
+		"deny 127.0.0.0/8 *",
+		"allow * * root",
+	)}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	connect := func(user, dst string) error {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(dst)
+	}
+
+	// the first matching rule applies
+	require.NoError(t, connect("alice", echoServer))
+	var replyErr *client.ReplyError
+	require.ErrorAs(t, connect("mallory", echoServer), &replyErr)
+	require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+
+	// other ports of the network are denied, even to root
+	require.ErrorAs(t, connect("root", fmt.Sprintf("127.0.0.1:%d", port+1)), &replyErr)
+
+	// and destinations no rule matches are denied
+	require.ErrorAs(t, connect("alice", "192.0.2.1:80"), &replyErr)
+	require.EqualValues(t, 3, s.Metrics().Counter("acl_denied_total", "").Value())
+}
+
+func TestUserACLs(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	s := createServer(t, server.WithPolicy(server.Policy{
+		ACL: parseACL(t, "deny * *"),
+		UserACLs: map[string][]server.Rule{
+			"scanner": parseACL(t, "allow 10.0.0.0/8 443"),
+			"dev":     parseACL(t, "allow * *"),
+		},
+	}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	connect := func(user string) error {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(echoServer)
+	}
+
+	// users with their own ACL aren't governed by the policy's
+	require.NoError(t, connect("dev"))
+	var replyErr *client.ReplyError
+	require.ErrorAs(t, connect("scanner"), &replyErr)
+	require.ErrorAs(t, connect("anyone"), &replyErr)
+	require.EqualValues(t, 2, s.Metrics().Counter("acl_denied_total", "").Value())
+}
+
+type fakeGeoIP map[string]string
+
+func (g fakeGeoIP) Locate(ip net.IP) (string, uint32, error) {
+	return g[ip.String()], 64500, nil
+}
+
+func TestGeoIPRules(t *testing.T) {
+	t.Parallel()
+
+	rule, err := server.ParseRule("deny cc:de,as:64500,10.0.0.0/8 *")
+	require.NoError(t, err)
+	require.Equal(t, []string{"DE"}, rule.Countries)
+	require.Equal(t, []uint32{64500}, rule.ASNs)
+	require.Equal(t, "deny 10.0.0.0/8,cc:DE,as:64500 * *", rule.String())
+
+	echoServer := newEchoServer(t)
+	s := createServer(t, server.WithPolicy(server.Policy{
+		ACL:   parseACL(t, "log cc:ZZ *", "deny cc:ZZ *", "allow * *"),
+		GeoIP: fakeGeoIP{"127.0.0.1": "ZZ"},
+	}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	connect := func() error {
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(echoServer)
+	}
+
+	var replyErr *client.ReplyError
+	require.ErrorAs(t, connect(), &replyErr)
+	require.EqualValues(t, 1, s.Metrics().Counter("acl_logged_total", "").Value())
+	require.EqualValues(t, 1, s.Metrics().Counter("acl_denied_total", "").Value())
+
+	// rules of autonomous systems, and without a GeoIP none match
+	s.SetPolicy(server.Policy{ACL: parseACL(t, "deny as:64500 *", "allow * *"), GeoIP: fakeGeoIP{}})
+	require.ErrorAs(t, connect(), &replyErr)
+	s.SetPolicy(server.Policy{ACL: parseACL(t, "deny as:64500 *", "allow * *")})
+	require.NoError(t, connect())
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net"
+)
+
+// canonicalIP returns IPv4 and IPv4-mapped IPv6 addresses (::ffff:a.b.c.d)
+// in their 4-byte form, so a client is compared, matched against IPv4
+// networks and logged the same whether it arrived over an IPv4 or a
+// dual-stack listener.
+func canonicalIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// canonicalAddr returns addr with its IP in canonical form.
+func canonicalAddr(addr net.Addr) net.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: canonicalIP(a.IP), Port: a.Port, Zone: a.Zone}
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: canonicalIP(a.IP), Port: a.Port, Zone: a.Zone}
+	}
+	return addr
+}
+
+// canonicalNet rewrites an IPv4-mapped network (::ffff:a.b.c.d/n, n >= 96)
+// as the equivalent IPv4 network. net.IPNet never matches a 4-byte IP
+// against a 16-byte network, so a rule written either way would otherwise
+// miss clients presented the other way.
+func canonicalNet(n *net.IPNet) *net.IPNet {
+	if len(n.IP) != net.IPv6len || n.IP.To4() == nil {
+		return n
+	}
+	ones, bits := n.Mask.Size()
+	if bits != 8*net.IPv6len || ones < 96 {
+		return n
+	}
+	return &net.IPNet{IP: n.IP.To4(), Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+}
+
+func canonicalNets(nets []*net.IPNet) []*net.IPNet {
+	out := make([]*net.IPNet, len(nets))
+	for i, n := range nets {
+		out[i] = canonicalNet(n)
+	}
+	return out
+}
@@ -0,0 +1,48 @@
+package server_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualStackClientAddress(t *testing.T) {
+	t.Parallel()
+
+	seen := make(chan net.Addr, 1)
+	s := createServer(t, server.WithAcceptFilter(func(remote net.Addr) bool {
+		seen <- remote
+		return false
+	}))
+
+	addr, err := s.ListenAndServe("[::]:0")
+	if err != nil {
+		t.Skipf("dual-stack listener unavailable - %v", err)
+	}
+
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	remote := (<-seen).(*net.TCPAddr)
+	require.Len(t, remote.IP, net.IPv4len)
+	require.Equal(t, conn.LocalAddr().String(), remote.String())
+}
+
+func TestBindAdvertiseMappedNetwork(t *testing.T) {
+	t.Parallel()
+
+	_, mapped, err := net.ParseCIDR("::ffff:127.0.0.0/104")
+	require.NoError(t, err)
+
+	host, _, err := net.SplitHostPort(boundAddress(t, server.WithBindAdvertise(server.BindAdvertise{
+		External: net.IPv4(203, 0, 113, 7),
+		Internal: []*net.IPNet{mapped},
+	})))
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AdminHandler returns the handler of an HTTP admin API of the server,
+// reporting as JSON:
+//
+//	GET  /status                       name, maintenance mode, listeners, sessions
+//	GET  /sessions                     active sessions
+//	GET  /sessions/{id}                a session
+//	POST /sessions/{id}/kill           ends a session, see Kill
+//	POST /sessions/{id}/pause          see PauseSession
+//	POST /sessions/{id}/resume         see ResumeSession
+//	GET  /metrics                      metric values by name and labels
+//	GET  /policy                       policy version and ACLs
+//	PUT  /policy                       replaces the ACLs, see SetPolicy
+//	GET  /quotas                       users' transfer quotas
+//	POST /quotas/reset?user={user}     see ResetQuota
+//	POST /maintenance?on={true|false}  see SetMaintenance
+//	POST /drain                        starts draining, see Drain
+//
+// The API has no authentication of its own, so it must only be served
+// where admins alone can reach it, or behind authentication.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.adminStatus)
+	mux.HandleFunc("/sessions", s.adminSessions)
+	mux.HandleFunc("/sessions/", s.adminSession)
+	mux.HandleFunc("/metrics", s.adminMetrics)
+	mux.HandleFunc("/policy", s.adminPolicy)
+	mux.HandleFunc("/quotas", s.adminQuotas)
+	mux.HandleFunc("/quotas/reset", s.adminResetQuota)
+	mux.HandleFunc("/maintenance", s.adminMaintenance)
+	mux.HandleFunc("/drain", s.adminDrain)
+	return mux
+}
+
+type adminStatus struct {
+	Name          string   `json:"name,omitempty"`
+	Maintenance   bool     `json:"maintenance"`
+	Stopped       bool     `json:"stopped"` // drained or closed
+	Listeners     []string `json:"listeners"`
+	Sessions      int      `json:"sessions"`
+	PolicyVersion uint64   `json:"policy_version"`
+}
+
+type adminSession struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Start    time.Time `json:"start"`
+	State    string    `json:"state"`
+	Paused   bool      `json:"paused"`
+	BytesOut int64     `json:"bytes_out"`
+	BytesIn  int64     `json:"bytes_in"`
+}
+
+func newAdminSession(sess Session) adminSession {
+	out := adminSession{
+		ID:       sess.Session,
+		Client:   sess.Client.String(),
+		User:     sess.User,
+		Start:    sess.Start,
+		State:    sess.State.String(),
+		Paused:   sess.Paused,
+		BytesOut: sess.BytesOut,
+		BytesIn:  sess.BytesIn,
+	}
+	if sess.Target != nil {
+		out.Target = sess.Target.String()
+	}
+	return out
+}
+
+type adminPolicy struct {
+	Version  uint64              `json:"version"`
+	ACL      []string            `json:"acl"`
+	UserACLs map[string][]string `json:"user_acls,omitempty"`
+}
+
+func newAdminPolicy(policy Policy, version uint64) adminPolicy {
+	out := adminPolicy{Version: version, ACL: ruleStrings(policy.ACL)}
+	if len(policy.UserACLs) != 0 {
+		out.UserACLs = make(map[string][]string, len(policy.UserACLs))
+		for user, acl := range policy.UserACLs {
+			out.UserACLs[user] = ruleStrings(acl)
+		}
+	}
+	return out
+}
+
+// maxAdminBody is the largest request body the admin API reads.
+const maxAdminBody = 1 << 20
+
+func (s *Server) adminStatus(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := adminStatus{
+		Name:          s.name,
+		Maintenance:   s.Maintenance(),
+		Listeners:     []string{},
+		Sessions:      len(s.activeSessions()),
+		PolicyVersion: s.policy.Load().version,
+	}
+	s.listenersMu.Lock()
+	status.Stopped = s.stopped
+	for _, ln := range s.listeners {
+		status.Listeners = append(status.Listeners, ln.Addr().String())
+	}
+	s.listenersMu.Unlock()
+	writeAdminJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+	sessions := []adminSession{}
+	for _, sess := range s.Sessions() {
+		sessions = append(sessions, newAdminSession(sess))
+	}
+	writeAdminJSON(w, http.StatusOK, sessions)
+}
+
+// adminSession serves /sessions/{id} and the actions on the session.
+func (s *Server) adminSession(w http.ResponseWriter, r *http.Request) {
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, ErrSessionNotFound)
+		return
+	}
+
+	var do func(uint64) error
+	switch action {
+	case "":
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		sess, err := s.Session(id)
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, newAdminSession(sess))
+		return
+	case "kill":
+		do = s.Kill
+	case "pause":
+		do = s.PauseSession
+	case "resume":
+		do = s.ResumeSession
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	} else if err := do(id); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if adminMethod(w, r, http.MethodGet) {
+		writeAdminJSON(w, http.StatusOK, s.metrics.Snapshot())
+	}
+}
+
+// adminPolicy serves the policy, and replaces its ACLs with those of a
+// PUT body, like {"acl": ["allow * 443 *"], "user_acls": {"alice": []}}.
+// The other parts of the policy are kept.
+func (s *Server) adminPolicy(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet, http.MethodPut) {
+		return
+	} else if r.Method == http.MethodGet {
+		policy, version := s.Policy()
+		writeAdminJSON(w, http.StatusOK, newAdminPolicy(policy, version))
+		return
+	}
+
+	var in adminPolicy
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&in); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid policy - %w", err))
+		return
+	}
+	acl, err := parseRules(in.ACL)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	var userACLs map[string][]Rule
+	for user, rules := range in.UserACLs {
+		userACL, err := parseRules(rules)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("user %q - %w", user, err))
+			return
+		}
+		if userACLs == nil {
+			userACLs = make(map[string][]Rule, len(in.UserACLs))
+		}
+		userACLs[user] = userACL
+	}
+
+	var updated Policy
+	version := s.updatePolicy(func(p Policy) Policy {
+		p.ACL, p.UserACLs = acl, userACLs
+		updated = p
+		return p
+	})
+	writeAdminJSON(w, http.StatusOK, newAdminPolicy(updated, version))
+}
+
+func parseRules(rules []string) ([]Rule, error) {
+	var acl []Rule
+	for _, line := range rules {
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, rule)
+	}
+	return acl, nil
+}
+
+func ruleStrings(acl []Rule) []string {
+	out := make([]string, len(acl))
+	for i, rule := range acl {
+		out[i] = rule.String()
+	}
+	return out
+}
+
+func (s *Server) adminQuotas(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+	quotas := s.Quotas()
+	if quotas == nil {
+		quotas = []QuotaUsage{}
+	}
+	writeAdminJSON(w, http.StatusOK, quotas)
+}
+
+func (s *Server) adminResetQuota(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	} else if err := s.ResetQuota(r.URL.Query().Get("user")); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("on must be true or false"))
+		return
+	}
+	s.SetMaintenance(on)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminDrain starts draining the server, without waiting for its sessions
+// to end.
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+	s.logger(SubsystemAdmin).Warn("draining requested")
+	go func() {
+		if err := s.Drain(context.Background()); err != nil {
+			s.logger(SubsystemAdmin).Error("failed to drain", zap.Error(err))
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminMethod reports whether r uses one of methods, replying with an
+// error if not.
+func adminMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if containsString(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
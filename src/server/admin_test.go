@@ -0,0 +1,207 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t,
+		server.WithName("edge"),
+		server.WithPolicy(server.Policy{ACL: parseACL(t, "allow 127.0.0.0/8 * *")}),
+	)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	admin := httptest.NewServer(s.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	do := func(method, path string, status int, out any) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+	}
+
+	c := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	var status struct {
+		Name      string   `json:"name"`
+		Listeners []string `json:"listeners"`
+		Sessions  int      `json:"sessions"`
+		Stopped   bool     `json:"stopped"`
+	}
+	do(http.MethodGet, "/status", http.StatusOK, &status)
+	require.Equal(t, "edge", status.Name)
+	require.Equal(t, []string{addr.String()}, status.Listeners)
+	require.Equal(t, 1, status.Sessions)
+
+	var sessions []struct {
+		ID    uint64 `json:"id"`
+		User  string `json:"user"`
+		State string `json:"state"`
+	}
+	require.Eventually(t, func() bool {
+		do(http.MethodGet, "/sessions", http.StatusOK, &sessions)
+		return len(sessions) == 1 && sessions[0].State == "active"
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, "alice", sessions[0].User)
+	path := "/sessions/" + strconv.FormatUint(sessions[0].ID, 10)
+	do(http.MethodGet, path, http.StatusOK, nil)
+
+	var policy struct {
+		ACL []string `json:"acl"`
+	}
+	do(http.MethodGet, "/policy", http.StatusOK, &policy)
+	require.Equal(t, []string{"allow 127.0.0.0/8 * *"}, policy.ACL)
+
+	var metrics map[string]float64
+	do(http.MethodGet, "/metrics", http.StatusOK, &metrics)
+	require.NotEmpty(t, metrics)
+
+	do(http.MethodGet, path+"/kill", http.StatusMethodNotAllowed, nil)
+	do(http.MethodPost, path+"/kill", http.StatusNoContent, nil)
+	requireClosed(t, c)
+	do(http.MethodGet, path, http.StatusNotFound, nil)
+	do(http.MethodPost, "/sessions/x/kill", http.StatusNotFound, nil)
+
+	do(http.MethodPost, "/maintenance?on=true", http.StatusNoContent, nil)
+	require.True(t, s.Maintenance())
+	do(http.MethodPost, "/maintenance", http.StatusBadRequest, nil)
+
+	do(http.MethodPost, "/drain", http.StatusAccepted, nil)
+	require.Eventually(t, func() bool {
+		do(http.MethodGet, "/status", http.StatusOK, &status)
+		return status.Stopped
+	}, time.Second*5, time.Millisecond*10)
+	require.Empty(t, status.Listeners)
+}
+
+func TestAdminSetPolicy(t *testing.T) {
+	t.Parallel()
+
+	origination := []server.TLSOrigination{{Suffix: "example.test", Port: 443}}
+	s := createServer(t, server.WithPolicy(server.Policy{
+		ACL:            parseACL(t, "allow 127.0.0.0/8 * *"),
+		TLSOrigination: origination,
+	}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	admin := httptest.NewServer(s.AdminHandler())
+	t.Cleanup(admin.Close)
+	echoServer := newEchoServer(t)
+
+	type policy struct {
+		Version  uint64              `json:"version"`
+		ACL      []string            `json:"acl"`
+		UserACLs map[string][]string `json:"user_acls"`
+	}
+	put := func(body string, status int) policy {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPut, admin.URL+"/policy", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode)
+		var out policy
+		if status == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out
+	}
+
+	updated := put(`{"acl": ["deny 127.0.0.0/8 * *"], "user_acls": {"alice": ["allow * * *"]}}`, http.StatusOK)
+	require.Equal(t, policy{
+		Version:  2,
+		ACL:      []string{"deny 127.0.0.0/8 * *"},
+		UserACLs: map[string][]string{"alice": {"allow * * *"}},
+	}, updated)
+	current, version := s.Policy()
+	require.EqualValues(t, 2, version)
+	require.Equal(t, origination, current.TLSOrigination)
+
+	denied := client.NewClient(addr.String(), "bob")
+	t.Cleanup(func() { denied.Close() })
+	var replyErr *client.ReplyError
+	require.ErrorAs(t, denied.Connect(echoServer), &replyErr)
+	allowed := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { allowed.Close() })
+	require.NoError(t, allowed.Connect(echoServer))
+
+	// an invalid policy is refused whole, leaving the current one
+	put(`{"acl": ["allow * * *"], "user_acls": {"alice": ["permit * * *"]}}`, http.StatusBadRequest)
+	put(`{"acls": []}`, http.StatusBadRequest)
+	put(`not json`, http.StatusBadRequest)
+	_, version = s.Policy()
+	require.EqualValues(t, 2, version)
+
+	req, err := http.NewRequest(http.MethodDelete, admin.URL+"/policy", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, "GET, PUT", resp.Header.Get("Allow"))
+}
+
+func TestExpvar(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+	writePacket(t, c, []byte("ping"))
+	data, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+
+	// nothing listens on the port of a closed listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+	failed := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { failed.Close() })
+	require.Error(t, failed.Connect(ln.Addr().String()))
+
+	var vars struct {
+		Total        uint64           `json:"connections_total"`
+		Active       int              `json:"connections_active"`
+		BytesRelayed map[string]int64 `json:"bytes_relayed"`
+		Errors       map[string]int64 `json:"errors"`
+	}
+	require.Eventually(t, func() bool {
+		require.NoError(t, json.Unmarshal([]byte(s.Expvar().String()), &vars))
+		return vars.Active == 0 && len(vars.Errors) != 0
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, uint64(2), vars.Total)
+	require.Equal(t, map[string]int64{"out": 4, "in": 4}, vars.BytesRelayed)
+	require.Equal(t, map[string]int64{string(server.CloseRequestFailed): 1}, vars.Errors)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnauthorized is returned by Authenticators to reject a request.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrNoIdentd is returned when the client's identd can't be reached to
+	// verify its user ID. The client is sent reply code 92.
+	ErrNoIdentd = errors.New("cannot connect to identd on the client")
+
+	// ErrIdentMismatch is returned when the client's identd reports a
+	// different user ID than the request. The client is sent reply code 93.
+	ErrIdentMismatch = errors.New("identd reported a different user ID")
+)
+
+// Authenticator decides whether a client may use the proxy, based on the
+// client's address and the user ID it sent in its request.
+type Authenticator interface {
+	Allow(ctx context.Context, clientAddr, userID string) error
+}
+
+// AuthenticatorFunc adapts an ordinary function to an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, clientAddr, userID string) error
+
+// Allow implements Authenticator by calling f.
+func (f AuthenticatorFunc) Allow(ctx context.Context, clientAddr, userID string) error {
+	return f(ctx, clientAddr, userID)
+}
+
+// PasswordAuthenticator is an Authenticator that also checks the passwords
+// of SOCKS5 and HTTP proxy clients. Authenticators that aren't are passed
+// the password as the user ID instead, so that the tokens SOCKS4 clients
+// send as their user ID can be sent as a password.
+type PasswordAuthenticator interface {
+	Authenticator
+	AllowPassword(ctx context.Context, clientAddr, username, password string) error
+}
+
+// IdentityFunc returns the effective user ID of a client, given its
+// connection and the user ID it sent. It allows identity to come from
+// stronger signals than the client-supplied user ID, such as the source
+// address or, for *tls.Conn, the client certificate.
+type IdentityFunc func(ctx context.Context, conn net.Conn, userID string) (string, error)
+
+// UserVerifier confirms out of band that the client of conn is the user it
+// claims to be, e.g. by asking identd or an agent on the client host, or a
+// NAC system. Errors wrapping ErrNoIdentd or ErrIdentMismatch are replied
+// to with codes 92 and 93 respectively.
+type UserVerifier interface {
+	Verify(ctx context.Context, conn net.Conn, userID string) error
+}
+
+// UserVerifierFunc adapts an ordinary function to a UserVerifier.
+type UserVerifierFunc func(ctx context.Context, conn net.Conn, userID string) error
+
+// Verify implements UserVerifier by calling f.
+func (f UserVerifierFunc) Verify(ctx context.Context, conn net.Conn, userID string) error {
+	return f(ctx, conn, userID)
+}
+
+// identify verifies the user ID the client sent, then sets the session's
+// user to its effective user ID. The user ID of a client certificate takes
+// the place of the one sent.
+func (s *Server) identify(sess *session, deadline time.Time, userID string) error {
+	if user, ok := s.certificateUser(sess); ok {
+		if user != userID {
+			sess.log.Info("user ID taken from client certificate", zap.String("sent-user", userID), zap.String("user", user))
+		}
+		userID = user
+	}
+	sess.user = userID
+	if s.identity == nil && s.verifier == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(sess.ctx, deadline.Add(-time.Second))
+	defer cancel()
+
+	if s.verifier != nil {
+		if err := s.verifier.Verify(ctx, sess.client, userID); err != nil {
+			return err
+		}
+	}
+	if s.identity == nil {
+		return nil
+	}
+
+	user, err := s.identity(ctx, sess.client, sess.user)
+	if err != nil {
+		return err
+	}
+	if user != sess.user {
+		sess.log.Info("user ID overridden", zap.String("sent-user", sess.user), zap.String("user", user))
+		sess.user = user
+	}
+	return nil
+}
+
+func (s *Server) authenticate(sess *session, deadline time.Time) error {
+	auth := sess.rules.Authenticator
+	if auth == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(sess.ctx, deadline.Add(-time.Second))
+	defer cancel()
+	return auth.Allow(ctx, sess.remote.String(), sess.user)
+}
+
+// authenticatePassword checks the credentials of a SOCKS5 or HTTP client; sess.user
+// holds its username.
+func (s *Server) authenticatePassword(sess *session, deadline time.Time, password string) error {
+	ctx, cancel := context.WithDeadline(sess.ctx, deadline.Add(-time.Second))
+	defer cancel()
+
+	switch auth := sess.rules.Authenticator.(type) {
+	case nil:
+		return nil
+	case PasswordAuthenticator:
+		return auth.AllowPassword(ctx, sess.remote.String(), sess.user, password)
+	default:
+		return auth.Allow(ctx, sess.remote.String(), password)
+	}
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithIdentity(t *testing.T) {
+	t.Parallel()
+
+	users := make(chan string, 1)
+	s := createServer(t,
+		server.WithIdentity(func(_ context.Context, conn net.Conn, userID string) (string, error) {
+			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err != nil {
+				return "", err
+			} else if userID == "blocked" {
+				return "", errors.New("blocked user")
+			}
+			return "host:" + host, nil
+		}),
+		server.WithAuthenticator(server.AuthenticatorFunc(func(_ context.Context, _, userID string) error {
+			users <- userID
+			return nil
+		})),
+	)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	c := client.NewClient(addr.String(), "claimed")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(echoServer))
+	require.Equal(t, "host:127.0.0.1", <-users)
+
+	blocked := client.NewClient(addr.String(), "blocked")
+	t.Cleanup(func() { blocked.Close() })
+	require.Error(t, blocked.Connect(echoServer))
+	requireClosed(t, blocked)
+}
+
+func TestIdentReplyCodes(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithIdentity(func(_ context.Context, _ net.Conn, userID string) (string, error) {
+		switch userID {
+		case "noidentd":
+			return "", fmt.Errorf("lookup failed - %w", server.ErrNoIdentd)
+		case "mismatch":
+			return "", server.ErrIdentMismatch
+		case "rejected":
+			return "", server.ErrUnauthorized
+		}
+		return userID, nil
+	}))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	for user, code := range map[string]proto.ReplyCode{
+		"noidentd": proto.NoIdentd,
+		"mismatch": proto.IdentMismatch,
+		"rejected": proto.RejectedFailed,
+	} {
+		t.Run(user, func(user string, code proto.ReplyCode) func(t *testing.T) {
+			return func(t *testing.T) {
+				t.Parallel()
+
+				conn, err := net.Dial("tcp", addr.String())
+				require.NoError(t, err)
+				t.Cleanup(func() { conn.Close() })
+
+				req, err := proto.NewRequest(proto.ConnectCommand, "127.0.0.1:80", user)
+				require.NoError(t, err)
+				_, err = conn.Write(req.Serialize())
+				require.NoError(t, err)
+
+				reply, err := proto.ReadReply(conn)
+				require.NoError(t, err)
+				require.Equal(t, code, reply.Code())
+			}
+		}(user, code))
+	}
+}
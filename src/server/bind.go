@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+)
+
+// BindAdvertise controls the address sent to clients in BIND replies, for
+// servers behind a NAT.
+type BindAdvertise struct {
+	// Address advertised to external clients, e.g. the public address of
+	// the NAT in front of the server.
+	External net.IP
+
+	// Client networks that reach the server without crossing the NAT. They
+	// are sent the server's own address instead, since connecting to the
+	// external address from inside would need the NAT to hairpin.
+	Internal []*net.IPNet
+}
+
+// bindAddress returns the address to advertise for a BIND listener to the
+// client of sess.
+func (s *Server) bindAddress(sess *session) net.IP {
+	if s.bindAdvertise.External == nil {
+		return net.IPv4(0, 0, 0, 0)
+	}
+
+	clientIP := addrIP(sess.remote)
+	if clientIP != nil && s.isInternalClient(clientIP) {
+		if local := addrIP(sess.client.LocalAddr()); local != nil && local.To4() != nil {
+			return local
+		}
+	}
+	return s.bindAdvertise.External
+}
+
+// isInternalClient reports whether ip is on an internal network, or is the
+// external address itself, which happens when the NAT hairpins traffic
+// from inside back to the server.
+func (s *Server) isInternalClient(ip net.IP) bool {
+	if ip.Equal(s.bindAdvertise.External) {
+		return true
+	}
+	for _, network := range s.bindAdvertise.Internal {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return canonicalIP(tcpAddr.IP)
+	}
+	return nil
+}
+
+// portRange is an inclusive range of ports; the zero value means any port.
+type portRange struct {
+	min, max int
+}
+
+// listenBind opens a listener for a BIND on a free port of the configured
+// range, starting from a random one.
+func (s *Server) listenBind() (*net.TCPListener, error) {
+	r := s.bindPorts
+	if r.min <= 0 || r.max < r.min {
+		return net.ListenTCP("tcp4", &net.TCPAddr{})
+	}
+
+	size := r.max - r.min + 1
+	offset := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := r.min + (offset+i)%size
+		ln, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: port})
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		return ln, err
+	}
+	s.metrics.Counter("bind_port_range_exhausted_total", "BINDs failed for lack of a free port in the bind range.").Inc()
+	return nil, fmt.Errorf("no free port in %d-%d", r.min, r.max)
+}
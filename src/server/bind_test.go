@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func boundAddress(t *testing.T, opts ...server.Option) string {
+	t.Helper()
+
+	s := createServer(t, opts...)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+
+	var bound string
+	c.Bind("1.2.3.4:0", func(boundAddress string) error {
+		bound = boundAddress
+		return c.Close()
+	})
+	return bound
+}
+
+func TestBindAdvertise(t *testing.T) {
+	t.Parallel()
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	external := net.IPv4(203, 0, 113, 7)
+
+	t.Run("Default", func(t *testing.T) {
+		t.Parallel()
+
+		host, _, err := net.SplitHostPort(boundAddress(t))
+		require.NoError(t, err)
+		require.Equal(t, "0.0.0.0", host)
+	})
+
+	t.Run("External", func(t *testing.T) {
+		t.Parallel()
+
+		host, _, err := net.SplitHostPort(boundAddress(t, server.WithBindAdvertise(server.BindAdvertise{
+			External: external,
+		})))
+		require.NoError(t, err)
+		require.Equal(t, external.String(), host)
+	})
+
+	t.Run("Internal", func(t *testing.T) {
+		t.Parallel()
+
+		host, _, err := net.SplitHostPort(boundAddress(t, server.WithBindAdvertise(server.BindAdvertise{
+			External: external,
+			Internal: []*net.IPNet{loopback},
+		})))
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1", host)
+	})
+
+	t.Run("Hairpin", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithBindAdvertise(server.BindAdvertise{
+			External: net.IPv4(127, 0, 0, 2),
+		}))
+		addr, err := s.ListenAndServe("127.0.0.1:0")
+		require.NoError(t, err)
+
+		// arrive from the "external" address, as a hairpinning NAT would
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+		conn, err := d.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		req, err := proto.NewRequest(proto.BindCommand, "1.2.3.4:0", "")
+		require.NoError(t, err)
+		_, err = conn.Write(req.Serialize())
+		require.NoError(t, err)
+
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.True(t, net.IPv4(127, 0, 0, 1).Equal(reply.IP()))
+	})
+}
+
+func TestBindPortRange(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := portOf(t, ln.Addr().String())
+	require.NoError(t, ln.Close())
+
+	bound := boundAddress(t, server.WithBindPortRange(port, port))
+	require.Equal(t, port, portOf(t, bound))
+}
+
+func TestBindHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the peer has until a second before the handshake times out
+	client := newClient(t, server.WithHandshakeTimeout(time.Second+200*time.Millisecond))
+	start := time.Now()
+	err := client.Bind("127.0.0.1:0", func(string) error { return nil })
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestBindReplayWindow(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithBindReplayWindow(time.Minute))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	bind := func(remote string) error {
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		return c.Bind(remote, func(string) error { return c.Close() })
+	}
+
+	// the first BINDs are granted, then abandoned by closing the client
+	require.NotErrorIs(t, bind("1.2.3.4:21"), client.ErrRejected)
+	require.ErrorIs(t, bind("1.2.3.4:21"), client.ErrRejected)
+	require.NotErrorIs(t, bind("1.2.3.4:22"), client.ErrRejected)
+	require.Equal(t, int64(1), s.Metrics().Counter("bind_replays_rejected_total", "").Value())
+}
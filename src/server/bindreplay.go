@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errBindReplay = errors.New("duplicate BIND within the replay window")
+
+type bindKey struct {
+	client, destination string
+}
+
+// bindReplays remembers recent BIND requests, to reject duplicates that
+// would open more listeners.
+type bindReplays struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	recent map[bindKey]time.Time
+	swept  time.Time
+}
+
+func newBindReplays(window time.Duration) *bindReplays {
+	return &bindReplays{window: window, recent: make(map[bindKey]time.Time)}
+}
+
+// check records a BIND from client for destination, failing if one was
+// already seen within the window.
+func (b *bindReplays) check(client net.Addr, destination string) error {
+	key := bindKey{client: addrHost(client), destination: destination}
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.swept) > b.window {
+		for k, seen := range b.recent {
+			if now.Sub(seen) > b.window {
+				delete(b.recent, k)
+			}
+		}
+		b.swept = now
+	}
+
+	if seen, ok := b.recent[key]; ok && now.Sub(seen) <= b.window {
+		return errBindReplay
+	}
+	b.recent[key] = now
+	return nil
+}
+
+// bindDestination identifies the destination of a BIND request.
+func bindDestination(req *request) string {
+	host := req.hostname
+	if host == "" {
+		host = canonicalIP(req.ip).String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(req.port))
+}
+
+func addrHost(addr net.Addr) string {
+	if ip := addrIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,32 @@
+package server
+
+import "sync"
+
+// bufferPool reuses relay buffers across sessions, so churning sessions
+// don't allocate two fresh buffers each.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: size}
+}
+
+// get returns a buffer of the pool's size.
+func (p *bufferPool) get() []byte {
+	if buffer, ok := p.pool.Get().(*[]byte); ok {
+		return *buffer
+	}
+	return make([]byte, p.size)
+}
+
+// put returns buffer to the pool once it's no longer used. A nil buffer is
+// ignored.
+func (p *bufferPool) put(buffer []byte) {
+	if cap(buffer) < p.size {
+		return
+	}
+	buffer = buffer[:p.size]
+	p.pool.Put(&buffer)
+}
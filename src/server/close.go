@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// CloseReason classifies why a session ended.
+type CloseReason string
+
+const (
+	// The request couldn't be read or wasn't a SOCKS4 or SOCKS5 request.
+	CloseBadRequest CloseReason = "bad_request"
+
+	// The handshake was refused because the server is in maintenance mode.
+	CloseMaintenance CloseReason = "maintenance"
+
+	// The client couldn't be identified or authenticated.
+	CloseUnauthorized CloseReason = "unauthorized"
+
+	// The CONNECT or BIND couldn't be carried out.
+	CloseRequestFailed CloseReason = "request_failed"
+
+	// The destination closed the connection before the client was replied
+	// to. See RemoteCloseMode.
+	CloseRemoteClosedEarly CloseReason = "remote_closed_early"
+
+	// A hook rejected the connection or its request. See Hooks.
+	CloseRejected CloseReason = "rejected"
+
+	// The client broke the protocol, e.g. under strict ordering.
+	CloseProtocolViolation CloseReason = "protocol_violation"
+
+	// The client sent another SOCKS request over its tunnel. See
+	// ConfusionMode.
+	CloseProtocolConfusion CloseReason = "protocol_confusion"
+
+	// The client or remote closed the tunnel.
+	CloseClientEOF CloseReason = "client_eof"
+	CloseRemoteEOF CloseReason = "remote_eof"
+
+	// Neither side sent anything within the idle timeout.
+	CloseIdleTimeout CloseReason = "idle_timeout"
+
+	// The session exceeded a limit of its SessionPolicy.
+	ClosePolicy CloseReason = "policy"
+
+	// The server was closed while the session was relaying.
+	CloseShutdown CloseReason = "shutdown"
+
+	// The session was ended with Kill.
+	CloseKilled CloseReason = "killed"
+
+	// I/O with the client or remote failed.
+	CloseClientError CloseReason = "client_error"
+	CloseRemoteError CloseReason = "remote_error"
+
+	// The handler of the session panicked.
+	ClosePanic CloseReason = "panic"
+)
+
+// relayError is an error that ended the relay of a session.
+type relayError struct {
+	reason CloseReason
+	err    error
+}
+
+func (e *relayError) Error() string {
+	return string(e.reason) + " - " + e.err.Error()
+}
+
+func (e *relayError) Unwrap() error {
+	return e.err
+}
+
+// classify wraps an I/O error from the client or remote side of a relay.
+func classify(err error, client bool) *relayError {
+	var reason CloseReason
+	switch {
+	case errors.Is(err, errSessionPolicy):
+		reason = ClosePolicy
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		reason = CloseIdleTimeout
+	case errors.Is(err, io.EOF) && client:
+		reason = CloseClientEOF
+	case errors.Is(err, io.EOF):
+		reason = CloseRemoteEOF
+	case client:
+		reason = CloseClientError
+	default:
+		reason = CloseRemoteError
+	}
+	return &relayError{reason: reason, err: err}
+}
+
+// end records why sess ended, keeping the first reason given.
+func (sess *session) end(reason CloseReason, err error) {
+	if sess.reason == "" {
+		sess.reason = reason
+		sess.closeErr = err
+	}
+}
+
+// logClose logs and counts the end of sess.
+func (s *Server) logClose(sess *session) {
+	s.metrics.Counter("sessions_closed_total", "Sessions closed, by reason.", "reason", string(sess.reason)).Inc()
+	s.endedMu.Lock()
+	s.ended[sess.reason]++
+	s.endedMu.Unlock()
+
+	level := zapcore.ErrorLevel
+	switch sess.reason {
+	case CloseClientEOF, CloseRemoteEOF:
+		level = zapcore.InfoLevel
+	case CloseIdleTimeout, ClosePolicy, CloseShutdown, CloseKilled, CloseUnauthorized, CloseRejected, CloseProtocolViolation, CloseProtocolConfusion, CloseRemoteClosedEarly, CloseMaintenance:
+		level = zapcore.WarnLevel
+	}
+
+	fields := []zap.Field{zap.String("reason", string(sess.reason)), zap.Int64("bytes", sess.relayed.Load())}
+	if sess.closeErr != nil && level != zapcore.InfoLevel {
+		fields = append(fields, zap.Error(sess.closeErr))
+	}
+	sess.log.Log(level, "session closed", fields...)
+}
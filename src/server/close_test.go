@@ -0,0 +1,114 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireClosedReason(t *testing.T, s *server.Server, reason server.CloseReason) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return s.Metrics().Counter("sessions_closed_total", "", "reason", string(reason)).Value() == 1
+	}, time.Second*5, time.Millisecond*10, "expected a session closed for %s", reason)
+}
+
+func TestCloseReasons(t *testing.T) {
+	t.Parallel()
+
+	listen := func(t *testing.T, opts ...server.Option) (*server.Server, string) {
+		s := createServer(t, opts...)
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		return s, addr.String()
+	}
+
+	t.Run("ClientEOF", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t)
+		c := client.NewClient(addr, "")
+		require.NoError(t, c.Connect(newEchoServer(t)))
+		require.NoError(t, c.Close())
+
+		requireClosedReason(t, s, server.CloseClientEOF)
+	})
+
+	t.Run("RemoteEOF", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t)
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		// the echo server hangs up after one echo
+		writePacket(t, c, []byte("hello"))
+
+		requireClosedReason(t, s, server.CloseRemoteEOF)
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		echoServer := newEchoServer(t)
+		s, addr := listen(t, server.WithPortIdleTimeouts(map[int]time.Duration{
+			portOf(t, echoServer): time.Millisecond * 50,
+		}))
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+
+		requireClosedReason(t, s, server.CloseIdleTimeout)
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t, server.WithSessionPolicy(server.SessionPolicy{MaxLifetime: time.Millisecond * 50}))
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		requireClosedReason(t, s, server.ClosePolicy)
+	})
+
+	t.Run("RequestFailed", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t)
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.Error(t, c.Connect("127.0.0.1:1"))
+
+		requireClosedReason(t, s, server.CloseRequestFailed)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("token")))
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.Error(t, c.Connect(newEchoServer(t)))
+
+		requireClosedReason(t, s, server.CloseUnauthorized)
+	})
+
+	t.Run("BadRequest", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t)
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		writePacket(t, c, []byte{proto.Version + 1, 0, 0, 0, 0, 0, 0, 0, 0})
+
+		requireClosedReason(t, s, server.CloseBadRequest)
+	})
+}
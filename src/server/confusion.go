@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"socks4/proto"
+)
+
+var errProtocolConfusion = errors.New("client sent another SOCKS request over its tunnel")
+
+// ConfusionMode selects what happens when a client sends what looks like
+// another SOCKS4 request as the first data over its established tunnel,
+// which means the client and server disagree about the state of the
+// connection.
+type ConfusionMode int
+
+const (
+	// The request is counted and logged, then relayed to the destination.
+	ConfusionCount ConfusionMode = iota
+
+	// The request is counted and the session closed with
+	// CloseProtocolConfusion instead of relaying it.
+	ConfusionAbort
+
+	// The client's data isn't checked.
+	ConfusionUnchecked
+)
+
+// requestGuard returns the check of the first data a client relays, or nil
+// if it isn't checked.
+func (s *Server) requestGuard(sess *session) func([]byte) error {
+	if s.confusionMode == ConfusionUnchecked {
+		return nil
+	}
+	return func(data []byte) error {
+		if !isRequest(data) {
+			return nil
+		}
+		s.metrics.Counter("protocol_confusion_total", "Sessions whose client sent another SOCKS request over the tunnel.").Inc()
+		if s.confusionMode == ConfusionAbort {
+			return errProtocolConfusion
+		}
+		sess.log.Warn("client sent another SOCKS request over the tunnel")
+		return nil
+	}
+}
+
+// isRequest reports whether data is exactly one SOCKS4 request.
+func isRequest(data []byte) bool {
+	_, ok := proto.ParseRequest(data)
+	return ok
+}
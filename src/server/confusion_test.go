@@ -0,0 +1,71 @@
+package server_test
+
+import (
+	"io"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolConfusion(t *testing.T) {
+	t.Parallel()
+
+	second, err := proto.NewRequest(proto.ConnectCommand, "127.0.0.1:80", "mcr")
+	require.NoError(t, err)
+
+	t.Run("Count", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t)
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		// the request still reaches the destination
+		writePacket(t, c, second.Serialize())
+		echoed := make([]byte, len(second.Serialize()))
+		_, err = io.ReadFull(c, echoed)
+		require.NoError(t, err)
+		require.Equal(t, second.Serialize(), echoed)
+
+		requireClosedReason(t, s, server.CloseRemoteEOF)
+		require.EqualValues(t, 1, s.Metrics().Counter("protocol_confusion_total", "").Value())
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithProtocolConfusion(server.ConfusionAbort))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		writePacket(t, c, second.Serialize())
+		requireClosed(t, c)
+		requireClosedReason(t, s, server.CloseProtocolConfusion)
+		require.EqualValues(t, 1, s.Metrics().Counter("protocol_confusion_total", "").Value())
+	})
+
+	t.Run("Data", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithProtocolConfusion(server.ConfusionAbort))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		requireEcho(t, c)
+		requireClosedReason(t, s, server.CloseRemoteEOF)
+		require.Zero(t, s.Metrics().Counter("protocol_confusion_total", "").Value())
+	})
+}
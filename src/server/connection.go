@@ -1,89 +1,342 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"socks4/proto"
 	"strconv"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-func handleNewClient(conn net.Conn, log *zap.Logger) {
-	log = log.With(zap.String("client", conn.RemoteAddr().String()))
-	log.Info("handling new client")
+// Maximum time to spend writing a reply to a client
+const replyTimeout = time.Second * 10
 
-	deadline := time.Now().Add(time.Minute * 2)
+func (s *Server) handleNewClient(conn net.Conn) {
+	if !s.limitRate(conn) {
+		return
+	}
+	start := time.Now()
+	sess := s.newSession(conn)
+	defer s.removeSession(sess)
+
+	fields := []zap.Field{
+		zap.Stringer("client", sess.remote),
+		zap.Uint64("session", sess.id),
+		zap.Uint64("policy-version", sess.rules.version),
+	}
+	sess.log = s.logger(SubsystemHandshake).With(fields...)
+	sess.log.Info("handling new client")
+	defer s.logClose(sess)
+	defer s.closeHooks(sess)
+	defer sess.endKilled()
+	s.setConnState(sess, StateNew)
+	defer s.setConnState(sess, StateClosed)
+
+	deadline := time.Now().Add(s.handshakeTimeout)
 	conn.SetDeadline(deadline)
 	defer conn.Close()
+	defer s.recoverSession(sess)
 
-	req, err := proto.ReadRequest(conn)
+	if err := s.acceptHooks(conn); err != nil {
+		sess.end(CloseRejected, err)
+		return
+	}
+
+	// a request may arrive in several segments, but must arrive promptly
+	if readDeadline := time.Now().Add(s.requestReadTimeout); readDeadline.Before(deadline) {
+		conn.SetReadDeadline(readDeadline)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.handshakeTLS(sess, tlsConn); err != nil {
+			sess.end(CloseBadRequest, err)
+			return
+		}
+	}
+	sess.in = bufio.NewReaderSize(conn, proto.DefaultRequestLimit)
+	protocol, err := s.sniff(sess)
 	if err != nil {
-		log.Error("failed to read request", zap.Error(err))
+		conn.SetReadDeadline(deadline)
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read request - %w", err))
+		return
+	}
+	s.metrics.Counter("handshakes_total", "Client handshakes started, by protocol.", "protocol", protocol.String()).Inc()
+	s.setConnState(sess, StateHandshaking)
+
+	if s.protocols&protocol == 0 {
+		conn.SetReadDeadline(deadline)
+		sess.end(CloseBadRequest, fmt.Errorf("%v - %w", protocol, errProtocolDisabled))
+		s.refuse(sess, protocol)
 		return
-	} else if req.Version() != proto.Version {
-		log.Error("not a socks4 request")
+	}
+	if s.Maintenance() {
+		conn.SetReadDeadline(deadline)
+		sess.end(CloseMaintenance, errMaintenance)
+		s.refuse(sess, protocol)
 		return
 	}
 
-	remote, err := handleRequest(conn, deadline, req)
-	if err != nil {
-		log.Error("failed to handle request", zap.Error(err))
-		err := sendReply(conn, proto.ErrorReply, req.IP(), req.Port())
-		if err != nil {
-			log.Error("failed to send error response", zap.Error(err))
-		}
+	if protocol == ProtocolSOCKS4 {
+		s.startEarlyDial(sess, deadline)
+		defer s.discardEarlyDial(sess)
+	}
+
+	var req *request
+	switch protocol {
+	case ProtocolSOCKS4, ProtocolSOCKS4a:
+		req = s.readSOCKS4(sess, deadline)
+	case ProtocolSOCKS5:
+		req = s.readSOCKS5(sess, deadline)
+	case ProtocolHTTPConnect:
+		req = s.readHTTP(sess, deadline)
+	}
+	if req == nil {
+		return
+	} else if err := s.requestHooks(sess, protocol, req); err != nil {
+		sess.end(CloseRejected, err)
+		s.sendError(sess, req, err)
+		return
+	} else if err := s.checkQuota(sess); err != nil {
+		sess.end(ClosePolicy, err)
+		s.sendError(sess, req, err)
+		return
+	} else if req.command == proto.UDPAssociateCommand && s.udpRelay {
+		s.associate(sess, deadline, req)
+		return
+	}
+
+	remote, err := s.handleRequest(sess, deadline, req)
+	if errors.Is(err, errRemoteClosedEarly) {
+		sess.end(CloseRemoteClosedEarly, fmt.Errorf("failed to handle request - %w", err))
+		s.sendError(sess, req, err)
+		return
+	} else if err != nil {
+		sess.end(CloseRequestFailed, fmt.Errorf("failed to handle request - %w", err))
+		s.sendError(sess, req, err)
 		return
 	}
 	defer remote.Close()
 
-	err = sendReply(conn, proto.SuccessReply, req.IP(), req.Port())
-	if err != nil {
-		log.Error("failed to send success response", zap.Error(err))
+	if req.command == proto.ConnectCommand {
+		remote, err = s.checkRemoteClosed(remote)
+		if err != nil && s.remoteCloseMode == RemoteCloseError {
+			sess.end(CloseRemoteClosedEarly, err)
+			s.sendError(sess, req, err)
+			return
+		} else if err != nil {
+			// reply success anyway; the relay then sees the remote's EOF
+			sess.end(CloseRemoteClosedEarly, err)
+		}
+	}
+
+	if len(s.hooks) != 0 {
+		if remote, err = s.dialedHooks(sess, remote); err != nil {
+			sess.end(CloseRejected, err)
+			s.sendError(sess, req, err)
+			return
+		}
+		defer remote.Close()
+	}
+
+	if err := s.checkEarlyData(sess, deadline); err != nil {
+		sess.end(CloseProtocolViolation, err)
+		s.sendError(sess, req, err)
 		return
 	}
 
-	if err := exchangePump(conn, remote); err != nil {
-		log.Error("exchange pump failure", zap.Error(err))
+	err = req.reply.granted(remote)
+	if err != nil {
+		sess.end(CloseClientError, fmt.Errorf("failed to send success response - %w", err))
 		return
+	} else if req.command == proto.ConnectCommand {
+		s.recordHandshake(time.Since(start))
 	}
+	s.replyHooks(sess, nil)
 
-	log.Info("client disconnected")
+	if req.hostname != "" {
+		fields = append(fields, zap.String("hostname", req.hostname), zap.Stringer("ip", addrIP(remote.RemoteAddr())))
+	}
+	sess.idle = s.idleTimeout(req.port)
+	sess.policy = s.sessionPolicy
+	sess.halfClose = s.halfClose
+	sess.buffers = s.buffers
+	sess.hibernation = s.hibernation
+	target := remote.RemoteAddr()
+	sess.target.Store(&target)
+	sess.log = s.logger(SubsystemRelay).With(fields...)
+	if len(s.byteTriggers) != 0 {
+		sess.triggers = newTriggers(s.byteTriggers)
+	}
+	sess.guard = s.requestGuard(sess)
+	sess.touch(true)
+	sess.touch(false)
+	s.setConnState(sess, StateActive)
+	err = s.exchangePump(sess.pipelined(), remote, sess)
+
+	var relayErr *relayError
+	if errors.As(err, &relayErr) {
+		sess.end(relayErr.reason, relayErr.err)
+	} else {
+		sess.end(CloseRemoteError, err)
+	}
+}
+
+// readSOCKS4 reads, identifies and authenticates a SOCKS4 request. It
+// returns nil if the session ended instead.
+func (s *Server) readSOCKS4(sess *session, deadline time.Time) *request {
+	msg, err := proto.ReadRequest(sess.in)
+	sess.client.SetReadDeadline(deadline)
+	if err != nil {
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read request - %w", err))
+		return nil
+	}
+
+	req := &request{
+		command: msg.Command(),
+		ip:      msg.IP(),
+		port:    msg.Port(),
+		reply:   socks4Replier{conn: sess.client, req: msg},
+	}
+	if msg.IsSocks4a() {
+		req.hostname = msg.Hostname()
+	}
+
+	if err := s.identify(sess, deadline, msg.UserID()); err != nil {
+		sess.end(CloseUnauthorized, fmt.Errorf("failed to identify client - %w", err))
+		s.sendError(sess, req, err)
+		return nil
+	}
+
+	if err := s.authenticate(sess, deadline); err != nil {
+		sess.end(CloseUnauthorized, fmt.Errorf("request not authorized for %q - %w", sess.user, err))
+		s.sendError(sess, req, err)
+		return nil
+	}
+	return req
 }
 
-func handleRequest(conn net.Conn, deadline time.Time, req *proto.Request) (net.Conn, error) {
-	switch req.Command() {
+// sendError replies to a request that failed with cause.
+func (s *Server) sendError(sess *session, req *request, cause error) {
+	if err := req.reply.failed(cause); err != nil {
+		sess.log.Error("failed to send error response", zap.Error(err))
+	}
+	s.replyHooks(sess, cause)
+}
+
+// socks4Replier answers SOCKS4 requests.
+type socks4Replier struct {
+	conn net.Conn
+	req  *proto.Request
+}
+
+func (r socks4Replier) bound(ip net.IP, port int) error {
+	return sendReply(r.conn, proto.SuccessReply, ip, port)
+}
+
+func (r socks4Replier) granted(net.Conn) error {
+	return sendReply(r.conn, proto.SuccessReply, r.req.IP(), r.req.Port())
+}
+
+func (r socks4Replier) failed(cause error) error {
+	return sendReply(r.conn, replyCode(cause), r.req.IP(), r.req.Port())
+}
+
+// replyCode returns the rejection code for a request that failed with err.
+func replyCode(err error) proto.ReplyCode {
+	switch {
+	case errors.Is(err, ErrNoIdentd):
+		return proto.NoIdentd
+	case errors.Is(err, ErrIdentMismatch):
+		return proto.IdentMismatch
+	default:
+		return proto.RejectedFailed
+	}
+}
+
+func (s *Server) handleRequest(sess *session, deadline time.Time, req *request) (net.Conn, error) {
+	switch req.command {
 	case proto.ConnectCommand:
-		return doConnect(conn, deadline, req)
+		return s.doConnect(sess, deadline, req)
 	case proto.BindCommand:
-		return doBind(conn, deadline, req)
+		return s.doBind(sess, deadline, req)
 	default:
 		return nil, errors.New("invalid request command")
 	}
 }
 
-func doConnect(conn net.Conn, deadline time.Time, req *proto.Request) (net.Conn, error) {
-	d := net.Dialer{}
-	ctx, cancel := context.WithDeadline(context.Background(), deadline.Add(-time.Second))
-	remote, err := d.DialContext(ctx, "tcp", req.Address())
-	cancel()
+func (s *Server) doConnect(sess *session, deadline time.Time, req *request) (net.Conn, error) {
+	route := s.route(sess.user)
+	addrs, err := s.destinationAddrs(sess, deadline, req, route)
 	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Conn
+	if res, ok := s.takeEarlyDial(sess, addrs); ok {
+		remote, err = res.conn, res.err
+	} else {
+		ctx, cancel := context.WithDeadline(sess.ctx, s.dialDeadline(deadline))
+		remote, err = s.dial(ctx, sess, route, addrs)
+		cancel()
+	}
+	s.recordDial(err)
+	if errors.Is(err, syscall.ECONNRESET) && s.remoteCloseMode != RemoteCloseUnchecked {
+		// accepted, then reset before the dial returned
+		return nil, s.remoteClosedEarly(err)
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to dial requested address - %w", err)
 	}
+	s.pinConnected(sess, req, remote)
+
+	if origination := sess.rules.tlsOrigination(req); origination != nil {
+		conn, err := s.originateTLS(sess, deadline, req, origination, remote)
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+		remote = conn
+	}
 	return remote, nil
 }
 
-func doBind(conn net.Conn, deadline time.Time, req *proto.Request) (net.Conn, error) {
-	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{})
+func (s *Server) doBind(sess *session, deadline time.Time, req *request) (net.Conn, error) {
+	if s.bindReplays != nil {
+		if err := s.bindReplays.check(sess.remote, bindDestination(req)); err != nil {
+			s.metrics.Counter("bind_replays_rejected_total", "BINDs rejected as duplicates within the replay window.").Inc()
+			return nil, err
+		}
+	}
+
+	expected, err := s.destinationIPs(sess, deadline, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range expected {
+		if err := s.checkPrivate(sess, ip); err != nil {
+			return nil, err
+		} else if _, err := s.checkACL(sess, ip, req.port); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := s.listenBind()
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen - %w", err)
 	}
 	defer ln.Close()
 
+	s.metrics.Counter("bind_listeners_opened_total", "BIND listeners opened.").Inc()
+	log := sess.log.With(zap.String("bind-address", ln.Addr().String()))
+	log.Info("bind listener opened")
+
 	if err := ln.SetDeadline(deadline.Add(-time.Second)); err != nil {
 		return nil, fmt.Errorf("failed to set listener deadline - %w", err)
 	}
@@ -97,78 +350,352 @@ func doBind(conn net.Conn, deadline time.Time, req *proto.Request) (net.Conn, er
 		lnPort = val
 	}
 
-	err = sendReply(conn, proto.SuccessReply, net.IPv4(0, 0, 0, 0), lnPort)
+	if err := s.checkEarlyData(sess, deadline); err != nil {
+		return nil, err
+	}
+
+	err = req.reply.bound(s.bindAddress(sess), lnPort)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send initial bind success - %w", err)
 	}
 
+	// closing the server ends the wait for the peer
+	accepted := make(chan struct{})
+	defer close(accepted)
+	go func() {
+		select {
+		case <-sess.ctx.Done():
+			ln.Close()
+		case <-accepted:
+		}
+	}()
+
+	start := time.Now()
 	remote, err := ln.Accept()
-	if err != nil {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.metrics.Counter("bind_accept_timeouts_total", "BIND listeners that timed out waiting for the peer.").Inc()
+		log.Warn("bind peer never connected", zap.Duration("waited", time.Since(start)))
+		return nil, fmt.Errorf("failed to accept remote - %w", err)
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to accept remote - %w", err)
 	}
+	s.metrics.Counter("bind_accepts_total", "Connections accepted by BIND listeners.").Inc()
 
 	host, _, err := net.SplitHostPort(remote.RemoteAddr().String())
 	if err != nil {
+		remote.Close()
 		return nil, fmt.Errorf("failed to split host from remote addr - %w", err)
 	}
 
-	if host != req.IP().String() {
+	if !containsIP(expected, canonicalIP(net.ParseIP(host))) {
+		s.metrics.Counter("bind_peer_mismatches_total", "BIND peers that didn't match the requested address.").Inc()
+		log.Warn("bind peer mismatch", zap.Stringers("expected", ipStringers(expected)), zap.String("peer", host))
 		remote.Close()
 		return nil, errors.New("requested remote does not match connected remote")
 	}
 
+	waited := time.Since(start)
+	s.metrics.Histogram("bind_peer_connect_seconds", "Time from BIND listener opening to the peer connecting.").Observe(waited.Seconds())
+	log.Info("bind peer connected", zap.String("peer", remote.RemoteAddr().String()), zap.Duration("waited", waited))
+
 	return remote, nil
 }
 
 func sendReply(conn net.Conn, code proto.ReplyCode, ip net.IP, port int) error {
 	body := proto.NewReply(code, ip, port).Serialize()
-	n, err := conn.Write(body)
-	if err != nil {
+	if err := proto.WriteFull(conn, body, replyTimeout); err != nil {
 		return fmt.Errorf("failed to write to client - %w", err)
-	} else if n != len(body) {
-		return errors.New("failed to write entire payload to client")
 	}
 	return nil
 }
 
-func exchangePump(client, remote net.Conn) error {
-	errChan := make(chan error, 1)
+// relayFlushTimeout bounds how long the directions of an ending session get
+// to finish writing what they already read.
+const relayFlushTimeout = time.Second * 5
 
-	// net.Conns are concurrent-safe
-	go exchange(client, remote, errChan)
-	go exchange(remote, client, errChan)
+// relayResult is how a direction of a relay ended.
+type relayResult struct {
+	err        *relayError // nil if the session was stopped
+	halfClosed bool        // the direction finished, the other may continue
+}
 
-	err := <-errChan
-	if errors.Is(err, io.EOF) {
-		return nil
+// exchangePump relays between client and remote until a direction fails, or
+// both finished with half-closes, then stops and joins both directions,
+// letting them finish writing what they already read. It returns why the
+// session ended, along with the error of the other direction if it failed
+// too.
+func (s *Server) exchangePump(client, remote net.Conn, sess *session) error {
+	results := make(chan relayResult, 2)
+	relay := func(reader, writer net.Conn, fromClient bool) {
+		defer func() {
+			if v := recover(); v != nil {
+				results <- relayResult{err: &relayError{reason: ClosePanic, err: s.recovered(sess.log, v)}}
+			}
+		}()
+		results <- exchange(reader, writer, fromClient, sess)
+	}
+	go relay(client, remote, true)
+	go relay(remote, client, false)
+
+	var lifetime <-chan time.Time
+	if sess.policy.MaxLifetime > 0 {
+		timer := time.NewTimer(sess.policy.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var ended *relayError
+	var others []error
+	var flushTimer *time.Timer
+	var flush <-chan time.Time
+	done := sess.ctx.Done()
+	stop := func(err *relayError) {
+		if ended == nil {
+			ended = err
+		}
+		if flushTimer != nil {
+			return
+		}
+		sess.relay.close()
+		// interrupt reads, leaving writes in progress to finish
+		now := time.Now()
+		client.SetReadDeadline(now)
+		remote.SetReadDeadline(now)
+		flushTimer = time.NewTimer(relayFlushTimeout)
+		flush = flushTimer.C
+	}
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+	}()
+
+	for pending := 2; pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			switch {
+			case res.err == nil:
+			case ended == nil:
+				ended = res.err
+			default:
+				others = append(others, res.err)
+			}
+			if !res.halfClosed {
+				stop(ended)
+			}
+		case <-lifetime:
+			stop(&relayError{reason: ClosePolicy, err: errMaxLifetime})
+		case <-done:
+			done = nil
+			stop(&relayError{reason: CloseShutdown, err: errServerClosed})
+		case <-flush:
+			// writers that won't drain are cut off
+			client.Close()
+			remote.Close()
+			flush = nil
+		}
+	}
+	sess.relay.close()
+
+	if len(others) != 0 {
+		return &relayError{reason: ended.reason, err: errors.Join(append([]error{ended.err}, others...)...)}
 	}
-	return err
+	return ended
 }
 
-func exchange(reader, writer net.Conn, errChan chan<- error) {
-	buffer := make([]byte, 1<<16)
+// closeWriter is a connection whose write half can be closed on its own,
+// like *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+var errNoCloseWrite = errors.New("connection can't close its write half")
+
+// exchange relays from reader to writer until either fails, the session was
+// idle in both directions for its idle timeout, or it was stopped. With
+// half-closes, when reader reaches EOF, writer's write half is closed and
+// the direction finishes, leaving the other direction to continue until it
+// finishes too. fromClient tells whether reader is the client side of the
+// session.
+func exchange(reader, writer net.Conn, fromClient bool, sess *session) relayResult {
+	buffer := sess.buffers.get()
+	defer func() { sess.buffers.put(buffer) }()
+	end := func(err *relayError) relayResult {
+		if sess.relay.closed() {
+			// a consequence of stopping the session
+			return relayResult{}
+		}
+		if cw, ok := writer.(closeWriter); ok && sess.halfClose && errors.Is(err.err, io.EOF) && cw.CloseWrite() == nil {
+			return relayResult{err: err, halfClosed: true}
+		}
+		return relayResult{err: err}
+	}
 	for {
-		if err := setDeadlines(reader, writer); err != nil {
-			errChan <- err
-			return
+		if !sess.relay.wait() {
+			return relayResult{}
 		}
-		n, err := reader.Read(buffer)
-		if err != nil {
-			errChan <- err
-			return
+		deadline := sess.idleDeadline()
+		if err := reader.SetReadDeadline(deadline); err != nil {
+			return end(classify(err, fromClient))
+		} else if sess.relay.closed() {
+			// stopped meanwhile, and setting the deadline undid the interruption
+			return relayResult{}
+		}
+		n, err := sess.hibernation.read(reader, &buffer, sess.buffers, sess.relay, deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) && !sess.relay.closed() &&
+			(sess.relay.isPaused() || time.Now().Before(sess.idleDeadline())) {
+			// the session was paused while idle, not abandoned, or only
+			// this direction is quiet
+			continue
+		} else if err != nil && n == 0 {
+			return end(classify(err, fromClient))
 		}
-		_, err = writer.Write(buffer[:n])
+		sess.touch(fromClient)
+		// what was read is written even if the session stopped meanwhile
+		sess.relay.wait()
+		if fromClient && sess.guard != nil {
+			guard := sess.guard
+			sess.guard = nil
+			if err := guard(buffer[:n]); err != nil {
+				return end(&relayError{reason: CloseProtocolConfusion, err: err})
+			}
+		}
+
+		read := n
+		n, capErr := sess.allow(n)
+		n, err = relayWrite(writer, buffer[:n], sess)
+		sess.account(n, fromClient)
 		if err != nil {
-			errChan <- err
-			return
+			return end(classify(err, !fromClient))
+		} else if capErr != nil {
+			return end(classify(capErr, fromClient))
+		}
+
+		if read == len(buffer) && canSplice(reader, writer) {
+			// more is likely on its way
+			if err := copyBulk(reader, writer, fromClient, buffer, sess); err != nil {
+				return end(err)
+			}
 		}
 	}
 }
 
-func setDeadlines(reader, writer net.Conn) error {
-	deadline := time.Now().Add(time.Second * 30)
-	if err := reader.SetReadDeadline(deadline); err != nil {
-		return err
+// bulkChunk is how much copyBulk copies at most before accounting for it.
+const bulkChunk = 1 << 20
+
+// canSplice tells whether reader can be spliced into writer, with a
+// splicePipe on Linux or the runtime's ReadFrom path of io.Copy.
+func canSplice(reader, writer net.Conn) bool {
+	_, tcpReader := reader.(*net.TCPConn)
+	_, tcpWriter := writer.(*net.TCPConn)
+	return tcpReader && tcpWriter
+}
+
+// copyBulk relays from reader to writer in chunks for as long as chunks
+// fill up, splicing them through a pipe on Linux so the kernel moves the
+// data without copying it through buffer, or with io.CopyBuffer otherwise.
+// Chunks are accounted for and the session checked for a pause or its
+// limits once they complete, and a stalled writer is waited on as long as
+// the session isn't idle in both directions, as relayWrite does. It returns
+// nil when the data slows down, to continue with reads through buffer.
+func copyBulk(reader, writer net.Conn, fromClient bool, buffer []byte, sess *session) *relayError {
+	refresh := func() bool {
+		deadline := sess.idleDeadline()
+		return time.Now().Before(deadline) && writer.SetWriteDeadline(deadline) == nil
+	}
+	pipe, _ := newSplicePipe()
+	defer func() {
+		if pipe != nil {
+			pipe.Close()
+		}
+	}()
+	for !sess.relay.isPaused() && !sess.relay.closed() {
+		limit := int64(bulkChunk)
+		if max := sess.policy.MaxBytes; max > 0 && max-sess.relayed.Load() < limit {
+			limit = max - sess.relayed.Load()
+		}
+		if limit < int64(len(buffer)) {
+			// close to the byte cap, which reads through buffer observe
+			return nil
+		}
+		if err := reader.SetReadDeadline(sess.idleDeadline()); err != nil {
+			return classify(err, fromClient)
+		} else if err := writer.SetWriteDeadline(sess.idleDeadline()); err != nil {
+			return classify(err, !fromClient)
+		} else if sess.relay.closed() {
+			return nil
+		}
+
+		copied, err := int64(0), errNoSplice
+		if pipe != nil {
+			copied, err = pipe.copy(writer.(*net.TCPConn), reader.(*net.TCPConn), limit, refresh)
+		}
+		if errors.Is(err, errNoSplice) {
+			if pipe != nil {
+				pipe.Close()
+				pipe = nil
+			}
+			copied, err = io.CopyBuffer(idleWriter{writer, sess}, &io.LimitedReader{R: reader, N: limit}, buffer)
+		}
+		var capErr error
+		if copied > 0 {
+			sess.touch(fromClient)
+			_, capErr = sess.allow(int(copied))
+			sess.account(int(copied), fromClient)
+		}
+
+		var opErr *net.OpError
+		switch {
+		case errors.As(err, &opErr) && opErr.Op == "write":
+			// including a writer stalled until the session went idle
+			return classify(err, !fromClient)
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil
+		case err != nil:
+			return classify(err, fromClient)
+		case copied < limit:
+			return classify(io.EOF, fromClient)
+		case capErr != nil:
+			return classify(capErr, fromClient)
+		}
+	}
+	return nil
+}
+
+// idleWriter writes to a relay's writer with relayWrite.
+type idleWriter struct {
+	writer net.Conn
+	sess   *session
+}
+
+func (w idleWriter) Write(p []byte) (int, error) {
+	return relayWrite(w.writer, p, w.sess)
+}
+
+// relayWrite writes p to writer, waiting on a stalled writer for as long as
+// the session isn't idle in both directions.
+func relayWrite(writer net.Conn, p []byte, sess *session) (int, error) {
+	written := 0
+	for {
+		deadline := sess.idleDeadline()
+		if err := writer.SetWriteDeadline(deadline); err != nil {
+			return written, err
+		}
+		n, err := writer.Write(p[written:])
+		written += n
+		// done, failed, timed out for good like TLS connections do, or idle
+		if !errors.Is(err, os.ErrDeadlineExceeded) || time.Now().Before(deadline) ||
+			!time.Now().Before(sess.idleDeadline()) {
+			return written, err
+		}
+	}
+}
+
+// report sends err to errChan unless another error was already reported.
+func report(errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	default:
 	}
-	return writer.SetWriteDeadline(deadline)
 }
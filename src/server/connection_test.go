@@ -2,22 +2,26 @@ package server_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 
 	"socks4/client"
 	"socks4/proto"
+	"socks4/server"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
-func newClient(t *testing.T) *client.Client {
+func newClient(t *testing.T, opts ...server.Option) *client.Client {
 	t.Helper()
 
-	s := createServer(t)
+	s := createServer(t, opts...)
 
 	addr, err := s.ListenAndServe("localhost:0")
 	require.NoError(t, err)
@@ -78,7 +82,17 @@ func requireClosed(t *testing.T, conn net.Conn) {
 	require.Zero(t, n)
 }
 
-func writePacket(t *testing.T, client *client.Client, packet []byte) {
+func portOf(t *testing.T, address string) int {
+	t.Helper()
+
+	_, portStr, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	return port
+}
+
+func writePacket(t testing.TB, client *client.Client, packet []byte) {
 	t.Helper()
 
 	n, err := client.Write(packet)
@@ -118,7 +132,7 @@ func TestBadRequest(t *testing.T) {
 
 	t.Run("ShortRead", func(t *testing.T) {
 		t.Parallel()
-		client := newClient(t)
+		client := newClient(t, server.WithRequestReadTimeout(time.Millisecond*100))
 
 		writePacket(t, client, []byte{proto.Version, 0, 0})
 
@@ -272,6 +286,223 @@ func TestBindExchange(t *testing.T) {
 	requireClosed(t, client)
 }
 
+func TestRelayBufferSize(t *testing.T) {
+	t.Parallel()
+
+	// a peer echoing whole messages, which arrive 3 bytes at a time
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buff := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buff); err == nil {
+			conn.Write(buff)
+		}
+	}()
+
+	client := newClient(t, server.WithRelayBufferSize(3))
+	require.NoError(t, client.Connect(ln.Addr().String()))
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	buff := make([]byte, 5)
+	_, err = io.ReadFull(client, buff)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buff))
+}
+
+func TestBulkRelay(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+
+	// a destination sending data when asked for it, then closing
+	download := func(t *testing.T) string {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				conn.Write(data)
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	t.Run("Complete", func(t *testing.T) {
+		t.Parallel()
+
+		client := newClient(t)
+		require.NoError(t, client.Connect(download(t)))
+		writePacket(t, client, []byte("?"))
+
+		received, err := io.ReadAll(client)
+		require.NoError(t, err)
+		require.Equal(t, data, received)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		t.Parallel()
+
+		const max = 3*1024*1024 + 5
+		client := newClient(t, server.WithSessionPolicy(server.SessionPolicy{MaxBytes: max}))
+		require.NoError(t, client.Connect(download(t)))
+		writePacket(t, client, []byte("?"))
+
+		received, err := io.ReadAll(client)
+		require.NoError(t, err)
+		// the cap counts the request for the data too
+		require.Equal(t, max-1, len(received))
+		require.Equal(t, data[:max-1], received)
+	})
+
+	t.Run("StalledClient", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithHalfClose(), server.WithIdleTimeout(time.Millisecond*300))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		req, err := proto.NewRequest(proto.ConnectCommand, download(t), "")
+		require.NoError(t, err)
+		_, err = conn.Write(req.Serialize())
+		require.NoError(t, err)
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+
+		// done sending, and never reading the download
+		_, err = conn.Write([]byte("?"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		// ended by the idle timeout, with the reason of the first direction
+		// that ended
+		requireClosedReason(t, s, server.CloseClientEOF)
+		require.Empty(t, s.Sessions())
+	})
+}
+
+func TestHalfClose(t *testing.T) {
+	t.Parallel()
+
+	// a destination answering once the client is done sending, like an
+	// HTTP/1.0 server
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err == nil {
+			conn.Write(bytes.ToUpper(request))
+		}
+	}()
+
+	s := createServer(t, server.WithHalfClose())
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	req, err := proto.NewRequest(proto.ConnectCommand, ln.Addr().String(), "")
+	require.NoError(t, err)
+	_, err = conn.Write(req.Serialize())
+	require.NoError(t, err)
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, reply.Code())
+
+	_, err = conn.Write([]byte("get /"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	response, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "GET /", string(response))
+	requireClosedReason(t, s, server.CloseClientEOF)
+}
+
+func TestRelayFlush(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+
+	s := createServer(t, server.WithSessionPolicy(server.SessionPolicy{MaxLifetime: time.Millisecond * 300}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(ln.Addr().String()))
+	remote := <-accepted
+
+	// data read while paused is still delivered when the session ends
+	time.Sleep(time.Millisecond * 50)
+	require.NoError(t, s.PauseSession(1))
+	_, err = remote.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	received, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(received))
+	requireClosedReason(t, s, server.ClosePolicy)
+}
+
+func TestHibernation(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithHibernation(time.Millisecond*50))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	// both directions release their buffers, and wake up for data
+	hibernating := s.Metrics().Gauge("relays_hibernating", "")
+	require.Eventually(t, func() bool {
+		return hibernating.Value() == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	buff := make([]byte, 5)
+	_, err = io.ReadFull(c, buff)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buff))
+
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+	require.GreaterOrEqual(t, s.Metrics().Counter("relay_hibernations_total", "").Value(), int64(2))
+	require.Zero(t, hibernating.Value())
+}
+
 func TestExchangeTimeout(t *testing.T) {
 	t.Parallel()
 
@@ -289,3 +520,235 @@ func TestExchangeTimeout(t *testing.T) {
 
 	requireClosed(t, client)
 }
+
+func TestPortIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	client := newClient(t, server.WithPortIdleTimeouts(map[int]time.Duration{
+		portOf(t, echoServer): time.Millisecond * 100,
+	}))
+
+	require.NoError(t, client.Connect(echoServer))
+
+	start := time.Now()
+	requireClosed(t, client)
+	require.Less(t, time.Since(start), time.Second*5)
+}
+
+func TestOneWayTraffic(t *testing.T) {
+	t.Parallel()
+
+	// a destination that only reads, like an upload
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+
+	client := newClient(t, server.WithIdleTimeout(time.Millisecond*200))
+	require.NoError(t, client.Connect(ln.Addr().String()))
+	remote := <-accepted
+
+	// the quiet direction outlives the idle timeout while the other is busy
+	buff := make([]byte, 4)
+	for i := 0; i < 8; i++ {
+		writePacket(t, client, []byte("ping"))
+		_, err := io.ReadFull(remote, buff)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond * 50)
+	}
+	_, err = remote.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, buff)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buff))
+
+	// and both directions quiet end the session
+	start := time.Now()
+	requireClosed(t, client)
+	require.Less(t, time.Since(start), time.Second*5)
+}
+
+func TestBindMetrics(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	ok := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { ok.Close() })
+	require.NoError(t, ok.Bind("127.0.0.1:0", func(boundAddress string) error {
+		remote, err := net.Dial("tcp", boundAddress)
+		require.NoError(t, err)
+		t.Cleanup(func() { remote.Close() })
+		return nil
+	}))
+
+	mismatch := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { mismatch.Close() })
+	require.Error(t, mismatch.Bind("1.2.3.4:0", func(boundAddress string) error {
+		remote, err := net.Dial("tcp", boundAddress)
+		require.NoError(t, err)
+		t.Cleanup(func() { remote.Close() })
+		return nil
+	}))
+
+	m := s.Metrics()
+	require.EqualValues(t, 2, m.Counter("bind_listeners_opened_total", "").Value())
+	require.EqualValues(t, 2, m.Counter("bind_accepts_total", "").Value())
+	require.EqualValues(t, 1, m.Counter("bind_peer_mismatches_total", "").Value())
+	require.EqualValues(t, 0, m.Counter("bind_accept_timeouts_total", "").Value())
+	require.EqualValues(t, 1, m.Histogram("bind_peer_connect_seconds", "").Count())
+}
+
+func TestSegmentedRequest(t *testing.T) {
+	t.Parallel()
+
+	client := newClient(t)
+	req, err := proto.NewRequest(proto.ConnectCommand, newEchoServer(t), "segmented")
+	require.NoError(t, err)
+
+	packet := req.Serialize()
+	writePacket(t, client, packet[:5])
+	time.Sleep(time.Millisecond * 50)
+	writePacket(t, client, packet[5:])
+
+	reply, err := proto.ReadReply(client)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, reply.Code())
+}
+
+func TestPipelinedData(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	req, err := proto.NewRequest(proto.ConnectCommand, newEchoServer(t), "")
+	require.NoError(t, err)
+	_, err = conn.Write(append(req.Serialize(), "pipelined"...))
+	require.NoError(t, err)
+
+	// the reply and the echo may arrive together
+	got := make([]byte, 8+len("pipelined"))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, got[1])
+	require.Equal(t, "pipelined", string(got[8:]))
+}
+
+// BenchmarkSessionChurn relays a message over a new session each iteration,
+// so its allocations show the cost of setting up and tearing down sessions.
+func BenchmarkSessionChurn(b *testing.B) {
+	s := server.NewServer(zap.NewNop())
+	b.Cleanup(func() { s.Close(context.Background()) })
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(b, err)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	message := []byte("hello")
+	buff := make([]byte, len(message))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := client.NewClient(addr.String(), "")
+		require.NoError(b, c.Connect(ln.Addr().String()))
+		_, err := c.Write(message)
+		require.NoError(b, err)
+		_, err = io.ReadFull(c, buff)
+		require.NoError(b, err)
+		require.NoError(b, c.Close())
+	}
+}
+
+// wrappedDialer dials TCP connections hidden behind another type, so they
+// are relayed through buffers rather than spliced.
+type wrappedDialer struct{}
+
+func (wrappedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ net.Conn }{conn}, nil
+}
+
+// BenchmarkRelayThroughput downloads through a session, spliced between TCP
+// connections or copied through buffers.
+func BenchmarkRelayThroughput(b *testing.B) {
+	const size = 64 * 1024 * 1024
+
+	for name, opts := range map[string][]server.Option{
+		"Splice": nil,
+		"Copy":   {server.WithDialer(wrappedDialer{})},
+	} {
+		b.Run(name, func(b *testing.B) {
+			s := server.NewServer(zap.NewNop(), opts...)
+			b.Cleanup(func() { s.Close(context.Background()) })
+			addr, err := s.ListenAndServe("localhost:0")
+			require.NoError(b, err)
+
+			// a destination sending size bytes for every byte it reads
+			ln, err := net.Listen("tcp", "localhost:0")
+			require.NoError(b, err)
+			b.Cleanup(func() { ln.Close() })
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				data := make([]byte, 1024*1024)
+				for {
+					if _, err := conn.Read(make([]byte, 1)); err != nil {
+						return
+					}
+					for sent := 0; sent < size; sent += len(data) {
+						if _, err := conn.Write(data); err != nil {
+							return
+						}
+					}
+				}
+			}()
+
+			c := client.NewClient(addr.String(), "")
+			b.Cleanup(func() { c.Close() })
+			require.NoError(b, c.Connect(ln.Addr().String()))
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writePacket(b, c, []byte("?"))
+				_, err := io.CopyN(io.Discard, c, size)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
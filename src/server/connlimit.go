@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// reserveConnection blocks until the server is below its connection limit,
+// taking a connection of it for the next one accepted, or returns false if
+// the server closes first.
+func (s *Server) reserveConnection() bool {
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	s.setSaturated(true)
+	s.metrics.Counter("connections_overflowed_total", "Connections beyond the connection limit, by action.", "action", "queued").Inc()
+	select {
+	case s.connSlots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// admitConnection counts conn as open, once it took a connection of the
+// limit unless reserved, or closes conn if the server turns it away or
+// closes while it waits. Admitted connections must be released.
+func (s *Server) admitConnection(conn net.Conn, reserved bool) bool {
+	if s.connSlots == nil || reserved {
+		s.connsOpen.Inc()
+		return true
+	}
+	select {
+	case s.connSlots <- struct{}{}:
+		s.connsOpen.Inc()
+		return true
+	default:
+	}
+
+	s.setSaturated(true)
+	if s.connOverflow == OverflowReject {
+		s.metrics.Counter("connections_overflowed_total", "Connections beyond the connection limit, by action.", "action", "rejected").Inc()
+		s.rejectOverflow(conn)
+		return false
+	}
+
+	s.metrics.Counter("connections_overflowed_total", "Connections beyond the connection limit, by action.", "action", "queued").Inc()
+	select {
+	case s.connSlots <- struct{}{}:
+		s.connsOpen.Inc()
+		return true
+	case <-s.done:
+		conn.Close()
+		return false
+	}
+}
+
+// releaseConnection frees a connection taken with reserveConnection or
+// admitConnection, which is no longer open if admitted.
+func (s *Server) releaseConnection(admitted bool) {
+	if admitted {
+		s.connsOpen.Dec()
+	}
+	if s.connSlots != nil {
+		<-s.connSlots
+		// with some headroom, not to flap while connections are churning
+		if len(s.connSlots) <= cap(s.connSlots)*9/10 {
+			s.setSaturated(false)
+		}
+	}
+}
+
+// setSaturated logs whether the server reached its connection limit or
+// went below it again.
+func (s *Server) setSaturated(saturated bool) {
+	if s.saturated.Swap(saturated) == saturated {
+		return
+	}
+	if saturated {
+		s.log.Warn("connection limit reached", zap.Int("max-connections", s.maxConns))
+	} else {
+		s.log.Info("below connection limit again", zap.Int("max-connections", s.maxConns))
+	}
+}
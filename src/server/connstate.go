@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConnState is a state of a client connection in its lifecycle, reported to
+// the hook given with WithConnState, like net/http's ConnState.
+type ConnState int
+
+const (
+	// The connection was just accepted.
+	StateNew ConnState = iota
+
+	// The client started sending its request, which is being handled.
+	StateHandshaking
+
+	// The request was granted and the session is relaying data.
+	StateActive
+
+	// The session is relaying, but nothing was relayed in either direction
+	// for the idle threshold. It becomes Active again once data flows.
+	StateIdle
+
+	// The session ended and the connection was closed. This is the final
+	// state.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateHandshaking:
+		return "handshaking"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("state(%d)", int(c))
+	}
+}
+
+// setConnState reports the state of sess's client connection.
+func (s *Server) setConnState(sess *session, state ConnState) {
+	sess.stateMu.Lock()
+	defer sess.stateMu.Unlock()
+
+	sess.state.Store(int32(state))
+	if s.connState != nil {
+		s.connState(sess.client, state)
+	}
+}
+
+// swapConnState reports sess's client connection in state to, if it is
+// still in state from.
+func (s *Server) swapConnState(sess *session, from, to ConnState) {
+	sess.stateMu.Lock()
+	defer sess.stateMu.Unlock()
+
+	if sess.state.CompareAndSwap(int32(from), int32(to)) && s.connState != nil {
+		s.connState(sess.client, to)
+	}
+}
+
+// sweepIdle reports relaying sessions Idle once they relayed nothing for
+// the idle threshold, and Active again once they do, checking them all
+// every quarter of the threshold until done is closed.
+func (s *Server) sweepIdle(done <-chan struct{}) {
+	ticker := time.NewTicker(s.connIdleAfter / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, sess := range s.activeSessions() {
+			if sess.target.Load() == nil {
+				// not relaying
+				continue
+			} else if time.Since(sess.lastActivity()) >= s.connIdleAfter {
+				s.swapConnState(sess, StateActive, StateIdle)
+			} else {
+				s.swapConnState(sess, StateIdle, StateActive)
+			}
+		}
+	}
+}
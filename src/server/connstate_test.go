@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnState(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var states []server.ConnState
+	seen := func() []server.ConnState {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]server.ConnState(nil), states...)
+	}
+
+	s := createServer(t, server.WithConnState(func(_ net.Conn, state server.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}, time.Millisecond*50))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	require.Eventually(t, func() bool {
+		return len(seen()) == 4
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, []server.ConnState{server.StateNew, server.StateHandshaking, server.StateActive, server.StateIdle}, seen())
+
+	// data wakes the session, which then ends as the echo server closes
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.NoError(t, err)
+
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+	states = seen()
+	require.Equal(t, server.StateClosed, states[len(states)-1])
+	for _, state := range states[4 : len(states)-1] {
+		require.Contains(t, []server.ConnState{server.StateActive, server.StateIdle}, state)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+// Dialer connects to destinations, like net.Dialer and
+// proxy.ContextDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// defaultFallbackDelay is how long a dial attempt gets before the next
+// address is also tried, as recommended by RFC 8305.
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// dial connects to the first of addrs that answers, through route. When
+// hedging is enabled, another attempt is started (cycling through addrs)
+// whenever the in-flight attempts haven't completed within the hedge delay
+// or one of them fails, up to the configured attempt budget. Otherwise each
+// address is tried once, Happy Eyeballs style, the next starting when the
+// fallback delay passes or an attempt fails. The first successful connection
+// wins and the others are cancelled.
+func (s *Server) dial(ctx context.Context, sess *session, route route, addrs []string) (net.Conn, error) {
+	dialAddr := func(ctx context.Context, addr string) (net.Conn, error) {
+		// checked for each attempt, as each may dial another address
+		source, err := s.checkDestination(sess, addr)
+		if err != nil {
+			return nil, err
+		}
+		if source == "" {
+			source = route.source
+		}
+		d := net.Dialer{}
+		if source != "" {
+			local, err := sourceAddr(source, addr)
+			if err != nil {
+				return nil, err
+			}
+			d.LocalAddr = local
+		}
+
+		if route.upstreams != nil {
+			return s.dialUpstream(ctx, route.upstreams, &d, addr)
+		}
+		return directDialer{s: s, d: &d}.DialContext(ctx, "tcp", addr)
+	}
+
+	delay, attempts := s.hedgeDelay, s.hedgeAttempts
+	if delay <= 0 || attempts <= 1 {
+		if len(addrs) == 1 {
+			return dialAddr(ctx, addrs[0])
+		}
+		delay, attempts = s.fallbackDelay, len(addrs)
+		if delay == 0 {
+			delay = defaultFallbackDelay
+		} else if delay < 0 {
+			// only once an attempt fails
+			delay = math.MaxInt64
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, attempts)
+	started, pending := 0, 0
+	start := func() {
+		addr := addrs[started%len(addrs)]
+		started++
+		pending++
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					results <- dialResult{nil, s.recovered(sess.log, v)}
+				}
+			}()
+			conn, err := dialAddr(ctx, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+
+	var errs []error
+	start()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if started < attempts {
+				start()
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go closeLosers(results, pending)
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if started < attempts && ctx.Err() == nil {
+				start()
+				resetTimer()
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// closeLosers closes connections from attempts that completed after a winner
+// was already chosen.
+func closeLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgedDials(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Connects", func(t *testing.T) {
+		t.Parallel()
+
+		client := newClient(t, server.WithHedgedDials(time.Millisecond, 3))
+		echoServer := newEchoServer(t)
+
+		require.NoError(t, client.Connect(echoServer))
+
+		message := []byte("hello world")
+		writePacket(t, client, message)
+
+		buff := make([]byte, len(message))
+		n, err := client.Read(buff)
+		require.NoError(t, err)
+		require.Equal(t, message, buff[:n])
+	})
+
+	t.Run("BudgetExhausted", func(t *testing.T) {
+		t.Parallel()
+
+		client := newClient(t, server.WithHedgedDials(time.Second, 3))
+
+		start := time.Now()
+		require.Error(t, client.Connect("127.0.0.1:1"))
+		// failures consume the budget without waiting for the hedge delay
+		require.Less(t, time.Since(start), time.Second)
+
+		requireClosed(t, client)
+	})
+}
+
+func TestPipelinedDial(t *testing.T) {
+	t.Parallel()
+
+	// starts a CONNECT to a new listener, sending only the request's header
+	start := func(t *testing.T, opts ...server.Option) (*server.Server, net.Conn, []byte, chan net.Conn) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				t.Cleanup(func() { conn.Close() })
+				accepted <- conn
+			}
+		}()
+
+		s := createServer(t, append(opts, server.WithPipelinedDial())...)
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		req, err := proto.NewRequest(proto.ConnectCommand, ln.Addr().String(), "user")
+		require.NoError(t, err)
+		_, err = conn.Write(req.Serialize()[:8])
+		require.NoError(t, err)
+		return s, conn, req.Serialize()[8:], accepted
+	}
+
+	t.Run("DialsEarly", func(t *testing.T) {
+		t.Parallel()
+
+		s, conn, rest, accepted := start(t)
+		var remote net.Conn
+		select {
+		case remote = <-accepted:
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected a dial before the user ID")
+		}
+
+		_, err := conn.Write(rest)
+		require.NoError(t, err)
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+
+		_, err = remote.Write([]byte("hello"))
+		require.NoError(t, err)
+		buff := make([]byte, 5)
+		_, err = io.ReadFull(conn, buff)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buff))
+		require.EqualValues(t, 1, s.Metrics().Counter("dials_pipelined_total", "").Value())
+	})
+
+	t.Run("Discarded", func(t *testing.T) {
+		t.Parallel()
+
+		s, conn, _, accepted := start(t)
+		remote := <-accepted
+		require.NoError(t, conn.Close())
+
+		requireClosed(t, remote)
+		requireClosedReason(t, s, server.CloseBadRequest)
+		require.EqualValues(t, 1, s.Metrics().Counter("dials_pipelined_discarded_total", "").Value())
+	})
+
+	t.Run("Authenticated", func(t *testing.T) {
+		t.Parallel()
+
+		// nothing is dialed before the authenticator allows the request
+		s, conn, rest, accepted := start(t, server.WithAuthenticator(server.AuthenticatorFunc(
+			func(context.Context, string, string) error { return nil },
+		)))
+		select {
+		case <-accepted:
+			t.Fatal("dialed before the request was authenticated")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		_, err := conn.Write(rest)
+		require.NoError(t, err)
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+		<-accepted
+		require.Zero(t, s.Metrics().Counter("dials_pipelined_total", "").Value())
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		t.Parallel()
+
+		// nor before the user is checked against their quota
+		s, conn, rest, accepted := start(t, server.WithUserQuotas(map[string]int64{"": 1 << 20}, time.Hour))
+		select {
+		case <-accepted:
+			t.Fatal("dialed before the user's quota was checked")
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		_, err := conn.Write(rest)
+		require.NoError(t, err)
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+		<-accepted
+		require.Zero(t, s.Metrics().Counter("dials_pipelined_total", "").Value())
+	})
+}
+
+type pipeDialer struct {
+	dialed chan string
+}
+
+func (d pipeDialer) DialContext(_ context.Context, network, addr string) (net.Conn, error) {
+	d.dialed <- addr
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		io.Copy(remote, remote)
+	}()
+	return local, nil
+}
+
+func TestDialer(t *testing.T) {
+	t.Parallel()
+
+	dialer := pipeDialer{dialed: make(chan string, 1)}
+	client := newClient(t, server.WithDialer(dialer))
+
+	// nothing listens at the destination, the dialer fakes it
+	require.NoError(t, client.Connect("192.0.2.1:7"))
+	require.Equal(t, "192.0.2.1:7", <-dialer.dialed)
+	requireEcho(t, client)
+}
+
+// staticResolver resolves every hostname to its addresses.
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(context.Context, string) ([]net.IP, error) {
+	return r, nil
+}
+
+// blackholeDialer never connects to blackhole, like a destination dropping
+// SYNs, and fakes every other destination with a pipeDialer.
+type blackholeDialer struct {
+	pipeDialer
+	blackhole string
+}
+
+func (d blackholeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr == d.blackhole {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return d.pipeDialer.DialContext(ctx, network, addr)
+}
+
+// refusingDialer refuses connections to refused, and fakes every other
+// destination with a pipeDialer.
+type refusingDialer struct {
+	pipeDialer
+	refused string
+}
+
+func (d refusingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr == d.refused {
+		return nil, syscall.ECONNREFUSED
+	}
+	return d.pipeDialer.DialContext(ctx, network, addr)
+}
+
+func TestFallbackDials(t *testing.T) {
+	t.Parallel()
+
+	connect := func(t *testing.T, opts ...server.Option) net.Conn {
+		resolver := staticResolver{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)}
+		s := createServer(t, append(opts, server.WithResolver(resolver))...)
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(socks4aRequest(proto.ConnectCommand, 7, "multi.test"))
+		require.NoError(t, err)
+		return conn
+	}
+
+	t.Run("Unreachable", func(t *testing.T) {
+		t.Parallel()
+
+		dialer := blackholeDialer{pipeDialer{make(chan string, 2)}, "192.0.2.1:7"}
+		conn := connect(t, server.WithDialer(dialer), server.WithFallbackDelay(50*time.Millisecond))
+
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+		require.Equal(t, "192.0.2.2:7", <-dialer.dialed)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buff := make([]byte, 4)
+		_, err = io.ReadFull(conn, buff)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buff))
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		t.Parallel()
+
+		// the next address is tried as soon as one fails
+		dialer := refusingDialer{pipeDialer{make(chan string, 2)}, "192.0.2.1:7"}
+		start := time.Now()
+		conn := connect(t, server.WithDialer(dialer), server.WithFallbackDelay(-1))
+
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+		require.Equal(t, "192.0.2.2:7", <-dialer.dialed)
+		require.Less(t, time.Since(start), time.Second)
+	})
+}
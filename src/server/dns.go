@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultDNSTimeout = time.Second * 5
+
+// minRecordTTL is the least TTL reported for records, as a TTL of zero,
+// meant to prevent caching, would read as unknown.
+const minRecordTTL = time.Second
+
+// DNSRoute sends lookups for names under Suffix to a specific set of DNS
+// servers. An empty Suffix matches every name.
+type DNSRoute struct {
+	// Domain suffix to match, e.g. "corp" matches "host.corp" and "corp".
+	Suffix string
+
+	// DNS server addresses (host:port), tried in order until one answers.
+	Servers []string
+
+	// Timeout for each server. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// RoutedResolver resolves hostnames using the DNS servers of the route with
+// the longest matching suffix, falling back to the system resolver when no
+// route matches.
+type RoutedResolver struct {
+	routes []DNSRoute
+}
+
+func NewRoutedResolver(routes ...DNSRoute) *RoutedResolver {
+	r := &RoutedResolver{}
+	for _, route := range routes {
+		route.Suffix = strings.ToLower(strings.Trim(route.Suffix, "."))
+		if route.Timeout <= 0 {
+			route.Timeout = defaultDNSTimeout
+		}
+		r.routes = append(r.routes, route)
+	}
+	return r
+}
+
+// LookupIP resolves host to its IPv4 addresses.
+func (r *RoutedResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPTTL is like LookupIP, also returning how long the addresses may
+// be cached: the least TTL of the records from a route's DNS servers, at
+// least a second, or zero if unknown, as with the system resolver.
+func (r *RoutedResolver) LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	route := r.match(host)
+	if route == nil || len(route.Servers) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		return ips, 0, err
+	} else if ip := net.ParseIP(host).To4(); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	var errs []error
+	for _, server := range route.Servers {
+		ips, ttl, err := lookupVia(ctx, server, route.Timeout, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+
+		// an authoritative "no such host" won't change by asking again
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, 0, err
+		}
+		errs = append(errs, fmt.Errorf("%s - %w", server, err))
+	}
+	return nil, 0, fmt.Errorf("all DNS servers failed - %w", errors.Join(errs...))
+}
+
+func (r *RoutedResolver) match(host string) *DNSRoute {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var best *DNSRoute
+	for i := range r.routes {
+		route := &r.routes[i]
+		if route.Suffix != "" && host != route.Suffix && !strings.HasSuffix(host, "."+route.Suffix) {
+			continue
+		}
+		if best == nil || len(route.Suffix) > len(best.Suffix) {
+			best = route
+		}
+	}
+	return best
+}
+
+// lookupVia queries server for the A records of host over UDP, or TCP if
+// the answer doesn't fit a datagram.
+func lookupVia(ctx context.Context, server string, timeout time.Duration, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid hostname - %w", err)
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, &query)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeDNS(ctx, "tcp", server, &query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	notFound := &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFound
+	default:
+		return nil, 0, &net.DNSError{Err: resp.RCode.String(), Name: host, Server: server}
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for _, answer := range resp.Answers {
+		a, ok := answer.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		ips = append(ips, net.IP(a.A[:]).To4())
+		if recordTTL := time.Duration(answer.Header.TTL) * time.Second; len(ips) == 1 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, notFound
+	} else if ttl < minRecordTTL {
+		ttl = minRecordTTL
+	}
+	return ips, ttl, nil
+}
+
+// exchangeDNS sends query to server over network and returns its answer.
+func exchangeDNS(ctx context.Context, network, server string, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query - %w", err)
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		// messages over TCP are prefixed with their length
+		packed = append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 0xffff)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("failed to unpack answer - %w", err)
+	} else if resp.ID != query.ID || !resp.Response {
+		return nil, errors.New("answer doesn't match the query")
+	}
+	return &resp, nil
+}
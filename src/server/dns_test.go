@@ -0,0 +1,235 @@
+package server_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDNSServer answers every query with an A record for ip.
+func newDNSServer(t *testing.T, ip net.IP) string {
+	t.Helper()
+	return newDNSServerTTL(t, ip, 60)
+}
+
+// newDNSServerTTL answers every query with ip, with a TTL of ttl seconds.
+func newDNSServerTTL(t *testing.T, ip net.IP, ttl uint32) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buff := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buff)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if !assert.NoError(t, err) {
+				// require can't stop the test from another goroutine
+				return
+			}
+
+			// skip the header and question name to the end of the question
+			end := 12
+			for end < n && buff[end] != 0 {
+				end += int(buff[end]) + 1
+			}
+			end += 5
+
+			resp := append([]byte{}, buff[:end]...)
+			binary.BigEndian.PutUint16(resp[2:4], 0x8180) // response, no error
+			binary.BigEndian.PutUint16(resp[4:6], 1)      // questions
+			binary.BigEndian.PutUint16(resp[6:8], 1)      // answers
+			binary.BigEndian.PutUint32(resp[8:12], 0)     // authority & additional
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1)
+			resp = binary.BigEndian.AppendUint32(resp, ttl)
+			resp = append(resp, 0, 4)
+			resp = append(resp, ip.To4()...)
+
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func deadDNSServer(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+	return addr
+}
+
+func TestRoutedResolver(t *testing.T) {
+	t.Parallel()
+
+	internal := newDNSServer(t, net.IPv4(10, 0, 0, 1))
+	public := newDNSServer(t, net.IPv4(1, 2, 3, 4))
+	dead := deadDNSServer(t)
+
+	r := server.NewRoutedResolver(
+		server.DNSRoute{Servers: []string{public}},
+		server.DNSRoute{Suffix: ".corp", Servers: []string{dead, internal}, Timeout: time.Second},
+		server.DNSRoute{Suffix: "dead.corp", Servers: []string{dead}, Timeout: time.Second},
+	)
+
+	for host, want := range map[string]net.IP{
+		"wiki.corp":    net.IPv4(10, 0, 0, 1),
+		"CORP.":        net.IPv4(10, 0, 0, 1),
+		"example.com":  net.IPv4(1, 2, 3, 4),
+		"notcorp":      net.IPv4(1, 2, 3, 4),
+		"a.b.corp.com": net.IPv4(1, 2, 3, 4),
+	} {
+		ips, err := r.LookupIP(context.Background(), host)
+		require.NoError(t, err, host)
+		require.Len(t, ips, 1, host)
+		require.True(t, want.Equal(ips[0]), host)
+	}
+
+	_, err := r.LookupIP(context.Background(), "host.dead.corp")
+	require.ErrorContains(t, err, "all DNS servers failed")
+}
+
+func TestRoutedResolverDefault(t *testing.T) {
+	t.Parallel()
+
+	r := server.NewRoutedResolver()
+
+	ips, err := r.LookupIP(context.Background(), "127.0.0.1")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.True(t, net.IPv4(127, 0, 0, 1).Equal(ips[0]))
+}
+
+// countingResolver resolves every hostname to ip, or fails for "fail.test",
+// counting its lookups.
+type countingResolver struct {
+	ip      net.IP
+	lookups atomic.Int64
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	if host == "fail.test" {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IP{r.ip}, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	t.Parallel()
+
+	r := &countingResolver{ip: net.IPv4(1, 2, 3, 4)}
+	cache := server.NewCachingResolver(r, 2, time.Minute)
+
+	for _, host := range []string{"a.test", "A.TEST", "a.test."} {
+		ips, err := cache.LookupIP(context.Background(), host)
+		require.NoError(t, err)
+		require.Equal(t, []net.IP{r.ip}, ips)
+
+		// callers get their own copy
+		ips[0] = nil
+	}
+	require.EqualValues(t, 1, r.lookups.Load())
+
+	// the least recently used hostname is evicted
+	cache.LookupIP(context.Background(), "b.test")
+	cache.LookupIP(context.Background(), "a.test")
+	cache.LookupIP(context.Background(), "c.test")
+	require.Equal(t, 2, cache.Len())
+	require.EqualValues(t, 3, r.lookups.Load())
+	cache.LookupIP(context.Background(), "a.test")
+	require.EqualValues(t, 3, r.lookups.Load())
+	cache.LookupIP(context.Background(), "b.test")
+	require.EqualValues(t, 4, r.lookups.Load())
+
+	// failures aren't cached
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupIP(context.Background(), "fail.test")
+		require.Error(t, err)
+	}
+	require.EqualValues(t, 6, r.lookups.Load())
+}
+
+func TestCachingResolverExpiry(t *testing.T) {
+	t.Parallel()
+
+	r := &countingResolver{ip: net.IPv4(1, 2, 3, 4)}
+	cache := server.NewCachingResolver(r, 10, 50*time.Millisecond)
+
+	cache.LookupIP(context.Background(), "a.test")
+	cache.LookupIP(context.Background(), "a.test")
+	require.EqualValues(t, 1, r.lookups.Load())
+
+	time.Sleep(100 * time.Millisecond)
+	cache.LookupIP(context.Background(), "a.test")
+	require.EqualValues(t, 2, r.lookups.Load())
+}
+
+func TestCachingResolverRecordTTL(t *testing.T) {
+	t.Parallel()
+
+	dns := newDNSServer(t, net.IPv4(10, 0, 0, 1))
+	r := server.NewRoutedResolver(server.DNSRoute{Suffix: "test", Servers: []string{dns}})
+
+	ips, ttl, err := r.LookupIPTTL(context.Background(), "a.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.Equal(t, time.Minute, ttl)
+
+	// IP literals carry no TTL
+	_, ttl, err = r.LookupIPTTL(context.Background(), "127.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, ttl)
+
+	cache := server.NewCachingResolver(r, 10, time.Hour)
+	ips, err = cache.LookupIP(context.Background(), "a.test")
+	require.NoError(t, err)
+	require.True(t, net.IPv4(10, 0, 0, 1).Equal(ips[0]))
+	require.Equal(t, 1, cache.Len())
+
+	// a TTL of zero is cached as briefly as possible, not as unknown
+	zero := newDNSServerTTL(t, net.IPv4(10, 0, 0, 2), 0)
+	r = server.NewRoutedResolver(server.DNSRoute{Suffix: "test", Servers: []string{zero}})
+	_, ttl, err = r.LookupIPTTL(context.Background(), "a.test")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, ttl)
+}
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	r := &countingResolver{ip: net.IPv4(127, 0, 0, 1)}
+	s := createServer(t, server.WithResolver(server.NewCachingResolver(r, 10, time.Minute)))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(socks4aRequest(proto.ConnectCommand, portOf(t, echoServer), "echo.test"))
+		require.NoError(t, err)
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+	}
+	require.EqualValues(t, 1, r.lookups.Load())
+}
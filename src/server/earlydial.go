@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"socks4/proto"
+	"strconv"
+	"time"
+)
+
+// earlyDial is a CONNECT dial started from a request's header, while the
+// rest of the request was still arriving.
+type earlyDial struct {
+	addr   string
+	cancel context.CancelFunc
+	done   chan dialResult
+}
+
+// startEarlyDial starts dialing the destination of a SOCKS4 CONNECT as soon
+// as the request's header is buffered, overlapping the dial with reading
+// the user ID. It only does so when nothing that decides on the request
+// depends on the user or the client's identity.
+func (s *Server) startEarlyDial(sess *session, deadline time.Time) {
+	if !s.pipelinedDial || sess.rules.Authenticator != nil || sess.rules.DestinationFilter != nil ||
+		sess.rules.hasACL() || s.identity != nil || s.verifier != nil || len(s.hooks) != 0 ||
+		len(s.userRoutes) != 0 || s.quotas != nil {
+		return
+	}
+
+	// sniff already buffered the header
+	header, err := sess.in.Peek(8)
+	if err != nil || header[1] != proto.ConnectCommand {
+		return
+	}
+	port := int(binary.BigEndian.Uint16(header[2:4]))
+	addr := net.JoinHostPort(net.IP(header[4:8]).String(), strconv.Itoa(port))
+
+	ctx, cancel := context.WithDeadline(sess.ctx, s.dialDeadline(deadline))
+	e := &earlyDial{addr: addr, cancel: cancel, done: make(chan dialResult, 1)}
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				e.done <- dialResult{nil, s.recovered(sess.log, v)}
+			}
+		}()
+		// the user ID is still being read, and without user routes
+		// everyone's is the default
+		conn, err := s.dial(ctx, sess, s.route(""), []string{addr})
+		e.done <- dialResult{conn, err}
+	}()
+	sess.early = e
+	s.metrics.Counter("dials_pipelined_total", "CONNECT dials started before the request was read in full.").Inc()
+}
+
+// takeEarlyDial returns the result of the session's early dial if it was to
+// addrs, the destination of the request as read in full.
+func (s *Server) takeEarlyDial(sess *session, addrs []string) (dialResult, bool) {
+	e := sess.early
+	if e == nil || len(addrs) != 1 || addrs[0] != e.addr {
+		return dialResult{}, false
+	}
+	sess.early = nil
+
+	res := <-e.done
+	e.cancel()
+	return res, true
+}
+
+// discardEarlyDial abandons an early dial the handshake didn't use.
+func (s *Server) discardEarlyDial(sess *session) {
+	e := sess.early
+	if e == nil {
+		return
+	}
+	sess.early = nil
+
+	s.metrics.Counter("dials_pipelined_discarded_total", "Pipelined CONNECT dials whose request didn't use them.").Inc()
+	e.cancel()
+	go func() {
+		if res := <-e.done; res.conn != nil {
+			res.conn.Close()
+		}
+	}()
+}
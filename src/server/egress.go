@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// Egress places the proxy's outbound connections on Linux in a network
+// namespace or net_cls cgroup, so that existing namespace routing or tc
+// shaping applies to proxied traffic. Each dial then runs on an OS thread
+// of its own, which is discarded afterwards.
+type Egress struct {
+	// Path of a network namespace, e.g. /var/run/netns/egress.
+	Namespace string
+
+	// Path of a cgroup v1 net_cls cgroup, e.g.
+	// /sys/fs/cgroup/net_cls/proxy, whose classid tags outbound sockets.
+	Cgroup string
+}
+
+func (e Egress) enabled() bool {
+	return e.Namespace != "" || e.Cgroup != ""
+}
+
+// dialEgress dials addr with d from within the server's egress namespace
+// and cgroup.
+func (s *Server) dialEgress(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := s.egress.dial(ctx, d, addr)
+		ch <- result{conn, err}
+	}()
+	res := <-ch
+	return res.conn, res.err
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// dial dials addr after moving the calling thread into the egress namespace
+// and cgroup. The thread is never unlocked, so it exits along with the
+// calling goroutine rather than running other goroutines from there.
+func (e Egress) dial(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	runtime.LockOSThread()
+
+	if e.Namespace != "" {
+		ns, err := os.Open(e.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open egress namespace - %w", err)
+		}
+		err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET)
+		ns.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to enter egress namespace - %w", err)
+		}
+	}
+
+	if e.Cgroup != "" {
+		tid := strconv.Itoa(unix.Gettid())
+		if err := os.WriteFile(filepath.Join(e.Cgroup, "tasks"), []byte(tid), 0); err != nil {
+			return nil, fmt.Errorf("failed to join egress cgroup - %w", err)
+		}
+	}
+
+	// sockets take their namespace and classid from the thread creating them
+	return d.DialContext(ctx, "tcp", addr)
+}
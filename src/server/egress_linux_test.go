@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEgress(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MissingNamespace", func(t *testing.T) {
+		t.Parallel()
+
+		c := newClient(t, server.WithEgress(server.Egress{Namespace: "/nonexistent/netns"}))
+		require.ErrorIs(t, c.Connect(newEchoServer(t)), client.ErrRejected)
+		requireClosed(t, c)
+	})
+
+	t.Run("OwnNamespace", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithEgress(server.Egress{Namespace: "/proc/self/ns/net"}))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		err = c.Connect(newEchoServer(t))
+		if errors.Is(err, client.ErrRejected) && !canSetns() {
+			t.Skip("entering a network namespace requires CAP_SYS_ADMIN")
+		}
+		require.NoError(t, err)
+		requireEcho(t, c)
+	})
+}
+
+// canSetns reports whether the test may enter network namespaces.
+func canSetns() bool {
+	var data unix.CapUserData
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if err := unix.Capget(&hdr, &data); err != nil {
+		return false
+	}
+	return data.Effective&(1<<unix.CAP_SYS_ADMIN) != 0
+}
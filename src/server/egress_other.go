@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func (e Egress) dial(context.Context, *net.Dialer, string) (net.Conn, error) {
+	return nil, errors.New("egress namespaces and cgroups are only supported on Linux")
+}
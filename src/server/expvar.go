@@ -0,0 +1,43 @@
+package server
+
+import (
+	"expvar"
+)
+
+// Expvar returns a variable reporting basic counters of the server, for
+// deployments that don't scrape its metrics, e.g. to publish with
+// expvar.Publish:
+//
+//	connections_total   clients connected since the server started
+//	connections_active  sessions that haven't ended yet
+//	bytes_relayed       bytes relayed "out" to and "in" from destinations
+//	errors              sessions ended other than by EOF, by close reason
+func (s *Server) Expvar() expvar.Var {
+	return expvar.Func(func() any {
+		// sessions add to the totals under the lock as they end
+		s.sessionsMu.Lock()
+		active := len(s.sessions)
+		out, in := s.bytesOut.Load(), s.bytesIn.Load()
+		for _, sess := range s.sessions {
+			out += sess.sent.Load()
+			in += sess.received.Load()
+		}
+		s.sessionsMu.Unlock()
+
+		errs := make(map[CloseReason]int64)
+		s.endedMu.Lock()
+		for reason, n := range s.ended {
+			if reason != CloseClientEOF && reason != CloseRemoteEOF {
+				errs[reason] = n
+			}
+		}
+		s.endedMu.Unlock()
+
+		return map[string]any{
+			"connections_total":  s.lastSessionID.Load(),
+			"connections_active": active,
+			"bytes_relayed":      map[string]int64{"out": out, "in": in},
+			"errors":             errs,
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultFlowInterval = time.Minute
+
+// FlowRecord reports the traffic of one session since its previous record,
+// in the spirit of NetFlow/IPFIX flow records. Records are written as one
+// JSON object per line.
+type FlowRecord struct {
+	Time    time.Time `json:"time"`
+	Session uint64    `json:"session"`
+	Src     string    `json:"src"`
+	Dst     string    `json:"dst"`
+	User    string    `json:"user,omitempty"`
+
+	// Bytes relayed from the client to the destination
+	BytesOut int64 `json:"bytes_out"`
+
+	// Bytes relayed from the destination to the client
+	BytesIn int64 `json:"bytes_in"`
+
+	// Set on the last record of a session
+	Final bool `json:"final,omitempty"`
+}
+
+type flowCounts struct {
+	out, in int64
+}
+
+// flowExporter periodically writes a FlowRecord for each relaying session.
+type flowExporter struct {
+	w        io.Writer
+	interval time.Duration
+
+	mu       sync.Mutex
+	reported map[uint64]flowCounts
+}
+
+func newFlowExporter(w io.Writer, interval time.Duration) *flowExporter {
+	if interval <= 0 {
+		interval = defaultFlowInterval
+	}
+	return &flowExporter{w: w, interval: interval, reported: make(map[uint64]flowCounts)}
+}
+
+// run exports records for the server's sessions every interval until done
+// is closed.
+func (f *flowExporter) run(s *Server, done <-chan struct{}) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, sess := range s.activeSessions() {
+			f.export(s.log, sess, false)
+		}
+	}
+}
+
+// export writes a record of sess's traffic since its last record. Sessions
+// that never started relaying, periodic records without traffic, and any
+// record after the final one, are skipped.
+func (f *flowExporter) export(log *zap.Logger, sess *session, final bool) {
+	target := sess.target.Load()
+	if target == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sess.flowDone {
+		// a periodic export that raced with the session's removal
+		return
+	}
+	now := flowCounts{out: sess.sent.Load(), in: sess.received.Load()}
+	last := f.reported[sess.id]
+	if final {
+		sess.flowDone = true
+		delete(f.reported, sess.id)
+	} else if now == last {
+		return
+	} else {
+		f.reported[sess.id] = now
+	}
+
+	record, err := json.Marshal(FlowRecord{
+		Time:     time.Now().UTC(),
+		Session:  sess.id,
+		Src:      sess.remote.String(),
+		Dst:      (*target).String(),
+		User:     sess.user,
+		BytesOut: now.out - last.out,
+		BytesIn:  now.in - last.in,
+		Final:    final,
+	})
+	if err != nil {
+		log.Error("failed to encode flow record", zap.Error(err))
+		return
+	}
+
+	// one write per record, so each is a single datagram for UDP collectors
+	if _, err := f.w.Write(append(record, '\n')); err != nil {
+		log.Warn("failed to export flow record", zap.Error(err))
+	}
+}
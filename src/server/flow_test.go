@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordWriter collects flow records, one per Write.
+type recordWriter chan server.FlowRecord
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	var record server.FlowRecord
+	if err := json.Unmarshal(p, &record); err != nil {
+		return 0, err
+	}
+	w <- record
+	return len(p), nil
+}
+
+func TestFlowRecords(t *testing.T) {
+	t.Parallel()
+
+	records := make(recordWriter, 16)
+	c := newClient(t, server.WithFlowRecords(records, 50*time.Millisecond))
+	echoServer := newEchoServer(t)
+	require.NoError(t, c.Connect(echoServer))
+
+	msg := []byte("hello flows")
+	_, err := c.Write(msg)
+	require.NoError(t, err)
+	_, err = c.Read(make([]byte, len(msg)))
+	require.NoError(t, err)
+
+	// the echo server hangs up after one echo, ending the session
+	var out, in int64
+	for {
+		select {
+		case record := <-records:
+			require.Equal(t, c.LocalAddr().String(), record.Src)
+			require.Equal(t, echoServer, record.Dst)
+			out += record.BytesOut
+			in += record.BytesIn
+			if !record.Final {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no final flow record for the session")
+		}
+		break
+	}
+	require.EqualValues(t, len(msg), out)
+	require.EqualValues(t, len(msg), in)
+}
@@ -0,0 +1,65 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func FuzzRequest(f *testing.F) {
+	for _, c := range proto.FuzzCorpus().Requests {
+		f.Add(c.Data)
+	}
+
+	// every request is refused once read, so nothing is dialed or bound
+	s := server.NewServer(zap.NewNop(),
+		server.WithProtocols(server.ProtocolSOCKS4, server.ProtocolSOCKS4a),
+		server.WithAuthenticator(server.AuthenticatorFunc(func(context.Context, string, string) error {
+			return errors.New("denied")
+		})),
+	)
+	f.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Close(ctx)
+	})
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		// the server ends every session, whatever it was sent, resetting
+		// it if data was left unread
+		resp, readErr := io.ReadAll(conn)
+
+		if req, ok := proto.ParseRequest(data); ok {
+			require.NoError(t, readErr)
+			require.Equal(t, proto.NewReply(proto.RejectedFailed, req.IP(), req.Port()).Serialize(), resp)
+			return
+		}
+		if readErr != nil {
+			require.ErrorIs(t, readErr, syscall.ECONNRESET)
+		}
+		if len(resp) >= 2 {
+			require.NotEqual(t, proto.SuccessReply, resp[1])
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"socks4/proto"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Overflow selects what happens to a connection accepted while every
+// client handler is busy, or while the server is at its connection limit.
+// See WithMaxHandlers and WithMaxConnections.
+type Overflow int
+
+const (
+	// The connection waits until it can be handled, and further
+	// connections wait in the listen backlog.
+	OverflowQueue Overflow = iota
+
+	// The connection is sent a SOCKS4 rejection (91) reply and closed,
+	// without its request being read.
+	OverflowReject
+)
+
+// Maximum time to spend writing the reply to a connection turned away
+const overflowReplyTimeout = time.Second
+
+// acquireHandler takes a client handler for conn, which must be released
+// once conn was handled, or closes conn if the server turns it away or
+// closes while it waits.
+func (s *Server) acquireHandler(conn net.Conn) bool {
+	if s.handlerSlots == nil {
+		return true
+	}
+	select {
+	case s.handlerSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if s.handlerOverflow == OverflowReject {
+		s.metrics.Counter("handlers_overflowed_total", "Connections accepted while every handler was busy, by action.", "action", "rejected").Inc()
+		s.rejectOverflow(conn)
+		return false
+	}
+
+	s.metrics.Counter("handlers_overflowed_total", "Connections accepted while every handler was busy, by action.", "action", "queued").Inc()
+	select {
+	case s.handlerSlots <- struct{}{}:
+		return true
+	case <-s.done:
+		conn.Close()
+		return false
+	}
+}
+
+// rejectOverflow sends conn a rejection reply, without reading its request,
+// and closes it.
+func (s *Server) rejectOverflow(conn net.Conn) {
+	reply := proto.NewReply(proto.RejectedFailed, net.IPv4zero, 0).Serialize()
+	if err := proto.WriteFull(conn, reply, overflowReplyTimeout); err != nil {
+		s.log.Debug("failed to reject connection", zap.Stringer("client", conn.RemoteAddr()), zap.Error(err))
+	}
+	conn.Close()
+}
+
+// releaseHandler frees a client handler taken with acquireHandler.
+func (s *Server) releaseHandler() {
+	if s.handlerSlots != nil {
+		<-s.handlerSlots
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"socks4/metrics"
+	"time"
+)
+
+// hibernation releases the relay buffers of directions of sessions that go
+// quiet, so mostly idle tunnels cost little more than their connections.
+type hibernation struct {
+	after time.Duration
+
+	hibernating *metrics.Gauge
+	total       *metrics.Counter
+}
+
+func newHibernation(after time.Duration, m *metrics.Registry) *hibernation {
+	return &hibernation{
+		after:       after,
+		hibernating: m.Gauge("relays_hibernating", "Relay directions waiting for data without a buffer."),
+		total:       m.Counter("relay_hibernations_total", "Relay directions that released their buffer after going idle."),
+	}
+}
+
+// read reads from reader into *buffer, whose read deadline is the end of
+// the idle timeout. If nothing arrives within the hibernation threshold,
+// the buffer is returned to buffers and the next byte awaited without one;
+// a buffer is taken from buffers again once data arrives. *buffer is nil
+// while hibernating. Reads stop early once relay is closed.
+func (h *hibernation) read(reader net.Conn, buffer *[]byte, buffers *bufferPool, relay *gate, deadline time.Time) (int, error) {
+	if h == nil || time.Until(deadline) <= h.after {
+		if *buffer == nil {
+			*buffer = buffers.get()
+		}
+		return reader.Read(*buffer)
+	}
+
+	if *buffer != nil {
+		if err := reader.SetReadDeadline(time.Now().Add(h.after)); err != nil {
+			return 0, err
+		} else if relay.closed() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		n, err := reader.Read(*buffer)
+		if !errors.Is(err, os.ErrDeadlineExceeded) || relay.closed() {
+			return n, err
+		}
+		buffers.put(*buffer)
+		*buffer = nil
+		h.total.Inc()
+	}
+
+	if err := reader.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	} else if relay.closed() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	var first [1]byte
+	h.hibernating.Inc()
+	n, err := reader.Read(first[:])
+	h.hibernating.Dec()
+	if n == 0 {
+		return 0, err
+	}
+
+	*buffer = buffers.get()
+	(*buffer)[0] = first[0]
+	return n, err
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"socks4/proto"
+)
+
+// ErrRejected is returned for connections and requests a hook rejected.
+var ErrRejected = errors.New("rejected by hook")
+
+// Request is a client's request as hooks see it.
+type Request struct {
+	Session  uint64
+	Client   net.Addr
+	Protocol Protocol
+	User     string
+	Command  proto.Command
+
+	// The destination, where Hostname is set if the proxy resolves it
+	IP       net.IP
+	Hostname string
+	Port     int
+}
+
+// Hooks are called at points of the lifecycle of every session, to extend
+// the server without changing how it handles clients. Any of them may be
+// nil. Hooks are called on the session's goroutine, so they hold up its
+// handshake until they return.
+type Hooks struct {
+	// Called with each accepted connection before anything is read from
+	// it. An error closes the connection.
+	OnAccept func(conn net.Conn) error
+
+	// Called with each request once its client is authenticated, before
+	// it is carried out. It may rewrite the destination; an error rejects
+	// the request.
+	OnRequest func(req *Request) error
+
+	// Called once the destination of a CONNECT, or the peer of a BIND, is
+	// connected, before the client is replied to. It returns the
+	// connection to relay with, e.g. remote wrapped; an error rejects the
+	// request.
+	OnDialed func(req *Request, remote net.Conn) (net.Conn, error)
+
+	// Called after the client was replied to, with the cause of the
+	// failure of its request or nil if it was granted.
+	OnReply func(req *Request, cause error)
+
+	// Called once the session ended, with its traffic and why it ended.
+	OnClose func(stats SessionStats, reason CloseReason)
+}
+
+// acceptHooks runs the OnAccept hooks.
+func (s *Server) acceptHooks(conn net.Conn) error {
+	for _, h := range s.hooks {
+		if h.OnAccept == nil {
+			continue
+		}
+		if err := h.OnAccept(conn); err != nil {
+			return fmt.Errorf("connection %w - %w", ErrRejected, err)
+		}
+	}
+	return nil
+}
+
+// requestHooks runs the OnRequest hooks for req, applying any changes to
+// its destination, and keeps what they saw for the later hooks.
+func (s *Server) requestHooks(sess *session, protocol Protocol, req *request) error {
+	if len(s.hooks) == 0 {
+		return nil
+	}
+
+	hookReq := &Request{
+		Session:  sess.id,
+		Client:   sess.remote,
+		Protocol: protocol,
+		User:     sess.user,
+		Command:  req.command,
+		IP:       req.ip,
+		Hostname: req.hostname,
+		Port:     req.port,
+	}
+	sess.request = hookReq
+	for _, h := range s.hooks {
+		if h.OnRequest == nil {
+			continue
+		}
+		if err := h.OnRequest(hookReq); err != nil {
+			return fmt.Errorf("request %w - %w", ErrRejected, err)
+		}
+	}
+	req.ip, req.hostname, req.port = hookReq.IP, hookReq.Hostname, hookReq.Port
+	return nil
+}
+
+// dialedHooks runs the OnDialed hooks for remote, returning the connection
+// to relay with.
+func (s *Server) dialedHooks(sess *session, remote net.Conn) (net.Conn, error) {
+	for _, h := range s.hooks {
+		if h.OnDialed == nil {
+			continue
+		}
+		conn, err := h.OnDialed(sess.request, remote)
+		if err != nil {
+			return nil, fmt.Errorf("remote %w - %w", ErrRejected, err)
+		}
+		remote = conn
+	}
+	return remote, nil
+}
+
+// replyHooks runs the OnReply hooks, if the request went through the
+// OnRequest hooks.
+func (s *Server) replyHooks(sess *session, cause error) {
+	if sess.request == nil {
+		return
+	}
+	for _, h := range s.hooks {
+		if h.OnReply != nil {
+			h.OnReply(sess.request, cause)
+		}
+	}
+}
+
+// closeHooks runs the OnClose hooks.
+func (s *Server) closeHooks(sess *session) {
+	for _, h := range s.hooks {
+		if h.OnClose != nil {
+			h.OnClose(sess.stats(), sess.reason)
+		}
+	}
+}
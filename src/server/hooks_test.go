@@ -0,0 +1,156 @@
+package server_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		t.Parallel()
+
+		echoServer := newEchoServer(t)
+		var calls []string
+		var written atomic.Int64
+		closed := make(chan server.SessionStats, 1)
+		s := createServer(t, server.WithHooks(server.Hooks{
+			OnAccept: func(net.Conn) error {
+				calls = append(calls, "accept")
+				return nil
+			},
+			OnRequest: func(req *server.Request) error {
+				calls = append(calls, "request")
+				require.Equal(t, server.ProtocolSOCKS4, req.Protocol)
+				require.Equal(t, "user", req.User)
+				require.Equal(t, 1, req.Port)
+
+				// redirected to the echo server
+				req.Port = portOf(t, echoServer)
+				return nil
+			},
+			OnDialed: func(req *server.Request, remote net.Conn) (net.Conn, error) {
+				calls = append(calls, "dialed")
+				return countingConn{Conn: remote, written: &written}, nil
+			},
+			OnReply: func(req *server.Request, cause error) {
+				calls = append(calls, "reply")
+				require.NoError(t, cause)
+			},
+			OnClose: func(stats server.SessionStats, reason server.CloseReason) {
+				calls = append(calls, "close")
+				require.Equal(t, server.CloseRemoteEOF, reason)
+				closed <- stats
+			},
+		}))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		c := client.NewClient(addr.String(), "user")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect("127.0.0.1:1"))
+		requireEcho(t, c)
+
+		stats := <-closed
+		require.EqualValues(t, 4, stats.BytesOut)
+		require.EqualValues(t, 4, written.Load())
+		require.Equal(t, []string{"accept", "request", "dialed", "reply", "close"}, calls)
+	})
+
+	t.Run("RejectAccept", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithHooks(server.Hooks{
+			OnAccept: func(net.Conn) error { return errors.New("not today") },
+		}))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		requireClosed(t, conn)
+		requireClosedReason(t, s, server.CloseRejected)
+	})
+
+	t.Run("RejectRequest", func(t *testing.T) {
+		t.Parallel()
+
+		replied := make(chan error, 1)
+		s := createServer(t, server.WithHooks(server.Hooks{
+			OnRequest: func(*server.Request) error { return errors.New("not there") },
+			OnReply:   func(_ *server.Request, cause error) { replied <- cause },
+		}))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, c.Connect(newEchoServer(t)), &replyErr)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+
+		select {
+		case cause := <-replied:
+			require.ErrorIs(t, cause, server.ErrRejected)
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected the rejection to be replied")
+		}
+		requireClosedReason(t, s, server.CloseRejected)
+	})
+	t.Run("Panic", func(t *testing.T) {
+		t.Parallel()
+
+		var requests atomic.Int64
+		s := createServer(t, server.WithHooks(server.Hooks{
+			OnRequest: func(*server.Request) error {
+				if requests.Add(1) == 1 {
+					panic("hook bug")
+				}
+				return nil
+			},
+		}))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.Error(t, c.Connect(echoServer))
+		requireClosedReason(t, s, server.ClosePanic)
+		require.EqualValues(t, 1, s.Metrics().Counter("panics_total", "").Value())
+
+		// the server survives to serve the next client
+		c = client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+		_, err = c.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+	})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"socks4/proto"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readHTTP reads an HTTP CONNECT request, authenticating the client with
+// the credentials of its Proxy-Authorization header when the policy has an
+// Authenticator. It returns nil if the session ended instead.
+func (s *Server) readHTTP(sess *session, deadline time.Time) *request {
+	msg, err := http.ReadRequest(sess.in)
+	sess.client.SetReadDeadline(deadline)
+	if err != nil {
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read request - %w", err))
+		writeHTTPStatus(sess.client, http.StatusBadRequest, nil)
+		return nil
+	} else if msg.Method != http.MethodConnect {
+		sess.end(CloseBadRequest, fmt.Errorf("unsupported method %s", msg.Method))
+		writeHTTPStatus(sess.client, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(msg.Host)
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || portErr != nil || port <= 0 || port > 0xffff {
+		sess.end(CloseBadRequest, fmt.Errorf("invalid destination %q", msg.Host))
+		writeHTTPStatus(sess.client, http.StatusBadRequest, nil)
+		return nil
+	}
+
+	req := &request{command: proto.ConnectCommand, port: port, reply: httpReplier{conn: sess.client}}
+	if ip := net.ParseIP(host); ip != nil {
+		req.ip = ip
+	} else {
+		req.hostname = host
+	}
+	sess.log.Info("http connect request", zap.String("destination", msg.Host))
+
+	username, password, hasAuth := proxyAuth(msg)
+	if sess.rules.Authenticator != nil && !hasAuth {
+		sess.end(CloseUnauthorized, errors.New("missing proxy credentials"))
+		writeHTTPStatus(sess.client, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}})
+		return nil
+	}
+
+	if err := s.identify(sess, deadline, username); err != nil {
+		sess.end(CloseUnauthorized, fmt.Errorf("failed to identify client - %w", err))
+		s.sendError(sess, req, err)
+		return nil
+	}
+	if err := s.authenticatePassword(sess, deadline, password); err != nil {
+		sess.end(CloseUnauthorized, fmt.Errorf("request not authorized for %q - %w", sess.user, err))
+		s.sendError(sess, req, err)
+		return nil
+	}
+	return req
+}
+
+// proxyAuth returns the Basic credentials of the Proxy-Authorization
+// header.
+func proxyAuth(msg *http.Request) (username, password string, ok bool) {
+	auth := &http.Request{Header: http.Header{"Authorization": msg.Header.Values("Proxy-Authorization")}}
+	return auth.BasicAuth()
+}
+
+// httpReplier answers HTTP CONNECT requests.
+type httpReplier struct {
+	conn net.Conn
+}
+
+func (r httpReplier) bound(net.IP, int) error {
+	return errors.New("http proxy clients can't bind")
+}
+
+func (r httpReplier) granted(net.Conn) error {
+	return writeHTTPStatus(r.conn, http.StatusOK, nil)
+}
+
+func (r httpReplier) failed(cause error) error {
+	return writeHTTPStatus(r.conn, httpStatus(cause), nil)
+}
+
+// httpStatus returns the status for a request that failed with err.
+func httpStatus(err error) int {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrNoIdentd), errors.Is(err, ErrIdentMismatch),
+		errors.Is(err, errQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &dnsErr),
+		errors.Is(err, errRemoteClosedEarly), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeHTTPStatus(conn net.Conn, status int, header http.Header) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	for key, values := range header {
+		for _, value := range values {
+			resp += key + ": " + value + "\r\n"
+		}
+	}
+	if status != http.StatusOK {
+		resp += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	if err := proto.WriteFull(conn, []byte(resp+"\r\n"), replyTimeout); err != nil {
+		return fmt.Errorf("failed to write to client - %w", err)
+	}
+	return nil
+}
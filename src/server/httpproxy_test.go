@@ -0,0 +1,99 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// httpConnect sends an HTTP CONNECT request with the given extra header
+// lines, returning the connection and the proxy's response.
+func httpConnect(t *testing.T, addr, dest, header string) (net.Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", dest, dest, header)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	return conn, resp
+}
+
+func TestHTTPConnect(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	conn, resp := httpConnect(t, addr.String(), echoServer, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireEcho(t, conn)
+
+	_, resp = httpConnect(t, addr.String(), "localhost:0", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	conn, err = net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", echoServer, echoServer)
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHTTPConnectAuth(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("secret")))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	_, resp := httpConnect(t, addr.String(), echoServer, "")
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Proxy-Authenticate"))
+
+	// alice:wrong
+	_, resp = httpConnect(t, addr.String(), echoServer, "Proxy-Authorization: Basic YWxpY2U6d3Jvbmc=\r\n")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// alice:secret
+	conn, resp := httpConnect(t, addr.String(), echoServer, "Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireEcho(t, conn)
+}
+
+func TestHTTPConnectQuota(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithUserQuotas(map[string]int64{"": 8}, time.Hour))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	// the echo uses up the quota
+	conn, resp := httpConnect(t, addr.String(), echoServer, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireEcho(t, conn)
+	require.Eventually(t, func() bool {
+		usage, err := s.Quota("")
+		return err == nil && usage.Exceeded()
+	}, time.Second*5, time.Millisecond*10)
+
+	_, resp = httpConnect(t, addr.String(), echoServer, "")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
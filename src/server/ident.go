@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdentPort     = 113
+	defaultIdentTimeout  = time.Second * 10
+	defaultIdentCacheTTL = time.Minute * 5
+
+	// longest response line RFC 1413 allows, including CRLF
+	maxIdentResponse = 1000
+)
+
+// IdentVerifier is a UserVerifier checking the user ID of a request against
+// the client's identd (RFC 1413), as the original SOCKS4 protocol describes.
+// Clients whose identd can't be reached get reply code 92, and clients whose
+// identd reports another user get reply code 93.
+//
+// The zero value is ready to use.
+type IdentVerifier struct {
+	// Port of identd on clients. Defaults to 113.
+	Port int
+
+	// Time allowed for each lookup. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// How long the result for a client address and user ID is reused.
+	// Defaults to 5 minutes. Negative disables caching.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[identKey]identResult
+}
+
+type identKey struct {
+	ip, user string
+}
+
+type identResult struct {
+	err     error
+	expires time.Time
+}
+
+// Verify implements UserVerifier.
+func (v *IdentVerifier) Verify(ctx context.Context, conn net.Conn, userID string) error {
+	_, err := v.Identify(ctx, conn, userID)
+	return err
+}
+
+// Identify implements IdentityFunc. It returns userID unchanged if the
+// client's identd confirms it.
+func (v *IdentVerifier) Identify(ctx context.Context, conn net.Conn, userID string) (string, error) {
+	local, lok := conn.LocalAddr().(*net.TCPAddr)
+	remote, rok := conn.RemoteAddr().(*net.TCPAddr)
+	if !lok || !rok {
+		return "", fmt.Errorf("ident requires a TCP connection - %w", ErrNoIdentd)
+	}
+
+	key := identKey{ip: canonicalIP(remote.IP).String(), user: userID}
+	if result, ok := v.cached(key); ok {
+		return userID, result.err
+	}
+
+	err := v.lookup(ctx, local, remote, userID)
+	v.store(key, err)
+	return userID, err
+}
+
+func (v *IdentVerifier) cached(key identKey) (identResult, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	result, ok := v.cache[key]
+	if !ok || time.Now().After(result.expires) {
+		return identResult{}, false
+	}
+	return result, true
+}
+
+func (v *IdentVerifier) store(key identKey, err error) {
+	ttl := v.CacheTTL
+	if ttl == 0 {
+		ttl = defaultIdentCacheTTL
+	} else if ttl < 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if v.cache == nil {
+		v.cache = make(map[identKey]identResult)
+	}
+	for k, result := range v.cache {
+		if now.After(result.expires) {
+			delete(v.cache, k)
+		}
+	}
+	v.cache[key] = identResult{err: err, expires: now.Add(ttl)}
+}
+
+// lookup asks the identd of remote who owns its connection to local.
+func (v *IdentVerifier) lookup(ctx context.Context, local, remote *net.TCPAddr, userID string) error {
+	port := v.Port
+	if port == 0 {
+		port = defaultIdentPort
+	}
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = defaultIdentTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// query from the address the client connected to, as identd may check
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local.IP}}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(remote.IP.String(), strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("%w - %v", ErrNoIdentd, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "%d , %d\r\n", remote.Port, local.Port); err != nil {
+		return fmt.Errorf("%w - failed to send query - %v", ErrNoIdentd, err)
+	}
+
+	line, err := bufio.NewReaderSize(conn, maxIdentResponse).ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("%w - failed to read response - %v", ErrNoIdentd, err)
+	}
+
+	user, err := parseIdentResponse(string(line), remote.Port, local.Port)
+	if err != nil {
+		return fmt.Errorf("%w - %v", ErrIdentMismatch, err)
+	} else if user != userID {
+		return fmt.Errorf("%w - identd reported %q", ErrIdentMismatch, user)
+	}
+	return nil
+}
+
+// parseIdentResponse returns the user ID of an RFC 1413 response line of the
+// form "<port> , <port> : USERID : <opsys> : <user-id>".
+func parseIdentResponse(line string, remotePort, localPort int) (string, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed ident response %q", line)
+	}
+
+	ports := strings.Split(fields[0], ",")
+	if len(ports) != 2 ||
+		strings.TrimSpace(ports[0]) != strconv.Itoa(remotePort) ||
+		strings.TrimSpace(ports[1]) != strconv.Itoa(localPort) {
+		return "", fmt.Errorf("ident response for other ports %q", fields[0])
+	}
+
+	switch strings.TrimSpace(fields[1]) {
+	case "USERID":
+		if len(fields) != 4 {
+			return "", fmt.Errorf("malformed ident response %q", line)
+		}
+		return strings.TrimLeft(fields[3], " \t"), nil
+	case "ERROR":
+		return "", fmt.Errorf("ident error %s", strings.TrimSpace(fields[2]))
+	default:
+		return "", fmt.Errorf("unknown ident response type %q", fields[1])
+	}
+}
@@ -0,0 +1,122 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newIdentd answers every query with user, and returns its port and the
+// number of queries answered.
+func newIdentd(t *testing.T, user string) (int, *atomic.Int32) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	queries := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			query, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				queries.Add(1)
+				fmt.Fprintf(conn, "%s : USERID : UNIX : %s\r\n", strings.TrimSpace(query), user)
+			}
+			conn.Close()
+		}
+	}()
+
+	return portOf(t, ln.Addr().String()), queries
+}
+
+func identReply(t *testing.T, verifier server.UserVerifier, user string) proto.ReplyCode {
+	t.Helper()
+
+	s := createServer(t, server.WithUserVerifier(verifier))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	req, err := proto.NewRequest(proto.ConnectCommand, newEchoServer(t), user)
+	require.NoError(t, err)
+	_, err = conn.Write(req.Serialize())
+	require.NoError(t, err)
+
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	return reply.Code()
+}
+
+func TestIdentVerifier(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Match", func(t *testing.T) {
+		t.Parallel()
+
+		port, _ := newIdentd(t, "mcr")
+		require.Equal(t, proto.SuccessReply, identReply(t, &server.IdentVerifier{Port: port}, "mcr"))
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		port, _ := newIdentd(t, "someone-else")
+		require.Equal(t, proto.IdentMismatch, identReply(t, &server.IdentVerifier{Port: port}, "mcr"))
+	})
+
+	t.Run("NoIdentd", func(t *testing.T) {
+		t.Parallel()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := portOf(t, ln.Addr().String())
+		ln.Close()
+
+		require.Equal(t, proto.NoIdentd, identReply(t, &server.IdentVerifier{Port: port}, "mcr"))
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		t.Parallel()
+
+		port, queries := newIdentd(t, "mcr")
+		verifier := &server.IdentVerifier{Port: port}
+		require.Equal(t, proto.SuccessReply, identReply(t, verifier, "mcr"))
+		require.Equal(t, proto.SuccessReply, identReply(t, verifier, "mcr"))
+		require.EqualValues(t, 1, queries.Load())
+	})
+}
+
+func TestUserVerifier(t *testing.T) {
+	t.Parallel()
+
+	verifier := server.UserVerifierFunc(func(_ context.Context, _ net.Conn, userID string) error {
+		switch userID {
+		case "unknown":
+			return fmt.Errorf("agent unreachable - %w", server.ErrNoIdentd)
+		case "impostor":
+			return server.ErrIdentMismatch
+		}
+		return nil
+	})
+
+	require.Equal(t, proto.SuccessReply, identReply(t, verifier, "mcr"))
+	require.Equal(t, proto.NoIdentd, identReply(t, verifier, "unknown"))
+	require.Equal(t, proto.IdentMismatch, identReply(t, verifier, "impostor"))
+}
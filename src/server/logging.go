@@ -0,0 +1,29 @@
+package server
+
+import "go.uber.org/zap"
+
+// Subsystem names a part of the server whose logs can be routed to their
+// own sink with WithSubsystemLogger.
+type Subsystem string
+
+const (
+	// Handshakes, including identification and authentication, and the
+	// sessions that end during them.
+	SubsystemHandshake Subsystem = "handshake"
+
+	// Relaying, and the sessions that end while relaying.
+	SubsystemRelay Subsystem = "relay"
+
+	// Administrative actions, such as policy updates, maintenance mode and
+	// pausing sessions.
+	SubsystemAdmin Subsystem = "admin"
+)
+
+// logger returns the logger of a subsystem, which defaults to the logger
+// of the server.
+func (s *Server) logger(subsystem Subsystem) *zap.Logger {
+	if log, ok := s.subsystemLogs[subsystem]; ok {
+		return log
+	}
+	return s.log
+}
@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWithSubsystemLogger(t *testing.T) {
+	t.Parallel()
+
+	handshakeCore, handshakeLogs := observer.New(zapcore.WarnLevel)
+	relayCore, relayLogs := observer.New(zapcore.InfoLevel)
+	adminCore, adminLogs := observer.New(zapcore.InfoLevel)
+	s := createServer(t,
+		server.WithAuthenticator(server.NewStaticTokenAuthenticator("token")),
+		server.WithSubsystemLogger(server.SubsystemHandshake, zap.New(handshakeCore)),
+		server.WithSubsystemLogger(server.SubsystemRelay, zap.New(relayCore)),
+		server.WithSubsystemLogger(server.SubsystemAdmin, zap.New(adminCore)),
+	)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	denied := client.NewClient(addr.String(), "wrong")
+	t.Cleanup(func() { denied.Close() })
+	require.Error(t, denied.Connect(echoServer))
+	requireClosedReason(t, s, server.CloseUnauthorized)
+
+	relayed := client.NewClient(addr.String(), "token")
+	t.Cleanup(func() { relayed.Close() })
+	require.NoError(t, relayed.Connect(echoServer))
+	requireEcho(t, relayed)
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+
+	s.SetMaintenance(true)
+
+	// sessions are counted closed just before the log line is written
+	require.Eventually(t, func() bool {
+		return relayLogs.FilterMessage("session closed").Len() == 1
+	}, time.Second, time.Millisecond*10)
+
+	// only warnings reach the handshake sink
+	require.Equal(t, 1, handshakeLogs.Len())
+	require.Equal(t, string(server.CloseUnauthorized), handshakeLogs.All()[0].ContextMap()["reason"])
+	require.Equal(t, 1, adminLogs.Len())
+}
@@ -0,0 +1,28 @@
+package server
+
+import "errors"
+
+var errMaintenance = errors.New("server is in maintenance mode")
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode,
+// established sessions carry on, but every new handshake is refused with an
+// error reply, so the server can be drained ahead of maintenance.
+func (s *Server) SetMaintenance(on bool) {
+	if s.maintenance.Swap(on) == on {
+		return
+	}
+
+	gauge := s.metrics.Gauge("maintenance_mode", "Whether new handshakes are refused for maintenance.")
+	if on {
+		gauge.Set(1)
+		s.logger(SubsystemAdmin).Warn("maintenance mode enabled, refusing new handshakes")
+	} else {
+		gauge.Set(0)
+		s.logger(SubsystemAdmin).Warn("maintenance mode disabled")
+	}
+}
+
+// Maintenance reports whether the server is in maintenance mode.
+func (s *Server) Maintenance() bool {
+	return s.maintenance.Load()
+}
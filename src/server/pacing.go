@@ -0,0 +1,47 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// pacer spaces events out to at most a fixed rate, without bursts. It is
+// safe for concurrent use.
+type pacer struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newPacer(perSecond int) *pacer {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &pacer{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the next event may happen, returning how long it
+// waited, or false if done was closed first.
+func (p *pacer) wait(done <-chan struct{}) (time.Duration, bool) {
+	now := time.Now()
+	p.mu.Lock()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+	if delay <= 0 {
+		return 0, true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, true
+	case <-done:
+		return delay, false
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+var errPanic = errors.New("recovered from panic")
+
+// recovered logs v, the value of a recovered panic, with the stack of the
+// panicking goroutine and counts it, returning it as an error.
+func (s *Server) recovered(log *zap.Logger, v any) error {
+	s.metrics.Counter("panics_total", "Panics recovered in connection handlers.").Inc()
+	log.Error("recovered from panic", zap.Any("panic", v), zap.ByteString("stack", debug.Stack()))
+	return fmt.Errorf("%w - %v", errPanic, v)
+}
+
+// recoverSession ends sess if its handler panicked, rather than the panic
+// taking down the server. It must be deferred by the handler, before the
+// handler closes the client.
+func (s *Server) recoverSession(sess *session) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	// the panic takes precedence over why the session was ending
+	sess.reason = ""
+	sess.end(ClosePanic, s.recovered(sess.log, v))
+}
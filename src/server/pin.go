@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultDNSPinTTL = time.Minute
+
+// ErrDestinationDenied is returned for destinations refused by the policy's
+// DestinationFilter.
+var ErrDestinationDenied = fmt.Errorf("destination denied - %w", ErrUnauthorized)
+
+// DestinationFilter decides whether user may connect to ip:port, returning
+// an error to refuse. It is consulted for every address dialed, including
+// hedged attempts, so that the addresses a hostname resolves to are checked
+// when they are used rather than when they are resolved.
+type DestinationFilter func(user string, ip net.IP, port int) error
+
+// dnsPin is a session's resolution of a hostname, reused until it expires
+// so every dial of the session goes to the same addresses.
+type dnsPin struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// pinned returns the addresses host is pinned to for sess, if any.
+func (sess *session) pinned(host string) ([]net.IP, bool) {
+	pin, ok := sess.pins[host]
+	if !ok || time.Now().After(pin.expires) {
+		return nil, false
+	}
+	return pin.ips, true
+}
+
+// pin pins host to ips for sess until ttl elapses.
+func (sess *session) pin(host string, ips []net.IP, ttl time.Duration) {
+	if sess.pins == nil {
+		sess.pins = make(map[string]dnsPin)
+	}
+	sess.pins[host] = dnsPin{ips: ips, expires: time.Now().Add(ttl)}
+}
+
+// pinConnected narrows the pin of the hostname of req to the address the
+// session connected to.
+func (s *Server) pinConnected(sess *session, req *request, remote net.Conn) {
+	ip := addrIP(remote.RemoteAddr())
+	if req.hostname == "" || ip == nil {
+		return
+	}
+	sess.pin(req.hostname, []net.IP{ip}, s.dnsPinTTL)
+	sess.log.Info("pinned hostname", zap.String("hostname", req.hostname), zap.Stringer("ip", ip))
+}
+
+// checkDestination refuses addr if it is private while those are blocked,
+// then applies the session's ACL and DestinationFilter to it. It returns
+// the local address or interface to dial addr from if the ACL rule that
+// allowed it has one.
+func (s *Server) checkDestination(sess *session, addr string) (string, error) {
+	filter := sess.rules.DestinationFilter
+	if filter == nil && !sess.rules.hasACL() && !s.blockPrivate {
+		return "", nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to split destination host & port - %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse destination port - %w", err)
+	}
+
+	ip := canonicalIP(net.ParseIP(host))
+	if err := s.checkPrivate(sess, ip); err != nil {
+		return "", err
+	}
+	rule, err := s.checkACL(sess, ip, port)
+	if err != nil {
+		return "", err
+	}
+	if filter != nil {
+		if err := filter(sess.user, ip, port); err != nil {
+			s.metrics.Counter("destinations_denied_total", "Destination addresses refused by the destination filter.").Inc()
+			return "", fmt.Errorf("%s - %w - %w", addr, ErrDestinationDenied, err)
+		}
+	}
+
+	if rule != nil {
+		return rule.Source, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDNSPinning(t *testing.T) {
+	t.Parallel()
+
+	dns := newDNSServer(t, net.IPv4(127, 0, 0, 1))
+	relayCore, relayLogs := observer.New(zapcore.InfoLevel)
+	s := createServer(t,
+		server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dns}}),
+		server.WithSubsystemLogger(server.SubsystemRelay, zap.New(relayCore)),
+	)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(socks4aRequest(proto.ConnectCommand, portOf(t, echoServer), "echo.test"))
+	require.NoError(t, err)
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, reply.Code())
+	requireEcho(t, conn)
+
+	// the access log records which address the hostname was pinned to
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+	require.Eventually(t, func() bool {
+		return relayLogs.FilterMessage("session closed").Len() == 1
+	}, time.Second, time.Millisecond*10)
+	fields := relayLogs.FilterMessage("session closed").All()[0].ContextMap()
+	require.Equal(t, "echo.test", fields["hostname"])
+	require.Equal(t, "127.0.0.1", fields["ip"])
+}
+
+func TestDestinationFilter(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	denied := portOf(t, echoServer)
+	s := createServer(t,
+		server.WithHedgedDials(time.Millisecond, 3),
+		server.WithPolicy(server.Policy{
+			DestinationFilter: func(user string, ip net.IP, port int) error {
+				if port == denied {
+					return errors.New("port not allowed")
+				}
+				return nil
+			},
+		}),
+	)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.ErrorIs(t, c.Connect(echoServer), client.ErrRejected)
+	requireClosedReason(t, s, server.CloseRequestFailed)
+
+	// every hedged attempt is checked
+	require.EqualValues(t, 3, s.Metrics().Counter("destinations_denied_total", "").Value())
+}
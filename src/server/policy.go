@@ -0,0 +1,82 @@
+package server
+
+import (
+	"go.uber.org/zap"
+)
+
+// Policy is the set of rules a Server enforces that can be replaced while
+// it is running, e.g. on SIGHUP or from an admin API.
+type Policy struct {
+	// Consulted for every request. A nil Authenticator allows everything.
+	Authenticator Authenticator
+
+	// Routes SOCKS4a hostname lookups to specific DNS servers.
+	DNSRoutes []DNSRoute
+
+	// Resolves hostnames instead of the DNSRoutes, e.g. a CachingResolver
+	// of a RoutedResolver.
+	Resolver Resolver
+
+	// Ordered rules consulted for every destination address dialed or
+	// bound for, before the DestinationFilter. The first matching rule
+	// applies, and destinations no rule matches are denied. An empty ACL
+	// allows every destination.
+	ACL []Rule
+
+	// ACLs of specific users, each evaluated like ACL instead of it for
+	// requests of its user.
+	UserACLs map[string][]Rule
+
+	// Locates destinations for rules matching countries or autonomous
+	// systems.
+	GeoIP GeoIP
+
+	// Consulted for every destination address dialed. A nil filter allows
+	// every destination.
+	DestinationFilter DestinationFilter
+
+	// Destinations the proxy connects to over TLS on behalf of clients.
+	// The first match applies.
+	TLSOrigination []TLSOrigination
+}
+
+// activePolicy is an immutable, versioned Policy in effect.
+type activePolicy struct {
+	Policy
+	version  uint64
+	resolver Resolver
+}
+
+func newActivePolicy(p Policy, version uint64) *activePolicy {
+	active := &activePolicy{Policy: p, version: version, resolver: p.Resolver}
+	if active.resolver == nil {
+		active.resolver = NewRoutedResolver(p.DNSRoutes...)
+	}
+	return active
+}
+
+// SetPolicy atomically replaces the server's policy and returns its
+// version. Sessions already past their handshake are unaffected; every
+// new session is governed by the new policy.
+func (s *Server) SetPolicy(p Policy) uint64 {
+	return s.updatePolicy(func(Policy) Policy { return p })
+}
+
+// updatePolicy atomically replaces the server's policy with what update
+// makes of it, and returns the new version.
+func (s *Server) updatePolicy(update func(Policy) Policy) uint64 {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+
+	current := s.policy.Load()
+	active := newActivePolicy(update(current.Policy), current.version+1)
+	s.policy.Store(active)
+	s.logger(SubsystemAdmin).Info("policy updated", zap.Uint64("policy-version", active.version))
+	return active.version
+}
+
+// Policy returns the server's current policy and its version.
+func (s *Server) Policy() (Policy, uint64) {
+	active := s.policy.Load()
+	return active.Policy, active.version
+}
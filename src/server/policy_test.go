@@ -0,0 +1,45 @@
+package server_test
+
+import (
+	"testing"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPolicy(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("old")))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	_, version := s.Policy()
+	require.EqualValues(t, 1, version)
+
+	connect := func(user string) error {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		return c.Connect(echoServer)
+	}
+
+	require.NoError(t, connect("old"))
+	require.Error(t, connect("new"))
+
+	version = s.SetPolicy(server.Policy{Authenticator: server.NewStaticTokenAuthenticator("new")})
+	require.EqualValues(t, 2, version)
+
+	policy, current := s.Policy()
+	require.Equal(t, version, current)
+	require.NotNil(t, policy.Authenticator)
+
+	require.Error(t, connect("old"))
+	require.NoError(t, connect("new"))
+
+	// an empty policy allows everyone
+	require.EqualValues(t, 3, s.SetPolicy(server.Policy{}))
+	require.NoError(t, connect("anyone"))
+}
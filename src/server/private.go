@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// ErrPrivateDestination is returned for destinations refused as private
+// when private destinations are blocked.
+var ErrPrivateDestination = fmt.Errorf("private destination - %w", ErrDestinationDenied)
+
+// checkPrivate refuses ip if private destinations are blocked and it is a
+// private, loopback, link-local or unspecified address, or one of the
+// proxy's own.
+func (s *Server) checkPrivate(sess *session, ip net.IP) error {
+	if !s.blockPrivate {
+		return nil
+	}
+
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		s.isOwnAddress(sess, ip) {
+		s.metrics.Counter("destinations_private_denied_total", "Destination addresses refused as private.").Inc()
+		return fmt.Errorf("%v - %w", ip, ErrPrivateDestination)
+	}
+	return nil
+}
+
+// isOwnAddress reports whether ip is an address of the proxy's host, which
+// includes the one the client connected to. Interfaces are listed on each
+// check, as their addresses may change while the server runs.
+func (s *Server) isOwnAddress(sess *session, ip net.IP) bool {
+	if local := addrIP(sess.client.LocalAddr()); local != nil && local.Equal(ip) {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		sess.log.Warn("failed to list interface addresses", zap.Error(err))
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockPrivateDestinations(t *testing.T) {
+	t.Parallel()
+
+	dns := newDNSServer(t, net.IPv4(10, 1, 2, 3))
+	s := createServer(t,
+		server.WithBlockPrivateDestinations(),
+		server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dns}}),
+	)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	var replyErr *client.ReplyError
+	for _, dst := range []string{echoServer, "0.0.0.0:80", "169.254.169.254:80", "192.168.1.1:22"} {
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.ErrorAs(t, c.Connect(dst), &replyErr, dst)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code(), dst)
+	}
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.ErrorAs(t, c.Bind("127.0.0.1:0", nil), &replyErr)
+
+	// hostnames are checked by what they resolve to
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(socks4aRequest(proto.ConnectCommand, 80, "internal.test"))
+	require.NoError(t, err)
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.RejectedFailed, reply.Code())
+
+	require.EqualValues(t, 6, s.Metrics().Counter("destinations_private_denied_total", "").Value())
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"socks4/store"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoQuota is returned when operating on the quota of a user who has
+// none.
+var ErrNoQuota = errors.New("user has no quota")
+
+var errQuotaExceeded = fmt.Errorf("exceeded transfer quota - %w", errSessionPolicy)
+
+// Number of slots the window of a quota is divided into; usage expires a
+// slot at a time.
+const quotaSlots = 60
+
+// Bytes a user's sessions relay before they're added to the Store, which
+// they also are when a slot ends, a session ends, or the quota is queried.
+const quotaFlushBytes = 64 << 10
+
+// QuotaUsage is the state of a user's transfer quota.
+type QuotaUsage struct {
+	User string `json:"user"`
+
+	// Bytes relayed for the user, in both directions, within the window
+	Used int64 `json:"used"`
+
+	// Bytes the user may relay within the window
+	Limit int64 `json:"limit"`
+}
+
+// Exceeded reports whether the user is refused for exceeding the quota.
+func (u QuotaUsage) Exceeded() bool {
+	return u.Used >= u.Limit
+}
+
+// userQuota tracks the bytes relayed for a user over a rolling window, in
+// a counter of the Store per slot.
+type userQuota struct {
+	quotas *quotas
+	user   string
+	limit  int64
+
+	mu       sync.Mutex
+	pending  int64 // relayed in the slot of epoch, not yet in the Store
+	epoch    int64 // in slot lengths since the Unix epoch
+	stored   int64 // in the Store within the window ending at epoch
+	sessions int   // using it
+}
+
+// quotas tracks the transfer quotas of users.
+type quotas struct {
+	store  store.Store
+	log    *zap.Logger
+	limits map[string]int64 // by user, "" being the default
+	slot   time.Duration
+
+	mu    sync.Mutex
+	users map[string]*userQuota
+}
+
+func newQuotas(st store.Store, log *zap.Logger, limits map[string]int64, window time.Duration) *quotas {
+	if len(limits) == 0 {
+		return nil
+	}
+	slot := window / quotaSlots
+	if slot <= 0 {
+		slot = 1
+	}
+	return &quotas{store: st, log: log, limits: limits, slot: slot, users: make(map[string]*userQuota)}
+}
+
+// limit returns the quota of user, or false if it has none.
+func (q *quotas) limit(user string) (int64, bool) {
+	if limit, ok := q.limits[user]; ok {
+		return limit, limit > 0
+	}
+	limit, ok := q.limits[""]
+	return limit, ok && limit > 0
+}
+
+// epoch returns the slot now is in.
+func (q *quotas) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(q.slot)
+}
+
+// key returns the key of the Store counting what user relayed in the slot
+// of epoch.
+func (q *quotas) key(user string, epoch int64) string {
+	return "quota/" + user + "/" + strconv.FormatInt(epoch, 10)
+}
+
+// stored returns the bytes the Store counts for user within the window
+// ending at epoch.
+func (q *quotas) stored(user string, epoch int64) (int64, error) {
+	var used int64
+	for e := epoch - quotaSlots + 1; e <= epoch; e++ {
+		n, err := q.store.Get(context.Background(), q.key(user, e))
+		if err != nil {
+			return 0, err
+		}
+		used += n
+	}
+	return used, nil
+}
+
+// acquire returns the quota of user for a session to account to, or nil if
+// the user has none. It must be released once the session ends.
+func (q *quotas) acquire(user string, now time.Time) *userQuota {
+	limit, ok := q.limit(user)
+	if !ok {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.users[user]
+	if !ok {
+		u = &userQuota{quotas: q, user: user, limit: limit}
+		u.mu.Lock()
+		u.flush(q.epoch(now))
+		u.mu.Unlock()
+		q.users[user] = u
+	}
+	u.mu.Lock()
+	u.sessions++
+	u.mu.Unlock()
+	return u
+}
+
+// release forgets the quota of user once no session uses it and nothing
+// relayed counts against it anymore.
+func (q *quotas) release(user string, u *userQuota, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sessions--
+	u.flush(q.epoch(now))
+	if u.sessions == 0 && u.used() == 0 {
+		delete(q.users, user)
+	}
+}
+
+// usage returns the state of the quota of user.
+func (q *quotas) usage(user string, now time.Time) (QuotaUsage, error) {
+	limit, ok := q.limit(user)
+	if !ok {
+		return QuotaUsage{}, ErrNoQuota
+	}
+	usage := QuotaUsage{User: user, Limit: limit}
+
+	q.mu.Lock()
+	u := q.users[user]
+	q.mu.Unlock()
+	if u != nil {
+		u.mu.Lock()
+		u.flush(q.epoch(now))
+		usage.Used = u.used()
+		u.mu.Unlock()
+		return usage, nil
+	}
+
+	used, err := q.stored(user, q.epoch(now))
+	if err != nil {
+		return QuotaUsage{}, fmt.Errorf("failed to read quota usage - %w", err)
+	}
+	usage.Used = used
+	return usage, nil
+}
+
+// reset forgets what user relayed within the window ending at now.
+func (q *quotas) reset(user string, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u := q.users[user]; u != nil {
+		u.mu.Lock()
+		u.pending, u.stored = 0, 0
+		u.mu.Unlock()
+	}
+
+	epoch := q.epoch(now)
+	for e := epoch - quotaSlots + 1; e <= epoch; e++ {
+		if err := q.store.Expire(context.Background(), q.key(user, e), 0); err != nil {
+			return fmt.Errorf("failed to reset quota - %w", err)
+		}
+	}
+	return nil
+}
+
+// add accounts n bytes relayed at now, returning the bytes used within the
+// window.
+func (u *userQuota) add(n int64, now time.Time) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if epoch := u.quotas.epoch(now); epoch != u.epoch {
+		u.flush(epoch)
+	}
+	if u.pending += n; u.pending >= quotaFlushBytes {
+		u.flush(u.epoch)
+	}
+	return u.used()
+}
+
+// used returns the bytes used within the window. u.mu must be held.
+func (u *userQuota) used() int64 {
+	return u.stored + u.pending
+}
+
+// flush adds the pending bytes to the Store, then rereads the bytes it
+// counts within the window ending at epoch. Bytes the Store failed to take
+// stay pending. u.mu must be held.
+func (u *userQuota) flush(epoch int64) {
+	q := u.quotas
+	ctx := context.Background()
+	if u.pending != 0 {
+		key := q.key(u.user, u.epoch)
+		if _, err := q.store.Incr(ctx, key, u.pending); err != nil {
+			q.log.Warn("failed to store quota usage", zap.String("user", u.user), zap.Error(err))
+			return
+		}
+		u.pending = 0
+		// kept while the slot is within the window
+		if err := q.store.Expire(ctx, key, (quotaSlots+1)*q.slot); err != nil {
+			q.log.Warn("failed to expire quota usage", zap.String("user", u.user), zap.Error(err))
+		}
+	}
+
+	stored, err := q.stored(u.user, epoch)
+	if err != nil {
+		q.log.Warn("failed to read quota usage", zap.String("user", u.user), zap.Error(err))
+		return
+	}
+	u.epoch, u.stored = epoch, stored
+}
+
+// checkQuota attaches the quota of the session's user to the session, or
+// returns errQuotaExceeded if the user already exceeded it. Users whose
+// usage can't be read from the Store are refused, rather than served past
+// their quota.
+func (s *Server) checkQuota(sess *session) error {
+	if s.quotas == nil {
+		return nil
+	}
+	usage, err := s.quotas.usage(sess.user, time.Now())
+	if errors.Is(err, ErrNoQuota) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to check transfer quota - %w", err)
+	} else if usage.Exceeded() {
+		s.metrics.Counter("quota_refusals_total", "Requests refused because their user exceeded its transfer quota.").Inc()
+		return errQuotaExceeded
+	}
+	sess.quota = s.quotas.acquire(sess.user, time.Now())
+	return nil
+}
+
+// Quota returns the state of the transfer quota of user, or ErrNoQuota if
+// the user has none.
+func (s *Server) Quota(user string) (QuotaUsage, error) {
+	if s.quotas == nil {
+		return QuotaUsage{}, ErrNoQuota
+	}
+	return s.quotas.usage(user, time.Now())
+}
+
+// Quotas returns the state of the transfer quotas of the users that relayed
+// data within their windows, or have sessions, sorted by user.
+func (s *Server) Quotas() []QuotaUsage {
+	if s.quotas == nil {
+		return nil
+	}
+	s.quotas.mu.Lock()
+	users := make([]string, 0, len(s.quotas.users))
+	for user := range s.quotas.users {
+		users = append(users, user)
+	}
+	s.quotas.mu.Unlock()
+	sort.Strings(users)
+
+	usages := make([]QuotaUsage, 0, len(users))
+	now := time.Now()
+	for _, user := range users {
+		if usage, err := s.quotas.usage(user, now); err == nil {
+			usages = append(usages, usage)
+		}
+	}
+	return usages
+}
+
+// ResetQuota forgets what user relayed so far, serving the user again if
+// it exceeded its transfer quota.
+func (s *Server) ResetQuota(user string) error {
+	if s.quotas == nil {
+		return ErrNoQuota
+	} else if _, ok := s.quotas.limit(user); !ok {
+		return ErrNoQuota
+	}
+
+	if err := s.quotas.reset(user, time.Now()); err != nil {
+		return err
+	}
+	s.logger(SubsystemAdmin).Warn("quota reset", zap.String("user", user))
+	return nil
+}
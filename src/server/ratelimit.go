@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net"
+	"socks4/store"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rateLimiter limits the rate of connections of each client IP with a token
+// bucket per IP, kept in the server's Store as the tokens taken since the
+// bucket was last full, which expire once it refilled. It is safe for
+// concurrent use.
+type rateLimiter struct {
+	store store.Store
+	rate  float64 // tokens added per second
+	burst float64 // tokens a bucket holds at most
+}
+
+func newRateLimiter(st store.Store, perSecond float64, burst int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{store: st, rate: perSecond, burst: float64(burst)}
+}
+
+// take takes a token of the bucket of client, returning how long to wait
+// for it, or 0 if it was available. A token that isn't available within
+// maxWait isn't taken, and false is returned.
+func (l *rateLimiter) take(ctx context.Context, client string, now time.Time, maxWait time.Duration) (time.Duration, bool, error) {
+	takenKey, sinceKey := "ratelimit/"+client+"/taken", "ratelimit/"+client+"/since"
+
+	since, err := l.store.Get(ctx, sinceKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if since == 0 {
+		// the bucket is full; of concurrent takes, the first sets since
+		// and the others undo their increment
+		since, err = l.store.Incr(ctx, sinceKey, now.UnixNano())
+		if err != nil {
+			return 0, false, err
+		}
+		if since != now.UnixNano() {
+			if since, err = l.store.Incr(ctx, sinceKey, -now.UnixNano()); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+	taken, err := l.store.Incr(ctx, takenKey, 1)
+	if err != nil {
+		return 0, false, err
+	}
+
+	elapsed := time.Duration(now.UnixNano() - since)
+	wait := time.Duration((float64(taken)-l.burst)/l.rate*float64(time.Second)) - elapsed
+	if wait <= 0 {
+		wait = 0
+	} else if wait > maxWait {
+		_, err := l.store.Incr(ctx, takenKey, -1)
+		return wait, false, err
+	}
+
+	// the bucket is full again once the tokens taken refilled
+	refilled := time.Duration(float64(taken)/l.rate*float64(time.Second)) - elapsed
+	for _, key := range []string{takenKey, sinceKey} {
+		if err := l.store.Expire(ctx, key, refilled); err != nil {
+			return 0, false, err
+		}
+	}
+	return wait, true, nil
+}
+
+// rateLimitKey returns the client IP of addr, which connections are rate
+// limited by.
+func rateLimitKey(addr net.Addr) string {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return canonicalIP(a.IP).String()
+	}
+	return addr.String()
+}
+
+// limitRate delays conn until its client is within its rate limit, or
+// rejects and closes it if it isn't delayed or would be delayed longer
+// than the handshake timeout. It returns whether conn may be handled.
+func (s *Server) limitRate(conn net.Conn) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	client := rateLimitKey(conn.RemoteAddr())
+	var maxWait time.Duration
+	if s.rateOverflow == OverflowQueue {
+		maxWait = s.handshakeTimeout
+	}
+	wait, ok, err := s.rateLimiter.take(context.Background(), client, time.Now(), maxWait)
+	if err != nil {
+		// rather than refusing everyone while the store fails
+		s.log.Warn("failed to rate limit connection", zap.String("client", client), zap.Error(err))
+		return true
+	} else if !ok {
+		s.metrics.Counter("connections_rate_limited_total", "Connections beyond the rate limit of their client IP, by action.", "action", "rejected").Inc()
+		s.log.Debug("rejected by rate limit", zap.String("client", client))
+		s.rejectOverflow(conn)
+		return false
+	} else if wait == 0 {
+		return true
+	}
+
+	s.metrics.Counter("connections_rate_limited_total", "Connections beyond the rate limit of their client IP, by action.", "action", "delayed").Inc()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		conn.Close()
+		return false
+	}
+}
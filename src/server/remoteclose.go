@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// RemoteCloseMode selects how a CONNECT is answered when the destination
+// accepts the connection but closes or resets it before the client has been
+// replied to, as FTP and SMTP servers rejecting a client by banner often do.
+// When checked, a destination that resets the connection before the dial
+// even completes is always answered with an error reply.
+type RemoteCloseMode int
+
+const (
+	// The destination isn't checked; the client is sent success and then
+	// sees the tunnel close.
+	RemoteCloseUnchecked RemoteCloseMode = iota
+
+	// The destination is checked and the case is counted, but the client
+	// is still sent success followed by EOF.
+	RemoteCloseSuccess
+
+	// The destination is checked and the client is sent an error reply.
+	RemoteCloseError
+)
+
+// Default time to wait for the destination to close before replying
+const defaultRemoteCloseWindow = time.Millisecond
+
+var errRemoteClosedEarly = errors.New("remote closed during handshake")
+
+// checkRemoteClosed reports whether remote has already closed the
+// connection. Anything the remote sent in the meantime, such as a banner,
+// is kept in the returned conn to be relayed.
+func (s *Server) checkRemoteClosed(remote net.Conn) (net.Conn, error) {
+	if s.remoteCloseMode == RemoteCloseUnchecked {
+		return remote, nil
+	}
+
+	if err := remote.SetReadDeadline(time.Now().Add(s.remoteCloseWindow)); err != nil {
+		return remote, err
+	}
+	buffer := make([]byte, 4096)
+	n, err := remote.Read(buffer)
+	if err := remote.SetReadDeadline(time.Time{}); err != nil {
+		return remote, err
+	}
+
+	if n > 0 {
+		// a banner is relayed even if the remote closed after sending it
+		return &prefixConn{Conn: remote, prefix: buffer[:n]}, nil
+	} else if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return remote, nil
+	}
+
+	return remote, s.remoteClosedEarly(err)
+}
+
+// remoteClosedEarly counts and wraps err, the error of a destination that
+// closed during the handshake.
+func (s *Server) remoteClosedEarly(err error) error {
+	s.metrics.Counter("remote_closed_during_handshake_total", "CONNECTs whose destination closed before the client was replied to.").Inc()
+	return fmt.Errorf("%w - %v", errRemoteClosedEarly, err)
+}
@@ -0,0 +1,96 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newRejectingServer accepts connections, sends banner, and closes them,
+// resetting them if reset is set.
+func newRejectingServer(t *testing.T, banner string, reset bool) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			if reset {
+				conn.(*net.TCPConn).SetLinger(0)
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRemoteCloseMode(t *testing.T) {
+	t.Parallel()
+
+	connect := func(t *testing.T, mode server.RemoteCloseMode, remote string) (*server.Server, net.Conn, proto.ReplyCode) {
+		s := createServer(t, server.WithRemoteCloseMode(mode, 100*time.Millisecond))
+		addr, err := s.ListenAndServe("127.0.0.1:0")
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		req, err := proto.NewRequest(proto.ConnectCommand, remote, "")
+		require.NoError(t, err)
+		_, err = conn.Write(req.Serialize())
+		require.NoError(t, err)
+
+		// the reply may arrive together with relayed data
+		reply := make([]byte, 8)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		return s, conn, reply[1]
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		t.Parallel()
+
+		s, conn, code := connect(t, server.RemoteCloseError, newRejectingServer(t, "", true))
+		require.Equal(t, proto.RejectedFailed, code)
+		requireClosed(t, conn)
+		requireClosedReason(t, s, server.CloseRemoteClosedEarly)
+		require.EqualValues(t, 1, s.Metrics().Counter("remote_closed_during_handshake_total", "").Value())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		t.Parallel()
+
+		s, conn, code := connect(t, server.RemoteCloseSuccess, newRejectingServer(t, "", false))
+		require.Equal(t, proto.SuccessReply, code)
+		requireClosed(t, conn)
+		requireClosedReason(t, s, server.CloseRemoteClosedEarly)
+	})
+
+	t.Run("Banner", func(t *testing.T) {
+		t.Parallel()
+
+		banner := "554 go away\r\n"
+		s, conn, code := connect(t, server.RemoteCloseError, newRejectingServer(t, banner, false))
+		require.Equal(t, proto.SuccessReply, code)
+
+		got, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, banner, string(got))
+		requireClosedReason(t, s, server.CloseRemoteEOF)
+		require.Zero(t, s.Metrics().Counter("remote_closed_during_handshake_total", "").Value())
+	})
+}
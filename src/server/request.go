@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net"
+	"socks4/proto"
+)
+
+// request is a CONNECT or BIND request, whichever SOCKS version it arrived
+// in.
+type request struct {
+	command  proto.Command
+	hostname string // set when the proxy resolves the destination
+	ip       net.IP
+	port     int
+	reply    replier
+}
+
+// replier answers a request in the protocol of the client.
+type replier interface {
+	// bound sends the address a BIND listens on.
+	bound(ip net.IP, port int) error
+
+	// granted sends the success reply for remote, the destination of a
+	// CONNECT or the peer of a BIND.
+	granted(remote net.Conn) error
+
+	// failed sends the error reply for a request that failed with cause.
+	failed(cause error) error
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves the hostnames of requests to IPv4 addresses.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver that also tells how long addresses may be
+// cached, or zero if it doesn't know.
+type TTLResolver interface {
+	Resolver
+	LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// CachingResolver caches the addresses a Resolver resolves hostnames to, so
+// hot destinations aren't resolved for every connection. Addresses are
+// cached for the TTL of their records if the resolver is a TTLResolver, up
+// to the cache's TTL, and the least recently used hostnames are evicted
+// beyond the cache's capacity. Failed lookups aren't cached.
+type CachingResolver struct {
+	resolver   Resolver
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	host    string
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewCachingResolver caches up to maxEntries hostnames resolved by
+// resolver, each for at most ttl.
+func NewCachingResolver(resolver Resolver, maxEntries int, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		resolver:   resolver,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// LookupIP returns the cached addresses of host, resolving it if they
+// aren't cached or expired.
+func (c *CachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := c.cached(key); ok {
+		return ips, nil
+	}
+
+	var ips []net.IP
+	ttl := c.ttl
+	var err error
+	if r, ok := c.resolver.(TTLResolver); ok {
+		var recordTTL time.Duration
+		ips, recordTTL, err = r.LookupIPTTL(ctx, host)
+		if recordTTL > 0 && recordTTL < ttl {
+			ttl = recordTTL
+		}
+	} else {
+		ips, err = c.resolver.LookupIP(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(key, ips, ttl)
+	return append([]net.IP(nil), ips...), nil
+}
+
+func (c *CachingResolver) cached(key string) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+
+	// callers may modify what they're given
+	return append([]net.IP(nil), entry.ips...), true
+}
+
+func (c *CachingResolver) store(key string, ips []net.IP, ttl time.Duration) {
+	if ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{host: key, ips: append([]net.IP(nil), ips...), expires: time.Now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).host)
+	}
+}
+
+// Len returns the number of hostnames cached.
+func (c *CachingResolver) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/url"
+)
+
+// Route is how the destinations of a user's requests are dialed.
+type Route struct {
+	// Local IP address or interface name to dial from.
+	Source string
+
+	// Proxies to dial through, balanced and failed over between like the
+	// server's.
+	Upstreams []*url.URL
+}
+
+// route is a Route in effect, with its upstream proxies' pool.
+type route struct {
+	source    string
+	upstreams *upstreamPool
+}
+
+// newRoutes builds the server's default route, and those of users, which
+// share its upstream proxies unless they have their own.
+func (s *Server) newRoutes() map[string]route {
+	def := route{source: s.source}
+	if len(s.upstreamURLs) != 0 {
+		def.upstreams = newUpstreamPool("default", s.upstreamURLs, s.balance, s.upstreamCheck, s.log, s.metrics)
+	}
+
+	routes := map[string]route{"": def}
+	for user, r := range s.userRoutes {
+		rt := def
+		if r.Source != "" {
+			rt.source = r.Source
+		}
+		if len(r.Upstreams) != 0 {
+			rt.upstreams = newUpstreamPool(user, r.Upstreams, s.balance, s.upstreamCheck, s.log, s.metrics)
+		}
+		routes[user] = rt
+	}
+	return routes
+}
+
+// checkUpstreams starts the health checks of every route's upstream
+// proxies.
+func (s *Server) checkUpstreams() {
+	started := make(map[*upstreamPool]bool)
+	for _, r := range s.routes {
+		if r.upstreams != nil && !started[r.upstreams] {
+			started[r.upstreams] = true
+			go r.upstreams.run(s, s.done)
+		}
+	}
+}
+
+// route returns the route of user's requests.
+func (s *Server) route(user string) route {
+	if r, ok := s.routes[user]; ok && user != "" {
+		return r
+	}
+	return s.routes[""]
+}
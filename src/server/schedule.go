@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule restricts a Rule to some times of the week.
+type Schedule struct {
+	// Days the rule applies on, or every day if empty
+	Days []time.Weekday
+
+	// Time of day the rule applies from and until, or all day if both are
+	// zero. A window with From after To spans midnight, e.g. 18:00-09:00.
+	From, To time.Duration
+
+	// Location of the times, or the server's local time if nil
+	Location *time.Location
+}
+
+// Contains reports whether t is within the schedule. The part of a window
+// spanning midnight that falls after it belongs to the day the window
+// started on, e.g. a Friday 22:00-02:00 window contains Saturday 01:00.
+func (s *Schedule) Contains(t time.Time) bool {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	}
+
+	hour, minute, sec := t.Clock()
+	clock := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(sec)*time.Second
+	day := t.Weekday()
+	switch {
+	case s.From == 0 && s.To == 0:
+	case s.From <= s.To:
+		if clock < s.From || clock >= s.To {
+			return false
+		}
+	case clock < s.To:
+		day = (day + 6) % 7
+	case clock < s.From:
+		return false
+	}
+
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) String() string {
+	var fields []string
+	if len(s.Days) != 0 {
+		days := make([]string, len(s.Days))
+		for i, day := range s.Days {
+			days[i] = strings.ToLower(day.String()[:3])
+		}
+		fields = append(fields, strings.Join(days, ","))
+	}
+	if s.From != 0 || s.To != 0 {
+		fields = append(fields, fmt.Sprintf("%s-%s", clockString(s.From), clockString(s.To)))
+	}
+	return strings.Join(fields, " ")
+}
+
+func clockString(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+// parseSchedule parses days, a time window or both, e.g. "mon-fri",
+// "18:00-09:00" or "sat,sun 10:00-16:00".
+func parseSchedule(fields []string) (*Schedule, error) {
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid schedule %q, expected [days] [hh:mm-hh:mm]", strings.Join(fields, " "))
+	}
+
+	schedule := &Schedule{}
+	if !strings.Contains(fields[0], ":") {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		schedule.Days = days
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return schedule, nil
+	}
+	fromStr, toStr, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid schedule window %q, expected hh:mm-hh:mm", fields[0])
+	}
+	from, err := parseClock(fromStr)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseClock(toStr)
+	if err != nil {
+		return nil, err
+	}
+	schedule.From, schedule.To = from, to
+	return schedule, nil
+}
+
+// parseDays parses a comma separated list of days and ranges of days,
+// e.g. "mon-fri,sun".
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, entry := range strings.Split(s, ",") {
+		firstStr, lastStr, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+		first, ok := weekdays[strings.ToLower(firstStr)]
+		if !ok {
+			return nil, fmt.Errorf("invalid day %q", firstStr)
+		}
+		last, ok := weekdays[strings.ToLower(lastStr)]
+		if !ok {
+			return nil, fmt.Errorf("invalid day %q", lastStr)
+		}
+
+		// ranges may wrap around the end of the week, e.g. fri-mon
+		for day := first; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q - %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,60 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	at := func(day, clock string) time.Time {
+		// 2024-01-01 was a Monday
+		date := map[string]string{"mon": "01", "fri": "05", "sat": "06", "sun": "07"}[day]
+		tm, err := time.Parse("2006-01-02 15:04", "2024-01-"+date+" "+clock)
+		require.NoError(t, err)
+		return tm
+	}
+
+	rule, err := server.ParseRule("deny * 1935 * at mon-fri 09:00-17:00")
+	require.NoError(t, err)
+	rule.Schedule.Location = time.UTC
+	require.Equal(t, "deny * 1935 * at mon,tue,wed,thu,fri 09:00-17:00", rule.String())
+	require.True(t, rule.Schedule.Contains(at("mon", "09:00")))
+	require.True(t, rule.Schedule.Contains(at("fri", "16:59")))
+	require.False(t, rule.Schedule.Contains(at("fri", "17:00")))
+	require.False(t, rule.Schedule.Contains(at("sat", "12:00")))
+
+	// windows may span midnight, and days the end of the week
+	rule, err = server.ParseRule("allow * * * at fri-sun 22:00-06:00")
+	require.NoError(t, err)
+	rule.Schedule.Location = time.UTC
+	require.True(t, rule.Schedule.Contains(at("sat", "23:00")))
+	require.True(t, rule.Schedule.Contains(at("sun", "05:59")))
+	require.False(t, rule.Schedule.Contains(at("sun", "12:00")))
+	require.False(t, rule.Schedule.Contains(at("mon", "23:00")))
+	require.True(t, rule.Schedule.Contains(at("mon", "01:00")))
+
+	// the part after midnight belongs to the day the window started on
+	rule, err = server.ParseRule("allow * * * at fri 22:00-02:00")
+	require.NoError(t, err)
+	rule.Schedule.Location = time.UTC
+	require.True(t, rule.Schedule.Contains(at("fri", "22:00")))
+	require.True(t, rule.Schedule.Contains(at("sat", "01:00")))
+	require.False(t, rule.Schedule.Contains(at("sat", "02:00")))
+	require.False(t, rule.Schedule.Contains(at("fri", "01:00")))
+	require.False(t, rule.Schedule.Contains(at("sat", "22:00")))
+
+	rule, err = server.ParseRule("allow * * at sat,sun")
+	require.NoError(t, err)
+	require.Equal(t, []time.Weekday{time.Saturday, time.Sunday}, rule.Schedule.Days)
+
+	for _, invalid := range []string{"allow * * at", "allow * * at someday", "allow * * at 9-17", "allow * * at mon 09:00 17:00", "allow * * at 25:00-26:00"} {
+		_, err := server.ParseRule(invalid)
+		require.Error(t, err, invalid)
+	}
+}
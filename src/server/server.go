@@ -2,77 +2,443 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"socks4/metrics"
+	"socks4/store"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+const (
+	defaultHandshakeTimeout   = time.Minute * 2
+	defaultIdleTimeout        = time.Second * 30
+	defaultDialTimeout        = time.Second * 30
+	defaultRequestReadTimeout = time.Second * 30
+	defaultRelayBufferSize    = 1 << 16
+)
+
 type Server struct {
-	log *zap.Logger
-	ln  net.Listener
-	wg  sync.WaitGroup
+	name     string
+	log      *zap.Logger
+	metrics  *metrics.Registry
+	wg       sync.WaitGroup // accept loops
+	handlers sync.WaitGroup // client handlers
+	store    store.Store
+
+	subsystemLogs map[Subsystem]*zap.Logger
+
+	identity     IdentityFunc
+	clientCAs    *x509.CertPool
+	certUser     func(*x509.Certificate) string
+	verifier     UserVerifier
+	acceptFilter AcceptFilter
+	acceptRate   int
+
+	maxHandlers     int
+	handlerOverflow Overflow
+	handlerSlots    chan struct{} // taken by busy handlers, or nil if unbounded
+	maxConns        int
+	connOverflow    Overflow
+	connSlots       chan struct{} // taken by open connections, or nil if unbounded
+	connsOpen       *metrics.Gauge
+	saturated       atomic.Bool // at the connection limit
+	clientRate      float64
+	clientBurst     int
+	rateOverflow    Overflow
+	rateLimiter     *rateLimiter
+	quotaLimits     map[string]int64
+	quotaWindow     time.Duration
+	quotas          *quotas
+
+	initialPolicy Policy
+	policyMu      sync.Mutex
+	policy        atomic.Pointer[activePolicy]
+
+	hedgeDelay    time.Duration
+	hedgeAttempts int
+	fallbackDelay time.Duration
+	pipelinedDial bool
+	dnsPinTTL     time.Duration
+	egress        Egress
+	dialer        Dialer
+	source        string
+	upstreamURLs  []*url.URL
+	balance       Balance
+	upstreamCheck time.Duration
+	userRoutes    map[string]Route
+	routes        map[string]route // by user, "" being the default
+	blockPrivate  bool
+
+	protocols          Protocol
+	handshakeTimeout   time.Duration
+	requestReadTimeout time.Duration
+	dialTimeout        time.Duration
+	defaultIdle        time.Duration
+	relayBufferSize    int
+	hibernateAfter     time.Duration
+	hibernation        *hibernation
+	buffers            *bufferPool
+	bindPorts          portRange
+	bindReplays        *bindReplays
+	udpRelay           bool
+	portIdleTimeouts   map[int]time.Duration
+	sessionPolicy      SessionPolicy
+	bindAdvertise      BindAdvertise
+	slo                SLO
+	strictOrdering     bool
+	remoteCloseMode    RemoteCloseMode
+	halfClose          bool
+	remoteCloseWindow  time.Duration
+	confusionMode      ConfusionMode
+	connState          func(net.Conn, ConnState)
+	connIdleAfter      time.Duration
+	flows              *flowExporter
+	byteTriggers       []ByteTrigger
+	hooks              []Hooks
+
+	maintenance atomic.Bool
+
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+	stopped     bool // by Drain or Close; no more listeners are served
+
+	sessionsMu    sync.Mutex
+	sessions      map[uint64]*session
+	lastSessionID atomic.Uint64
+
+	// totals of ended sessions
+	bytesOut atomic.Int64
+	bytesIn  atomic.Int64
+	endedMu  sync.Mutex
+	ended    map[CloseReason]int64
 }
 
-func NewServer(log *zap.Logger) *Server {
-	return &Server{
-		log: log,
-		wg:  sync.WaitGroup{},
+func NewServer(log *zap.Logger, opts ...Option) *Server {
+	s := &Server{
+		log:      log,
+		metrics:  metrics.NewRegistry("socks4_"),
+		store:    store.NewMemory(),
+		wg:       sync.WaitGroup{},
+		sessions: make(map[uint64]*session),
+		ended:    make(map[CloseReason]int64),
+		slo:      defaultSLO,
+		done:     make(chan struct{}),
+
+		protocols:          allProtocols,
+		handshakeTimeout:   defaultHandshakeTimeout,
+		requestReadTimeout: defaultRequestReadTimeout,
+		dialTimeout:        defaultDialTimeout,
+		defaultIdle:        defaultIdleTimeout,
+		relayBufferSize:    defaultRelayBufferSize,
+		dnsPinTTL:          defaultDNSPinTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.name != "" {
+		s.log = s.log.With(zap.String("server", s.name))
+		for subsystem, log := range s.subsystemLogs {
+			s.subsystemLogs[subsystem] = log.With(zap.String("server", s.name))
+		}
+		s.metrics.SetConstLabels("server", s.name)
+	}
+	metrics.RegisterRuntime(s.metrics)
+	if s.maxHandlers > 0 {
+		s.handlerSlots = make(chan struct{}, s.maxHandlers)
 	}
+	if s.maxConns > 0 {
+		s.connSlots = make(chan struct{}, s.maxConns)
+	}
+	s.connsOpen = s.metrics.Gauge("connections_open", "Client connections open.")
+	s.rateLimiter = newRateLimiter(s.store, s.clientRate, s.clientBurst)
+	s.quotas = newQuotas(s.store, s.logger(SubsystemRelay), s.quotaLimits, s.quotaWindow)
+	s.routes = s.newRoutes()
+	s.buffers = newBufferPool(s.relayBufferSize)
+	if s.hibernateAfter > 0 {
+		s.hibernation = newHibernation(s.hibernateAfter, s.metrics)
+	}
+	s.policy.Store(newActivePolicy(s.initialPolicy, 1))
+	return s
+}
+
+// Name returns the name given to the server with WithName.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Metrics returns the registry holding the server's metrics.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics
 }
 
+// ListenAndServe listens on localEndpoint and serves clients from it in the
+// background. It may be called several times to accept on more addresses.
 func (s *Server) ListenAndServe(localEndpoint string) (net.Addr, error) {
-	var err error
+	ln, err := net.Listen("tcp", localEndpoint)
+	if err != nil {
+		s.log.Error("failed to listen", zap.String("endpoint", localEndpoint), zap.Error(err))
+		return nil, err
+	}
+	if err := s.Serve(ln); err != nil {
+		return nil, err
+	}
+	return ln.Addr(), nil
+}
 
-	s.ln, err = net.Listen("tcp", localEndpoint)
+// ListenAndServeTLS is like ListenAndServe, but terminates TLS with config
+// on accepted connections, encrypting the handshake and relayed data
+// between clients and the server. With WithClientCertificates, clients
+// must also present a certificate.
+func (s *Server) ListenAndServeTLS(localEndpoint string, config *tls.Config) (net.Addr, error) {
+	ln, err := net.Listen("tcp", localEndpoint)
 	if err != nil {
 		s.log.Error("failed to listen", zap.String("endpoint", localEndpoint), zap.Error(err))
 		return nil, err
 	}
+	if err := s.ServeTLS(ln, config); err != nil {
+		return nil, err
+	}
+	return ln.Addr(), nil
+}
+
+// ServeTLS is like Serve, but terminates TLS on connections accepted from ln
+// as ListenAndServeTLS does.
+func (s *Server) ServeTLS(ln net.Listener, config *tls.Config) error {
+	if s.clientCAs != nil {
+		config = config.Clone()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = s.clientCAs
+	}
+	return s.Serve(tls.NewListener(ln, config))
+}
+
+// Serve serves clients accepted from ln in the background, and closes ln
+// when the server is closed. It may be called several times; all listeners
+// share the server's state, limits and metrics.
+func (s *Server) Serve(ln net.Listener) error {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	if s.stopped {
+		ln.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, ln)
+
+	s.startOnce.Do(func() {
+		if s.flows != nil {
+			go s.flows.run(s, s.done)
+		}
+		if s.connState != nil && s.connIdleAfter > 0 {
+			go s.sweepIdle(s.done)
+		}
+		s.checkUpstreams()
+	})
 
 	s.wg.Add(1)
-	go s.listenAndServe()
-	return s.ln.Addr(), nil
+	go s.listenAndServe(ln)
+	return nil
+}
+
+// ServeConn serves a client whose connection was accepted elsewhere, e.g.
+// by a server that speaks other protocols on the same port and detected
+// the client's with DetectProtocol. buffered holds what was already read
+// from conn, which is handled as if it had just arrived. ServeConn returns
+// once the session ends, or net.ErrClosed at once if the server was
+// drained or closed.
+func (s *Server) ServeConn(conn net.Conn, buffered []byte) error {
+	s.listenersMu.Lock()
+	if s.stopped {
+		s.listenersMu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.handlers.Add(1)
+	s.listenersMu.Unlock()
+	defer s.handlers.Done()
+
+	if !s.admitConnection(conn, false) {
+		return nil
+	}
+	defer s.releaseConnection(true)
+
+	if len(buffered) != 0 {
+		conn = &prefixConn{Conn: conn, prefix: append([]byte(nil), buffered...)}
+	}
+	s.handleNewClient(conn)
+	return nil
 }
 
-func (s *Server) listenAndServe() {
+func (s *Server) listenAndServe(ln net.Listener) {
+	// connections wait in the listen backlog while accepts are paced, at
+	// the accept rate of each listener
+	pacer := newPacer(s.acceptRate)
 	for {
-		conn, err := s.ln.Accept()
+		if pacer != nil {
+			delay, ok := pacer.wait(s.done)
+			if !ok {
+				break
+			} else if delay > 0 {
+				s.metrics.Counter("accepts_paced_total", "Accepts delayed to stay within the accept rate.").Inc()
+			}
+		}
+
+		// and while the server is at its connection limit, unless they
+		// are rejected instead
+		reserved := s.connSlots != nil && s.connOverflow == OverflowQueue
+		if reserved && !s.reserveConnection() {
+			break
+		}
+
+		conn, err := ln.Accept()
 		if err != nil {
+			if reserved {
+				s.releaseConnection(false)
+			}
 			if !errors.Is(err, net.ErrClosed) {
-				s.log.Error("failed to accept new connection", zap.Error(err))
+				s.log.Error("failed to accept new connection", zap.Stringer("endpoint", ln.Addr()), zap.Error(err))
 			}
 			break
 		}
-		go handleNewClient(conn, s.log)
+		if remote := canonicalAddr(conn.RemoteAddr()); s.acceptFilter != nil && !s.acceptFilter(remote) {
+			s.log.Debug("rejected by accept filter", zap.Stringer("client", remote))
+			conn.Close()
+			if reserved {
+				s.releaseConnection(false)
+			}
+			continue
+		}
+		if !s.admitConnection(conn, reserved) {
+			continue
+		}
+		if !s.acquireHandler(conn) {
+			s.releaseConnection(true)
+			continue
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			defer s.releaseConnection(true)
+			defer s.releaseHandler()
+			s.handleNewClient(conn)
+		}()
 	}
 	s.wg.Done()
 }
 
+// Drain stops accepting clients but, unlike Close, lets sessions run to
+// completion, e.g. while a load balancer moves traffic to other servers. It
+// returns once every session has ended, or with ctx's error if ctx expires
+// first, leaving the remaining sessions to Close.
+func (s *Server) Drain(ctx context.Context) error {
+	if err := s.closeListeners(); err != nil {
+		return err
+	}
+	s.log.Warn("draining sessions", zap.Int("sessions", len(s.activeSessions())))
+
+	if err := s.wait(ctx); err != nil {
+		s.log.Error("context error draining server", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Close stops accepting clients and ends every session, waiting for their
+// handlers to return. Sessions are signaled to end promptly; the client
+// connections of any still running when ctx expires are closed forcibly,
+// and ctx's error is returned.
 func (s *Server) Close(ctx context.Context) error {
-	if s.ln == nil {
-		return nil
+	s.closeOnce.Do(func() { close(s.done) })
+	if err := s.closeListeners(); err != nil {
+		return err
 	}
-	if err := s.ln.Close(); err != nil {
-		s.log.Error("failed to close listener", zap.Error(err))
-		return fmt.Errorf("failed to close listener - %w", err)
+
+	for _, sess := range s.activeSessions() {
+		sess.cancel()
+	}
+
+	if err := s.wait(ctx); err != nil {
+		s.log.Error("context error closing server", zap.Error(err))
+		s.forceClose()
+		return err
+	}
+	return nil
+}
+
+// closeListeners stops serving clients from all listeners, for good.
+func (s *Server) closeListeners() error {
+	s.listenersMu.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.stopped = true
+	s.listenersMu.Unlock()
+
+	var closeErr error
+	for _, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			s.log.Error("failed to close listener", zap.Stringer("endpoint", ln.Addr()), zap.Error(err))
+			closeErr = errors.Join(closeErr, fmt.Errorf("failed to close listener - %w", err))
+		}
 	}
+	return closeErr
+}
 
+// wait waits for the accept loops and client handlers to return.
+func (s *Server) wait(ctx context.Context) error {
 	ch := make(chan struct{}, 1)
 	go func() {
 		s.wg.Wait()
+		s.handlers.Wait()
 		ch <- struct{}{}
 	}()
 
 	select {
 	case <-ctx.Done():
-		if err := ctx.Err(); err != nil {
-			s.log.Error("context error closing server", zap.Error(err))
-			return err
-		}
+		return ctx.Err()
 	case <-ch:
+		return nil
 	}
-	return nil
+}
+
+// forceClose closes the client connections of the remaining sessions.
+func (s *Server) forceClose() {
+	sessions := s.activeSessions()
+	for _, sess := range sessions {
+		sess.client.Close()
+	}
+	if len(sessions) != 0 {
+		s.metrics.Counter("sessions_force_closed_total", "Sessions whose connections were closed forcibly on shutdown.").Add(int64(len(sessions)))
+		s.log.Warn("closed remaining sessions forcibly", zap.Int("sessions", len(sessions)))
+	}
+}
+
+// idleTimeout returns how long a session to the given destination port may
+// go without traffic before it is closed.
+func (s *Server) idleTimeout(port int) time.Duration {
+	if idle, ok := s.portIdleTimeouts[port]; ok {
+		return idle
+	}
+	return s.defaultIdle
+}
+
+// dialDeadline returns when a dial for a handshake ending at deadline must
+// have connected, leaving a second to reply to the client.
+func (s *Server) dialDeadline(deadline time.Time) time.Time {
+	deadline = deadline.Add(-time.Second)
+	if timeout := time.Now().Add(s.dialTimeout); timeout.Before(deadline) {
+		return timeout
+	}
+	return deadline
 }
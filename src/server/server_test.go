@@ -2,20 +2,23 @@ package server_test
 
 import (
 	"context"
+	"io"
 	"net"
 	"testing"
 	"time"
 
+	"socks4/client"
+	"socks4/proto"
 	"socks4/server"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 )
 
-func createServer(t *testing.T) *server.Server {
+func createServer(t *testing.T, opts ...server.Option) *server.Server {
 	t.Helper()
 
-	s := server.NewServer(zaptest.NewLogger(t))
+	s := server.NewServer(zaptest.NewLogger(t), opts...)
 	require.NotNil(t, s)
 
 	t.Cleanup(func() {
@@ -96,4 +99,401 @@ func TestShutdown(t *testing.T) {
 		s := createServer(t)
 		require.NotNil(t, s)
 	})
+
+	t.Run("endsSessions", func(t *testing.T) {
+		t.Parallel()
+
+		s := server.NewServer(zaptest.NewLogger(t))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		require.NoError(t, s.Close(ctx))
+
+		_, err = c.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+		require.EqualValues(t, 1, s.Metrics().Counter("sessions_closed_total", "", "reason", string(server.CloseShutdown)).Value())
+	})
+
+	t.Run("forceClose", func(t *testing.T) {
+		t.Parallel()
+
+		s := server.NewServer(zaptest.NewLogger(t))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+
+		// a client that never finishes its request holds up the handler
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte{4, 1, 0, 80, 127, 0, 0, 1})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return s.Metrics().Counter("handshakes_total", "", "protocol", "socks4").Value() == 1
+		}, time.Second, time.Millisecond*10)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		require.ErrorIs(t, s.Close(ctx), context.DeadlineExceeded)
+
+		requireClosed(t, conn)
+		requireClosedReason(t, s, server.CloseBadRequest)
+		require.EqualValues(t, 1, s.Metrics().Counter("sessions_force_closed_total", "").Value())
+	})
+}
+
+func TestAcceptFilter(t *testing.T) {
+	t.Parallel()
+
+	seen := make(chan net.Addr, 1)
+	s := createServer(t, server.WithAcceptFilter(func(remote net.Addr) bool {
+		seen <- remote
+		return false
+	}))
+
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.Equal(t, conn.LocalAddr().String(), (<-seen).String())
+	requireClosed(t, conn)
+}
+
+func TestAcceptRate(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAcceptRate(10))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+	}
+
+	// the first accept isn't delayed, the others are 100ms apart
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	require.Equal(t, int64(3), s.Metrics().Counter("accepts_paced_total", "").Value())
+}
+
+func TestAcceptRatePerListener(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAcceptRate(10))
+	first, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	second, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		for _, addr := range []net.Addr{first, second} {
+			c := client.NewClient(addr.String(), "")
+			t.Cleanup(func() { c.Close() })
+			require.NoError(t, c.Connect(echoServer))
+		}
+	}
+
+	// each listener's second accept is delayed 100ms, not 300ms as with a
+	// rate shared between them
+	require.Less(t, time.Since(start), 250*time.Millisecond)
+	require.Equal(t, int64(2), s.Metrics().Counter("accepts_paced_total", "").Value())
+}
+
+func TestClientRateLimit(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Reject", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithClientRateLimit(1, 2, server.OverflowReject))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		// the burst is allowed
+		for i := 0; i < 2; i++ {
+			c := client.NewClient(addr.String(), "")
+			t.Cleanup(func() { c.Close() })
+			require.NoError(t, c.Connect(echoServer))
+		}
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, c.Connect(echoServer), &replyErr)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+		require.Equal(t, int64(1), s.Metrics().Counter("connections_rate_limited_total", "", "action", "rejected").Value())
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithClientRateLimit(10, 1, server.OverflowQueue))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			c := client.NewClient(addr.String(), "")
+			t.Cleanup(func() { c.Close() })
+			require.NoError(t, c.Connect(echoServer))
+		}
+
+		// the first connection isn't delayed, the others are 100ms apart
+		require.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+		require.Equal(t, int64(2), s.Metrics().Counter("connections_rate_limited_total", "", "action", "delayed").Value())
+	})
+}
+
+func TestMaxHandlers(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Queue", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithMaxHandlers(1, server.OverflowQueue))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		first := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { first.Close() })
+		require.NoError(t, first.Connect(echoServer))
+
+		second := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { second.Close() })
+		connected := make(chan error, 1)
+		go func() { connected <- second.Connect(echoServer) }()
+
+		select {
+		case err := <-connected:
+			t.Fatalf("expected the second client to wait, got %v", err)
+		case <-time.After(time.Millisecond * 200):
+		}
+		require.Equal(t, int64(1), s.Metrics().Counter("handlers_overflowed_total", "", "action", "queued").Value())
+
+		// the first client's handler frees up for the second
+		require.NoError(t, first.Close())
+		select {
+		case err := <-connected:
+			require.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected the second client to be handled")
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithMaxHandlers(1, server.OverflowReject))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		first := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { first.Close() })
+		require.NoError(t, first.Connect(echoServer))
+
+		second := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { second.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, second.Connect(echoServer), &replyErr)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+		require.Equal(t, int64(1), s.Metrics().Counter("handlers_overflowed_total", "", "action", "rejected").Value())
+
+		// the first client is still relayed
+		_, err = first.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(first, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+	})
+}
+
+func TestMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Queue", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithMaxConnections(1, server.OverflowQueue))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+		open := s.Metrics().Gauge("connections_open", "")
+
+		first := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { first.Close() })
+		require.NoError(t, first.Connect(echoServer))
+		require.Equal(t, int64(1), open.Value())
+
+		// the second client waits in the listen backlog
+		second := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { second.Close() })
+		connected := make(chan error, 1)
+		go func() { connected <- second.Connect(echoServer) }()
+		select {
+		case err := <-connected:
+			t.Fatalf("expected the second client to wait, got %v", err)
+		case <-time.After(time.Millisecond * 200):
+		}
+
+		require.NoError(t, first.Close())
+		select {
+		case err := <-connected:
+			require.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected the second client to be accepted")
+		}
+		require.Equal(t, int64(1), open.Value())
+
+		require.NoError(t, second.Close())
+		require.Eventually(t, func() bool {
+			return open.Value() == 0
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithMaxConnections(1, server.OverflowReject))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		echoServer := newEchoServer(t)
+
+		first := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { first.Close() })
+		require.NoError(t, first.Connect(echoServer))
+
+		second := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { second.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, second.Connect(echoServer), &replyErr)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+		require.Equal(t, int64(1), s.Metrics().Counter("connections_overflowed_total", "", "action", "rejected").Value())
+		require.Equal(t, int64(1), s.Metrics().Gauge("connections_open", "").Value())
+	})
+}
+
+func TestMultipleServers(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	servers := make([]*server.Server, 2)
+	for i, name := range []string{"tenant-a", "tenant-b"} {
+		servers[i] = createServer(t, server.WithName(name))
+		require.Equal(t, name, servers[i].Name())
+
+		addr, err := servers[i].ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+	}
+
+	for _, s := range servers {
+		require.Contains(t, s.Metrics().Snapshot(), `socks4_handshakes_total{protocol="socks4",server="`+s.Name()+`"}`)
+		require.Equal(t, int64(1), s.Metrics().Counter("handshakes_total", "", "protocol", "socks4").Value())
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	first, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, s.Serve(ln))
+
+	echoServer := newEchoServer(t)
+	for _, addr := range []string{first.String(), ln.Addr().String()} {
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+	}
+	require.Equal(t, int64(2), s.Metrics().Counter("handshakes_total", "", "protocol", "socks4").Value())
+
+	require.NoError(t, s.Close(context.Background()))
+	for _, addr := range []string{first.String(), ln.Addr().String()} {
+		_, err := net.Dial("tcp", addr)
+		require.Error(t, err)
+	}
+
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.ErrorIs(t, s.Serve(late), net.ErrClosed)
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		drained <- s.Drain(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, time.Millisecond*10, "expected new clients to be refused")
+	_, err = s.ListenAndServe("localhost:0")
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	// the session relays until the echo server closes it
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	buff := make([]byte, 5)
+	_, err = io.ReadFull(c, buff)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buff))
+
+	require.NoError(t, <-drained)
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+
+	// sessions still running when the drain deadline passes are left to Close
+	s = createServer(t)
+	addr, err = s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	c = client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	require.ErrorIs(t, s.Drain(ctx), context.DeadlineExceeded)
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, buff)
+	require.NoError(t, err)
 }
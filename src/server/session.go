@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrSessionNotFound is returned when operating on a session that doesn't
+// exist or has already ended.
+var ErrSessionNotFound = errors.New("session not found")
+
+var (
+	errSessionPolicy = errors.New("session policy limit reached")
+	errMaxLifetime   = fmt.Errorf("exceeded maximum lifetime - %w", errSessionPolicy)
+	errMaxBytes      = fmt.Errorf("exceeded byte cap - %w", errSessionPolicy)
+	errServerClosed  = errors.New("server closed")
+	errKilled        = errors.New("session killed")
+)
+
+// SessionPolicy bounds every session regardless of its activity.
+// Zero values mean no limit.
+type SessionPolicy struct {
+	// Maximum number of bytes relayed in both directions combined.
+	MaxBytes int64
+
+	// Maximum time a session may relay data for.
+	MaxLifetime time.Duration
+}
+
+// Session describes a session and the traffic it relayed so far. User and
+// Target are empty, and the byte counts zero, until the session starts
+// relaying.
+type Session struct {
+	SessionStats
+
+	// When the client connected
+	Start time.Time
+
+	// Where the session is in its lifecycle. Sessions are only reported
+	// Idle if WithConnState is given an idle threshold.
+	State ConnState
+
+	// Whether relaying was paused with PauseSession
+	Paused bool
+}
+
+type session struct {
+	id     uint64
+	start  time.Time
+	client net.Conn
+	remote net.Addr      // the client's canonical address
+	in     *bufio.Reader // buffers reads from client during the handshake
+	relay  *gate
+	state  atomic.Int32 // ConnState
+	killed atomic.Bool
+	log    *zap.Logger
+	user   string
+	rules  *activePolicy
+	pins   map[string]dnsPin
+	early  *earlyDial
+
+	// the request as hooks see it, once they saw it
+	request *Request
+
+	// orders the changes of state and their reports
+	stateMu sync.Mutex
+
+	// canceled when the server is closed, to end the session
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	idle        time.Duration
+	buffers     *bufferPool
+	hibernation *hibernation
+	policy      SessionPolicy
+	halfClose   bool
+	relayed     atomic.Int64
+	quota       *userQuota // of the user, if any
+
+	// unix nanoseconds of the last data relayed from the client and from
+	// the destination
+	lastSent     atomic.Int64
+	lastReceived atomic.Int64
+
+	// set once relaying starts
+	target   atomic.Pointer[net.Addr]
+	sent     atomic.Int64 // client to destination
+	received atomic.Int64 // destination to client
+	flowDone bool         // final flow record exported, under the exporter's lock
+	triggers *triggers
+	guard    func([]byte) error // checks the first data from the client
+
+	reason   CloseReason
+	closeErr error
+}
+
+// pipelined returns the client connection, replaying anything the client
+// sent after its request that was buffered during the handshake.
+func (sess *session) pipelined() net.Conn {
+	n := sess.in.Buffered()
+	if n == 0 {
+		return sess.client
+	}
+	buffered, _ := sess.in.Peek(n)
+	return &prefixConn{Conn: sess.client, prefix: append([]byte(nil), buffered...)}
+}
+
+// stats returns a snapshot of the traffic of sess.
+func (sess *session) stats() SessionStats {
+	stats := SessionStats{
+		Session:  sess.id,
+		Client:   sess.remote,
+		User:     sess.user,
+		BytesOut: sess.sent.Load(),
+		BytesIn:  sess.received.Load(),
+	}
+	if target := sess.target.Load(); target != nil {
+		stats.Target = *target
+	}
+	return stats
+}
+
+// touch records that data was just relayed from the client, or from the
+// destination if fromClient is false.
+func (sess *session) touch(fromClient bool) {
+	now := time.Now().UnixNano()
+	if fromClient {
+		sess.lastSent.Store(now)
+	} else {
+		sess.lastReceived.Store(now)
+	}
+}
+
+// lastActivity returns when data was last relayed in either direction.
+func (sess *session) lastActivity() time.Time {
+	last := sess.lastSent.Load()
+	if received := sess.lastReceived.Load(); received > last {
+		last = received
+	}
+	return time.Unix(0, last)
+}
+
+// idleDeadline returns when the session will have been idle in both
+// directions for its idle timeout, unless data is relayed before.
+func (sess *session) idleDeadline() time.Time {
+	return sess.lastActivity().Add(sess.idle)
+}
+
+// account records n bytes relayed from the client, or from the destination
+// if fromClient is false, firing any triggers they reach.
+func (sess *session) account(n int, fromClient bool) {
+	if fromClient {
+		sess.sent.Add(int64(n))
+	} else {
+		sess.received.Add(int64(n))
+	}
+	if sess.triggers != nil && n > 0 {
+		sess.triggers.check(sess)
+	}
+}
+
+// allow accounts n relayed bytes against the session's byte cap and its
+// user's quota, returning how many of them may still be relayed and an
+// error if either was reached.
+func (sess *session) allow(n int) (int, error) {
+	allowed, err := n, error(nil)
+	total := sess.relayed.Add(int64(n))
+	if sess.policy.MaxBytes > 0 && total >= sess.policy.MaxBytes {
+		allowed, err = within(n, total-sess.policy.MaxBytes), errMaxBytes
+	}
+	if sess.quota != nil {
+		used := sess.quota.add(int64(n), time.Now())
+		if quotaAllowed := within(n, used-sess.quota.limit); used >= sess.quota.limit && quotaAllowed <= allowed {
+			allowed, err = quotaAllowed, errQuotaExceeded
+		}
+	}
+	return allowed, err
+}
+
+// within returns how many of n bytes were within a limit they exceeded by
+// over.
+func within(n int, over int64) int {
+	if over > int64(n) {
+		over = int64(n)
+	}
+	return n - int(over)
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	sess := &session{
+		id:     s.lastSessionID.Add(1),
+		start:  time.Now(),
+		client: conn,
+		remote: canonicalAddr(conn.RemoteAddr()),
+		relay:  newGate(),
+		log:    s.log,
+		rules:  s.policy.Load(),
+	}
+	sess.ctx, sess.cancel = context.WithCancel(context.Background())
+
+	s.sessionsMu.Lock()
+	s.sessions[sess.id] = sess
+	s.sessionsMu.Unlock()
+
+	// Close may have signaled the sessions before this one was added
+	select {
+	case <-s.done:
+		sess.cancel()
+	default:
+	}
+	return sess
+}
+
+func (s *Server) removeSession(sess *session) {
+	if s.flows != nil {
+		s.flows.export(sess.log, sess, true)
+	}
+
+	// totaled under the lock, so Expvar counts the session's bytes either
+	// in the totals or in the session, never both or neither
+	s.sessionsMu.Lock()
+	s.bytesOut.Add(sess.sent.Load())
+	s.bytesIn.Add(sess.received.Load())
+	delete(s.sessions, sess.id)
+	s.sessionsMu.Unlock()
+	if sess.quota != nil {
+		s.quotas.release(sess.user, sess.quota, time.Now())
+	}
+	sess.relay.close()
+	sess.cancel()
+}
+
+// activeSessions returns the sessions that haven't ended yet.
+func (s *Server) activeSessions() []*session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *Server) session(id uint64) (*session, error) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// Session returns the session with the given ID, or ErrSessionNotFound if
+// it ended.
+func (s *Server) Session(id uint64) (Session, error) {
+	sess, err := s.session(id)
+	if err != nil {
+		return Session{}, err
+	}
+	return sess.describe(), nil
+}
+
+// Sessions returns the sessions that haven't ended yet, ordered by ID.
+func (s *Server) Sessions() []Session {
+	active := s.activeSessions()
+	sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+	sessions := make([]Session, len(active))
+	for i, sess := range active {
+		sessions[i] = sess.describe()
+	}
+	return sessions
+}
+
+// describe returns the Session describing sess. Unlike stats, it may be
+// called from outside the session's goroutines.
+func (sess *session) describe() Session {
+	d := Session{
+		SessionStats: SessionStats{Session: sess.id, Client: sess.remote},
+		Start:        sess.start,
+		State:        ConnState(sess.state.Load()),
+		Paused:       sess.relay.isPaused(),
+	}
+	// the user is settled once the target is set
+	if sess.target.Load() != nil {
+		d.SessionStats = sess.stats()
+	}
+	return d
+}
+
+// PauseSession stops relaying data for the session with the given ID while
+// keeping both of its connections open.
+func (s *Server) PauseSession(id uint64) error {
+	sess, err := s.session(id)
+	if err != nil {
+		return err
+	}
+	sess.relay.pause()
+	s.logger(SubsystemAdmin).Warn("session paused", zap.Uint64("session", id))
+	return nil
+}
+
+// Kill ends the session with the given ID at once, closing its client
+// connection, e.g. to evict a misbehaving client. The session is closed with
+// CloseKilled.
+func (s *Server) Kill(id uint64) error {
+	sess, err := s.session(id)
+	if err != nil {
+		return err
+	}
+	sess.killed.Store(true)
+	sess.cancel()
+	sess.client.Close()
+	s.logger(SubsystemAdmin).Warn("session killed", zap.Uint64("session", id))
+	return nil
+}
+
+// endKilled attributes the end of sess to Kill, rather than to the errors
+// closing its connection caused.
+func (sess *session) endKilled() {
+	if sess.killed.Load() {
+		sess.reason = ""
+		sess.end(CloseKilled, errKilled)
+	}
+}
+
+// ResumeSession resumes relaying data for a session paused by PauseSession.
+func (s *Server) ResumeSession(id uint64) error {
+	sess, err := s.session(id)
+	if err != nil {
+		return err
+	}
+	sess.relay.resume()
+	s.logger(SubsystemAdmin).Warn("session resumed", zap.Uint64("session", id))
+	return nil
+}
+
+// gate blocks the relay of a session while it is paused.
+type gate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newGate() *gate {
+	return &gate{done: make(chan struct{})}
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *gate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+func (g *gate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while the gate is paused. It returns false if the gate was
+// closed while waiting.
+func (g *gate) wait() bool {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+
+	if !paused {
+		return true
+	}
+
+	select {
+	case <-resumed:
+		return true
+	case <-g.done:
+		return false
+	}
+}
+
+// closed tells whether the gate was closed.
+func (g *gate) closed() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close releases any waiters for good.
+func (g *gate) close() {
+	g.once.Do(func() { close(g.done) })
+}
@@ -0,0 +1,320 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+	"socks4/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauseSession(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	require.ErrorIs(t, s.PauseSession(1), server.ErrSessionNotFound)
+	require.ErrorIs(t, s.ResumeSession(1), server.ErrSessionNotFound)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	require.NoError(t, s.PauseSession(1))
+	require.NoError(t, s.PauseSession(1))
+
+	message := []byte("hello world")
+	writePacket(t, c, message)
+
+	buff := make([]byte, len(message))
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Millisecond*100)))
+	_, err = c.Read(buff)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, s.ResumeSession(1))
+
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := c.Read(buff)
+	require.NoError(t, err)
+	require.Equal(t, message, buff[:n])
+}
+
+func TestSessionAccounting(t *testing.T) {
+	t.Parallel()
+
+	// the destination answers and keeps the tunnel open
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, make([]byte, 5)); err == nil {
+			conn.Write([]byte("hi!"))
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	require.Empty(t, s.Sessions())
+
+	start := time.Now()
+	c := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(ln.Addr().String()))
+	writePacket(t, c, []byte("hello"))
+	_, err = io.ReadFull(c, make([]byte, 3))
+	require.NoError(t, err)
+
+	var sess server.Session
+	require.Eventually(t, func() bool {
+		sessions := s.Sessions()
+		if len(sessions) != 1 {
+			return false
+		}
+		sess = sessions[0]
+		return sess.BytesIn == 3
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, "alice", sess.User)
+	require.Equal(t, ln.Addr().String(), sess.Target.String())
+	require.Equal(t, c.LocalAddr().String(), sess.Client.String())
+	require.Equal(t, int64(5), sess.BytesOut)
+	require.WithinRange(t, sess.Start, start, time.Now())
+
+	got, err := s.Session(sess.Session)
+	require.NoError(t, err)
+	require.Equal(t, sess, got)
+
+	require.NoError(t, c.Close())
+	require.Eventually(t, func() bool {
+		return len(s.Sessions()) == 0
+	}, time.Second*5, time.Millisecond*10)
+	_, err = s.Session(sess.Session)
+	require.ErrorIs(t, err, server.ErrSessionNotFound)
+}
+
+func TestKill(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+
+	var sess server.Session
+	require.Eventually(t, func() bool {
+		sessions := s.Sessions()
+		if len(sessions) == 1 {
+			sess = sessions[0]
+		}
+		return sess.State == server.StateActive
+	}, time.Second*5, time.Millisecond*10)
+	require.False(t, sess.Paused)
+
+	require.NoError(t, s.PauseSession(sess.Session))
+	paused, err := s.Session(sess.Session)
+	require.NoError(t, err)
+	require.True(t, paused.Paused)
+
+	require.NoError(t, s.Kill(sess.Session))
+	requireClosed(t, c)
+	requireClosedReason(t, s, server.CloseKilled)
+	require.ErrorIs(t, s.Kill(sess.Session), server.ErrSessionNotFound)
+}
+
+func TestSessionPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		t.Parallel()
+
+		client := newClient(t, server.WithSessionPolicy(server.SessionPolicy{MaxLifetime: time.Millisecond * 100}))
+		require.NoError(t, client.Connect(newEchoServer(t)))
+
+		start := time.Now()
+		requireClosed(t, client)
+		require.Less(t, time.Since(start), time.Second*5)
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		t.Parallel()
+
+		client := newClient(t, server.WithSessionPolicy(server.SessionPolicy{MaxBytes: 5}))
+		require.NoError(t, client.Connect(newEchoServer(t)))
+
+		writePacket(t, client, []byte("hello world"))
+
+		// the cap is used up by the upstream direction
+		data, err := io.ReadAll(client)
+		require.NoError(t, err)
+		require.Empty(t, data)
+	})
+
+	t.Run("MaxSessionBytes", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithMaxSessionBytes(6))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		// the echo relays the rest of the cap
+		writePacket(t, c, []byte("ping"))
+		data, err := io.ReadAll(c)
+		require.NoError(t, err)
+		require.Equal(t, "pi", string(data))
+		requireClosedReason(t, s, server.ClosePolicy)
+	})
+}
+
+func TestUserQuotas(t *testing.T) {
+	t.Parallel()
+
+	st := store.NewMemory()
+	s := createServer(t, server.WithUserQuotas(map[string]int64{"alice": 8}, time.Hour), server.WithStore(st))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	alice := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { alice.Close() })
+	require.NoError(t, alice.Connect(echoServer))
+
+	// the echo uses up the quota, ending the session
+	writePacket(t, alice, []byte("ping"))
+	data, err := io.ReadAll(alice)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+
+	usage, err := s.Quota("alice")
+	require.NoError(t, err)
+	require.Equal(t, server.QuotaUsage{User: "alice", Used: 8, Limit: 8}, usage)
+	require.True(t, usage.Exceeded())
+	require.Equal(t, []server.QuotaUsage{usage}, s.Quotas())
+
+	// usage is kept in the store, as seen by another server sharing it
+	restarted := createServer(t, server.WithUserQuotas(map[string]int64{"alice": 8}, time.Hour), server.WithStore(st))
+	restartedUsage, err := restarted.Quota("alice")
+	require.NoError(t, err)
+	require.Equal(t, usage, restartedUsage)
+
+	refused := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { refused.Close() })
+	var replyErr *client.ReplyError
+	require.ErrorAs(t, refused.Connect(echoServer), &replyErr)
+	require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+	require.Equal(t, int64(1), s.Metrics().Counter("quota_refusals_total", "").Value())
+
+	// other users have no quota
+	bob := client.NewClient(addr.String(), "bob")
+	t.Cleanup(func() { bob.Close() })
+	require.NoError(t, bob.Connect(echoServer))
+	_, err = s.Quota("bob")
+	require.ErrorIs(t, err, server.ErrNoQuota)
+	require.ErrorIs(t, s.ResetQuota("bob"), server.ErrNoQuota)
+
+	require.NoError(t, s.ResetQuota("alice"))
+	usage, err = s.Quota("alice")
+	require.NoError(t, err)
+	require.Zero(t, usage.Used)
+
+	served := client.NewClient(addr.String(), "alice")
+	t.Cleanup(func() { served.Close() })
+	require.NoError(t, served.Connect(echoServer))
+}
+
+func TestMaintenance(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	established := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { established.Close() })
+	require.NoError(t, established.Connect(echoServer))
+
+	s.SetMaintenance(true)
+	require.True(t, s.Maintenance())
+
+	refused := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { refused.Close() })
+	require.Error(t, refused.Connect(echoServer))
+	requireClosedReason(t, s, server.CloseMaintenance)
+	require.Equal(t, int64(1), s.Metrics().Gauge("maintenance_mode", "").Value())
+
+	// the established session is unaffected
+	_, err = established.Write([]byte("ping"))
+	require.NoError(t, err)
+	buff := make([]byte, 4)
+	_, err = io.ReadFull(established, buff)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buff))
+
+	s.SetMaintenance(false)
+	accepted := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { accepted.Close() })
+	require.NoError(t, accepted.Connect(echoServer))
+}
+
+func TestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	listen := func(t *testing.T, opts ...server.Option) (*server.Server, *client.Client) {
+		s := createServer(t, opts...)
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		return s, c
+	}
+
+	t.Run("Idle", func(t *testing.T) {
+		t.Parallel()
+
+		s, c := listen(t, server.WithIdleTimeout(time.Millisecond*50))
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		requireClosedReason(t, s, server.CloseIdleTimeout)
+	})
+
+	t.Run("Dial", func(t *testing.T) {
+		t.Parallel()
+
+		dialer := blackholeDialer{pipeDialer{make(chan string, 1)}, "192.0.2.1:7"}
+		_, c := listen(t, server.WithDialer(dialer), server.WithDialTimeout(time.Millisecond*100))
+
+		start := time.Now()
+		require.Error(t, c.Connect("192.0.2.1:7"))
+		require.Less(t, time.Since(start), time.Second*5)
+	})
+
+	t.Run("MaxSessionDuration", func(t *testing.T) {
+		t.Parallel()
+
+		s, c := listen(t, server.WithMaxSessionDuration(time.Millisecond*50))
+		require.NoError(t, c.Connect(newEchoServer(t)))
+
+		requireClosedReason(t, s, server.ClosePolicy)
+	})
+}
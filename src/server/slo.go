@@ -0,0 +1,35 @@
+package server
+
+import (
+	"time"
+)
+
+// SLO configures the service level indicators the server exports.
+type SLO struct {
+	// Rolling window the indicators are computed over. Defaults to 5
+	// minutes.
+	Window time.Duration
+
+	// CONNECT handshakes completing within this time count as good.
+	// Defaults to 100 milliseconds.
+	HandshakeThreshold time.Duration
+}
+
+var defaultSLO = SLO{
+	Window:             time.Minute * 5,
+	HandshakeThreshold: time.Millisecond * 100,
+}
+
+// recordHandshake records the latency of a completed CONNECT handshake.
+func (s *Server) recordHandshake(latency time.Duration) {
+	s.metrics.Histogram("connect_handshake_seconds", "Time from accepting a client to replying to its CONNECT.").
+		Observe(latency.Seconds())
+	s.metrics.SLI("connect_handshake_sli", "Fraction of CONNECT handshakes within the SLO threshold.", s.slo.Window).
+		Record(latency <= s.slo.HandshakeThreshold)
+}
+
+// recordDial records the outcome of an outbound dial.
+func (s *Server) recordDial(err error) {
+	s.metrics.SLI("dial_success_sli", "Fraction of outbound dials succeeding.", s.slo.Window).
+		Record(err == nil)
+}
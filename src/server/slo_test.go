@@ -0,0 +1,32 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLO(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithSLO(server.SLO{HandshakeThreshold: time.Hour}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	ok := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { ok.Close() })
+	require.NoError(t, ok.Connect(newEchoServer(t)))
+
+	refused := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { refused.Close() })
+	require.Error(t, refused.Connect("127.0.0.1:1"))
+
+	m := s.Metrics()
+	require.InDelta(t, 0.5, m.SLI("dial_success_sli", "", 0).Ratio(), 1e-9)
+	require.InDelta(t, 1, m.SLI("connect_handshake_sli", "", 0).Ratio(), 1e-9)
+	require.EqualValues(t, 1, m.Histogram("connect_handshake_seconds", "").Count())
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"socks4/proto"
+	"socks4/proto/socks5"
+
+	"go.uber.org/zap"
+)
+
+// Protocol is a protocol a client may speak on the listen port.
+type Protocol uint8
+
+const (
+	ProtocolSOCKS4 Protocol = 1 << iota
+	ProtocolSOCKS4a
+	ProtocolSOCKS5
+	ProtocolHTTPConnect
+
+	allProtocols = ProtocolSOCKS4 | ProtocolSOCKS4a | ProtocolSOCKS5 | ProtocolHTTPConnect
+)
+
+var errProtocolDisabled = errors.New("protocol is disabled")
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolSOCKS4:
+		return "socks4"
+	case ProtocolSOCKS4a:
+		return "socks4a"
+	case ProtocolSOCKS5:
+		return "socks5"
+	case ProtocolHTTPConnect:
+		return "http_connect"
+	default:
+		return fmt.Sprintf("protocol(%d)", uint8(p))
+	}
+}
+
+// sniff detects the protocol of the client from the start of its first
+// message, without consuming it.
+func (s *Server) sniff(sess *session) (Protocol, error) {
+	return DetectProtocol(sess.in)
+}
+
+// DetectProtocol detects the protocol of a client from the start of its
+// first message, peeking at as few bytes as it needs without consuming them.
+// Servers that speak other protocols on the same port can use it to pick out
+// the clients to hand to Server.ServeConn, along with what r buffered. As
+// anything starting with an upper-case letter is taken for an HTTP request
+// line, such servers should check for the protocols they mean to hand over.
+func DetectProtocol(r *bufio.Reader) (Protocol, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case first[0] == proto.Version:
+		// SOCKS4a requests carry an IP of 0.0.0.x, x != 0
+		header, err := r.Peek(8)
+		if err != nil {
+			return 0, err
+		} else if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+			return ProtocolSOCKS4a, nil
+		}
+		return ProtocolSOCKS4, nil
+	case first[0] == socks5.Version:
+		return ProtocolSOCKS5, nil
+	case first[0] >= 'A' && first[0] <= 'Z':
+		// the method of an HTTP request line
+		return ProtocolHTTPConnect, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol starting with %#x", first[0])
+	}
+}
+
+// refuse sends a client an error reply before its request has been read,
+// using only what sniff peeked.
+func (s *Server) refuse(sess *session, protocol Protocol) {
+	var err error
+	switch protocol {
+	case ProtocolSOCKS4, ProtocolSOCKS4a:
+		header, _ := sess.in.Peek(8)
+		port := int(header[2])<<8 | int(header[3])
+		err = sendReply(sess.client, proto.RejectedFailed, header[4:8], port)
+	case ProtocolSOCKS5:
+		err = writeSOCKS5(sess.client, socks5.MethodSelection{Method: socks5.MethodNoAcceptable}.Serialize())
+	case ProtocolHTTPConnect:
+		status := http.StatusForbidden
+		if s.Maintenance() {
+			status = http.StatusServiceUnavailable
+		}
+		err = writeHTTPStatus(sess.client, status, nil)
+	}
+	if err != nil {
+		sess.log.Error("failed to send error response", zap.Error(err))
+	}
+}
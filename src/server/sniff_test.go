@@ -0,0 +1,158 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/proto/socks5"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolSniffing(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	conn := socks5Dial(t, addr.String(), nil)
+	reply := socks5Request(t, conn, socks5.ConnectCommand, socks5.Addr{IP: net.IPv4(127, 0, 0, 1), Port: portOf(t, echoServer)})
+	require.Equal(t, socks5.Succeeded, reply.Code)
+	requireEcho(t, conn)
+
+	conn, err = net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(socks4aRequest(proto.ConnectCommand, portOf(t, echoServer), "localhost"))
+	require.NoError(t, err)
+	socks4Reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, socks4Reply.Code())
+	requireEcho(t, conn)
+
+	for _, protocol := range []server.Protocol{server.ProtocolSOCKS4a, server.ProtocolSOCKS5} {
+		require.Equal(t, int64(1), s.Metrics().Counter("handshakes_total", "", "protocol", protocol.String()).Value())
+	}
+}
+
+func TestWithProtocols(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	listen := func(t *testing.T, protocols ...server.Protocol) (*server.Server, string) {
+		s := createServer(t, server.WithProtocols(protocols...))
+		addr, err := s.ListenAndServe("localhost:0")
+		require.NoError(t, err)
+		return s, addr.String()
+	}
+
+	t.Run("socks4 disabled", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t, server.ProtocolSOCKS4a, server.ProtocolSOCKS5)
+		c := client.NewClient(addr, "")
+		t.Cleanup(func() { c.Close() })
+		require.ErrorContains(t, c.Connect(echoServer), "91")
+		requireClosedReason(t, s, server.CloseBadRequest)
+
+		conn := socks5Dial(t, addr, nil)
+		reply := socks5Request(t, conn, socks5.ConnectCommand, socks5.Addr{IP: net.IPv4(127, 0, 0, 1), Port: portOf(t, echoServer)})
+		require.Equal(t, socks5.Succeeded, reply.Code)
+	})
+
+	t.Run("socks5 disabled", func(t *testing.T) {
+		t.Parallel()
+
+		s, addr := listen(t, server.ProtocolSOCKS4)
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}.Serialize())
+		require.NoError(t, err)
+		selection, err := socks5.ReadMethodSelection(conn)
+		require.NoError(t, err)
+		require.Equal(t, socks5.MethodNoAcceptable, selection.Method)
+		requireClosedReason(t, s, server.CloseBadRequest)
+	})
+}
+
+func TestDetectProtocol(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		prefix   []byte
+		protocol server.Protocol
+	}{
+		{[]byte{4, 1, 0, 80, 1, 2, 3, 4}, server.ProtocolSOCKS4},
+		{[]byte{4, 1, 0, 80, 0, 0, 0, 1}, server.ProtocolSOCKS4a},
+		{[]byte{5, 1, 0}, server.ProtocolSOCKS5},
+		{[]byte("CONNECT "), server.ProtocolHTTPConnect},
+	} {
+		protocol, err := server.DetectProtocol(bufio.NewReader(bytes.NewReader(test.prefix)))
+		require.NoError(t, err)
+		require.Equal(t, test.protocol, protocol)
+	}
+
+	_, err := server.DetectProtocol(bufio.NewReader(bytes.NewReader([]byte{4, 1, 0, 80})))
+	require.Error(t, err)
+	_, err = server.DetectProtocol(bufio.NewReader(bytes.NewReader([]byte{0x16, 3, 1})))
+	require.Error(t, err)
+}
+
+func TestServeConn(t *testing.T) {
+	t.Parallel()
+
+	// a server that greets anything but SOCKS clients
+	s := createServer(t)
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				if _, err := server.DetectProtocol(r); err != nil {
+					conn.Write([]byte("not socks\n"))
+					conn.Close()
+					return
+				}
+				buffered, _ := r.Peek(r.Buffered())
+				s.ServeConn(conn, buffered)
+			}()
+		}
+	}()
+
+	c := client.NewClient(ln.Addr().String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+	requireEcho(t, c)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte{0x16, 3, 1})
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "not socks\n", line)
+
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Close(ctx))
+	require.ErrorIs(t, s.ServeConn(conn, nil), net.ErrClosed)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// destinationIPs returns the IPs a request's destination refers to.
+// Hostnames, as sent by SOCKS4a and SOCKS5 clients, are resolved on the
+// proxy using the session's DNS routes, and pinned for the session.
+func (s *Server) destinationIPs(sess *session, deadline time.Time, req *request) ([]net.IP, error) {
+	if req.hostname == "" {
+		return []net.IP{canonicalIP(req.ip)}, nil
+	}
+
+	ctx, cancel := context.WithDeadline(sess.ctx, deadline.Add(-time.Second))
+	defer cancel()
+
+	host := req.hostname
+	if ips, ok := sess.pinned(host); ok {
+		return ips, nil
+	}
+	ips, err := s.lookupHostname(ctx, sess, host)
+	if err != nil {
+		return nil, err
+	}
+	s.pinHostname(sess, host, ips)
+	return ips, nil
+}
+
+// lookupHostname resolves host using the session's DNS routes.
+func (s *Server) lookupHostname(ctx context.Context, sess *session, host string) ([]net.IP, error) {
+	ips, err := sess.rules.resolver.LookupIP(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses for %q", host)
+	}
+	if err != nil {
+		s.metrics.Counter("socks4a_resolve_failures_total", "SOCKS4a hostnames that failed to resolve.").Inc()
+		return nil, fmt.Errorf("failed to resolve hostname - %w", err)
+	}
+
+	for i := range ips {
+		ips[i] = canonicalIP(ips[i])
+	}
+	return ips, nil
+}
+
+// pinHostname pins host to the addresses it resolved to for the session.
+func (s *Server) pinHostname(sess *session, host string, ips []net.IP) {
+	sess.log.Info("resolved hostname", zap.String("hostname", host), zap.Stringers("ips", ipStringers(ips)))
+	sess.pin(host, ips, s.dnsPinTTL)
+}
+
+// destinationAddrs returns the dialable addresses for a request through
+// route. A hostname is passed on unresolved when the route's upstream
+// proxies all resolve hostnames themselves, unless the destination's
+// address must be checked against the ACL, DestinationFilter or private
+// addresses.
+func (s *Server) destinationAddrs(sess *session, deadline time.Time, req *request, route route) ([]string, error) {
+	port := strconv.Itoa(req.port)
+	if req.hostname != "" && route.upstreams != nil && route.upstreams.resolvesRemotely() &&
+		sess.rules.DestinationFilter == nil && !sess.rules.hasACL() && !s.blockPrivate {
+		return []string{net.JoinHostPort(req.hostname, port)}, nil
+	}
+
+	ips, err := s.destinationIPs(sess, deadline, req)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs, nil
+}
+
+func ipStringers(ips []net.IP) []fmt.Stringer {
+	out := make([]fmt.Stringer, len(ips))
+	for i, ip := range ips {
+		out[i] = ip
+	}
+	return out
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func socks4aRequest(cmd proto.Command, port int, host string) []byte {
+	p := []byte{proto.Version, cmd, byte(port >> 8), byte(port), 0, 0, 0, 1, 0}
+	return append(append(p, host...), 0)
+}
+
+func TestSocks4aConnect(t *testing.T) {
+	t.Parallel()
+
+	dns := newDNSServer(t, net.IPv4(127, 0, 0, 1))
+	s := createServer(t, server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dns}}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write(socks4aRequest(proto.ConnectCommand, portOf(t, echoServer), "echo.test"))
+	require.NoError(t, err)
+
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, reply.Code())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buff := make([]byte, 4)
+	_, err = io.ReadFull(conn, buff)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buff))
+}
+
+func TestSocks4aResolveFailure(t *testing.T) {
+	t.Parallel()
+
+	dead := deadDNSServer(t)
+	s := createServer(t, server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dead}, Timeout: 100 * time.Millisecond}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write(socks4aRequest(proto.ConnectCommand, 80, "missing.test"))
+	require.NoError(t, err)
+
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.ErrorReply, reply.Code())
+	requireClosed(t, conn)
+
+	require.EqualValues(t, 1, s.Metrics().Counter("socks4a_resolve_failures_total", "").Value())
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"socks4/proto"
+	"socks4/proto/socks5"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readSOCKS5 negotiates authentication with a SOCKS5 client and reads its
+// request. It returns nil if the session ended instead.
+//
+// Clients must use username/password authentication when the policy has
+// an Authenticator, and no authentication otherwise.
+func (s *Server) readSOCKS5(sess *session, deadline time.Time) *request {
+	greeting, err := socks5.ReadGreeting(sess.in)
+	if err != nil {
+		sess.client.SetReadDeadline(deadline)
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read greeting - %w", err))
+		return nil
+	}
+
+	method := socks5.MethodNoAuth
+	if sess.rules.Authenticator != nil {
+		method = socks5.MethodUserPass
+	}
+	if !greeting.Offers(method) {
+		sess.client.SetReadDeadline(deadline)
+		sess.end(CloseUnauthorized, fmt.Errorf("client doesn't offer authentication method %#x", method))
+		writeSOCKS5(sess.client, socks5.MethodSelection{Method: socks5.MethodNoAcceptable}.Serialize())
+		return nil
+	}
+	if err := writeSOCKS5(sess.client, socks5.MethodSelection{Method: method}.Serialize()); err != nil {
+		sess.end(CloseClientError, fmt.Errorf("failed to send method selection - %w", err))
+		return nil
+	}
+
+	if method == socks5.MethodUserPass && !s.negotiatePassword(sess, deadline) {
+		return nil
+	}
+
+	msg, err := socks5.ReadRequest(sess.in)
+	sess.client.SetReadDeadline(deadline)
+	if err != nil {
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read request - %w", err))
+		if errors.Is(err, socks5.ErrAddressType) {
+			sendSOCKS5Reply(sess.client, socks5.AddressTypeNotSupported, socks5.Addr{IP: net.IPv4zero})
+		}
+		return nil
+	}
+
+	req := &request{
+		hostname: msg.Addr.Host,
+		ip:       msg.Addr.IP,
+		port:     msg.Addr.Port,
+		reply:    socks5Replier{conn: sess.client, command: msg.Command},
+	}
+	switch msg.Command {
+	case socks5.ConnectCommand:
+		req.command = proto.ConnectCommand
+	case socks5.BindCommand:
+		req.command = proto.BindCommand
+	default:
+		sess.end(CloseBadRequest, fmt.Errorf("unsupported command %#x", msg.Command))
+		sendSOCKS5Reply(sess.client, socks5.CommandNotSupported, socks5.Addr{IP: net.IPv4zero})
+		return nil
+	}
+	sess.log.Info("socks5 request", zap.Stringer("destination", msg.Addr))
+
+	if method == socks5.MethodNoAuth {
+		if err := s.identify(sess, deadline, ""); err != nil {
+			sess.end(CloseUnauthorized, fmt.Errorf("failed to identify client - %w", err))
+			s.sendError(sess, req, err)
+			return nil
+		}
+	}
+	return req
+}
+
+// negotiatePassword runs the username/password subnegotiation, returning
+// false if the session ended.
+func (s *Server) negotiatePassword(sess *session, deadline time.Time) bool {
+	creds, err := socks5.ReadUserPassRequest(sess.in)
+	if err != nil {
+		sess.client.SetReadDeadline(deadline)
+		sess.end(CloseBadRequest, fmt.Errorf("failed to read credentials - %w", err))
+		return false
+	}
+
+	err = s.identify(sess, deadline, creds.Username)
+	if err != nil {
+		err = fmt.Errorf("failed to identify client - %w", err)
+	} else if err = s.authenticatePassword(sess, deadline, creds.Password); err != nil {
+		err = fmt.Errorf("request not authorized for %q - %w", sess.user, err)
+	}
+	if err != nil {
+		sess.client.SetReadDeadline(deadline)
+		sess.end(CloseUnauthorized, err)
+		writeSOCKS5(sess.client, socks5.UserPassStatus{Status: 1}.Serialize())
+		return false
+	}
+
+	if err := writeSOCKS5(sess.client, socks5.UserPassStatus{}.Serialize()); err != nil {
+		sess.end(CloseClientError, fmt.Errorf("failed to send authentication status - %w", err))
+		return false
+	}
+	return true
+}
+
+// socks5Replier answers SOCKS5 requests.
+type socks5Replier struct {
+	conn    net.Conn
+	command byte
+}
+
+func (r socks5Replier) bound(ip net.IP, port int) error {
+	return sendSOCKS5Reply(r.conn, socks5.Succeeded, socks5.Addr{IP: ip, Port: port})
+}
+
+func (r socks5Replier) granted(remote net.Conn) error {
+	// a CONNECT is answered with the address the proxy connected from,
+	// a BIND with the address of the peer
+	addr := remote.LocalAddr()
+	if r.command == socks5.BindCommand {
+		addr = remote.RemoteAddr()
+	}
+	return sendSOCKS5Reply(r.conn, socks5.Succeeded, socks5.AddrFrom(canonicalAddr(addr)))
+}
+
+func (r socks5Replier) failed(cause error) error {
+	return sendSOCKS5Reply(r.conn, socks5ReplyCode(cause), socks5.Addr{IP: net.IPv4zero})
+}
+
+// socks5ReplyCode returns the reply code for a request that failed with err.
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrNoIdentd), errors.Is(err, ErrIdentMismatch),
+		errors.Is(err, errQuotaExceeded):
+		return socks5.NotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5.HostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return socks5.TTLExpired
+	default:
+		return socks5.GeneralFailure
+	}
+}
+
+func sendSOCKS5Reply(conn net.Conn, code byte, addr socks5.Addr) error {
+	body, err := socks5.Reply{Code: code, Addr: addr}.Serialize()
+	if err != nil {
+		return fmt.Errorf("failed to serialize reply - %w", err)
+	}
+	return writeSOCKS5(conn, body)
+}
+
+func writeSOCKS5(conn net.Conn, body []byte) error {
+	if err := proto.WriteFull(conn, body, replyTimeout); err != nil {
+		return fmt.Errorf("failed to write to client - %w", err)
+	}
+	return nil
+}
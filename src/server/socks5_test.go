@@ -0,0 +1,196 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"socks4/proto/socks5"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// socks5Dial connects to a server and negotiates authentication, using
+// username/password if creds is set.
+func socks5Dial(t *testing.T, addr string, creds *socks5.UserPassRequest) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	method := socks5.MethodNoAuth
+	if creds != nil {
+		method = socks5.MethodUserPass
+	}
+	_, err = conn.Write(socks5.Greeting{Methods: []byte{method}}.Serialize())
+	require.NoError(t, err)
+	selection, err := socks5.ReadMethodSelection(conn)
+	require.NoError(t, err)
+	require.Equal(t, method, selection.Method)
+
+	if creds != nil {
+		body, err := creds.Serialize()
+		require.NoError(t, err)
+		_, err = conn.Write(body)
+		require.NoError(t, err)
+		status, err := socks5.ReadUserPassStatus(conn)
+		require.NoError(t, err)
+		require.Zero(t, status.Status)
+	}
+	return conn
+}
+
+func socks5Request(t *testing.T, conn net.Conn, cmd byte, addr socks5.Addr) *socks5.Reply {
+	t.Helper()
+
+	body, err := socks5.Request{Command: cmd, Addr: addr}.Serialize()
+	require.NoError(t, err)
+	_, err = conn.Write(body)
+	require.NoError(t, err)
+
+	reply, err := socks5.ReadReply(conn)
+	require.NoError(t, err)
+	return reply
+}
+
+func requireEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buff := make([]byte, 4)
+	_, err = io.ReadFull(conn, buff)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buff))
+}
+
+func TestSocks5Connect(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	port := portOf(t, newEchoServer(t))
+
+	for name, dest := range map[string]socks5.Addr{
+		"ipv4":   {IP: net.IPv4(127, 0, 0, 1), Port: port},
+		"domain": {Host: "localhost", Port: port},
+	} {
+		t.Run(name, func(dest socks5.Addr) func(t *testing.T) {
+			return func(t *testing.T) {
+				t.Parallel()
+
+				conn := socks5Dial(t, addr.String(), nil)
+				reply := socks5Request(t, conn, socks5.ConnectCommand, dest)
+				require.Equal(t, socks5.Succeeded, reply.Code)
+				require.True(t, reply.Addr.IP.IsLoopback())
+				requireEcho(t, conn)
+			}
+		}(dest))
+	}
+}
+
+func TestSocks5ConnectIPv6(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable")
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			echo(t, conn)
+		}
+	}()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	conn := socks5Dial(t, addr.String(), nil)
+	reply := socks5Request(t, conn, socks5.ConnectCommand, socks5.Addr{IP: net.IPv6loopback, Port: portOf(t, ln.Addr().String())})
+	require.Equal(t, socks5.Succeeded, reply.Code)
+	requireEcho(t, conn)
+}
+
+func TestSocks5PasswordAuth(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("secret")))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	port := portOf(t, newEchoServer(t))
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		conn := socks5Dial(t, addr.String(), &socks5.UserPassRequest{Username: "alice", Password: "secret"})
+		reply := socks5Request(t, conn, socks5.ConnectCommand, socks5.Addr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		require.Equal(t, socks5.Succeeded, reply.Code)
+		requireEcho(t, conn)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(socks5.Greeting{Methods: []byte{socks5.MethodUserPass}}.Serialize())
+		require.NoError(t, err)
+		_, err = socks5.ReadMethodSelection(conn)
+		require.NoError(t, err)
+
+		body, err := socks5.UserPassRequest{Username: "alice", Password: "wrong"}.Serialize()
+		require.NoError(t, err)
+		_, err = conn.Write(body)
+		require.NoError(t, err)
+		status, err := socks5.ReadUserPassStatus(conn)
+		require.NoError(t, err)
+		require.NotZero(t, status.Status)
+		requireClosed(t, conn)
+	})
+
+	t.Run("no auth offered", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}.Serialize())
+		require.NoError(t, err)
+		selection, err := socks5.ReadMethodSelection(conn)
+		require.NoError(t, err)
+		require.Equal(t, socks5.MethodNoAcceptable, selection.Method)
+		requireClosed(t, conn)
+	})
+}
+
+func TestSocks5ReplyCodes(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := portOf(t, ln.Addr().String())
+	ln.Close()
+
+	conn := socks5Dial(t, addr.String(), nil)
+	reply := socks5Request(t, conn, socks5.ConnectCommand, socks5.Addr{IP: net.IPv4(127, 0, 0, 1), Port: refused})
+	require.Equal(t, socks5.ConnectionRefused, reply.Code)
+
+	conn = socks5Dial(t, addr.String(), nil)
+	reply = socks5Request(t, conn, socks5.UDPAssociateCommand, socks5.Addr{IP: net.IPv4zero})
+	require.Equal(t, socks5.CommandNotSupported, reply.Code)
+
+	requireClosedReason(t, s, server.CloseBadRequest)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// sourceAddr returns the local address to dial addr from, given source,
+// an IP address or the name of an interface. Any address of the interface
+// will do for a hostname, which an upstream proxy resolves.
+func sourceAddr(source, addr string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split destination host & port - %w", err)
+	}
+	dst := net.ParseIP(host)
+
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q - %w", source, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s - %w", source, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if ok && (dst == nil || (ipNet.IP.To4() != nil) == (dst.To4() != nil)) && !ipNet.IP.IsLinkLocalUnicast() {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no address to dial %s from", source, addr)
+}
@@ -0,0 +1,106 @@
+package server_test
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newPeerServer accepts connections, reporting the IP each came from.
+func newPeerServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	peers := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peers <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), peers
+}
+
+func TestSourceAddress(t *testing.T) {
+	t.Parallel()
+
+	dst, peers := newPeerServer(t)
+	s := createServer(t,
+		server.WithSourceAddress("127.0.0.2"),
+		server.WithPolicy(server.Policy{ACL: parseACL(t,
+			"allow * * rerouted from 127.0.0.3",
+			"allow * * local from lo",
+			"allow * *",
+		)}),
+	)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	for user, source := range map[string]string{"": "127.0.0.2", "rerouted": "127.0.0.3", "local": "127.0.0.1"} {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(dst))
+
+		select {
+		case peer := <-peers:
+			require.Equal(t, source, peer, user)
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected a connection")
+		}
+	}
+}
+
+func TestUserRoutes(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	upstream := createServer(t, server.WithHooks(server.Hooks{
+		OnRequest: func(*server.Request) error {
+			requests.Add(1)
+			return nil
+		},
+	}))
+	upstreamAddr, err := upstream.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	dst, peers := newPeerServer(t)
+	s := createServer(t,
+		server.WithSourceAddress("127.0.0.2"),
+		server.WithUserRoutes(map[string]server.Route{
+			"alice": {Source: "127.0.0.4"},
+			"bob":   {Upstreams: []*url.URL{{Scheme: "socks4", Host: upstreamAddr.String()}}},
+		}),
+	)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	for user, source := range map[string]string{"": "127.0.0.2", "alice": "127.0.0.4", "carol": "127.0.0.2", "bob": "127.0.0.1"} {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(dst))
+
+		select {
+		case peer := <-peers:
+			require.Equal(t, source, peer, user)
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected a connection")
+		}
+	}
+
+	// only bob's requests went through the upstream proxy
+	require.EqualValues(t, 1, requests.Load())
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSplice bounds each splice(2) call, which moves no more than the pipe
+// holds anyway.
+const maxSplice = 1 << 20
+
+// errNoSplice reports that the sockets of a relay can't be spliced.
+var errNoSplice = errors.New("splice unsupported")
+
+// splicePipe is a pipe a relay direction splices data through, from one
+// socket into the pipe and from the pipe into the other, so the data never
+// enters user space.
+type splicePipe struct {
+	r, w int
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	return &splicePipe{r: fds[0], w: fds[1]}, nil
+}
+
+func (p *splicePipe) Close() error {
+	unix.Close(p.r)
+	return unix.Close(p.w)
+}
+
+// copy moves up to limit bytes from src to dst through the pipe, like
+// io.Copy of an io.LimitedReader: it returns a nil error once src reaches
+// EOF. Errors of dst are reported as write errors. It returns errNoSplice
+// without moving anything if the sockets can't be spliced. When a write to
+// dst times out, refresh is called to extend its deadline, and the write
+// retried if it returns true. The pipe is left empty unless writing to dst
+// failed.
+func (p *splicePipe) copy(dst, src *net.TCPConn, limit int64, refresh func() bool) (int64, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for written < limit {
+		chunk := limit - written
+		if chunk > maxSplice {
+			chunk = maxSplice
+		}
+
+		var n int
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = splice(int(fd), p.w, int(chunk))
+			return spliceErr != unix.EAGAIN
+		})
+		if err == nil && spliceErr != nil {
+			if written == 0 && (spliceErr == unix.EINVAL || spliceErr == unix.ENOSYS) {
+				return 0, errNoSplice
+			}
+			err = os.NewSyscallError("splice", spliceErr)
+		}
+		if err != nil {
+			return written, &net.OpError{Op: "read", Net: "tcp", Source: src.LocalAddr(), Addr: src.RemoteAddr(), Err: err}
+		} else if n == 0 {
+			return written, nil
+		}
+
+		for n > 0 {
+			var m int
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = splice(p.r, int(fd), n)
+				return spliceErr != unix.EAGAIN
+			})
+			if err == nil && spliceErr != nil {
+				err = os.NewSyscallError("splice", spliceErr)
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && refresh() {
+				continue
+			} else if err != nil {
+				return written, &net.OpError{Op: "write", Net: "tcp", Source: dst.LocalAddr(), Addr: dst.RemoteAddr(), Err: err}
+			}
+			n -= m
+			written += int64(m)
+		}
+	}
+	return written, nil
+}
+
+// splice moves up to n bytes from the file descriptor in to out, retrying
+// when interrupted.
+func splice(in, out, n int) (int, error) {
+	for {
+		moved, err := unix.Splice(in, nil, out, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err != unix.EINTR {
+			return int(moved), err
+		}
+	}
+}
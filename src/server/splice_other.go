@@ -0,0 +1,26 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoSplice = errors.New("splice is only supported on Linux")
+
+// splicePipe is unavailable outside of Linux, leaving relays to
+// io.CopyBuffer.
+type splicePipe struct{}
+
+func newSplicePipe() (*splicePipe, error) {
+	return nil, errNoSplice
+}
+
+func (p *splicePipe) Close() error {
+	return nil
+}
+
+func (p *splicePipe) copy(dst, src *net.TCPConn, limit int64, refresh func() bool) (int64, error) {
+	return 0, errNoSplice
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+var errEarlyData = errors.New("client sent data before the success reply")
+
+// checkEarlyData fails with errEarlyData if strict ordering is enabled and
+// the client has sent anything past its request.
+func (s *Server) checkEarlyData(sess *session, deadline time.Time) error {
+	if !s.strictOrdering {
+		return nil
+	}
+
+	// anything buffered or readable now was sent after the request
+	if sess.in.Buffered() > 0 {
+		return s.earlyData(sess)
+	}
+	if err := sess.client.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return err
+	}
+	n, _ := sess.client.Read(make([]byte, 1))
+	if err := sess.client.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	if n > 0 {
+		return s.earlyData(sess)
+	}
+	return nil
+}
+
+func (s *Server) earlyData(sess *session) error {
+	s.metrics.Counter("early_data_violations_total", "Sessions failed for sending data before the success reply.").Inc()
+	return errEarlyData
+}
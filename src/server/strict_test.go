@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrictOrdering(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithStrictOrdering())
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	req, err := proto.NewRequest(proto.ConnectCommand, echoServer, "")
+	require.NoError(t, err)
+
+	t.Run("Ordered", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(req.Serialize())
+		require.NoError(t, err)
+
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.SuccessReply, reply.Code())
+	})
+
+	t.Run("Pipelined", func(t *testing.T) {
+		t.Parallel()
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		_, err = conn.Write(append(req.Serialize(), []byte("early")...))
+		require.NoError(t, err)
+
+		reply, err := proto.ReadReply(conn)
+		require.NoError(t, err)
+		require.Equal(t, proto.ErrorReply, reply.Code())
+		requireClosed(t, conn)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// handshakeTLS runs the TLS handshake with a client accepted by a TLS
+// listener, within the connection's deadlines.
+func (s *Server) handshakeTLS(sess *session, conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		s.metrics.Counter("tls_handshake_failures_total", "TLS handshakes with clients that failed.").Inc()
+		return fmt.Errorf("failed TLS handshake with client - %w", err)
+	}
+
+	s.metrics.Counter("tls_handshakes_total", "TLS handshakes with clients.").Inc()
+	state := conn.ConnectionState()
+	sess.log.Debug("TLS established with client",
+		zap.String("tls-version", tls.VersionName(state.Version)),
+		zap.Bool("resumed", state.DidResume),
+	)
+	return nil
+}
+
+// certificateUser returns the user ID of the verified client certificate of
+// sess, if it has one.
+func (s *Server) certificateUser(sess *session) (string, bool) {
+	conn, ok := sess.client.(*tls.Conn)
+	if !ok || s.clientCAs == nil {
+		return "", false
+	}
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", false
+	}
+
+	cert := chains[0][0]
+	if s.certUser != nil {
+		return s.certUser(cert), true
+	}
+	return cert.Subject.CommonName, true
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func selfSignedCert(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	t.Parallel()
+
+	cert := selfSignedCert(t, "localhost")
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	s := createServer(t)
+	addr, err := s.ListenAndServeTLS("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "", client.WithTLSConfig(&tls.Config{RootCAs: pool}))
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+	requireEcho(t, c)
+	require.Equal(t, int64(1), s.Metrics().Counter("tls_handshakes_total", "").Value())
+
+	// plaintext SOCKS4 is refused
+	plain := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { plain.Close() })
+	require.Error(t, plain.Connect(newEchoServer(t)))
+	requireClosedReason(t, s, server.CloseBadRequest)
+	require.Equal(t, int64(1), s.Metrics().Counter("tls_handshake_failures_total", "").Value())
+}
+
+func TestClientCertificates(t *testing.T) {
+	t.Parallel()
+
+	serverCert := selfSignedCert(t, "localhost")
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	clientCert := selfSignedCert(t, "mcr")
+	cas := x509.NewCertPool()
+	cas.AddCert(clientCert.Leaf)
+
+	s := createServer(t,
+		server.WithClientCertificates(cas, nil),
+		server.WithAuthenticator(server.NewStaticTokenAuthenticator("mcr")),
+	)
+	addr, err := s.ListenAndServeTLS("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	require.NoError(t, err)
+
+	// the user ID comes from the certificate, not the request
+	c := client.NewClient(addr.String(), "someone-else", client.WithTLSConfig(&tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}))
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(newEchoServer(t)))
+	requireEcho(t, c)
+
+	anonymous := client.NewClient(addr.String(), "mcr", client.WithTLSConfig(&tls.Config{RootCAs: roots}))
+	t.Cleanup(func() { anonymous.Close() })
+	require.Error(t, anonymous.Connect(newEchoServer(t)))
+	requireClosedReason(t, s, server.CloseBadRequest)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TLSOrigination makes the proxy wrap connections to matching destinations
+// in TLS itself, for clients that can't speak TLS but must reach TLS-only
+// services. The client then speaks plaintext through the tunnel.
+type TLSOrigination struct {
+	// Destination port to match.
+	Port int
+
+	// Domain suffix of the requested hostname to match, e.g. "corp". An
+	// empty Suffix also matches destinations requested by IP.
+	Suffix string
+
+	// Used for the handshake with the destination. ServerName defaults to
+	// the requested hostname or IP. A nil Config uses the system roots.
+	Config *tls.Config
+}
+
+func (o *TLSOrigination) matches(req *request) bool {
+	if o.Port != req.port {
+		return false
+	}
+	suffix := strings.ToLower(strings.Trim(o.Suffix, "."))
+	if suffix == "" {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(req.hostname, "."))
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+// tlsOrigination returns the first TLSOrigination of the policy matching
+// req, or nil.
+func (p *activePolicy) tlsOrigination(req *request) *TLSOrigination {
+	for i := range p.TLSOrigination {
+		if p.TLSOrigination[i].matches(req) {
+			return &p.TLSOrigination[i]
+		}
+	}
+	return nil
+}
+
+// originateTLS runs a TLS handshake with the destination over remote.
+func (s *Server) originateTLS(sess *session, deadline time.Time, req *request, origination *TLSOrigination, remote net.Conn) (net.Conn, error) {
+	config := &tls.Config{}
+	if origination.Config != nil {
+		config = origination.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = req.hostname
+		if config.ServerName == "" {
+			config.ServerName = req.ip.String()
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(sess.ctx, deadline.Add(-time.Second))
+	defer cancel()
+
+	conn := tls.Client(remote, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		s.metrics.Counter("tls_origination_failures_total", "TLS handshakes with destinations that failed.").Inc()
+		return nil, fmt.Errorf("failed TLS handshake with destination - %w", err)
+	}
+
+	s.metrics.Counter("tls_originations_total", "Connections the proxy wrapped in TLS for the client.").Inc()
+	state := conn.ConnectionState()
+	sess.log.Info("originated TLS to destination",
+		zap.String("server-name", config.ServerName),
+		zap.String("tls-version", tls.VersionName(state.Version)),
+	)
+	return conn, nil
+}
@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSOrigination(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "tls-only")
+	}))
+	t.Cleanup(origin.Close)
+	roots := origin.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	s := createServer(t, server.WithTLSOrigination(server.TLSOrigination{
+		Port:   portOf(t, origin.Listener.Addr().String()),
+		Config: &tls.Config{RootCAs: roots},
+	}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(origin.Listener.Addr().String()))
+
+	// plaintext HTTP through the tunnel
+	_, err = fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: origin\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int64(1), s.Metrics().Counter("tls_originations_total", "").Value())
+}
+
+func TestTLSOriginationUntrusted(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(origin.Close)
+
+	s := createServer(t, server.WithTLSOrigination(server.TLSOrigination{Port: portOf(t, origin.Listener.Addr().String())}))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.Error(t, c.Connect(origin.Listener.Addr().String()))
+	requireClosedReason(t, s, server.CloseRequestFailed)
+	require.Equal(t, int64(1), s.Metrics().Counter("tls_origination_failures_total", "").Value())
+}
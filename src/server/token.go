@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticTokenAuthenticator treats the user ID as a bearer token and allows
+// requests carrying one of a fixed set of tokens.
+type StaticTokenAuthenticator struct {
+	tokens [][]byte
+}
+
+func NewStaticTokenAuthenticator(tokens ...string) *StaticTokenAuthenticator {
+	a := &StaticTokenAuthenticator{}
+	for _, token := range tokens {
+		a.tokens = append(a.tokens, []byte(token))
+	}
+	return a
+}
+
+func (a *StaticTokenAuthenticator) Allow(_ context.Context, _, userID string) error {
+	if userID == "" {
+		return fmt.Errorf("missing token - %w", ErrUnauthorized)
+	}
+
+	// compare against every token so timing doesn't reveal which matched
+	found := 0
+	for _, token := range a.tokens {
+		found |= subtle.ConstantTimeCompare(token, []byte(userID))
+	}
+	if found == 0 {
+		return fmt.Errorf("unknown token - %w", ErrUnauthorized)
+	}
+	return nil
+}
+
+// HMACTokenAuthenticator treats the user ID as a bearer token of the form
+// "<expiry>.<signature>", where expiry is a unix timestamp and signature is
+// the unpadded base64url HMAC-SHA256 of the expiry under a shared key.
+// Tokens are issued with NewHMACToken.
+type HMACTokenAuthenticator struct {
+	key []byte
+	now func() time.Time
+}
+
+func NewHMACTokenAuthenticator(key []byte) *HMACTokenAuthenticator {
+	return &HMACTokenAuthenticator{
+		key: key,
+		now: time.Now,
+	}
+}
+
+// NewHMACToken issues a token that HMACTokenAuthenticator accepts until expiry.
+func NewHMACToken(key []byte, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(sign(key, exp))
+}
+
+func (a *HMACTokenAuthenticator) Allow(_ context.Context, _, userID string) error {
+	exp, sig, ok := strings.Cut(userID, ".")
+	if !ok {
+		return fmt.Errorf("malformed token - %w", ErrUnauthorized)
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("malformed token signature - %w", ErrUnauthorized)
+	} else if !hmac.Equal(mac, sign(a.key, exp)) {
+		return fmt.Errorf("invalid token signature - %w", ErrUnauthorized)
+	}
+
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed token expiry - %w", ErrUnauthorized)
+	} else if a.now().Unix() >= expiry {
+		return fmt.Errorf("token expired - %w", ErrUnauthorized)
+	}
+	return nil
+}
+
+func sign(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// IntrospectionAuthenticator treats the user ID as a bearer token and
+// validates it against an RFC 7662 token introspection endpoint.
+type IntrospectionAuthenticator struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewIntrospectionAuthenticator(endpoint string, client *http.Client) *IntrospectionAuthenticator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &IntrospectionAuthenticator{
+		endpoint: endpoint,
+		client:   client,
+	}
+}
+
+func (a *IntrospectionAuthenticator) Allow(ctx context.Context, _, userID string) error {
+	if userID == "" {
+		return fmt.Errorf("missing token - %w", ErrUnauthorized)
+	}
+
+	form := url.Values{"token": {userID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create introspection request - %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to introspect token - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		Active bool  `json:"active"`
+		Exp    int64 `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to decode introspection response - %w", err)
+	} else if !body.Active {
+		return fmt.Errorf("token is not active - %w", ErrUnauthorized)
+	} else if body.Exp != 0 && time.Now().Unix() >= body.Exp {
+		return fmt.Errorf("token expired - %w", ErrUnauthorized)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	auth := server.NewStaticTokenAuthenticator("alpha", "bravo")
+
+	require.NoError(t, auth.Allow(context.Background(), "", "alpha"))
+	require.NoError(t, auth.Allow(context.Background(), "", "bravo"))
+	require.ErrorIs(t, auth.Allow(context.Background(), "", "charlie"), server.ErrUnauthorized)
+	require.ErrorIs(t, auth.Allow(context.Background(), "", ""), server.ErrUnauthorized)
+}
+
+func TestHMACTokenAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("secret")
+	auth := server.NewHMACTokenAuthenticator(key)
+
+	token := server.NewHMACToken(key, time.Now().Add(time.Hour))
+	require.LessOrEqual(t, len(token), 63)
+	require.NoError(t, auth.Allow(context.Background(), "", token))
+
+	expired := server.NewHMACToken(key, time.Now().Add(-time.Hour))
+	require.ErrorIs(t, auth.Allow(context.Background(), "", expired), server.ErrUnauthorized)
+
+	forged := server.NewHMACToken([]byte("other"), time.Now().Add(time.Hour))
+	require.ErrorIs(t, auth.Allow(context.Background(), "", forged), server.ErrUnauthorized)
+
+	for _, bad := range []string{"", "nodot", "123.!!!", "abc." + token[len("123."):]} {
+		require.ErrorIs(t, auth.Allow(context.Background(), "", bad), server.ErrUnauthorized)
+	}
+}
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch r.PostForm.Get("token") {
+		case "active":
+			json.NewEncoder(w).Encode(map[string]any{"active": true})
+		case "expired":
+			json.NewEncoder(w).Encode(map[string]any{"active": true, "exp": time.Now().Add(-time.Minute).Unix()})
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"active": false})
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+
+	auth := server.NewIntrospectionAuthenticator(endpoint.URL, nil)
+
+	require.NoError(t, auth.Allow(context.Background(), "", "active"))
+	require.ErrorIs(t, auth.Allow(context.Background(), "", "inactive"), server.ErrUnauthorized)
+	require.ErrorIs(t, auth.Allow(context.Background(), "", "expired"), server.ErrUnauthorized)
+	require.ErrorIs(t, auth.Allow(context.Background(), "", ""), server.ErrUnauthorized)
+
+	err := auth.Allow(context.Background(), "", "broken")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, server.ErrUnauthorized)
+}
+
+func TestTokenAuthRejectsClient(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAuthenticator(server.NewStaticTokenAuthenticator("token")))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+
+	echoServer := newEchoServer(t)
+
+	denied := client.NewClient(addr.String(), "wrong")
+	t.Cleanup(func() { denied.Close() })
+	require.Error(t, denied.Connect(echoServer))
+	requireClosed(t, denied)
+
+	allowed := client.NewClient(addr.String(), "token")
+	t.Cleanup(func() { allowed.Close() })
+	require.NoError(t, allowed.Connect(echoServer))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// SessionStats is a snapshot of the traffic of a relaying session.
+type SessionStats struct {
+	Session uint64
+	Client  net.Addr
+	Target  net.Addr
+	User    string
+
+	// Bytes relayed from the client to the destination
+	BytesOut int64
+
+	// Bytes relayed from the destination to the client
+	BytesIn int64
+}
+
+// ByteTrigger calls Func with the stats of a session once the bytes it has
+// relayed in both directions reach After, then every Every bytes after that
+// if Every is positive. An After of 1 fires on the first byte; an After of
+// zero fires first at Every.
+//
+// Func is called from the relay of the session, so it must not block.
+type ByteTrigger struct {
+	After int64
+	Every int64
+	Func  func(SessionStats)
+}
+
+// triggers tracks when each ByteTrigger of a session fires next.
+type triggers struct {
+	mu   sync.Mutex
+	defs []ByteTrigger
+	next []int64 // zero once a trigger is spent
+}
+
+func newTriggers(defs []ByteTrigger) *triggers {
+	t := &triggers{defs: defs, next: make([]int64, len(defs))}
+	for i, def := range defs {
+		t.next[i] = def.After
+		if def.After <= 0 {
+			t.next[i] = def.Every
+		}
+	}
+	return t
+}
+
+// check calls the triggers whose threshold the session has reached.
+func (t *triggers) check(sess *session) {
+	total := sess.sent.Load() + sess.received.Load()
+
+	var fire []func(SessionStats)
+	t.mu.Lock()
+	for i, def := range t.defs {
+		if t.next[i] <= 0 || total < t.next[i] {
+			continue
+		}
+		fire = append(fire, def.Func)
+
+		if def.Every <= 0 {
+			t.next[i] = 0
+			continue
+		}
+		for t.next[i] <= total {
+			t.next[i] += def.Every
+		}
+	}
+	t.mu.Unlock()
+
+	if len(fire) == 0 {
+		return
+	}
+	stats := sess.stats()
+	for _, f := range fire {
+		f(stats)
+	}
+}
@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteTriggers(t *testing.T) {
+	t.Parallel()
+
+	first := make(chan server.SessionStats, 10)
+	every := make(chan server.SessionStats, 10)
+	s := createServer(t, server.WithByteTriggers(
+		server.ByteTrigger{After: 1, Func: func(stats server.SessionStats) { first <- stats }},
+		server.ByteTrigger{Every: 4, Func: func(stats server.SessionStats) { every <- stats }},
+	))
+	addr, err := s.ListenAndServe("localhost:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	c := client.NewClient(addr.String(), "mcr")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(echoServer))
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 4))
+	require.NoError(t, err)
+
+	stats := <-first
+	require.Equal(t, "mcr", stats.User)
+	require.Equal(t, echoServer, stats.Target.String())
+	require.Equal(t, int64(4), stats.BytesOut)
+
+	require.Equal(t, int64(4), (<-every).BytesOut)
+	require.Equal(t, int64(4), (<-every).BytesIn)
+
+	requireClosedReason(t, s, server.CloseRemoteEOF)
+	select {
+	case <-first:
+		t.Fatal("first byte trigger fired twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
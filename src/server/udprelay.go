@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"socks4/proto"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Largest datagram relayed
+const maxDatagramSize = 1<<16 - 1
+
+// Most destinations an association relays datagrams back from
+const maxUDPPeers = 1024
+
+// Most datagrams queued for a destination hostname while it is resolved
+const maxPendingDatagrams = 16
+
+var errControlData = errors.New("data on the control connection of a UDP association")
+
+// udpAssociation relays datagrams between a client and the destinations it
+// sends to over one UDP socket.
+type udpAssociation struct {
+	sess *session
+	pc   *net.UDPConn
+
+	errs chan error // ends the association from hostname lookups
+
+	// the client's expected source; unset fields match any
+	expectIP   netip.Addr
+	expectPort uint16
+
+	// guards the fields below and the session's pins, shared by the relay
+	// loop and the lookups of destination hostnames
+	mu     sync.Mutex
+	client netip.AddrPort // set by the first datagram from the client
+
+	// destinations the client sent to within the idle timeout, by when it
+	// last did, the only sources relayed back
+	peers map[netip.AddrPort]time.Time
+
+	// datagrams awaiting the lookup of their destination's hostname
+	pending map[string][]*proto.Datagram
+
+	relayed time.Time // when a datagram was last relayed
+}
+
+// associate relays UDP datagrams for the client of a UDP ASSOCIATE request
+// until its TCP connection closes or the association goes idle.
+func (s *Server) associate(sess *session, deadline time.Time, req *request) {
+	local := addrIP(sess.client.LocalAddr())
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		sess.end(CloseRequestFailed, fmt.Errorf("failed to listen for datagrams - %w", err))
+		s.sendError(sess, req, err)
+		return
+	}
+	defer pc.Close()
+
+	a := &udpAssociation{
+		sess:    sess,
+		pc:      pc,
+		errs:    make(chan error, 1),
+		peers:   make(map[netip.AddrPort]time.Time),
+		pending: make(map[string][]*proto.Datagram),
+	}
+	a.expectIP, _ = netip.AddrFromSlice(addrIP(sess.remote))
+	if ip, ok := netip.AddrFromSlice(canonicalIP(req.ip)); ok && !ip.IsUnspecified() && req.hostname == "" {
+		a.expectIP = ip
+	}
+	a.expectPort = uint16(req.port)
+
+	if err := s.checkEarlyData(sess, deadline); err != nil {
+		sess.end(CloseProtocolViolation, err)
+		s.sendError(sess, req, err)
+		return
+	}
+	if err := req.reply.bound(s.bindAddress(sess), pc.LocalAddr().(*net.UDPAddr).Port); err != nil {
+		sess.end(CloseClientError, fmt.Errorf("failed to send UDP relay address - %w", err))
+		return
+	}
+
+	s.metrics.Counter("udp_associations_total", "UDP associations opened.").Inc()
+	sess.log = s.logger(SubsystemRelay).With(zap.Stringer("client", sess.remote), zap.Uint64("session", sess.id))
+	sess.log.Info("udp association opened", zap.Stringer("relay", pc.LocalAddr()))
+	sess.idle = s.idleTimeout(0)
+	sess.policy = s.sessionPolicy
+	sess.client.SetDeadline(time.Time{})
+	s.setConnState(sess, StateActive)
+
+	errChan := a.errs
+	if sess.policy.MaxLifetime > 0 {
+		timer := time.AfterFunc(sess.policy.MaxLifetime, func() {
+			report(errChan, &relayError{reason: ClosePolicy, err: errMaxLifetime})
+			pc.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// closing the server ends the association; the goroutine otherwise
+	// exits once the session is removed
+	go func() {
+		<-sess.ctx.Done()
+		report(errChan, &relayError{reason: CloseShutdown, err: errServerClosed})
+		pc.Close()
+	}()
+
+	// the association lasts as long as the control connection
+	go func() {
+		_, err := sess.client.Read(make([]byte, 1))
+		if err == nil {
+			err = errControlData
+		}
+		report(errChan, classify(err, true))
+		pc.Close()
+	}()
+
+	err = s.relayDatagrams(a)
+	select {
+	case err = <-errChan:
+	default:
+	}
+
+	var relayErr *relayError
+	if errors.Is(err, errControlData) {
+		sess.end(CloseProtocolViolation, err)
+	} else if errors.As(err, &relayErr) {
+		sess.end(relayErr.reason, relayErr.err)
+	} else {
+		sess.end(CloseRemoteError, err)
+	}
+}
+
+// relayDatagrams relays datagrams until the association's socket fails,
+// or no datagram was relayed within the idle timeout.
+func (s *Server) relayDatagrams(a *udpAssociation) error {
+	buff := make([]byte, maxDatagramSize)
+	a.relayed = time.Now()
+	for {
+		deadline := a.idleDeadline()
+		if err := a.pc.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+		n, from, err := a.pc.ReadFromUDPAddrPort(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if errors.Is(err, os.ErrDeadlineExceeded) && a.idleDeadline().After(deadline) {
+			// a datagram that awaited its hostname was relayed meanwhile
+			continue
+		} else if err != nil {
+			return classify(err, true)
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		a.mu.Lock()
+		if a.fromClient(from) {
+			err = s.sendDatagram(a, buff[:n])
+		} else if a.isPeer(from, time.Now()) && a.client.IsValid() {
+			err = s.returnDatagram(a, from, buff[:n])
+		} else {
+			err = errors.New("datagram from unknown source")
+		}
+		a.mu.Unlock()
+
+		if err := s.datagramFailed(a, from, err); err != nil {
+			return err
+		}
+	}
+}
+
+// idleDeadline returns when the association goes idle unless it relays
+// another datagram.
+func (a *udpAssociation) idleDeadline() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.relayed.Add(a.sess.idle)
+}
+
+// datagramFailed drops a datagram from source that failed to be relayed
+// with err, if any, returning the error ending the association if err
+// breaks the session's policy.
+func (s *Server) datagramFailed(a *udpAssociation, source netip.AddrPort, err error) error {
+	if errors.Is(err, errSessionPolicy) {
+		return classify(err, true)
+	} else if err != nil {
+		s.metrics.Counter("udp_datagrams_dropped_total", "Datagrams dropped by UDP associations.").Inc()
+		a.sess.log.Debug("dropped datagram", zap.Stringer("source", source), zap.Error(err))
+	}
+	return nil
+}
+
+// fromClient reports whether a datagram from source was sent by the client,
+// which is the first source matching what the client asked for.
+func (a *udpAssociation) fromClient(source netip.AddrPort) bool {
+	if a.client.IsValid() {
+		return source == a.client
+	} else if source.Addr() != a.expectIP || (a.expectPort != 0 && source.Port() != a.expectPort) {
+		return false
+	}
+	a.client = source
+	return true
+}
+
+// isPeer reports whether the client sent to source within the idle timeout.
+func (a *udpAssociation) isPeer(source netip.AddrPort, now time.Time) bool {
+	sent, ok := a.peers[source]
+	return ok && now.Sub(sent) < a.sess.idle
+}
+
+// addPeer records that the client sent to dst at now. Once maxUDPPeers are
+// recorded, those gone idle are forgotten, and if none did, the one sent to
+// least recently.
+func (a *udpAssociation) addPeer(dst netip.AddrPort, now time.Time) {
+	if _, ok := a.peers[dst]; !ok && len(a.peers) >= maxUDPPeers {
+		var oldest netip.AddrPort
+		for peer := range a.peers {
+			if !a.isPeer(peer, now) {
+				delete(a.peers, peer)
+			} else if !oldest.IsValid() || a.peers[peer].Before(a.peers[oldest]) {
+				oldest = peer
+			}
+		}
+		if len(a.peers) >= maxUDPPeers {
+			delete(a.peers, oldest)
+		}
+	}
+	a.peers[dst] = now
+}
+
+// sendDatagram forwards a datagram from the client to its destination. A
+// datagram to a hostname that isn't pinned for the session waits for its
+// lookup, which is left to another goroutine so as not to hold up the
+// relay.
+func (s *Server) sendDatagram(a *udpAssociation, packet []byte) error {
+	msg, err := proto.ReadDatagram(packet)
+	if err != nil {
+		return fmt.Errorf("bad datagram from client - %w", err)
+	}
+	var ips []net.IP
+	if msg.Hostname != "" {
+		var ok bool
+		if ips, ok = a.sess.pinned(msg.Hostname); !ok {
+			return s.awaitHostname(a, msg)
+		}
+	}
+	return s.forwardDatagram(a, msg, ips)
+}
+
+// forwardDatagram sends msg to its destination, ips being the addresses of
+// its hostname if it has one.
+func (s *Server) forwardDatagram(a *udpAssociation, msg *proto.Datagram, ips []net.IP) error {
+	dst, err := s.datagramDestination(a, msg, ips)
+	if err != nil {
+		return err
+	}
+
+	n, capErr := a.sess.allow(len(msg.Data))
+	if _, err := a.pc.WriteToUDPAddrPort(msg.Data[:n], dst); err != nil {
+		return fmt.Errorf("failed to send datagram - %w", err)
+	}
+	a.relayed = time.Now()
+	a.addPeer(dst, a.relayed)
+	a.sess.sent.Add(int64(n))
+	s.metrics.Counter("udp_datagrams_total", "Datagrams relayed by UDP associations, by direction.", "direction", "out").Inc()
+	return capErr
+}
+
+// awaitHostname queues msg until its destination's hostname is resolved,
+// starting the lookup unless one is under way. The association's lock
+// must be held.
+func (s *Server) awaitHostname(a *udpAssociation, msg *proto.Datagram) error {
+	host := msg.Hostname
+	queue, resolving := a.pending[host]
+	if len(queue) >= maxPendingDatagrams {
+		return fmt.Errorf("too many datagrams awaiting %q", host)
+	}
+	// the relay loop reuses the buffer the data is in
+	msg.Data = append([]byte(nil), msg.Data...)
+	a.pending[host] = append(queue, msg)
+	if resolving {
+		return nil
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(a.sess.ctx, replyTimeout)
+		ips, err := s.lookupHostname(ctx, a.sess, host)
+		cancel()
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err == nil {
+			s.pinHostname(a.sess, host, ips)
+		}
+		queue := a.pending[host]
+		delete(a.pending, host)
+		for _, msg := range queue {
+			sendErr := err
+			if sendErr == nil {
+				sendErr = s.forwardDatagram(a, msg, ips)
+			}
+			if sendErr = s.datagramFailed(a, a.client, sendErr); sendErr != nil {
+				report(a.errs, sendErr)
+				a.pc.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// returnDatagram forwards a datagram from a destination to the client.
+func (s *Server) returnDatagram(a *udpAssociation, source netip.AddrPort, data []byte) error {
+	if !source.Addr().Is4() {
+		return errors.New("datagram source is not IPv4")
+	}
+	n, capErr := a.sess.allow(len(data))
+	msg := proto.Datagram{IP: source.Addr().AsSlice(), Port: int(source.Port()), Data: data[:n]}
+	if _, err := a.pc.WriteToUDPAddrPort(msg.Serialize(), a.client); err != nil {
+		return fmt.Errorf("failed to return datagram - %w", err)
+	}
+	a.relayed = time.Now()
+	a.sess.received.Add(int64(n))
+	s.metrics.Counter("udp_datagrams_total", "Datagrams relayed by UDP associations, by direction.", "direction", "in").Inc()
+	return capErr
+}
+
+// datagramDestination returns where to send a datagram, ips being the
+// addresses its hostname, if any, resolved to.
+func (s *Server) datagramDestination(a *udpAssociation, msg *proto.Datagram, ips []net.IP) (netip.AddrPort, error) {
+	ip, _ := netip.AddrFromSlice(msg.IP)
+	if msg.Hostname != "" {
+		// the relay socket has the address family of the control connection
+		ip, _ = netip.AddrFromSlice(ips[0])
+		for _, candidate := range ips {
+			if addr, _ := netip.AddrFromSlice(candidate); addr.Is4() == a.expectIP.Is4() {
+				ip = addr
+				break
+			}
+		}
+	}
+
+	dst := netip.AddrPortFrom(ip, uint16(msg.Port))
+	if _, err := s.checkDestination(a.sess, dst.String()); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, nil
+}
@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newUDPEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buff[:n], from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPRelay(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newUDPEchoServer(t)
+	s := createServer(t, server.WithUDPRelay())
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	pc, err := c.Associate()
+	require.NoError(t, err)
+
+	for _, dest := range []net.Addr{
+		echoServer,
+		&hostAddr{net.JoinHostPort("localhost", strconv.Itoa(echoServer.Port))},
+	} {
+		_, err = pc.WriteTo([]byte("query"), dest)
+		require.NoError(t, err)
+
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second*5)))
+		buff := make([]byte, 64)
+		n, from, err := pc.ReadFrom(buff)
+		require.NoError(t, err)
+		require.Equal(t, "query", string(buff[:n]))
+		require.Equal(t, echoServer.String(), from.String())
+	}
+
+	require.NoError(t, pc.Close())
+	requireClosedReason(t, s, server.CloseClientEOF)
+	m := s.Metrics()
+	require.EqualValues(t, 1, m.Counter("udp_associations_total", "").Value())
+	require.EqualValues(t, 2, m.Counter("udp_datagrams_total", "", "direction", "out").Value())
+	require.EqualValues(t, 2, m.Counter("udp_datagrams_total", "", "direction", "in").Value())
+}
+
+// gatedResolver resolves every hostname to ip, holding lookups of
+// "slow.test" until release is closed.
+type gatedResolver struct {
+	ip      net.IP
+	release chan struct{}
+}
+
+func (r *gatedResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if host == "slow.test" {
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []net.IP{r.ip}, nil
+}
+
+func TestUDPRelaySlowLookup(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newUDPEchoServer(t)
+	resolver := &gatedResolver{ip: echoServer.IP, release: make(chan struct{})}
+	s := createServer(t, server.WithUDPRelay(), server.WithResolver(resolver))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	pc, err := c.Associate()
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	read := func() string {
+		t.Helper()
+
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second*5)))
+		buff := make([]byte, 64)
+		n, _, err := pc.ReadFrom(buff)
+		require.NoError(t, err)
+		return string(buff[:n])
+	}
+
+	// datagrams to other destinations are relayed while a lookup is held
+	_, err = pc.WriteTo([]byte("slow"), &hostAddr{net.JoinHostPort("slow.test", strconv.Itoa(echoServer.Port))})
+	require.NoError(t, err)
+	_, err = pc.WriteTo([]byte("fast"), echoServer)
+	require.NoError(t, err)
+	require.Equal(t, "fast", read())
+
+	close(resolver.release)
+	require.Equal(t, "slow", read())
+}
+
+func TestUDPRelayIdleUnknownSource(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithUDPRelay(), server.WithIdleTimeout(time.Millisecond*200))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	req, err := proto.NewRequest(proto.UDPAssociateCommand, "0.0.0.0:0", "")
+	require.NoError(t, err)
+	_, err = conn.Write(req.Serialize())
+	require.NoError(t, err)
+	reply, err := proto.ReadReply(conn)
+	require.NoError(t, err)
+	require.Equal(t, proto.SuccessReply, reply.Code())
+
+	// datagrams from another host are dropped, and don't keep the
+	// association from going idle
+	stranger, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: reply.Port()})
+	require.NoError(t, err)
+	t.Cleanup(func() { stranger.Close() })
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 20)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stranger.Write([]byte{0, 0, 0, 80, 127, 0, 0, 1, 'x'})
+			}
+		}
+	}()
+
+	requireClosedReason(t, s, server.CloseIdleTimeout)
+	require.NotZero(t, s.Metrics().Counter("udp_datagrams_dropped_total", "").Value())
+}
+
+func TestUDPRelayDisabled(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t)
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	_, err = c.Associate()
+	require.ErrorIs(t, err, client.ErrRejected)
+	requireClosedReason(t, s, server.CloseRequestFailed)
+}
+
+// hostAddr is an address with a hostname, for the relay to resolve.
+type hostAddr struct {
+	address string
+}
+
+func (a *hostAddr) Network() string { return "udp" }
+func (a *hostAddr) String() string  { return a.address }
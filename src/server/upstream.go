@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"socks4/client"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// directDialer dials destinations from the server itself, within its
+// egress namespace and cgroup if any, or with the server's Dialer.
+type directDialer struct {
+	s *Server
+	d *net.Dialer
+}
+
+func (d directDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.s.dialer != nil {
+		return d.s.dialer.DialContext(ctx, network, addr)
+	} else if d.s.egress.enabled() {
+		return d.s.dialEgress(ctx, d.d, addr)
+	}
+	return d.d.DialContext(ctx, network, addr)
+}
+
+// upstreamDialer returns a dialer connecting through the proxy of u, which
+// is reached with forward.
+func upstreamDialer(u *url.URL, forward proxy.ContextDialer) (proxy.ContextDialer, error) {
+	switch u.Scheme {
+	case "socks4":
+		return client.NewDialer(u.Host, u.User.Username(), client.WithDialer(forward)), nil
+	case "socks4a":
+		return client.NewDialer(u.Host, u.User.Username(), client.WithDialer(forward), client.WithResolution(client.ResolveRemote)), nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forward.(proxy.Dialer))
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer), nil
+	case "http":
+		return &httpConnectDialer{addr: u.Host, user: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+}
+
+// dialUpstream dials addr through the upstream proxies of pool, in the
+// order it selects them, failing over to the next while a proxy can't be
+// reached. The connection's RemoteAddr is addr, rather than the proxy's
+// address; a hostname addr is left for the proxies to resolve.
+func (s *Server) dialUpstream(ctx context.Context, pool *upstreamPool, d *net.Dialer, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr = unresolvedAddr(addr)
+	if net.ParseIP(host) != nil {
+		if remote, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for i, u := range pool.order() {
+		if ctx.Err() != nil {
+			break
+		} else if i > 0 {
+			s.metrics.Counter("upstream_failovers_total", "Dials failed over to another upstream proxy.").Inc()
+		}
+
+		forward := &reachDialer{direct: directDialer{s: s, d: d}}
+		dialer, err := upstreamDialer(u.url, forward)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			pool.setDown(u, false, nil)
+			u.active.Add(1)
+			return &upstreamConn{Conn: conn, remote: remote, upstream: u}, nil
+		}
+
+		s.metrics.Counter("upstream_dial_failures_total", "Dials through an upstream proxy that failed.").Inc()
+		err = fmt.Errorf("failed to dial through upstream proxy %s - %w", u.url.Redacted(), err)
+		if forward.reached.Load() {
+			// the proxy answered, the destination failed
+			return nil, err
+		}
+		pool.setDown(u, true, err)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// reachDialer records whether it connected to the upstream proxy.
+type reachDialer struct {
+	direct  directDialer
+	reached atomic.Bool
+}
+
+func (d *reachDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *reachDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.direct.DialContext(ctx, network, addr)
+	d.reached.Store(err == nil)
+	return conn, err
+}
+
+// unresolvedAddr is a hostname destination, resolved by an upstream proxy.
+type unresolvedAddr string
+
+func (a unresolvedAddr) Network() string { return "tcp" }
+func (a unresolvedAddr) String() string  { return string(a) }
+
+// upstreamConn is a connection to a destination through an upstream
+// proxy.
+type upstreamConn struct {
+	net.Conn
+	remote   net.Addr
+	upstream *upstream
+	once     sync.Once
+}
+
+func (c *upstreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() { c.upstream.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with CONNECT.
+type httpConnectDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward proxy.ContextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial HTTP proxy - %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write CONNECT request - %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response - %w", err)
+	} else if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT - %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if n := reader.Buffered(); n != 0 {
+		prefix, _ := reader.Peek(n)
+		return &prefixConn{Conn: conn, prefix: prefix}, nil
+	}
+	return conn, nil
+}
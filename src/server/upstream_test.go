@@ -0,0 +1,190 @@
+package server_test
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	for _, scheme := range []string{"socks4", "socks5", "http"} {
+		scheme := scheme
+		t.Run(scheme, func(t *testing.T) {
+			t.Parallel()
+
+			var requests atomic.Int64
+			upstream := createServer(t, server.WithHooks(server.Hooks{
+				OnRequest: func(req *server.Request) error {
+					requests.Add(1)
+					return nil
+				},
+			}))
+			upstreamAddr, err := upstream.ListenAndServe("127.0.0.1:0")
+			require.NoError(t, err)
+
+			s := createServer(t, server.WithUpstream(&url.URL{Scheme: scheme, Host: upstreamAddr.String()}))
+			addr, err := s.ListenAndServe("127.0.0.1:0")
+			require.NoError(t, err)
+
+			c := client.NewClient(addr.String(), "")
+			t.Cleanup(func() { c.Close() })
+			require.NoError(t, c.Connect(echoServer))
+			requireEcho(t, c)
+			require.EqualValues(t, 1, requests.Load())
+		})
+	}
+
+	t.Run("Unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		s := createServer(t, server.WithUpstream(&url.URL{Scheme: "ftp", Host: "127.0.0.1:21"}))
+		addr, err := s.ListenAndServe("127.0.0.1:0")
+		require.NoError(t, err)
+
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, c.Connect(echoServer), &replyErr)
+		require.Equal(t, proto.RejectedFailed, replyErr.Reply.Code())
+	})
+}
+
+func TestUpstreamRemoteResolution(t *testing.T) {
+	t.Parallel()
+
+	echoServer := newEchoServer(t)
+	dns := newDNSServer(t, net.IPv4(127, 0, 0, 1))
+	dead := deadDNSServer(t)
+	for _, scheme := range []string{"socks4a", "socks5h"} {
+		scheme := scheme
+		t.Run(scheme, func(t *testing.T) {
+			t.Parallel()
+
+			var hostname atomic.Value
+			upstream := createServer(t,
+				server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dns}}),
+				server.WithHooks(server.Hooks{
+					OnRequest: func(req *server.Request) error {
+						hostname.Store(req.Hostname)
+						return nil
+					},
+				}))
+			upstreamAddr, err := upstream.ListenAndServe("127.0.0.1:0")
+			require.NoError(t, err)
+
+			// the hostname can't be resolved here, only by the upstream
+			s := createServer(t,
+				server.WithDNSRoutes(server.DNSRoute{Suffix: "test", Servers: []string{dead}, Timeout: 100 * time.Millisecond}),
+				server.WithUpstream(&url.URL{Scheme: scheme, Host: upstreamAddr.String()}))
+			addr, err := s.ListenAndServe("127.0.0.1:0")
+			require.NoError(t, err)
+
+			conn, err := net.Dial("tcp", addr.String())
+			require.NoError(t, err)
+			t.Cleanup(func() { conn.Close() })
+
+			_, err = conn.Write(socks4aRequest(proto.ConnectCommand, portOf(t, echoServer), "echo.test"))
+			require.NoError(t, err)
+			reply, err := proto.ReadReply(conn)
+			require.NoError(t, err)
+			require.Equal(t, proto.SuccessReply, reply.Code())
+			requireEcho(t, conn)
+
+			require.Equal(t, "echo.test", hostname.Load())
+			require.EqualValues(t, 0, s.Metrics().Counter("socks4a_resolve_failures_total", "").Value())
+		})
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := &url.URL{Scheme: "socks4", Host: ln.Addr().String()}
+	ln.Close()
+
+	upstream := createServer(t)
+	upstreamAddr, err := upstream.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	live := &url.URL{Scheme: "socks4", Host: upstreamAddr.String()}
+
+	s := createServer(t, server.WithUpstream(dead, live))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+	failovers := s.Metrics().Counter("upstream_failovers_total", "")
+
+	for i := 0; i < 2; i++ {
+		c := client.NewClient(addr.String(), "")
+		t.Cleanup(func() { c.Close() })
+		require.NoError(t, c.Connect(echoServer))
+		requireEcho(t, c)
+
+		// the unreachable upstream is only tried until it is marked down
+		require.EqualValues(t, 1, failovers.Value())
+		require.EqualValues(t, 1, s.Metrics().Gauge("upstreams_healthy", "", "route", "default").Value())
+	}
+}
+
+func TestUpstreamRecovery(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstreamAddr := ln.Addr().String()
+	ln.Close()
+
+	s := createServer(t, server.WithUpstream(&url.URL{Scheme: "socks4", Host: upstreamAddr}))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+	healthy := s.Metrics().Gauge("upstreams_healthy", "", "route", "default")
+
+	failed := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { failed.Close() })
+	require.Error(t, failed.Connect(echoServer))
+	require.EqualValues(t, 0, healthy.Value())
+
+	// a down upstream is still tried as a last resort, and is up again
+	// once a dial through it succeeds
+	upstream := createServer(t)
+	_, err = upstream.ListenAndServe(upstreamAddr)
+	require.NoError(t, err)
+	c := client.NewClient(addr.String(), "")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(echoServer))
+	requireEcho(t, c)
+	require.EqualValues(t, 1, healthy.Value())
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := &url.URL{Scheme: "socks5", Host: ln.Addr().String()}
+	ln.Close()
+
+	s := createServer(t,
+		server.WithUpstream(dead, &url.URL{Scheme: "http", Host: newEchoServer(t)}),
+		server.WithUpstreamBalancing(server.LeastConnections, time.Millisecond*10),
+	)
+	_, err = s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+
+	healthy := s.Metrics().Gauge("upstreams_healthy", "", "route", "default")
+	require.EqualValues(t, 2, healthy.Value())
+	require.Eventually(t, func() bool { return healthy.Value() == 1 }, time.Second*5, time.Millisecond*10)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"socks4/metrics"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Balance selects which upstream proxy each dial goes through first.
+type Balance int
+
+const (
+	// RoundRobin takes turns among the upstream proxies.
+	RoundRobin Balance = iota
+
+	// LeastConnections prefers the upstream proxy with the fewest open
+	// connections, taking turns among those tied.
+	LeastConnections
+)
+
+// upstream is an upstream proxy of the pool.
+type upstream struct {
+	url    *url.URL
+	active atomic.Int64 // open connections through it
+	down   atomic.Bool
+}
+
+// upstreamPool is the upstream proxies destinations are dialed through.
+type upstreamPool struct {
+	upstreams []*upstream
+	balance   Balance
+	interval  time.Duration // between health checks, or none if 0
+	next      atomic.Uint64
+	log       *zap.Logger
+	healthy   *metrics.Gauge
+}
+
+// newUpstreamPool returns the pool of the route named name, "default" or
+// a user's, which labels its metrics.
+func newUpstreamPool(name string, urls []*url.URL, balance Balance, interval time.Duration, log *zap.Logger, m *metrics.Registry) *upstreamPool {
+	p := &upstreamPool{
+		balance:  balance,
+		interval: interval,
+		log:      log,
+		healthy:  m.Gauge("upstreams_healthy", "Upstream proxies considered reachable.", "route", name),
+	}
+	for _, u := range urls {
+		p.upstreams = append(p.upstreams, &upstream{url: u})
+	}
+	p.healthy.Add(int64(len(urls)))
+	return p
+}
+
+// order returns the upstream proxies in the order a dial should try them:
+// those up as the balancing selects them, then those down as a last
+// resort.
+func (p *upstreamPool) order() []*upstream {
+	n := len(p.upstreams)
+	start := int(p.next.Add(1)-1) % n
+	rotated := append(append([]*upstream(nil), p.upstreams[start:]...), p.upstreams[:start]...)
+	if p.balance == LeastConnections {
+		sort.SliceStable(rotated, func(i, j int) bool {
+			return rotated[i].active.Load() < rotated[j].active.Load()
+		})
+	}
+
+	up := make([]*upstream, 0, n)
+	var down []*upstream
+	for _, u := range rotated {
+		if u.down.Load() {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	return append(up, down...)
+}
+
+// resolvesRemotely reports whether every upstream proxy of the pool
+// resolves hostnames itself, as socks4a and socks5h proxies do.
+func (p *upstreamPool) resolvesRemotely() bool {
+	for _, u := range p.upstreams {
+		if u.url.Scheme != "socks4a" && u.url.Scheme != "socks5h" {
+			return false
+		}
+	}
+	return true
+}
+
+// setDown marks u as down or up again, logging the change.
+func (p *upstreamPool) setDown(u *upstream, down bool, cause error) {
+	if u.down.Swap(down) == down {
+		return
+	}
+	log := p.log.With(zap.String("upstream", u.url.Redacted()))
+	if down {
+		p.healthy.Dec()
+		log.Warn("upstream proxy down", zap.Error(cause))
+	} else {
+		p.healthy.Inc()
+		log.Info("upstream proxy up")
+	}
+}
+
+// run checks every upstream proxy is reachable at each interval, until
+// done is closed.
+func (p *upstreamPool) run(s *Server, done <-chan struct{}) {
+	if p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for _, u := range p.upstreams {
+			p.check(s, u)
+		}
+	}
+}
+
+// check connects to the upstream proxy u to tell whether it's up.
+func (p *upstreamPool) check(s *Server, u *upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	conn, err := directDialer{s: s, d: &net.Dialer{}}.DialContext(ctx, "tcp", u.url.Host)
+	if err == nil {
+		conn.Close()
+	}
+	p.setDown(u, err != nil, err)
+}
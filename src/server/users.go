@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+)
+
+// StaticUserAuthenticator allows the user IDs of a fixed list, each from
+// any client or only from some networks. Unlike StaticTokenAuthenticator,
+// user IDs aren't secrets: they name users, whose address is what's
+// checked. Unknown user IDs are replied to with code 91, and listed ones
+// from other networks with 93, as the user ID doesn't match the client.
+type StaticUserAuthenticator struct {
+	users map[string][]netip.Prefix
+}
+
+// NewStaticUserAuthenticator allows each user ID of users from its
+// networks, or from anywhere if it has none.
+func NewStaticUserAuthenticator(users map[string][]netip.Prefix) *StaticUserAuthenticator {
+	a := &StaticUserAuthenticator{users: make(map[string][]netip.Prefix, len(users))}
+	for user, networks := range users {
+		a.users[user] = append([]netip.Prefix(nil), networks...)
+	}
+	return a
+}
+
+func (a *StaticUserAuthenticator) Allow(_ context.Context, clientAddr, userID string) error {
+	networks, ok := a.users[userID]
+	if !ok {
+		return fmt.Errorf("unknown user %q - %w", userID, ErrUnauthorized)
+	} else if len(networks) == 0 {
+		return nil
+	}
+
+	client, err := netip.ParseAddrPort(clientAddr)
+	if err != nil {
+		return fmt.Errorf("invalid client address %q - %w", clientAddr, ErrUnauthorized)
+	}
+	for _, network := range networks {
+		if network.Contains(client.Addr().Unmap()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %q not allowed from %v - %w - %w", userID, client.Addr(), ErrUnauthorized, ErrIdentMismatch)
+}
@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"socks4/client"
+	"socks4/proto"
+	"socks4/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticUserAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	auth := server.NewStaticUserAuthenticator(map[string][]netip.Prefix{
+		"alice": nil,
+		"bob":   {netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	})
+	ctx := context.Background()
+
+	require.NoError(t, auth.Allow(ctx, "192.0.2.1:1234", "alice"))
+	require.NoError(t, auth.Allow(ctx, "10.1.2.3:1234", "bob"))
+	require.NoError(t, auth.Allow(ctx, "[::1]:1234", "bob"))
+	require.NoError(t, auth.Allow(ctx, "[::ffff:10.1.2.3]:1234", "bob"))
+
+	err := auth.Allow(ctx, "192.0.2.1:1234", "bob")
+	require.ErrorIs(t, err, server.ErrUnauthorized)
+	require.ErrorIs(t, err, server.ErrIdentMismatch)
+
+	err = auth.Allow(ctx, "10.1.2.3:1234", "mallory")
+	require.ErrorIs(t, err, server.ErrUnauthorized)
+	require.NotErrorIs(t, err, server.ErrIdentMismatch)
+}
+
+func TestStaticUserReplyCodes(t *testing.T) {
+	t.Parallel()
+
+	s := createServer(t, server.WithAuthenticator(server.NewStaticUserAuthenticator(map[string][]netip.Prefix{
+		"local":  {netip.MustParsePrefix("127.0.0.0/8")},
+		"remote": {netip.MustParsePrefix("192.0.2.0/24")},
+	})))
+	addr, err := s.ListenAndServe("127.0.0.1:0")
+	require.NoError(t, err)
+	echoServer := newEchoServer(t)
+
+	for user, code := range map[string]proto.ReplyCode{
+		"unknown": proto.RejectedFailed,
+		"remote":  proto.IdentMismatch,
+	} {
+		c := client.NewClient(addr.String(), user)
+		t.Cleanup(func() { c.Close() })
+		var replyErr *client.ReplyError
+		require.ErrorAs(t, c.Connect(echoServer), &replyErr, user)
+		require.Equal(t, code, replyErr.Reply.Code(), user)
+	}
+
+	c := client.NewClient(addr.String(), "local")
+	t.Cleanup(func() { c.Close() })
+	require.NoError(t, c.Connect(echoServer))
+}
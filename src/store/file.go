@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between writes of the changes of a File
+const persistInterval = time.Second
+
+// File is a Store kept in memory and persisted to a JSON file, so state
+// survives restarts. Changes are written in the background at most every
+// persistInterval, and when the File is closed.
+type File struct {
+	mem  *Memory
+	path string
+
+	changed   atomic.Bool
+	done      chan struct{}
+	persisted chan struct{} // closed once the background writes stopped
+	closeOnce sync.Once
+
+	// serializes writes of the file
+	mu sync.Mutex
+}
+
+// OpenFile loads the store persisted at path, or starts an empty one if the
+// file doesn't exist yet. It must be closed to write the last changes.
+func OpenFile(path string) (*File, error) {
+	f := &File{mem: NewMemory(), path: path, done: make(chan struct{}), persisted: make(chan struct{})}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		go f.run()
+		return f, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read store - %w", err)
+	}
+
+	if err := json.Unmarshal(data, &f.mem.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse store - %w", err)
+	}
+	f.mem.sweep()
+	go f.run()
+	return f, nil
+}
+
+func (f *File) Get(ctx context.Context, key string) (int64, error) {
+	return f.mem.Get(ctx, key)
+}
+
+func (f *File) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	v, _ := f.mem.Incr(ctx, key, delta)
+	f.changed.Store(true)
+	return v, nil
+}
+
+func (f *File) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	f.mem.Expire(ctx, key, ttl)
+	f.changed.Store(true)
+	return nil
+}
+
+// Close stops the background writes and writes the last changes.
+func (f *File) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	<-f.persisted
+	if !f.changed.Swap(false) {
+		return nil
+	}
+	return f.persist()
+}
+
+// run writes the changes every persistInterval until the File is closed.
+// Changes that fail to be written are retried on the next write.
+func (f *File) run() {
+	defer close(f.persisted)
+	ticker := time.NewTicker(persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if f.changed.Swap(false) {
+				if err := f.persist(); err != nil {
+					f.changed.Store(true)
+				}
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// persist atomically replaces the file with the current state.
+func (f *File) persist() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mem.mu.Lock()
+	data, err := json.Marshal(f.mem.entries)
+	f.mem.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to serialize store - %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary store file - %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store - %w", err)
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync store - %w", err)
+	} else if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write store - %w", err)
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
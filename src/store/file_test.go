@@ -0,0 +1,87 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"socks4/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	s, err := store.OpenFile(filepath.Join(t.TempDir(), "store.json"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	testStore(t, s)
+}
+
+func TestFilePersists(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	s, err := store.OpenFile(path)
+	require.NoError(t, err)
+	_, err = s.Incr(ctx, "kept", 7)
+	require.NoError(t, err)
+	_, err = s.Incr(ctx, "expiring", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.Expire(ctx, "expiring", time.Millisecond*20))
+	_, err = s.Incr(ctx, "lasting", 2)
+	require.NoError(t, err)
+	require.NoError(t, s.Expire(ctx, "lasting", time.Hour))
+
+	time.Sleep(time.Millisecond * 30)
+	require.NoError(t, s.Close())
+
+	reopened, err := store.OpenFile(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { reopened.Close() })
+	for key, want := range map[string]int64{"kept": 7, "expiring": 0, "lasting": 2} {
+		v, err := reopened.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, want, v, key)
+	}
+}
+
+func TestFileWritesInBackground(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	s, err := store.OpenFile(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	_, err = s.Incr(ctx, "kept", 7)
+	require.NoError(t, err)
+
+	// written without closing the store
+	require.Eventually(t, func() bool {
+		reopened, err := store.OpenFile(path)
+		if err != nil {
+			return false
+		}
+		defer reopened.Close()
+		v, err := reopened.Get(ctx, "kept")
+		return err == nil && v == 7
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestFileCorrupt(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+
+	_, err := store.OpenFile(path)
+	require.ErrorContains(t, err, "failed to parse store")
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweep expired keys every this many increments
+const sweepInterval = 1024
+
+type entry struct {
+	Value   int64     `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// Memory is a Store kept in process memory.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	incrs   int
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		entries: make(map[string]entry),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Get(_ context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key).Value, nil
+}
+
+func (m *Memory) Incr(_ context.Context, key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.get(key)
+	e.Value += delta
+	m.entries[key] = e
+
+	if m.incrs++; m.incrs%sweepInterval == 0 {
+		m.sweep()
+	}
+	return e.Value, nil
+}
+
+func (m *Memory) Expire(_ context.Context, key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ttl <= 0 {
+		delete(m.entries, key)
+		return nil
+	}
+
+	if e, ok := m.entries[key]; ok {
+		e.Expires = m.now().Add(ttl)
+		m.entries[key] = e
+	}
+	return nil
+}
+
+// get returns the live entry of key, dropping it if it expired.
+func (m *Memory) get(key string) entry {
+	e, ok := m.entries[key]
+	if ok && e.expired(m.now()) {
+		delete(m.entries, key)
+		return entry{}
+	}
+	return e
+}
+
+func (m *Memory) sweep() {
+	now := m.now()
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package store_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"socks4/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, s store.Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	v, err := s.Get(ctx, "missing")
+	require.NoError(t, err)
+	require.Zero(t, v)
+
+	v, err = s.Incr(ctx, "a", 5)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, v)
+
+	v, err = s.Incr(ctx, "a", -2)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, v)
+
+	v, err = s.Get(ctx, "a")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, v)
+
+	require.NoError(t, s.Expire(ctx, "a", 0))
+	v, err = s.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Zero(t, v)
+
+	_, err = s.Incr(ctx, "b", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.Expire(ctx, "b", time.Millisecond*50))
+	v, err = s.Get(ctx, "b")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v)
+
+	time.Sleep(time.Millisecond * 60)
+	v, err = s.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Zero(t, v)
+
+	// expiring a missing key is fine
+	require.NoError(t, s.Expire(ctx, "missing", time.Second))
+}
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+
+	testStore(t, store.NewMemory())
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	t.Parallel()
+
+	s := store.NewMemory()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.Incr(context.Background(), "counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.Get(context.Background(), "counter")
+	require.NoError(t, err)
+	require.EqualValues(t, 8000, v)
+}
@@ -0,0 +1,21 @@
+// Package store is the persistence abstraction shared by the stateful
+// policy features of the server, its client rate limits and user quotas.
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Store holds integer counters that can expire.
+type Store interface {
+	// Get returns the value of key, or 0 if it doesn't exist.
+	Get(ctx context.Context, key string) (int64, error)
+
+	// Incr adds delta to key, creating it if needed, and returns the new
+	// value.
+	Incr(ctx context.Context, key string, delta int64) (int64, error)
+
+	// Expire deletes key after ttl. A ttl <= 0 deletes it immediately.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Environment of a process started by an upgrade: the number of plain
+	// and TLS listeners it inherits as "plain:tls", starting at fd 3, and
+	// the fd to report readiness on.
+	listenFDsEnv = "SOCKS4_LISTEN_FDS"
+	readyFDEnv   = "SOCKS4_READY_FD"
+
+	// Maximum time to wait for the new process to be ready
+	upgradeTimeout = time.Second * 30
+)
+
+// listeners are the sockets the server accepts clients on, which are handed
+// over to the new process on an upgrade.
+type listeners struct {
+	plain []*net.TCPListener
+	tls   []*net.TCPListener
+}
+
+// openListeners inherits the listeners of the process that started this one
+// for an upgrade, or else listens on the configured addresses.
+func openListeners(log *zap.Logger, conf *config) (*listeners, error) {
+	if inherited, ok := os.LookupEnv(listenFDsEnv); ok {
+		log.Info("inheriting listeners", zap.String("fds", inherited))
+		return inheritListeners(inherited)
+	}
+
+	lns := &listeners{}
+	for _, addr := range listenAddresses(conf) {
+		ln, err := listenTCP(addr)
+		if err != nil {
+			return nil, err
+		}
+		lns.plain = append(lns.plain, ln)
+	}
+	for _, addr := range conf.TLSListenAddresses {
+		ln, err := listenTCP(addr)
+		if err != nil {
+			return nil, err
+		}
+		lns.tls = append(lns.tls, ln)
+	}
+	return lns, nil
+}
+
+func listenTCP(addr string) (*net.TCPListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s - %w", addr, err)
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+func inheritListeners(counts string) (*listeners, error) {
+	plainStr, tlsStr, _ := strings.Cut(counts, ":")
+	nPlain, err := strconv.Atoi(plainStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s - %w", listenFDsEnv, err)
+	}
+	nTLS, err := strconv.Atoi(tlsStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s - %w", listenFDsEnv, err)
+	}
+
+	lns := &listeners{}
+	for i := 0; i < nPlain+nTLS; i++ {
+		file := os.NewFile(uintptr(3+i), "listener")
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit listener %d - %w", i, err)
+		}
+		tcp, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("inherited listener %d is not TCP", i)
+		}
+		if i < nPlain {
+			lns.plain = append(lns.plain, tcp)
+		} else {
+			lns.tls = append(lns.tls, tcp)
+		}
+	}
+	return lns, nil
+}
+
+// notifyReady tells the process that started this one for an upgrade that
+// it is serving clients.
+func notifyReady() error {
+	fdStr, ok := os.LookupEnv(readyFDEnv)
+	if !ok {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s - %w", readyFDEnv, err)
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	defer ready.Close()
+	_, err = ready.Write([]byte{1})
+	return err
+}
+
+// upgrade starts a new process of the current executable, handing it the
+// listeners, and waits until it serves clients. The listening sockets stay
+// open throughout, so no connection is refused.
+func upgrade(log *zap.Logger, lns *listeners) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable - %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, ln := range append(append([]*net.TCPListener(nil), lns.plain...), lns.tls...) {
+		file, err := ln.File()
+		if err != nil {
+			return fmt.Errorf("failed to get listener file - %w", err)
+		}
+		files = append(files, file)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe - %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d:%d", listenFDsEnv, len(lns.plain), len(lns.tls)),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)-1),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process - %w", err)
+	}
+	readyW.Close()
+	log.Info("started new process", zap.Int("pid", cmd.Process.Pid))
+
+	// a read fails early if the new process exits without being ready
+	readyR.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if n, err := readyR.Read(make([]byte, 1)); n == 1 {
+		go cmd.Wait()
+		return nil
+	} else if err == nil {
+		err = errors.New("no readiness reported")
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return fmt.Errorf("new process failed to become ready - %w", err)
+}